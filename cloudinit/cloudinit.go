@@ -0,0 +1,154 @@
+// Package cloudinit generates cloud-init NoCloud seed images.
+//
+// A Seed holds typed user-data, meta-data and network-config. Its
+// WriteFile method renders them into an ISO 9660 image labelled "cidata",
+// which cloud-init finds when the image is attached to the guest:
+//
+//	seed := &cloudinit.Seed{
+//		MetaData: cloudinit.MetaData{LocalHostname: "vm1"},
+//		UserData: &cloudinit.UserData{
+//			SSHAuthorizedKeys: []string{key},
+//		},
+//	}
+//	if err := seed.WriteFile("seed.iso"); err != nil {
+//		return err
+//	}
+//	attachment, err := vz.NewDiskImageStorageDeviceAttachment("seed.iso", true)
+package cloudinit
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/Code-Hex/vz/v3/internal/memfs"
+	"github.com/Code-Hex/vz/v3/iso9660"
+)
+
+// VolumeLabel is the volume label cloud-init looks for.
+const VolumeLabel = "cidata"
+
+// File names in a NoCloud seed.
+const (
+	UserDataFile      = "user-data"
+	MetaDataFile      = "meta-data"
+	NetworkConfigFile = "network-config"
+)
+
+// Seed is a NoCloud seed.
+type Seed struct {
+	MetaData MetaData
+
+	// UserData is the user-data. If it is nil, the seed has an empty
+	// "#cloud-config" user-data.
+	UserData *UserData
+
+	// NetworkConfig is the network-config. If it is nil, the guest uses
+	// cloud-init's fallback configuration, DHCP on the first interface.
+	NetworkConfig *NetworkConfig
+}
+
+// MetaData is the meta-data of a seed.
+type MetaData struct {
+	// InstanceID identifies the instance. cloud-init runs its per-instance
+	// modules, which include users, packages, write_files and runcmd, only
+	// when the instance ID changes.
+	//
+	// If it is empty, the instance ID is derived from the content of the
+	// seed, so changing the seed makes cloud-init run again on the next
+	// boot while an unchanged seed keeps the instance. Use NewInstanceID
+	// to force a new instance with the same seed.
+	InstanceID string
+
+	// LocalHostname is the hostname of the guest.
+	LocalHostname string
+}
+
+// NewInstanceID returns a random instance ID.
+func NewInstanceID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return "iid-" + hex.EncodeToString(b[:])
+}
+
+// InstanceID returns the instance ID of the seed, which is
+// s.MetaData.InstanceID if it is set.
+func (s *Seed) InstanceID() (string, error) {
+	files, err := s.Files()
+	if err != nil {
+		return "", err
+	}
+	return s.instanceID(files), nil
+}
+
+func (s *Seed) instanceID(files map[string][]byte) string {
+	if s.MetaData.InstanceID != "" {
+		return s.MetaData.InstanceID
+	}
+	h := sha256.New()
+	for _, name := range []string{UserDataFile, NetworkConfigFile} {
+		if b, ok := files[name]; ok {
+			io.WriteString(h, name+"\x00")
+			h.Write(b)
+			io.WriteString(h, "\x00")
+		}
+	}
+	io.WriteString(h, "local-hostname\x00"+s.MetaData.LocalHostname)
+	return "iid-" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Files returns the content of the seed files by name.
+func (s *Seed) Files() (map[string][]byte, error) {
+	files := make(map[string][]byte, 3)
+	userData := s.UserData
+	if userData == nil {
+		userData = &UserData{}
+	}
+	b, err := userData.MarshalYAML()
+	if err != nil {
+		return nil, err
+	}
+	files[UserDataFile] = b
+	if s.NetworkConfig != nil {
+		b, err := s.NetworkConfig.MarshalYAML()
+		if err != nil {
+			return nil, err
+		}
+		files[NetworkConfigFile] = b
+	}
+
+	var m yamlMap
+	m.add("instance-id", s.instanceID(files))
+	m.add("local-hostname", s.MetaData.LocalHostname)
+	files[MetaDataFile] = marshalYAML(m)
+	return files, nil
+}
+
+// Write writes the seed as an ISO 9660 image labelled "cidata" to w.
+func (s *Seed) Write(w io.Writer) error {
+	files, err := s.Files()
+	if err != nil {
+		return err
+	}
+	return iso9660.Write(w, memfs.FS(files), iso9660.WithVolumeLabel(VolumeLabel))
+}
+
+// WriteFile creates a seed image at path with Write. If path already
+// exists, WriteFile returns an error satisfying os.IsExist.
+func (s *Seed) WriteFile(path string) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	return s.Write(f)
+}
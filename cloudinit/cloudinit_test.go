@@ -0,0 +1,258 @@
+package cloudinit_test
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Code-Hex/vz/v3/cloudinit"
+	"github.com/Code-Hex/vz/v3/iso9660"
+)
+
+func TestUserDataMarshalYAML(t *testing.T) {
+	lock := false
+	u := &cloudinit.UserData{
+		Users: []cloudinit.User{
+			{Name: cloudinit.DefaultUser},
+			{
+				Name:              "alice",
+				Groups:            []string{"wheel", "docker"},
+				Shell:             "/bin/bash",
+				Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+				LockPasswd:        &lock,
+				SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA alice@example.com"},
+			},
+		},
+		PackageUpdate: true,
+		Packages:      []string{"qemu-guest-agent"},
+		WriteFiles: []cloudinit.WriteFile{
+			{Path: "/etc/motd", Content: []byte("hello \"vz\"\n"), Permissions: 0o644},
+			{Path: "/var/lib/blob", Content: []byte{0xff, 0x00}, Owner: "alice:alice", Defer: true},
+		},
+		RunCmd: []cloudinit.Command{
+			{"systemctl", "enable", "--now", "qemu-guest-agent"},
+			cloudinit.ShellCommand("echo done > /run/done"),
+		},
+	}
+	got, err := u.MarshalYAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `#cloud-config
+users:
+  - "default"
+  - name: "alice"
+    groups:
+      - "wheel"
+      - "docker"
+    shell: "/bin/bash"
+    sudo: "ALL=(ALL) NOPASSWD:ALL"
+    lock_passwd: false
+    ssh_authorized_keys:
+      - "ssh-ed25519 AAAA alice@example.com"
+package_update: true
+packages:
+  - "qemu-guest-agent"
+write_files:
+  - path: "/etc/motd"
+    content: "hello \"vz\"\n"
+    permissions: "0644"
+  - path: "/var/lib/blob"
+    encoding: "b64"
+    content: "/wA="
+    owner: "alice:alice"
+    defer: true
+runcmd:
+  -
+    - "systemctl"
+    - "enable"
+    - "--now"
+    - "qemu-guest-agent"
+  -
+    - "sh"
+    - "-c"
+    - "echo done > /run/done"
+`
+	if string(got) != want {
+		t.Fatalf("want\n%s\nbut got\n%s", want, got)
+	}
+}
+
+func TestNetworkConfigMarshalYAML(t *testing.T) {
+	n := &cloudinit.NetworkConfig{
+		Ethernets: map[string]cloudinit.Ethernet{
+			"lan": {
+				Match:     &cloudinit.Match{MACAddress: "52:54:00:12:34:56"},
+				SetName:   "eth0",
+				Addresses: []string{"192.168.64.10/24"},
+				Routes:    []cloudinit.Route{{To: "default", Via: "192.168.64.1"}},
+				Nameservers: &cloudinit.Nameservers{
+					Addresses: []string{"192.168.64.1"},
+					Search:    []string{"example.com"},
+				},
+			},
+			"eth1": {DHCP4: true, MTU: 9000},
+			"eth2": {},
+		},
+	}
+	got, err := n.MarshalYAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `version: 2
+ethernets:
+  eth1:
+    dhcp4: true
+    mtu: 9000
+  eth2: {}
+  lan:
+    match:
+      macaddress: "52:54:00:12:34:56"
+    set-name: "eth0"
+    addresses:
+      - "192.168.64.10/24"
+    routes:
+      - to: "default"
+        via: "192.168.64.1"
+    nameservers:
+      addresses:
+        - "192.168.64.1"
+      search:
+        - "example.com"
+`
+	if string(got) != want {
+		t.Fatalf("want\n%s\nbut got\n%s", want, got)
+	}
+}
+
+func TestMarshalYAMLInvalid(t *testing.T) {
+	users := []*cloudinit.UserData{
+		{Users: []cloudinit.User{{}}},
+		{WriteFiles: []cloudinit.WriteFile{{Path: "etc/motd"}}},
+		{WriteFiles: []cloudinit.WriteFile{{Path: "/etc/motd", Permissions: fs.ModeDir | 0o755}}},
+		{RunCmd: []cloudinit.Command{{}}},
+	}
+	for i, u := range users {
+		if _, err := u.MarshalYAML(); err == nil {
+			t.Errorf("user-data %d: want error", i)
+		}
+	}
+	networks := []cloudinit.Ethernet{
+		{Match: &cloudinit.Match{}},
+		{Match: &cloudinit.Match{MACAddress: "52:54"}},
+		{Addresses: []string{"192.168.64.10"}},
+		{Routes: []cloudinit.Route{{To: "default", Via: "gateway"}}},
+		{Nameservers: &cloudinit.Nameservers{Addresses: []string{"dns.example.com"}}},
+	}
+	for i, eth := range networks {
+		n := &cloudinit.NetworkConfig{Ethernets: map[string]cloudinit.Ethernet{"eth0": eth}}
+		if _, err := n.MarshalYAML(); err == nil {
+			t.Errorf("network-config %d: want error", i)
+		}
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	seed := &cloudinit.Seed{
+		MetaData: cloudinit.MetaData{LocalHostname: "vm1"},
+		UserData: &cloudinit.UserData{Packages: []string{"git"}},
+	}
+	id1, err := seed.InstanceID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := seed.InstanceID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 != id2 {
+		t.Fatalf("instance ID is not stable: %q and %q", id1, id2)
+	}
+
+	seed.UserData.Packages = append(seed.UserData.Packages, "curl")
+	id3, err := seed.InstanceID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id3 == id1 {
+		t.Fatalf("instance ID %q did not change with the user-data", id3)
+	}
+
+	seed.MetaData.InstanceID = "i-1234"
+	if id, _ := seed.InstanceID(); id != "i-1234" {
+		t.Fatalf("want %q but got %q", "i-1234", id)
+	}
+
+	if a, b := cloudinit.NewInstanceID(), cloudinit.NewInstanceID(); a == b {
+		t.Fatalf("NewInstanceID returned %q twice", a)
+	}
+}
+
+func TestSeedWriteFile(t *testing.T) {
+	seed := &cloudinit.Seed{
+		MetaData: cloudinit.MetaData{LocalHostname: "vm1"},
+		UserData: &cloudinit.UserData{
+			SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA"},
+		},
+		NetworkConfig: &cloudinit.NetworkConfig{
+			Ethernets: map[string]cloudinit.Ethernet{"eth0": {DHCP4: true}},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "seed.iso")
+	if err := seed.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.WriteFile(path); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("want %v but got %v", os.ErrExist, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fsys, err := iso9660.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fsys.Label(); got != cloudinit.VolumeLabel {
+		t.Fatalf("want label %q but got %q", cloudinit.VolumeLabel, got)
+	}
+	files, err := seed.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, cloudinit.UserDataFile, cloudinit.MetaDataFile, cloudinit.NetworkConfigFile); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: want\n%s\nbut got\n%s", name, want, got)
+		}
+	}
+
+	id, _ := seed.InstanceID()
+	want := "instance-id: \"" + id + "\"\nlocal-hostname: \"vm1\"\n"
+	if got := string(files[cloudinit.MetaDataFile]); got != want {
+		t.Fatalf("want\n%s\nbut got\n%s", want, got)
+	}
+
+	var b1, b2 bytes.Buffer
+	if err := seed.Write(&b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.Write(&b2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+		t.Fatal("seed images differ")
+	}
+}
@@ -0,0 +1,172 @@
+package cloudinit
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// NetworkConfig is a version 2 network-config. It uses the netplan
+// format, which cloud-init translates for the guest's network renderer.
+type NetworkConfig struct {
+	// Ethernets maps a configuration ID to an ethernet device. The ID
+	// is the interface name unless the Ethernet has a Match.
+	Ethernets map[string]Ethernet
+}
+
+// Ethernet configures an ethernet device.
+type Ethernet struct {
+	// Match selects the devices to configure. If it is nil the device
+	// is selected by the configuration ID.
+	Match *Match
+
+	// SetName renames the matched device.
+	SetName string
+
+	DHCP4 bool
+	DHCP6 bool
+
+	// Addresses are static addresses in CIDR notation, e.g.
+	// "192.168.64.10/24".
+	Addresses []string
+
+	Routes      []Route
+	Nameservers *Nameservers
+
+	// MTU of the device. Zero keeps the default.
+	MTU int
+}
+
+// Match selects network devices. All set fields must match.
+type Match struct {
+	// MACAddress is the device's MAC address, e.g. the address of a
+	// vz.MACAddress.
+	MACAddress string
+
+	// Name is the interface name, which may contain shell globs.
+	Name string
+
+	Driver string
+}
+
+// Route is a static route.
+type Route struct {
+	// To is the destination in CIDR notation or "default".
+	To string
+
+	// Via is the gateway address.
+	Via string
+
+	Metric int
+}
+
+// Nameservers configures DNS resolution.
+type Nameservers struct {
+	Addresses []string
+	Search    []string
+}
+
+func (n *NetworkConfig) validate() error {
+	for id, eth := range n.Ethernets {
+		if id == "" {
+			return fmt.Errorf("cloudinit: ethernet configuration ID is empty")
+		}
+		if m := eth.Match; m != nil {
+			if m.MACAddress == "" && m.Name == "" && m.Driver == "" {
+				return fmt.Errorf("cloudinit: ethernet %q: match is empty", id)
+			}
+			if m.MACAddress != "" {
+				if _, err := net.ParseMAC(m.MACAddress); err != nil {
+					return fmt.Errorf("cloudinit: ethernet %q: %w", id, err)
+				}
+			}
+		}
+		for _, addr := range eth.Addresses {
+			if _, err := netip.ParsePrefix(addr); err != nil {
+				return fmt.Errorf("cloudinit: ethernet %q: %w", id, err)
+			}
+		}
+		for _, r := range eth.Routes {
+			if r.To != "default" {
+				if _, err := netip.ParsePrefix(r.To); err != nil {
+					return fmt.Errorf("cloudinit: ethernet %q: route: %w", id, err)
+				}
+			}
+			if _, err := netip.ParseAddr(r.Via); err != nil {
+				return fmt.Errorf("cloudinit: ethernet %q: route: %w", id, err)
+			}
+		}
+		if ns := eth.Nameservers; ns != nil {
+			for _, addr := range ns.Addresses {
+				if _, err := netip.ParseAddr(addr); err != nil {
+					return fmt.Errorf("cloudinit: ethernet %q: nameserver: %w", id, err)
+				}
+			}
+		}
+		if eth.MTU < 0 {
+			return fmt.Errorf("cloudinit: ethernet %q: invalid MTU %d", id, eth.MTU)
+		}
+	}
+	return nil
+}
+
+// MarshalYAML returns the network-config document.
+func (n *NetworkConfig) MarshalYAML() ([]byte, error) {
+	if err := n.validate(); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(n.Ethernets))
+	for id := range n.Ethernets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var ethernets yamlMap
+	for _, id := range ids {
+		// Devices without settings still need an entry.
+		ethernets = append(ethernets, yamlItem{key: id, value: n.Ethernets[id].yaml()})
+	}
+
+	var m yamlMap
+	m.add("version", 2)
+	if len(ethernets) > 0 {
+		m.add("ethernets", ethernets)
+	}
+	return marshalYAML(m), nil
+}
+
+func (e Ethernet) yaml() yamlMap {
+	var m yamlMap
+	if e.Match != nil {
+		var match yamlMap
+		match.add("macaddress", e.Match.MACAddress)
+		match.add("name", e.Match.Name)
+		match.add("driver", e.Match.Driver)
+		m.add("match", match)
+	}
+	m.add("set-name", e.SetName)
+	m.add("dhcp4", e.DHCP4)
+	m.add("dhcp6", e.DHCP6)
+	m.add("addresses", stringList(e.Addresses))
+	routes := make([]any, 0, len(e.Routes))
+	for _, r := range e.Routes {
+		var route yamlMap
+		route.add("to", r.To)
+		route.add("via", r.Via)
+		if r.Metric != 0 {
+			route.add("metric", r.Metric)
+		}
+		routes = append(routes, route)
+	}
+	m.add("routes", routes)
+	if ns := e.Nameservers; ns != nil {
+		var nameservers yamlMap
+		nameservers.add("addresses", stringList(ns.Addresses))
+		nameservers.add("search", stringList(ns.Search))
+		m.add("nameservers", nameservers)
+	}
+	if e.MTU != 0 {
+		m.add("mtu", e.MTU)
+	}
+	return m
+}
@@ -0,0 +1,176 @@
+package cloudinit
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"path"
+	"unicode/utf8"
+)
+
+// DefaultUser is the name of the distribution's default user. Listing
+// it in UserData.Users keeps that user when other users are added.
+const DefaultUser = "default"
+
+// UserData is the "#cloud-config" user-data of a seed.
+type UserData struct {
+	// Users replaces the distribution's default user unless one of the
+	// users is named DefaultUser. Fields other than Name are ignored for
+	// DefaultUser.
+	Users []User
+
+	// SSHAuthorizedKeys are added to the default user.
+	SSHAuthorizedKeys []string
+
+	// PackageUpdate updates the package database before Packages are
+	// installed.
+	PackageUpdate bool
+
+	// Packages are installed on first boot.
+	Packages []string
+
+	// WriteFiles are written on first boot.
+	WriteFiles []WriteFile
+
+	// RunCmd are run once, late in the first boot.
+	RunCmd []Command
+}
+
+// User is a user account created by cloud-init.
+type User struct {
+	Name  string
+	Gecos string
+
+	// Groups are supplementary groups of the user.
+	Groups []string
+
+	// Shell is the login shell, e.g. "/bin/bash".
+	Shell string
+
+	// Sudo is a sudoers rule for the user, e.g. "ALL=(ALL) NOPASSWD:ALL".
+	Sudo string
+
+	// HashedPasswd is a crypt(3) password hash.
+	HashedPasswd string
+
+	// LockPasswd disables password login when it is set. cloud-init
+	// locks passwords by default.
+	LockPasswd *bool
+
+	SSHAuthorizedKeys []string
+}
+
+// WriteFile is a file written by cloud-init.
+type WriteFile struct {
+	// Path is the absolute path of the file.
+	Path string
+
+	// Content is the content of the file. Content which is not valid
+	// UTF-8 is base64 encoded.
+	Content []byte
+
+	// Owner is "user:group". The default is "root:root".
+	Owner string
+
+	// Permissions of the file. The default is 0644.
+	Permissions fs.FileMode
+
+	// Append appends Content instead of replacing the file.
+	Append bool
+
+	// Defer writes the file after users and packages are set up.
+	Defer bool
+}
+
+// Command is a command run by cloud-init. It is executed directly, not
+// through a shell; use ShellCommand for shell syntax.
+type Command []string
+
+// ShellCommand returns a Command which runs script with /bin/sh.
+func ShellCommand(script string) Command {
+	return Command{"sh", "-c", script}
+}
+
+func (u *UserData) validate() error {
+	for _, user := range u.Users {
+		if user.Name == "" {
+			return fmt.Errorf("cloudinit: user name is empty")
+		}
+	}
+	for _, f := range u.WriteFiles {
+		if !path.IsAbs(f.Path) {
+			return fmt.Errorf("cloudinit: write_files path %q is not absolute", f.Path)
+		}
+		if f.Permissions&^fs.ModePerm != 0 {
+			return fmt.Errorf("cloudinit: write_files %q: invalid permissions %v", f.Path, f.Permissions)
+		}
+	}
+	for _, cmd := range u.RunCmd {
+		if len(cmd) == 0 {
+			return fmt.Errorf("cloudinit: runcmd command is empty")
+		}
+	}
+	return nil
+}
+
+// MarshalYAML returns the user-data document, including the
+// "#cloud-config" header.
+func (u *UserData) MarshalYAML() ([]byte, error) {
+	if err := u.validate(); err != nil {
+		return nil, err
+	}
+	var m yamlMap
+	users := make([]any, 0, len(u.Users))
+	for _, user := range u.Users {
+		users = append(users, user.yaml())
+	}
+	m.add("users", users)
+	m.add("ssh_authorized_keys", stringList(u.SSHAuthorizedKeys))
+	m.add("package_update", u.PackageUpdate)
+	m.add("packages", stringList(u.Packages))
+	files := make([]any, 0, len(u.WriteFiles))
+	for _, f := range u.WriteFiles {
+		files = append(files, f.yaml())
+	}
+	m.add("write_files", files)
+	cmds := make([]any, 0, len(u.RunCmd))
+	for _, cmd := range u.RunCmd {
+		cmds = append(cmds, stringList(cmd))
+	}
+	m.add("runcmd", cmds)
+	return append([]byte("#cloud-config\n"), marshalYAML(m)...), nil
+}
+
+func (u User) yaml() any {
+	if u.Name == DefaultUser {
+		return u.Name
+	}
+	var m yamlMap
+	m.add("name", u.Name)
+	m.add("gecos", u.Gecos)
+	m.add("groups", stringList(u.Groups))
+	m.add("shell", u.Shell)
+	m.add("sudo", u.Sudo)
+	m.add("hashed_passwd", u.HashedPasswd)
+	m.add("lock_passwd", u.LockPasswd)
+	m.add("ssh_authorized_keys", stringList(u.SSHAuthorizedKeys))
+	return m
+}
+
+func (f WriteFile) yaml() yamlMap {
+	var m yamlMap
+	m.add("path", f.Path)
+	if utf8.Valid(f.Content) {
+		m.add("content", string(f.Content))
+	} else {
+		m.add("encoding", "b64")
+		m.add("content", base64.StdEncoding.EncodeToString(f.Content))
+	}
+	m.add("owner", f.Owner)
+	if f.Permissions != 0 {
+		m.add("permissions", fmt.Sprintf("%#04o", uint32(f.Permissions)))
+	}
+	m.add("append", f.Append)
+	m.add("defer", f.Defer)
+	return m
+}
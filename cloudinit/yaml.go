@@ -0,0 +1,131 @@
+package cloudinit
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// yamlMap is a YAML mapping which keeps the order of its keys.
+// Values are string, bool, int, []any or yamlMap.
+type yamlMap []yamlItem
+
+type yamlItem struct {
+	key   string
+	value any
+}
+
+// add appends key unless value is empty, so optional fields are omitted.
+func (m *yamlMap) add(key string, value any) {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return
+		}
+	case bool:
+		if !v {
+			return
+		}
+	case *bool:
+		if v == nil {
+			return
+		}
+		value = *v
+	case []any:
+		if len(v) == 0 {
+			return
+		}
+	case yamlMap:
+		if len(v) == 0 {
+			return
+		}
+	}
+	*m = append(*m, yamlItem{key: key, value: value})
+}
+
+func stringList(s []string) []any {
+	l := make([]any, len(s))
+	for i, v := range s {
+		l[i] = v
+	}
+	return l
+}
+
+var plainKey = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+func yamlKey(k string) string {
+	if plainKey.MatchString(k) {
+		return k
+	}
+	return strconv.Quote(k)
+}
+
+func yamlScalar(v any) string {
+	switch v := v.(type) {
+	case string:
+		// A Go quoted string is a valid YAML double-quoted scalar.
+		return strconv.Quote(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	}
+	panic("cloudinit: unsupported YAML value")
+}
+
+// marshalYAML renders m as a block style YAML document.
+func marshalYAML(m yamlMap) []byte {
+	var b strings.Builder
+	writeMap(&b, m, 0, "")
+	return []byte(b.String())
+}
+
+// writeMap writes m at indent. The first line starts with first instead
+// of the indentation, which is used for mappings in sequences.
+func writeMap(b *strings.Builder, m yamlMap, indent int, first string) {
+	pad := strings.Repeat(" ", indent)
+	for i, item := range m {
+		if i == 0 && first != "" {
+			b.WriteString(first)
+		} else {
+			b.WriteString(pad)
+		}
+		b.WriteString(yamlKey(item.key))
+		b.WriteString(":")
+		writeValue(b, item.value, indent)
+	}
+}
+
+func writeValue(b *strings.Builder, v any, indent int) {
+	switch v := v.(type) {
+	case yamlMap:
+		if len(v) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+		b.WriteString("\n")
+		writeMap(b, v, indent+2, "")
+	case []any:
+		b.WriteString("\n")
+		writeList(b, v, indent+2)
+	default:
+		b.WriteString(" ")
+		b.WriteString(yamlScalar(v))
+		b.WriteString("\n")
+	}
+}
+
+func writeList(b *strings.Builder, l []any, indent int) {
+	pad := strings.Repeat(" ", indent)
+	for _, v := range l {
+		switch v := v.(type) {
+		case yamlMap:
+			writeMap(b, v, indent+2, pad+"- ")
+		case []any:
+			b.WriteString(pad + "-\n")
+			writeList(b, v, indent+2)
+		default:
+			b.WriteString(pad + "- " + yamlScalar(v) + "\n")
+		}
+	}
+}
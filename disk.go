@@ -2,10 +2,20 @@ package vz
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+
+	"github.com/Code-Hex/vz/v3/gpt"
+	"github.com/Code-Hex/vz/v3/internal/compact"
+	"github.com/Code-Hex/vz/v3/internal/diskimage"
+	"github.com/Code-Hex/vz/v3/internal/progress"
+	"github.com/Code-Hex/vz/v3/internal/sparse"
 )
 
 // CreateDiskImage is creating disk image with specified filename and filesize.
@@ -26,6 +36,143 @@ func CreateDiskImage(pathname string, size int64) error {
 	return nil
 }
 
+// DiskImagePreallocation is how the blocks of a raw disk image are allocated
+// when it is created with CreateDiskImageWithOptions.
+//
+//go:generate stringer -type=DiskImagePreallocation
+type DiskImagePreallocation int
+
+const (
+	// DiskImagePreallocationSparse creates a sparse file, so blocks are only
+	// allocated when the guest writes them. This is what CreateDiskImage does.
+	DiskImagePreallocationSparse DiskImagePreallocation = iota
+
+	// DiskImagePreallocationMetadata allocates every block of the disk image
+	// without writing it, using fallocate on Linux and F_PREALLOCATE on macOS.
+	// This is fast, but not every file system supports it.
+	DiskImagePreallocationMetadata
+
+	// DiskImagePreallocationFull allocates every block of the disk image by
+	// writing zeros to it. This takes as long as writing the whole disk image,
+	// but works on every file system.
+	DiskImagePreallocationFull
+)
+
+// ErrInsufficientFreeSpace is returned by CreateDiskImageWithOptions when the file
+// system does not have enough free space for the disk image.
+var ErrInsufficientFreeSpace = errors.New("insufficient free space")
+
+type createDiskImageOptions struct {
+	preallocation  DiskImagePreallocation
+	alignment      int64
+	checkFreeSpace bool
+}
+
+// CreateDiskImageOption is an option for CreateDiskImageWithOptions.
+type CreateDiskImageOption func(*createDiskImageOptions) error
+
+// WithCreateDiskImagePreallocation sets how the blocks of the disk image are allocated.
+// The default is DiskImagePreallocationSparse.
+func WithCreateDiskImagePreallocation(preallocation DiskImagePreallocation) CreateDiskImageOption {
+	return func(o *createDiskImageOptions) error {
+		switch preallocation {
+		case DiskImagePreallocationSparse, DiskImagePreallocationMetadata, DiskImagePreallocationFull:
+		default:
+			return fmt.Errorf("invalid disk image preallocation: %v", preallocation)
+		}
+		o.preallocation = preallocation
+		return nil
+	}
+}
+
+// WithCreateDiskImageAlignment rounds the size of the disk image up to a multiple
+// of alignment, which must be a power of two. For example, use 512 to round up to
+// a whole sector or 1024 * 1024 to round up to a whole MiB, which keeps partitions
+// created by most tools aligned to the end of the disk.
+func WithCreateDiskImageAlignment(alignment int64) CreateDiskImageOption {
+	return func(o *createDiskImageOptions) error {
+		if alignment <= 0 || alignment&(alignment-1) != 0 {
+			return fmt.Errorf("disk image alignment must be a power of two: %d", alignment)
+		}
+		o.alignment = alignment
+		return nil
+	}
+}
+
+// WithCreateDiskImageFreeSpaceCheck makes CreateDiskImageWithOptions fail with
+// ErrInsufficientFreeSpace if the file system does not have enough free space
+// for the whole disk image. The check is done for sparse disk images too, so the
+// guest can not run out of space on the host when it fills up its disk.
+func WithCreateDiskImageFreeSpaceCheck() CreateDiskImageOption {
+	return func(o *createDiskImageOptions) error {
+		o.checkFreeSpace = true
+		return nil
+	}
+}
+
+// CreateDiskImageWithOptions is creating raw disk image with specified filename
+// and filesize like CreateDiskImage, but allows to preallocate its blocks and to
+// align its size. Preallocated disk images avoid fragmentation when the guest
+// writes to them for the first time, which is useful for databases.
+//
+// If an option can not be applied, the disk image is removed and an error is returned.
+//
+// Note that if you have specified a pathname which already exists, this function
+// returns os.ErrExist error. So you can handle it with os.IsExist function.
+func CreateDiskImageWithOptions(pathname string, size int64, opts ...CreateDiskImageOption) error {
+	o := &createDiskImageOptions{alignment: 1}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return err
+		}
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid disk image size: %d", size)
+	}
+	size = (size + o.alignment - 1) &^ (o.alignment - 1)
+
+	f, err := os.OpenFile(pathname, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = createDiskImage(f, size, o)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(pathname)
+		return err
+	}
+	return nil
+}
+
+func createDiskImage(f *os.File, size int64, o *createDiskImageOptions) error {
+	if o.checkFreeSpace {
+		free, err := sparse.FreeSpace(filepath.Dir(f.Name()))
+		if err != nil {
+			return err
+		}
+		if free < size {
+			return fmt.Errorf("%w: %s needs %d bytes but only %d bytes are available",
+				ErrInsufficientFreeSpace, f.Name(), size, free)
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+	switch o.preallocation {
+	case DiskImagePreallocationMetadata:
+		return sparse.Allocate(f, size)
+	case DiskImagePreallocationFull:
+		if err := sparse.Fill(f, size); err != nil {
+			return err
+		}
+		return f.Sync()
+	default:
+		return f.Truncate(size)
+	}
+}
+
 // CreateSparseDiskImage is creating an "Apple Sparse Image Format" disk image
 // with specified filename and filesize. The function "shells out" to diskutil, as currently
 // this is the only known way of creating ASIF images.
@@ -59,3 +206,724 @@ func CreateSparseDiskImage(ctx context.Context, pathname string, size int64) err
 
 	return nil
 }
+
+// ConvertDiskImageOption is an option for ConvertDiskImage.
+type ConvertDiskImageOption func(*diskimage.Options) error
+
+// WithConvertDiskImageNoBackingFile makes ConvertDiskImage fail if the source
+// disk image refers to a backing file. This is useful for images from an
+// untrusted origin, since a backing file name can point at any file on the host.
+func WithConvertDiskImageNoBackingFile() ConvertDiskImageOption {
+	return func(o *diskimage.Options) error {
+		o.NoBackingFile = true
+		return nil
+	}
+}
+
+// ConvertDiskImage converts the disk image at srcPath into a raw disk image at
+// dstPath, which can be used with NewDiskImageStorageDeviceAttachment.
+//
+// Supported source formats are:
+//
+//   - qcow2 version 2 and 3, including compressed clusters and backing files.
+//   - VMDK monolithicSparse and streamOptimized images as created by VMware Fusion.
+//   - Fixed and dynamic VHDX images as created by Hyper-V.
+//
+// The allocation tables of the source image are verified before dstPath is created,
+// so a corrupt source image fails with a descriptive error. Blocks of the virtual
+// disk which only contain zeros are not written, so dstPath is created as a sparse file.
+//
+// The conversion runs in the background. The returned progress reader reports
+// how many bytes of the virtual disk have been converted, and is finished
+// when the conversion completes or ctx is done. If the conversion fails, dstPath
+// is removed.
+//
+// Note that if you have specified a dstPath which already exists, this function
+// returns os.ErrExist error. So you can handle it with os.IsExist function.
+func ConvertDiskImage(ctx context.Context, srcPath, dstPath string, opts ...ConvertDiskImageOption) (*progress.Reader, error) {
+	o := &diskimage.Options{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	img, err := diskimage.Open(srcPath, o)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+
+	reader := progress.NewReader(diskimage.NewReader(ctx, img), img.Size(), 0)
+
+	go func() {
+		defer img.Close()
+		err := writeSparse(f, reader)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dstPath)
+		}
+		reader.Finish(err)
+	}()
+
+	return reader, nil
+}
+
+// CloneDiskImage copies the disk image at srcPath to dstPath.
+//
+// If both paths are on a file system which supports copy-on-write clones,
+// such as APFS on macOS or Btrfs and XFS on Linux, dstPath is created as
+// a clone of srcPath, which completes instantly and shares the storage until
+// either file is modified. Otherwise the data is copied. Holes of srcPath are
+// skipped, as are blocks which only contain zeros, so dstPath is created as
+// a sparse file.
+//
+// The copy runs in the background. The returned progress reader reports how
+// many bytes of the disk image have been copied, and is finished when the copy
+// completes or ctx is done. If the copy fails, dstPath is removed.
+//
+// Note that if you have specified a dstPath which already exists, this function
+// returns os.ErrExist error. So you can handle it with os.IsExist function.
+func CloneDiskImage(ctx context.Context, srcPath, dstPath string) (*progress.Reader, error) {
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%q is not a regular file", srcPath)
+	}
+	if err := sparse.CloneFile(srcPath, dstPath); err == nil {
+		reader := progress.NewReader(io.MultiReader(), fi.Size(), fi.Size())
+		reader.Finish(nil)
+		return reader, nil
+	} else if !errors.Is(err, sparse.ErrCloneUnsupported) {
+		return nil, err
+	}
+
+	img, err := diskimage.OpenRaw(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+
+	reader := progress.NewReader(diskimage.NewReader(ctx, img), img.Size(), 0)
+
+	go func() {
+		defer img.Close()
+		err := writeSparse(f, reader)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dstPath)
+		}
+		reader.Finish(err)
+	}()
+
+	return reader, nil
+}
+
+// ImportDiskImage decompresses the disk image at srcPath into a raw disk image
+// at dstPath, which can be used with NewDiskImageStorageDeviceAttachment.
+//
+// The compression is detected by the magic bytes of srcPath. Supported are
+// gzip, xz, Zstandard and bzip2. An uncompressed raw disk image or ISO 9660
+// image is copied as it is. Blocks which only contain zeros are not written,
+// so dstPath is created as a sparse file.
+//
+// The source must contain a raw disk image or ISO 9660 image. Other disk image
+// formats, such as a compressed qcow2 disk image, return an error wrapping
+// ErrUnsupportedDiskImageFormat.
+//
+// The decompression runs in the background. The returned progress reader reports
+// how many bytes of srcPath have been read, and is finished when the decompression
+// completes or ctx is done. If the decompression fails, dstPath is removed.
+//
+// Note that if you have specified a dstPath which already exists, this function
+// returns os.ErrExist error. So you can handle it with os.IsExist function.
+func ImportDiskImage(ctx context.Context, srcPath, dstPath string) (*progress.Reader, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := src.Stat()
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	reader, err := importDiskImage(ctx, src, fi.Size(), strconv.Quote(srcPath), dstPath, src.Close)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// ImportDiskImageFromReader is like ImportDiskImage, but reads the disk image
+// from src, such as the body of an HTTP response. size is the number of bytes
+// in src, such as the Content-Length of the response, and is used by the
+// returned progress reader to report the fraction completed.
+func ImportDiskImageFromReader(ctx context.Context, src io.Reader, size int64, dstPath string) (*progress.Reader, error) {
+	return importDiskImage(ctx, src, size, "the source", dstPath, func() error { return nil })
+}
+
+func importDiskImage(ctx context.Context, src io.Reader, size int64, name, dstPath string, closeSrc func() error) (*progress.Reader, error) {
+	reader := progress.NewReader(diskimage.NewContextReader(ctx, src), size, 0)
+	stream, err := diskimage.NewStream(reader)
+	if err != nil {
+		return nil, err
+	}
+	switch format := diskImageFormatOf(stream.Format); format {
+	case DiskImageFormatRaw, DiskImageFormatISO9660:
+	case DiskImageFormatASIF:
+		return nil, fmt.Errorf("%w: %s contains an ASIF disk image, which can not be imported",
+			ErrUnsupportedDiskImageFormat, name)
+	default:
+		if stream.Compression != diskimage.FormatRaw {
+			return nil, fmt.Errorf("%w: %s contains a %s disk image, decompress it and convert it to a raw disk image with ConvertDiskImage",
+				ErrUnsupportedDiskImageFormat, name, diskImageFormatName(format))
+		}
+		return nil, fmt.Errorf("%w: %s is a %s disk image, convert it to a raw disk image with ConvertDiskImage",
+			ErrUnsupportedDiskImageFormat, name, diskImageFormatName(format))
+	}
+	f, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer closeSrc()
+		err := writeSparse(f, stream)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dstPath)
+		}
+		reader.Finish(err)
+	}()
+
+	return reader, nil
+}
+
+// writeSparse copies r to the empty file f, leaving blocks which only contain
+// zeros as holes.
+func writeSparse(f *os.File, r io.Reader) error {
+	w := sparse.NewWriter(f)
+	if _, err := io.CopyBuffer(w, r, make([]byte, 1<<20)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// DiskImageFormat is the format of a disk image file.
+//
+//go:generate stringer -type=DiskImageFormat
+type DiskImageFormat int
+
+const (
+	// DiskImageFormatRaw is a raw disk image, which can be attached as it is.
+	DiskImageFormatRaw DiskImageFormat = 1 + iota
+
+	// DiskImageFormatISO9660 is an ISO 9660 optical disc image, which can be attached as it is.
+	DiskImageFormatISO9660
+
+	// DiskImageFormatASIF is an Apple Sparse Image Format disk image.
+	// It can be attached from macOS 26.
+	DiskImageFormatASIF
+
+	// DiskImageFormatQCOW2 is a QEMU copy-on-write disk image.
+	DiskImageFormatQCOW2
+
+	// DiskImageFormatVMDK is a VMware virtual disk image.
+	DiskImageFormatVMDK
+
+	// DiskImageFormatVHDX is a Hyper-V virtual disk image.
+	DiskImageFormatVHDX
+
+	// DiskImageFormatGzip is a gzip compressed file.
+	DiskImageFormatGzip
+
+	// DiskImageFormatXz is an xz compressed file.
+	DiskImageFormatXz
+
+	// DiskImageFormatZstd is a Zstandard compressed file.
+	DiskImageFormatZstd
+
+	// DiskImageFormatBzip2 is a bzip2 compressed file.
+	DiskImageFormatBzip2
+)
+
+// DiskImagePartitionScheme is the partition table found in a raw disk image.
+//
+//go:generate stringer -type=DiskImagePartitionScheme
+type DiskImagePartitionScheme int
+
+const (
+	// DiskImagePartitionSchemeNone represents that no partition table was found.
+	DiskImagePartitionSchemeNone DiskImagePartitionScheme = iota
+
+	// DiskImagePartitionSchemeMBR represents a Master Boot Record partition table.
+	DiskImagePartitionSchemeMBR
+
+	// DiskImagePartitionSchemeGPT represents a GUID Partition Table.
+	DiskImagePartitionSchemeGPT
+)
+
+// DiskImageFormatInfo describes the format of a disk image file.
+type DiskImageFormatInfo struct {
+	// Format is the detected format of the file.
+	Format DiskImageFormat
+
+	// PartitionScheme is the partition table of a raw disk image.
+	PartitionScheme DiskImagePartitionScheme
+
+	// VirtualSize is the size of the disk seen by the guest in bytes. It is zero if the
+	// size can not be determined without reading the whole file, such as compressed files.
+	VirtualSize int64
+}
+
+// DetectDiskImageFormat detects the format of the disk image at path by its magic bytes.
+// Any file which is not recognized as another format is reported as DiskImageFormatRaw.
+func DetectDiskImageFormat(path string) (*DiskImageFormatInfo, error) {
+	info, err := diskimage.Detect(path)
+	if err != nil {
+		return nil, err
+	}
+	ret := &DiskImageFormatInfo{
+		Format:      diskImageFormatOf(info.Format),
+		VirtualSize: info.VirtualSize,
+	}
+	switch info.PartitionScheme {
+	case diskimage.PartitionSchemeMBR:
+		ret.PartitionScheme = DiskImagePartitionSchemeMBR
+	case diskimage.PartitionSchemeGPT:
+		ret.PartitionScheme = DiskImagePartitionSchemeGPT
+	}
+	return ret, nil
+}
+
+// DiskImageExtent is a range of a disk image file.
+type DiskImageExtent struct {
+	Offset int64
+	Length int64
+}
+
+// DiskImagePartition is a partition found in the partition table of a raw disk image.
+type DiskImagePartition struct {
+	// Number is the 1-based number of the partition. Linux names the partition
+	// after it, e.g. /dev/vda1.
+	Number int
+
+	// Offset and Size are the location of the partition on the disk in bytes.
+	Offset int64
+	Size   int64
+
+	// Type is the partition type GUID of a GPT partition.
+	Type gpt.GUID
+
+	// ID is the unique partition GUID of a GPT partition.
+	ID gpt.GUID
+
+	// Name is the name of a GPT partition.
+	Name string
+
+	// MBRType is the partition type of an MBR partition, e.g. 0x83 for Linux.
+	MBRType byte
+
+	// Bootable reports whether an MBR partition is marked as active.
+	Bootable bool
+}
+
+// DiskImageDetails describes a disk image file and how much host storage it uses.
+type DiskImageDetails struct {
+	DiskImageFormatInfo
+
+	// AllocatedSize is the number of bytes of host storage allocated for the file.
+	// It is less than the size of the file if the file is sparse.
+	AllocatedSize int64
+
+	// Extents is the ranges of the file which contain data in ascending order,
+	// found with SEEK_DATA and SEEK_HOLE. The rest of the file is holes. If the
+	// file system does not support finding holes, the whole file is one extent.
+	Extents []DiskImageExtent
+
+	// Partitions is the partitions of the partition table of a raw disk image,
+	// ordered by number. Only the primary partitions of a Master Boot Record
+	// are reported.
+	Partitions []DiskImagePartition
+}
+
+// DiskImageInfo returns the format, the virtual size, the allocated size, the
+// extent map and the partitions of the disk image at path.
+//
+// This is useful to monitor how much host storage a sparse raw disk image,
+// e.g. created by CreateDiskImage, actually uses.
+func DiskImageInfo(path string) (*DiskImageDetails, error) {
+	format, err := DetectDiskImageFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &DiskImageDetails{DiskImageFormatInfo: *format}
+	ret.AllocatedSize, err = sparse.AllocatedSize(f)
+	if err != nil {
+		return nil, err
+	}
+	extents, err := sparse.DataExtents(f)
+	if err != nil {
+		return nil, err
+	}
+	ret.Extents = make([]DiskImageExtent, len(extents))
+	for i, e := range extents {
+		ret.Extents[i] = DiskImageExtent{Offset: e.Offset, Length: e.Length}
+	}
+
+	if format.Format != DiskImageFormatRaw {
+		return ret, nil
+	}
+	switch format.PartitionScheme {
+	case DiskImagePartitionSchemeGPT:
+		table, err := gpt.Read(f, fi.Size())
+		if err != nil {
+			return nil, err
+		}
+		for i := range table.Partitions {
+			p := &table.Partitions[i]
+			offset, size := table.Bounds(p)
+			ret.Partitions = append(ret.Partitions, DiskImagePartition{
+				Number: p.Number,
+				Offset: offset,
+				Size:   size,
+				Type:   p.Type,
+				ID:     p.ID,
+				Name:   p.Name,
+			})
+		}
+	case DiskImagePartitionSchemeMBR:
+		ret.Partitions = mbrPartitions(f)
+	}
+	return ret, nil
+}
+
+func diskImageFormatOf(format diskimage.Format) DiskImageFormat {
+	switch format {
+	case diskimage.FormatRaw:
+		return DiskImageFormatRaw
+	case diskimage.FormatISO9660:
+		return DiskImageFormatISO9660
+	case diskimage.FormatASIF:
+		return DiskImageFormatASIF
+	case diskimage.FormatQCOW2:
+		return DiskImageFormatQCOW2
+	case diskimage.FormatVMDK:
+		return DiskImageFormatVMDK
+	case diskimage.FormatVHDX:
+		return DiskImageFormatVHDX
+	case diskimage.FormatGzip:
+		return DiskImageFormatGzip
+	case diskimage.FormatXz:
+		return DiskImageFormatXz
+	case diskimage.FormatZstd:
+		return DiskImageFormatZstd
+	case diskimage.FormatBzip2:
+		return DiskImageFormatBzip2
+	}
+	return 0
+}
+
+// ErrUnsupportedDiskImageFormat is returned when a disk image is in a format which
+// Virtualization.framework can not attach.
+var ErrUnsupportedDiskImageFormat = errors.New("unsupported disk image format")
+
+// checkDiskImageFormat returns an error wrapping ErrUnsupportedDiskImageFormat if
+// the disk image at path can not be attached by Virtualization.framework.
+func checkDiskImageFormat(path string) error {
+	info, err := DetectDiskImageFormat(path)
+	if err != nil {
+		return err
+	}
+	switch info.Format {
+	case DiskImageFormatRaw, DiskImageFormatISO9660:
+		return nil
+	case DiskImageFormatASIF:
+		if err := macOSAvailable(26); err != nil {
+			return fmt.Errorf("%w: %q is an ASIF disk image which requires macOS 26 or newer: %w",
+				ErrUnsupportedDiskImageFormat, path, err)
+		}
+		return nil
+	case DiskImageFormatQCOW2, DiskImageFormatVMDK, DiskImageFormatVHDX:
+		return fmt.Errorf("%w: %q is a %s disk image, convert it to a raw disk image with ConvertDiskImage",
+			ErrUnsupportedDiskImageFormat, path, diskImageFormatName(info.Format))
+	}
+	return fmt.Errorf("%w: %q is a %s compressed file, decompress it to a raw disk image with ImportDiskImage",
+		ErrUnsupportedDiskImageFormat, path, diskImageFormatName(info.Format))
+}
+
+func diskImageFormatName(format DiskImageFormat) string {
+	switch format {
+	case DiskImageFormatQCOW2:
+		return "qcow2"
+	case DiskImageFormatVMDK:
+		return "VMDK"
+	case DiskImageFormatVHDX:
+		return "VHDX"
+	case DiskImageFormatGzip:
+		return "gzip"
+	case DiskImageFormatXz:
+		return "xz"
+	case DiskImageFormatZstd:
+		return "zstd"
+	case DiskImageFormatBzip2:
+		return "bzip2"
+	}
+	return format.String()
+}
+
+// ErrDiskImageTooSmall is returned by ResizeDiskImage when the new size would
+// cut off a partition of the disk image.
+var ErrDiskImageTooSmall = errors.New("disk image is too small for its partitions")
+
+// ResizeDiskImageOption is an option for ResizeDiskImage.
+type ResizeDiskImageOption func(*resizeDiskImageOptions) error
+
+type resizeDiskImageOptions struct {
+	growLastPartition bool
+}
+
+// WithResizeDiskImageGrowLastPartition extends the last partition of the GUID
+// Partition Table to the end of the resized disk image. The file system in the
+// partition still has to be grown by the guest, e.g. with resize2fs.
+func WithResizeDiskImageGrowLastPartition() ResizeDiskImageOption {
+	return func(o *resizeDiskImageOptions) error {
+		o.growLastPartition = true
+		return nil
+	}
+}
+
+// ResizeDiskImage changes the size of the raw disk image at path to newSize bytes.
+// newSize must be a multiple of the sector size.
+//
+// If the disk image has a GUID Partition Table, the backup table is moved to the
+// new end of the disk, so guests see a consistent partition table. Shrinking a
+// disk image below the end of its last partition fails with ErrDiskImageTooSmall.
+//
+// Only raw disk images can be resized, other formats return an error wrapping
+// ErrUnsupportedDiskImageFormat.
+func ResizeDiskImage(path string, newSize int64, opts ...ResizeDiskImageOption) error {
+	o := &resizeDiskImageOptions{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return err
+		}
+	}
+	if newSize <= 0 || newSize%512 != 0 {
+		return fmt.Errorf("disk image size %d is not a positive multiple of 512", newSize)
+	}
+	info, err := DetectDiskImageFormat(path)
+	if err != nil {
+		return err
+	}
+	if info.Format != DiskImageFormatRaw {
+		return fmt.Errorf("%w: %q is a %s disk image, only raw disk images can be resized",
+			ErrUnsupportedDiskImageFormat, path, diskImageFormatName(info.Format))
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	oldSize := fi.Size()
+
+	switch info.PartitionScheme {
+	case DiskImagePartitionSchemeGPT:
+		err = resizeGPTDiskImage(f, oldSize, newSize, o)
+	case DiskImagePartitionSchemeMBR:
+		if o.growLastPartition {
+			return fmt.Errorf("%q has no GUID Partition Table to grow the last partition of", path)
+		}
+		if end := mbrPartitionsEnd(f); newSize < end {
+			return fmt.Errorf("%w: the last partition of %q ends at byte %d", ErrDiskImageTooSmall, path, end)
+		}
+		err = f.Truncate(newSize)
+	default:
+		if o.growLastPartition {
+			return fmt.Errorf("%q has no GUID Partition Table to grow the last partition of", path)
+		}
+		err = f.Truncate(newSize)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func resizeGPTDiskImage(f *os.File, oldSize, newSize int64, o *resizeDiskImageOptions) error {
+	table, err := gpt.Read(f, oldSize)
+	if err != nil {
+		return err
+	}
+	if err := table.Resize(newSize); err != nil {
+		if errors.Is(err, gpt.ErrDoesNotFit) {
+			return fmt.Errorf("%w: %w", ErrDiskImageTooSmall, err)
+		}
+		return err
+	}
+	if o.growLastPartition {
+		last := -1
+		for i, p := range table.Partitions {
+			if last < 0 || p.LastLBA > table.Partitions[last].LastLBA {
+				last = i
+			}
+		}
+		if last < 0 {
+			return fmt.Errorf("%q has no partition to grow", f.Name())
+		}
+		table.Partitions[last].LastLBA = table.LastUsableLBA
+	}
+
+	if newSize < oldSize {
+		// Write the tables inside the new size first, so the disk keeps
+		// a valid primary table if truncating fails.
+		if err := table.Write(f, newSize); err != nil {
+			return err
+		}
+		return f.Truncate(newSize)
+	}
+	if err := f.Truncate(newSize); err != nil {
+		return err
+	}
+	// Clear the old backup header so it is not mistaken for the current one.
+	ss := int64(table.SectorSize)
+	if _, err := f.WriteAt(make([]byte, ss), oldSize-ss); err != nil {
+		return err
+	}
+	return table.Write(f, newSize)
+}
+
+// mbrPartitionsEnd returns the end in bytes of the last partition in the
+// Master Boot Record of f.
+func mbrPartitionsEnd(f *os.File) int64 {
+	var end int64
+	for _, p := range mbrPartitions(f) {
+		end = max(end, p.Offset+p.Size)
+	}
+	return end
+}
+
+// mbrPartitions returns the used primary partitions in the Master Boot Record
+// read from r.
+func mbrPartitions(r io.ReaderAt) []DiskImagePartition {
+	mbr := make([]byte, 512)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil
+	}
+	var partitions []DiskImagePartition
+	for i := range 4 {
+		entry := mbr[446+i*16:]
+		start := int64(binary.LittleEndian.Uint32(entry[8:]))
+		count := int64(binary.LittleEndian.Uint32(entry[12:]))
+		if entry[4] != 0 && count != 0 {
+			partitions = append(partitions, DiskImagePartition{
+				Number:   i + 1,
+				Offset:   start * 512,
+				Size:     count * 512,
+				MBRType:  entry[4],
+				Bootable: entry[0] == 0x80,
+			})
+		}
+	}
+	return partitions
+}
+
+// CompactDiskImageOption is an option for CompactDiskImage.
+type CompactDiskImageOption func(*compact.Options) error
+
+// WithCompactDiskImageFileSystems makes CompactDiskImage also deallocate the
+// blocks which the file systems on the disk image mark as free, even if the
+// guest left stale data in them. FAT and ext4 file systems are supported, either
+// on the whole disk or in partitions of a GUID Partition Table; other
+// partitions are left alone.
+//
+// The content of the free blocks changes, so this must only be used while the
+// virtual machine using the disk image is stopped, and its file systems were
+// unmounted cleanly.
+func WithCompactDiskImageFileSystems() CompactDiskImageOption {
+	return func(o *compact.Options) error {
+		o.FileSystems = true
+		return nil
+	}
+}
+
+// CompactDiskImage deallocates the blocks of the raw disk image at path which
+// only contain zeros by punching holes into the file, so that the host storage
+// taken by data the guest deleted is reclaimed. The content of the disk image
+// does not change. It returns the number of bytes reclaimed.
+//
+// Guests can zero their free space before shutting down, e.g. with fstrim when
+// the disk has discard enabled, or use WithCompactDiskImageFileSystems to
+// reclaim free blocks without the help of the guest.
+//
+// The disk image must not be attached to a running virtual machine while it is
+// compacted. Only raw disk images can be compacted, other formats return an error
+// wrapping ErrUnsupportedDiskImageFormat.
+func CompactDiskImage(ctx context.Context, path string, opts ...CompactDiskImageOption) (int64, error) {
+	o := &compact.Options{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return 0, err
+		}
+	}
+	info, err := DetectDiskImageFormat(path)
+	if err != nil {
+		return 0, err
+	}
+	if info.Format != DiskImageFormatRaw {
+		return 0, fmt.Errorf("%w: %q is a %s disk image, only raw disk images can be compacted",
+			ErrUnsupportedDiskImageFormat, path, diskImageFormatName(info.Format))
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	before, err := sparse.AllocatedSize(f)
+	if err != nil {
+		return 0, err
+	}
+	if err := compact.File(ctx, f, o); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	after, err := sparse.AllocatedSize(f)
+	if err != nil {
+		return 0, err
+	}
+	return max(before-after, 0), f.Close()
+}
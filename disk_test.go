@@ -1,7 +1,11 @@
 package vz_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -10,6 +14,7 @@ import (
 	"testing"
 
 	"github.com/Code-Hex/vz/v3"
+	"github.com/Code-Hex/vz/v3/gpt"
 )
 
 func TestCreateSparseDiskImage_FileCreated(t *testing.T) {
@@ -111,3 +116,514 @@ func TestCreateSparseDiskImage_CorrectSize(t *testing.T) {
 		t.Fatalf("actual disk size (%d) doesn't equal to desired size (%d)", actualSize, desiredSize)
 	}
 }
+
+func TestCreateDiskImageWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name string
+		size int64
+		opts []vz.CreateDiskImageOption
+		want int64
+	}{
+		{
+			name: "sparse",
+			size: 1000,
+			want: 1000,
+		},
+		{
+			name: "sector",
+			size: 1000,
+			opts: []vz.CreateDiskImageOption{vz.WithCreateDiskImageAlignment(512)},
+			want: 1024,
+		},
+		{
+			name: "metadata",
+			size: 3*1024*1024 + 1,
+			opts: []vz.CreateDiskImageOption{
+				vz.WithCreateDiskImagePreallocation(vz.DiskImagePreallocationMetadata),
+				vz.WithCreateDiskImageAlignment(1024 * 1024),
+			},
+			want: 4 * 1024 * 1024,
+		},
+		{
+			name: "full",
+			size: 2 * 1024 * 1024,
+			opts: []vz.CreateDiskImageOption{
+				vz.WithCreateDiskImagePreallocation(vz.DiskImagePreallocationFull),
+				vz.WithCreateDiskImageFreeSpaceCheck(),
+			},
+			want: 2 * 1024 * 1024,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name+".img")
+			if err := vz.CreateDiskImageWithOptions(path, tc.size, tc.opts...); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(got)) != tc.want {
+				t.Fatalf("want size %d but got %d", tc.want, len(got))
+			}
+			if !bytes.Equal(got, make([]byte, tc.want)) {
+				t.Fatal("want disk image filled with zeros")
+			}
+			err = vz.CreateDiskImageWithOptions(path, tc.size, tc.opts...)
+			if !os.IsExist(err) {
+				t.Fatalf("want os.ErrExist but got %v", err)
+			}
+		})
+	}
+
+	t.Run("insufficient free space", func(t *testing.T) {
+		path := filepath.Join(dir, "huge.img")
+		err := vz.CreateDiskImageWithOptions(path, 1<<62, vz.WithCreateDiskImageFreeSpaceCheck())
+		if !errors.Is(err, vz.ErrInsufficientFreeSpace) {
+			t.Fatalf("want ErrInsufficientFreeSpace but got %v", err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("want %s removed but got %v", path, err)
+		}
+	})
+
+	t.Run("invalid alignment", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.img")
+		err := vz.CreateDiskImageWithOptions(path, 1024, vz.WithCreateDiskImageAlignment(1000))
+		if err == nil {
+			t.Fatal("want error for alignment which is not a power of two")
+		}
+	})
+}
+
+func TestConvertDiskImage(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk.qcow2")
+	dst := filepath.Join(dir, "disk.img")
+
+	// An empty qcow2 version 3 image with 64 KiB clusters: the header in
+	// the first cluster and an L1 table without any L2 tables in the second.
+	const clusterSize = 64 * 1024
+	const size = 8 * 1024 * 1024
+	qcow2 := make([]byte, 2*clusterSize)
+	copy(qcow2, "QFI\xfb")
+	binary.BigEndian.PutUint32(qcow2[4:], 3)            // version
+	binary.BigEndian.PutUint32(qcow2[20:], 16)          // cluster bits
+	binary.BigEndian.PutUint64(qcow2[24:], size)        // virtual size
+	binary.BigEndian.PutUint32(qcow2[36:], 1)           // L1 size
+	binary.BigEndian.PutUint64(qcow2[40:], clusterSize) // L1 table offset
+	binary.BigEndian.PutUint32(qcow2[96:], 4)           // refcount order
+	binary.BigEndian.PutUint32(qcow2[100:], 104)        // header length
+	if err := os.WriteFile(src, qcow2, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	progress, err := vz.ConvertDiskImage(context.Background(), src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-progress.Finished()
+	if err := progress.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := progress.FractionCompleted(); got != 1 {
+		t.Fatalf("want fraction completed 1 but got %f", got)
+	}
+
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, make([]byte, size)) {
+		t.Fatal("converted disk image must be empty")
+	}
+
+	_, err = vz.ConvertDiskImage(context.Background(), src, dst)
+	if !os.IsExist(err) {
+		t.Fatalf("want os.ErrExist but got %v", err)
+	}
+}
+
+func TestCloneDiskImage(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.img")
+	dst := filepath.Join(dir, "dst.img")
+
+	const size = 8 * 1024 * 1024
+	if err := vz.CreateDiskImage(src, size); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	copy(want[1024*1024:], "hello, world")
+	f, err := os.OpenFile(src, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(want[1024*1024:1024*1024+4096], 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	progress, err := vz.CloneDiskImage(context.Background(), src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-progress.Finished()
+	if err := progress.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := progress.FractionCompleted(); got != 1 {
+		t.Fatalf("want fraction completed 1 but got %f", got)
+	}
+
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("cloned disk image content mismatch")
+	}
+
+	_, err = vz.CloneDiskImage(context.Background(), src, dst)
+	if !os.IsExist(err) {
+		t.Fatalf("want os.ErrExist but got %v", err)
+	}
+}
+
+func TestImportDiskImage(t *testing.T) {
+	dir := t.TempDir()
+	const size = 8 * 1024 * 1024
+	want := make([]byte, size)
+	copy(want[510:], []byte{0x55, 0xaa})
+	copy(want[4*1024*1024:], "hello, world")
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "disk.img.gz")
+	if err := os.WriteFile(src, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "disk.img")
+	progress, err := vz.ImportDiskImage(context.Background(), src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-progress.Finished()
+	if err := progress.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := progress.FractionCompleted(); got != 1 {
+		t.Fatalf("want fraction completed 1 but got %f", got)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("imported disk image content mismatch")
+	}
+
+	_, err = vz.ImportDiskImage(context.Background(), src, dst)
+	if !os.IsExist(err) {
+		t.Fatalf("want os.ErrExist but got %v", err)
+	}
+
+	dst2 := filepath.Join(dir, "disk2.img")
+	progress, err = vz.ImportDiskImageFromReader(context.Background(), bytes.NewReader(buf.Bytes()), int64(buf.Len()), dst2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-progress.Finished()
+	if err := progress.Err(); err != nil {
+		t.Fatal(err)
+	}
+	got, err = os.ReadFile(dst2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("imported disk image content mismatch")
+	}
+
+	buf.Reset()
+	zw = gzip.NewWriter(&buf)
+	qcow2 := make([]byte, 4096)
+	copy(qcow2, "QFI\xfb")
+	binary.BigEndian.PutUint32(qcow2[4:], 3)
+	if _, err := zw.Write(qcow2); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dst3 := filepath.Join(dir, "disk3.img")
+	progress, err = vz.ImportDiskImageFromReader(context.Background(), &buf, -1, dst3)
+	if err == nil {
+		<-progress.Finished()
+		err = progress.Err()
+	}
+	if !errors.Is(err, vz.ErrUnsupportedDiskImageFormat) {
+		t.Fatalf("want ErrUnsupportedDiskImageFormat but got %v", err)
+	}
+	if _, err := os.Stat(dst3); !os.IsNotExist(err) {
+		t.Fatalf("want %s removed but got %v", dst3, err)
+	}
+}
+
+func TestResizeDiskImage(t *testing.T) {
+	const size = 8 * 1024 * 1024
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := vz.CreateDiskImage(path, size); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbr := make([]byte, 512)
+	mbr[446+4] = 0xee
+	binary.LittleEndian.PutUint32(mbr[446+8:], 1)
+	binary.LittleEndian.PutUint32(mbr[446+12:], size/512-1)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if _, err := f.WriteAt(mbr, 0); err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{
+		SectorSize:     512,
+		FirstUsableLBA: 34,
+		LastUsableLBA:  size/512 - 34,
+		NumEntries:     128,
+		Partitions: []gpt.Partition{
+			{Number: 1, Type: gpt.GUID{1}, FirstLBA: 2048, LastLBA: 4095},
+			{Number: 2, Type: gpt.GUID{2}, FirstLBA: 4096, LastLBA: size/512 - 34},
+		},
+	}
+	if err := table.Write(f, size); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	const newSize = 2 * size
+	if err := vz.ResizeDiskImage(path, newSize, vz.WithResizeDiskImageGrowLastPartition()); err != nil {
+		t.Fatal(err)
+	}
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != newSize {
+		t.Fatalf("want size %d but got %d", newSize, fi.Size())
+	}
+	got, err := gpt.Read(f, newSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(newSize/512 - 34); got.LastUsableLBA != want || got.Partitions[1].LastLBA != want {
+		t.Fatalf("want last partition to end at LBA %d but got %+v", want, got)
+	}
+	backup := make([]byte, 8)
+	if _, err := f.ReadAt(backup, newSize-512); err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != "EFI PART" {
+		t.Fatalf("want backup header at the end of the disk but got %q", backup)
+	}
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint32(mbr[446+12:]); got != newSize/512-1 {
+		t.Fatalf("want protective MBR of %d sectors but got %d", newSize/512-1, got)
+	}
+
+	err = vz.ResizeDiskImage(path, size)
+	if !errors.Is(err, vz.ErrDiskImageTooSmall) {
+		t.Fatalf("want ErrDiskImageTooSmall but got %v", err)
+	}
+}
+
+func TestCompactDiskImage(t *testing.T) {
+	const size = 8 * 1024 * 1024
+	dir := t.TempDir()
+	path := filepath.Join(dir, "disk.img")
+	want := make([]byte, size)
+	copy(want[1024*1024:], "hello, world")
+	copy(want[size-4096:], "goodbye")
+	if err := os.WriteFile(path, want, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reclaimed, err := vz.CompactDiskImage(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed < size-2*4096 {
+		t.Fatalf("want at least %d bytes reclaimed but got %d", size-2*4096, reclaimed)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("compacted disk image content mismatch")
+	}
+
+	reclaimed, err = vz.CompactDiskImage(context.Background(), path, vz.WithCompactDiskImageFileSystems())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed != 0 {
+		t.Fatalf("want nothing reclaimed twice but got %d", reclaimed)
+	}
+
+	qcow2 := filepath.Join(dir, "disk.qcow2")
+	header := make([]byte, 4096)
+	copy(header, "QFI\xfb")
+	binary.BigEndian.PutUint32(header[4:], 3)
+	if err := os.WriteFile(qcow2, header, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = vz.CompactDiskImage(context.Background(), qcow2)
+	if !errors.Is(err, vz.ErrUnsupportedDiskImageFormat) {
+		t.Fatalf("want ErrUnsupportedDiskImageFormat but got %v", err)
+	}
+}
+
+func TestDiskImageInfo(t *testing.T) {
+	const size = 16 * 1024 * 1024
+	dir := t.TempDir()
+	path := filepath.Join(dir, "disk.img")
+	if err := vz.CreateDiskImage(path, size); err != nil {
+		t.Fatal(err)
+	}
+	table, err := gpt.New(size, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	esp, err := table.Add(gpt.TypeEFISystem, "EFI System Partition", 4*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Add(gpt.TypeLinuxFilesystem, "root", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := vz.DiskImageInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != vz.DiskImageFormatRaw || info.PartitionScheme != vz.DiskImagePartitionSchemeGPT {
+		t.Fatalf("want raw disk image with GPT but got %v %v", info.Format, info.PartitionScheme)
+	}
+	if info.VirtualSize != size {
+		t.Fatalf("want virtual size %d but got %d", size, info.VirtualSize)
+	}
+	if info.AllocatedSize >= size {
+		t.Fatalf("want sparse disk image but got %d bytes allocated", info.AllocatedSize)
+	}
+	if len(info.Extents) == 0 || info.Extents[0].Offset != 0 {
+		t.Fatalf("want an extent for the partition table but got %+v", info.Extents)
+	}
+	if len(info.Partitions) != 2 {
+		t.Fatalf("want 2 partitions but got %+v", info.Partitions)
+	}
+	offset, partSize := table.Bounds(esp)
+	want := vz.DiskImagePartition{
+		Number: 1,
+		Offset: offset,
+		Size:   partSize,
+		Type:   gpt.TypeEFISystem,
+		ID:     esp.ID,
+		Name:   "EFI System Partition",
+	}
+	if got := info.Partitions[0]; got != want {
+		t.Fatalf("want %+v but got %+v", want, got)
+	}
+	if got := info.Partitions[1]; got.Name != "root" || got.Type != gpt.TypeLinuxFilesystem {
+		t.Fatalf("want root partition but got %+v", got)
+	}
+
+	mbrPath := filepath.Join(dir, "mbr.img")
+	mbr := make([]byte, 1024*1024)
+	mbr[446] = 0x80
+	mbr[446+4] = 0x83
+	binary.LittleEndian.PutUint32(mbr[446+8:], 1)
+	binary.LittleEndian.PutUint32(mbr[446+12:], 2047)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if err := os.WriteFile(mbrPath, mbr, 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err = vz.DiskImageInfo(mbrPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = vz.DiskImagePartition{Number: 1, Offset: 512, Size: 2047 * 512, MBRType: 0x83, Bootable: true}
+	if len(info.Partitions) != 1 || info.Partitions[0] != want {
+		t.Fatalf("want %+v but got %+v", want, info.Partitions)
+	}
+}
+
+func TestDetectDiskImageFormat(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "disk.img")
+	if err := vz.CreateDiskImage(raw, 4096); err != nil {
+		t.Fatal(err)
+	}
+	qcow2 := filepath.Join(dir, "disk.qcow2")
+	header := make([]byte, 512)
+	copy(header, "QFI\xfb")
+	binary.BigEndian.PutUint64(header[24:], 1<<30)
+	if err := os.WriteFile(qcow2, header, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path string
+		want vz.DiskImageFormatInfo
+	}{
+		{
+			path: raw,
+			want: vz.DiskImageFormatInfo{
+				Format:          vz.DiskImageFormatRaw,
+				PartitionScheme: vz.DiskImagePartitionSchemeNone,
+				VirtualSize:     4096,
+			},
+		},
+		{
+			path: qcow2,
+			want: vz.DiskImageFormatInfo{
+				Format:      vz.DiskImageFormatQCOW2,
+				VirtualSize: 1 << 30,
+			},
+		},
+	}
+	for _, tc := range cases {
+		got, err := vz.DetectDiskImageFormat(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != tc.want {
+			t.Errorf("want %+v but got %+v", tc.want, *got)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Package erofs creates EROFS file systems from an fs.FS, and reads them
+// back.
+//
+// EROFS is the read-only file system of Linux for root file systems and
+// container images. Its images are compact and need no journal, so they
+// suit a root file system attached to a guest as a read-only block device,
+// with an overlay or tmpfs for the writable parts:
+//
+//	fsys, err := tarfs.New(layer)
+//	...
+//	err = erofs.WriteFile("root.erofs", fsys, erofs.WithLabel("root"))
+//
+// Images are uncompressed with 4 KiB blocks, which Linux 5.4 and later
+// mounts. FS reads uncompressed images, including ones made by mkfs.erofs
+// without compression.
+package erofs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	superblockOffset = 1024
+	superblockSize   = 128
+	magic            = 0xe0f5e1e2
+
+	featureCompatSbChksum = 0x1
+
+	blockSizeBits = 12
+	blockSize     = 1 << blockSizeBits
+
+	// inodes are addressed by their node id, the offset in the metadata
+	// area in units of 32 bytes.
+	slotSize          = 32
+	compactInodeSize  = 32
+	extendedInodeSize = 64
+
+	layoutFlatPlain  = 0
+	layoutFlatInline = 2
+
+	direntSize      = 12
+	xattrHeaderSize = 12
+	xattrEntrySize  = 4
+
+	maxNameLen     = 255
+	maxLabelLength = 16
+)
+
+// ErrCorrupt is returned when an EROFS image is damaged.
+var ErrCorrupt = errors.New("erofs: corrupt image")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// sbChecksum returns the checksum of the first block b of an image, whose
+// checksum field is zero.
+func sbChecksum(b []byte) uint32 {
+	// crc32c of Linux, which neither inverts the seed nor the result.
+	return ^crc32.Checksum(b[superblockOffset:], castagnoli)
+}
+
+// superblock is the part of the EROFS superblock used by FS.
+type superblock struct {
+	blockSize  int64
+	compat     uint32
+	rootNid    uint64
+	buildTime  time.Time
+	blocks     int64
+	metaBlock  int64
+	xattrBlock int64
+	uuid       [16]byte
+	label      string
+}
+
+func parseSuperblock(b []byte) (*superblock, error) {
+	le := binary.LittleEndian
+	sb := b[superblockOffset:]
+	if le.Uint32(sb[0:]) != magic {
+		return nil, fmt.Errorf("%w: bad magic number", ErrCorrupt)
+	}
+	bits := sb[12]
+	if bits < 9 || bits > 16 {
+		return nil, fmt.Errorf("%w: invalid block size", ErrCorrupt)
+	}
+	s := &superblock{
+		blockSize:  1 << bits,
+		compat:     le.Uint32(sb[8:]),
+		rootNid:    uint64(le.Uint16(sb[14:])),
+		buildTime:  time.Unix(int64(le.Uint64(sb[24:])), int64(le.Uint32(sb[32:]))),
+		blocks:     int64(le.Uint32(sb[36:])),
+		metaBlock:  int64(le.Uint32(sb[40:])),
+		xattrBlock: int64(le.Uint32(sb[44:])),
+	}
+	copy(s.uuid[:], sb[48:64])
+	s.label, _, _ = strings.Cut(string(sb[64:80]), "\x00")
+	if s.compat&featureCompatSbChksum != 0 && s.blockSize <= int64(len(b)) {
+		block := append([]byte(nil), b[:s.blockSize]...)
+		le.PutUint32(block[superblockOffset+4:], 0)
+		if sbChecksum(block) != le.Uint32(sb[4:]) {
+			return nil, fmt.Errorf("%w: superblock checksum mismatch", ErrCorrupt)
+		}
+	}
+	return s, nil
+}
+
+// FS is a read-only EROFS file system. It implements fs.FS, fs.ReadDirFS
+// and fs.StatFS. Symbolic links are followed within the file system, and
+// absolute link targets are resolved from its root.
+//
+// Compressed and chunk-based files return an error wrapping
+// errors.ErrUnsupported when they are opened.
+type FS struct {
+	r  io.ReaderAt
+	sb *superblock
+}
+
+// Open opens the EROFS file system in r.
+func Open(r io.ReaderAt) (*FS, error) {
+	b := make([]byte, 1<<16)
+	n, err := r.ReadAt(b, 0)
+	if n < superblockOffset+superblockSize {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("%w: image is too small", ErrCorrupt)
+		}
+		return nil, err
+	}
+	sb, err := parseSuperblock(b[:n])
+	if err != nil {
+		return nil, err
+	}
+	return &FS{r: r, sb: sb}, nil
+}
+
+// Label returns the volume name of the file system.
+func (f *FS) Label() string { return f.sb.label }
+
+// UUID returns the UUID of the file system.
+func (f *FS) UUID() [16]byte { return f.sb.uuid }
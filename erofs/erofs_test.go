@@ -0,0 +1,234 @@
+package erofs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/erofs"
+	"github.com/Code-Hex/vz/v3/tarfs"
+)
+
+var modTime = time.Date(2024, 5, 6, 7, 8, 9, 500, time.UTC)
+
+// rootfs returns a tar archive of a small root file system.
+func rootfs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(hdr *tar.Header, data string) {
+		t.Helper()
+		hdr.Size = int64(len(data))
+		hdr.ModTime = modTime
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(&tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0o755}, "")
+	add(&tar.Header{Typeflag: tar.TypeReg, Name: "bin/busybox", Mode: 0o4755}, strings.Repeat("busybox\n", 1000))
+	add(&tar.Header{Typeflag: tar.TypeLink, Name: "bin/ls", Linkname: "bin/busybox"}, "")
+	add(&tar.Header{Typeflag: tar.TypeSymlink, Name: "bin/sh", Linkname: "busybox", Mode: 0o777}, "")
+	add(&tar.Header{Typeflag: tar.TypeSymlink, Name: "sbin", Linkname: "/bin", Mode: 0o777}, "")
+	add(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, "guest\n")
+	add(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/empty", Mode: 0o644}, "")
+	add(&tar.Header{Typeflag: tar.TypeChar, Name: "dev/console", Mode: 0o600, Devmajor: 5, Devminor: 1}, "")
+	add(&tar.Header{Typeflag: tar.TypeBlock, Name: "dev/nvme0n1p300", Mode: 0o660, Gid: 6, Devmajor: 259, Devminor: 300}, "")
+	add(&tar.Header{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 0o1777}, "")
+	add(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "usr/bin/ping",
+		Mode:     0o755,
+		PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00",
+			"SCHILY.xattr.user.comment":        "ping",
+		},
+	}, "ping")
+	add(&tar.Header{Typeflag: tar.TypeReg, Name: "home/guest/.profile", Mode: 0o600, Uid: 1000, Gid: 1000}, "export PS1='$ '\n")
+	for i := range 300 {
+		add(&tar.Header{Typeflag: tar.TypeReg, Name: fmt.Sprintf("usr/share/many/file-with-a-long-name-%04d", i), Mode: 0o644}, strings.Repeat("x", i*29))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestWrite(t *testing.T) {
+	src, err := tarfs.New(rootfs(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := erofs.Write(&buf, src, erofs.WithLabel("root")); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%4096 != 0 {
+		t.Fatalf("want a multiple of the block size but got %d bytes", buf.Len())
+	}
+	fsys, err := erofs.Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsys.Label() != "root" {
+		t.Fatalf("want label root but got %q", fsys.Label())
+	}
+	if err := fstest.TestFS(fsys, "bin/busybox", "bin/ls", "etc/hostname", "usr/bin/ping", "home/guest/.profile", "usr/share/many/file-with-a-long-name-0299"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		want, err := fs.ReadFile(src, name)
+		if err != nil {
+			return err
+		}
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(want, got) {
+			return fmt.Errorf("%s: want %d bytes but got %d", name, len(want), len(got))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"bin/sh": "busybox", "sbin": "/bin"} {
+		got, err := fsys.ReadLink(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%s: want %q but got %q", name, want, got)
+		}
+	}
+	if _, err := fsys.Stat("sbin/sh"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		mode  fs.FileMode
+		uid   uint32
+		gid   uint32
+		nlink uint32
+		rdev  uint32
+	}{
+		{name: ".", mode: fs.ModeDir | 0o755, nlink: 8},
+		{name: "bin/busybox", mode: fs.ModeSetuid | 0o755, nlink: 2},
+		{name: "tmp", mode: fs.ModeDir | fs.ModeSticky | 0o777, nlink: 2},
+		{name: "home/guest/.profile", mode: 0o600, uid: 1000, gid: 1000, nlink: 1},
+		{name: "dev/console", mode: fs.ModeDevice | fs.ModeCharDevice | 0o600, nlink: 1, rdev: 5<<8 | 1},
+		{name: "dev/nvme0n1p300", mode: fs.ModeDevice | 0o660, gid: 6, nlink: 1, rdev: 300&0xff | 259<<8 | (300&^0xff)<<12},
+	}
+	for _, tc := range cases {
+		info, err := fsys.Stat(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != tc.mode {
+			t.Fatalf("%s: want mode %v but got %v", tc.name, tc.mode, info.Mode())
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Fatalf("%s: want mod time %v but got %v", tc.name, modTime, info.ModTime())
+		}
+		st := info.Sys().(*erofs.Stat)
+		if st.UID != tc.uid || st.GID != tc.gid || st.Nlink != tc.nlink || st.Rdev != tc.rdev {
+			t.Fatalf("%s: want %d:%d, %d links and device %#x but got %d:%d, %d links and device %#x",
+				tc.name, tc.uid, tc.gid, tc.nlink, tc.rdev, st.UID, st.GID, st.Nlink, st.Rdev)
+		}
+	}
+	busybox, err := fsys.Stat("bin/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := fsys.Stat("bin/ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := busybox.Sys().(*erofs.Stat), ls.Sys().(*erofs.Stat); a.Nid != b.Nid {
+		t.Fatalf("want a hard link but got node ids %d and %d", a.Nid, b.Nid)
+	}
+	ping, err := fsys.Stat("usr/bin/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xattrs := ping.Sys().(*erofs.Stat).Xattrs
+	if string(xattrs["user.comment"]) != "ping" || string(xattrs["security.capability"]) != "\x01\x00\x00\x02\x00\x20\x00\x00" {
+		t.Fatalf("want user.comment and security.capability but got %q", xattrs)
+	}
+
+	// the image only depends on the files.
+	var again bytes.Buffer
+	if err := erofs.Write(&again, src, erofs.WithLabel("root")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Fatal("want the same image from the same files")
+	}
+
+	b := buf.Bytes()
+	b[1024+128+100] ^= 1 // an inode in the first block
+	if _, err := erofs.Open(bytes.NewReader(b)); !errors.Is(err, erofs.ErrCorrupt) {
+		t.Fatalf("want ErrCorrupt but got %v", err)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	fsys := fstest.MapFS{
+		"hello.txt": &fstest.MapFile{Data: []byte("hello\n"), Mode: 0o644, ModTime: modTime},
+		"bad":       &fstest.MapFile{Mode: 0o644, Sys: &tar.Header{PAXRecords: map[string]string{"SCHILY.xattr.system.foo": "x"}}},
+	}
+	path := filepath.Join(t.TempDir(), "root.erofs")
+	if err := erofs.WriteFile(path, fsys); err == nil {
+		t.Fatal("want an error for an unsupported extended attribute")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("want the image to be removed but got %v", err)
+	}
+	delete(fsys, "bad")
+	uuid := [16]byte{1, 2, 3}
+	if err := erofs.WriteFile(path, fsys, erofs.WithUUID(uuid)); err != nil {
+		t.Fatal(err)
+	}
+	if err := erofs.WriteFile(path, fsys); !os.IsExist(err) {
+		t.Fatalf("want an error satisfying os.IsExist but got %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := erofs.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UUID() != uuid {
+		t.Fatalf("want UUID %x but got %x", uuid, got.UUID())
+	}
+	data, err := fs.ReadFile(got, "hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello\n" {
+		t.Fatalf("want hello but got %q", data)
+	}
+	if err := erofs.WriteFile(filepath.Join(t.TempDir(), "x"), fsys, erofs.WithLabel(strings.Repeat("x", 17))); err == nil {
+		t.Fatal("want an error for a long label")
+	}
+}
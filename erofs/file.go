@@ -0,0 +1,326 @@
+package erofs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	_ fs.FS        = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+)
+
+// maxLinks is the number of symbolic links followed while resolving a path,
+// the same limit as Linux.
+const maxLinks = 40
+
+var errLoop = errors.New("too many levels of symbolic links")
+
+// Open opens the named file or directory, following symbolic links.
+func (f *FS) Open(name string) (fs.File, error) {
+	in, err := f.walk("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := &fileInfo{name: path.Base(name), in: in}
+	if in.typ() == modeDir {
+		entries, _, err := f.readDir(in)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dirFile{fileInfo: info, fs: f, entries: entries}, nil
+	}
+	r, err := f.newReader(in)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{fileInfo: info, r: r}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dir, ok := file.(*dirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Stat returns the fs.FileInfo of the named file, following symbolic links.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	in, err := f.walk("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), in: in}, nil
+}
+
+// Lstat returns the fs.FileInfo of the named file without following a
+// symbolic link at the end of name. Together with ReadLink, it makes FS
+// an fs.ReadLinkFS from Go 1.25.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	in, err := f.walk("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), in: in}, nil
+}
+
+// ReadLink returns the target of the named symbolic link.
+func (f *FS) ReadLink(name string) (string, error) {
+	in, err := f.walk("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if in.typ() != modeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := f.readLink(in)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+// lookup returns the inode of the entry name in the directory dir, or nil
+// if there is no such entry. "." and ".." are resolved too.
+func (f *FS) lookup(dir *inode, name string) (*inode, error) {
+	entries, parent, err := f.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case ".":
+		return dir, nil
+	case "..":
+		return f.inode(parent)
+	}
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].name >= name })
+	if i < len(entries) && entries[i].name == name {
+		return f.inode(entries[i].nid)
+	}
+	return nil, nil
+}
+
+// walk returns the inode of the file at name. Symbolic links are followed,
+// except for the last element of name if follow is false.
+func (f *FS) walk(op, name string, follow bool) (*inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	in, err := f.inode(f.sb.rootNid)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	var elems []string
+	if name != "." {
+		elems = strings.Split(name, "/")
+	}
+	links := 0
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		if in.typ() != modeDir {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		next, err := f.lookup(in, elem)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if next == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if next.typ() == modeSymlink && (follow || len(elems) > 0) {
+			if links++; links > maxLinks {
+				return nil, &fs.PathError{Op: op, Path: name, Err: errLoop}
+			}
+			target, err := f.readLink(next)
+			if err != nil {
+				return nil, &fs.PathError{Op: op, Path: name, Err: err}
+			}
+			if target == "" {
+				return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+			}
+			if strings.HasPrefix(target, "/") {
+				// the guest's root is the root of the file system.
+				if in, err = f.inode(f.sb.rootNid); err != nil {
+					return nil, &fs.PathError{Op: op, Path: name, Err: err}
+				}
+			}
+			var link []string
+			for _, e := range strings.Split(target, "/") {
+				if e != "" {
+					link = append(link, e)
+				}
+			}
+			elems = append(link, elems...)
+			continue
+		}
+		in = next
+	}
+	return in, nil
+}
+
+// readLink returns the target of the symbolic link in.
+func (f *FS) readLink(in *inode) (string, error) {
+	if in.size > f.sb.blockSize {
+		return "", fmt.Errorf("%w: invalid size of symbolic link %d", ErrCorrupt, in.Nid)
+	}
+	r, err := f.newReader(in)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, in.size)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// fileInfo describes a file by its inode.
+type fileInfo struct {
+	name string
+	in   *inode
+}
+
+var _ fs.FileInfo = (*fileInfo)(nil)
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.in.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.in.fileMode() }
+func (fi *fileInfo) ModTime() time.Time { return fi.in.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.in.typ() == modeDir }
+func (fi *fileInfo) Sys() any           { return &fi.in.Stat }
+
+// dirEntry is an fs.DirEntry which reads the inode for Info.
+type dirEntry struct {
+	fs *FS
+	dirent
+	mode fs.FileMode
+}
+
+var _ fs.DirEntry = (*dirEntry)(nil)
+
+func (e *dirEntry) Name() string      { return e.name }
+func (e *dirEntry) IsDir() bool       { return e.mode.IsDir() }
+func (e *dirEntry) Type() fs.FileMode { return e.mode }
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	in, err := e.fs.inode(e.nid)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: e.name, in: in}, nil
+}
+
+// fileTypes maps the file type of directory entries to fs.FileMode.
+var fileTypes = [...]fs.FileMode{
+	1: 0,
+	2: fs.ModeDir,
+	3: fs.ModeDevice | fs.ModeCharDevice,
+	4: fs.ModeDevice,
+	5: fs.ModeNamedPipe,
+	6: fs.ModeSocket,
+	7: fs.ModeSymlink,
+}
+
+// newDirEntry returns the fs.DirEntry of e. If the entry has no valid file
+// type, the inode is read for it.
+func (f *FS) newDirEntry(e dirent) (*dirEntry, error) {
+	if e.typ != 0 && int(e.typ) < len(fileTypes) {
+		return &dirEntry{fs: f, dirent: e, mode: fileTypes[e.typ]}, nil
+	}
+	in, err := f.inode(e.nid)
+	if err != nil {
+		return nil, err
+	}
+	return &dirEntry{fs: f, dirent: e, mode: in.fileMode().Type()}, nil
+}
+
+type file struct {
+	*fileInfo
+	r   *reader
+	off int64
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.fileInfo, nil }
+func (f *file) Close() error               { return nil }
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.r.ReadAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *file) ReadAt(p []byte, off int64) (int, error) { return f.r.ReadAt(p, off) }
+
+// Seek implements io.Seeker.
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.r.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+type dirFile struct {
+	*fileInfo
+	fs      *FS
+	entries []dirent
+	off     int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.fileInfo, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.off:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	entries := make([]fs.DirEntry, 0, len(rest))
+	for _, e := range rest {
+		entry, err := d.fs.newDirEntry(e)
+		if err != nil {
+			return entries, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		entries = append(entries, entry)
+		d.off++
+	}
+	return entries, nil
+}
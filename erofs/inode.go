@@ -0,0 +1,336 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+const (
+	modeTypeMask = 0xf000
+	modeFIFO     = 0x1000
+	modeChar     = 0x2000
+	modeDir      = 0x4000
+	modeBlock    = 0x6000
+	modeRegular  = 0x8000
+	modeSymlink  = 0xa000
+	modeSocket   = 0xc000
+)
+
+// xattrPrefixes maps the name index of extended attributes to the prefix of
+// their name. The POSIX ACLs have no name of their own.
+var xattrPrefixes = [...]string{
+	1: "user.",
+	2: "system.posix_acl_access",
+	3: "system.posix_acl_default",
+	4: "trusted.",
+	5: "lustre.",
+	6: "security.",
+}
+
+// Stat is the inode metadata of a file. The Sys method of the fs.FileInfo
+// returned by FS returns a *Stat.
+type Stat struct {
+	Nid    uint64 // the node id, which is the inode number Linux shows
+	UID    uint32
+	GID    uint32
+	Nlink  uint32
+	Rdev   uint32            // the device number of a device, as encoded by new_encode_dev
+	Xattrs map[string][]byte // the extended attributes
+}
+
+// inode is a decoded inode.
+type inode struct {
+	Stat
+	mode   uint16
+	size   int64
+	layout int
+	mtime  time.Time
+	block  int64 // the first data block
+	inline int64 // the offset of the inline data in the image
+}
+
+func (in *inode) typ() uint16 { return in.mode & modeTypeMask }
+
+// inode reads the inode nid.
+func (f *FS) inode(nid uint64) (*inode, error) {
+	sb := f.sb
+	le := binary.LittleEndian
+	off := sb.metaBlock*sb.blockSize + int64(nid)*slotSize
+	b := make([]byte, extendedInodeSize)
+	if _, err := f.r.ReadAt(b[:compactInodeSize], off); err != nil {
+		return nil, err
+	}
+	format := le.Uint16(b[0:])
+	in := &inode{
+		Stat:   Stat{Nid: nid},
+		mode:   le.Uint16(b[4:]),
+		layout: int(format>>1) & 0x7,
+	}
+	var iu uint32
+	size := int64(compactInodeSize)
+	if format&1 == 0 {
+		in.Nlink = uint32(le.Uint16(b[6:]))
+		in.size = int64(le.Uint32(b[8:]))
+		iu = le.Uint32(b[16:])
+		in.UID, in.GID = uint32(le.Uint16(b[24:])), uint32(le.Uint16(b[26:]))
+		in.mtime = sb.buildTime
+	} else {
+		size = extendedInodeSize
+		if _, err := f.r.ReadAt(b[compactInodeSize:], off+compactInodeSize); err != nil {
+			return nil, err
+		}
+		in.size = int64(le.Uint64(b[8:]))
+		iu = le.Uint32(b[16:])
+		in.UID, in.GID = le.Uint32(b[24:]), le.Uint32(b[28:])
+		in.mtime = time.Unix(int64(le.Uint64(b[32:])), int64(le.Uint32(b[40:])))
+		in.Nlink = le.Uint32(b[44:])
+	}
+	if in.size < 0 {
+		return nil, fmt.Errorf("%w: invalid size of inode %d", ErrCorrupt, nid)
+	}
+	var xattrSize int64
+	if icount := int64(le.Uint16(b[2:])); icount > 0 {
+		xattrSize = xattrHeaderSize + (icount-1)*4
+		xattrs, err := f.readXattrs(off+size, xattrSize)
+		if err != nil {
+			return nil, fmt.Errorf("inode %d: %w", nid, err)
+		}
+		in.Xattrs = xattrs
+	}
+	in.inline = off + size + xattrSize
+	switch in.typ() {
+	case modeRegular, modeDir, modeSymlink:
+		in.block = int64(iu)
+	case modeChar, modeBlock:
+		in.Rdev = iu
+		in.size = 0
+	default:
+		in.size = 0
+	}
+	return in, nil
+}
+
+// readXattrs reads the extended attributes of size bytes which follow an
+// inode at off, including the shared ones they refer to.
+func (f *FS) readXattrs(off, size int64) (map[string][]byte, error) {
+	le := binary.LittleEndian
+	b := make([]byte, size)
+	if _, err := f.r.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	shared := int(b[4])
+	if xattrHeaderSize+shared*4 > len(b) {
+		return nil, fmt.Errorf("%w: invalid extended attributes", ErrCorrupt)
+	}
+	xattrs := make(map[string][]byte)
+	for i := range shared {
+		id := int64(le.Uint32(b[xattrHeaderSize+i*4:]))
+		// a shared entry is at most 4 + 255 + 65535 bytes long.
+		e := make([]byte, xattrEntrySize+maxNameLen+1<<16)
+		n, err := f.r.ReadAt(e, f.sb.xattrBlock*f.sb.blockSize+id*4)
+		if n < xattrEntrySize && err != nil {
+			return nil, err
+		}
+		if _, err := parseXattr(xattrs, e[:n]); err != nil {
+			return nil, err
+		}
+	}
+	for e := b[xattrHeaderSize+shared*4:]; len(e) > 0; {
+		n, err := parseXattr(xattrs, e)
+		if err != nil {
+			return nil, err
+		}
+		e = e[min(len(e), (n+3)&^3):]
+	}
+	return xattrs, nil
+}
+
+// parseXattr adds the extended attribute entry at the start of b to xattrs,
+// and returns the length of the entry. Attributes with long name prefixes
+// are left out.
+func parseXattr(xattrs map[string][]byte, b []byte) (int, error) {
+	if len(b) < xattrEntrySize {
+		return 0, fmt.Errorf("%w: invalid extended attribute", ErrCorrupt)
+	}
+	nameLen, index, valueLen := int(b[0]), int(b[1]), int(binary.LittleEndian.Uint16(b[2:]))
+	n := xattrEntrySize + nameLen + valueLen
+	if n > len(b) {
+		return 0, fmt.Errorf("%w: invalid extended attribute", ErrCorrupt)
+	}
+	if index < len(xattrPrefixes) && xattrPrefixes[index] != "" {
+		name := xattrPrefixes[index] + string(b[xattrEntrySize:xattrEntrySize+nameLen])
+		xattrs[name] = append([]byte(nil), b[xattrEntrySize+nameLen:n]...)
+	}
+	return n, nil
+}
+
+// fileMode converts the mode of the inode to fs.FileMode.
+func (in *inode) fileMode() fs.FileMode {
+	mode := fs.FileMode(in.mode & 0o777)
+	switch in.typ() {
+	case modeDir:
+		mode |= fs.ModeDir
+	case modeSymlink:
+		mode |= fs.ModeSymlink
+	case modeChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case modeBlock:
+		mode |= fs.ModeDevice
+	case modeFIFO:
+		mode |= fs.ModeNamedPipe
+	case modeSocket:
+		mode |= fs.ModeSocket
+	case modeRegular:
+	default:
+		mode |= fs.ModeIrregular
+	}
+	if in.mode&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if in.mode&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if in.mode&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// reader reads the data of an inode. The blocks of a flat inode are
+// contiguous, except that the last one may be stored inline after the
+// inode.
+type reader struct {
+	fs   *FS
+	in   *inode
+	size int64
+}
+
+func (f *FS) newReader(in *inode) (*reader, error) {
+	switch in.layout {
+	case layoutFlatPlain, layoutFlatInline:
+	default:
+		return nil, fmt.Errorf("erofs: compressed or chunk-based inode %d: %w", in.Nid, errors.ErrUnsupported)
+	}
+	if in.layout == layoutFlatInline && in.size > 0 {
+		// the inline block must not cross into the next one.
+		bs := f.sb.blockSize
+		if tail := in.size - (in.size-1)/bs*bs; in.inline%bs+tail > bs {
+			return nil, fmt.Errorf("%w: invalid inline data of inode %d", ErrCorrupt, in.Nid)
+		}
+	}
+	return &reader{fs: f, in: in, size: in.size}, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("erofs: negative offset %d", off)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	bs := r.fs.sb.blockSize
+	last := (r.size - 1) / bs
+	n := 0
+	for n < len(p) && off < r.size {
+		m := min(int64(len(p)-n), r.size-off)
+		pos := r.in.block*bs + off
+		if r.in.layout == layoutFlatInline {
+			if off >= last*bs {
+				pos = r.in.inline + off - last*bs
+			} else {
+				m = min(m, last*bs-off)
+			}
+		}
+		if _, err := r.fs.r.ReadAt(p[n:n+int(m)], pos); err != nil {
+			return n, err
+		}
+		n += int(m)
+		off += m
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// dirent is a directory entry.
+type dirent struct {
+	name string
+	nid  uint64
+	typ  byte
+}
+
+// readDir returns the entries of the directory in without "." and "..",
+// and the node id of its parent.
+func (f *FS) readDir(in *inode) ([]dirent, uint64, error) {
+	bs := f.sb.blockSize
+	if in.size > f.sb.blocks*bs {
+		return nil, 0, fmt.Errorf("%w: invalid size of directory %d", ErrCorrupt, in.Nid)
+	}
+	r, err := f.newReader(in)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, in.size)
+	if _, err := r.ReadAt(data, 0); err != nil {
+		return nil, 0, err
+	}
+	le := binary.LittleEndian
+	var (
+		entries []dirent
+		parent  uint64
+	)
+	for off := int64(0); off < int64(len(data)); off += bs {
+		b := data[off:min(off+bs, int64(len(data)))]
+		if len(b) < direntSize {
+			return nil, 0, fmt.Errorf("%w: invalid directory %d", ErrCorrupt, in.Nid)
+		}
+		// the names follow the entries, and the first name gives their
+		// number.
+		count := int(le.Uint16(b[8:])) / direntSize
+		if count == 0 || count*direntSize > len(b) {
+			return nil, 0, fmt.Errorf("%w: invalid directory %d", ErrCorrupt, in.Nid)
+		}
+		for i := range count {
+			e := b[i*direntSize:]
+			start, end := int(le.Uint16(e[8:])), len(b)
+			if i+1 < count {
+				end = int(le.Uint16(e[direntSize+8:]))
+			}
+			if start < count*direntSize || end < start || end > len(b) {
+				return nil, 0, fmt.Errorf("%w: invalid directory %d", ErrCorrupt, in.Nid)
+			}
+			name := string(b[start:end])
+			if i+1 == count {
+				// the last name of a block is padded with zeros.
+				name = string(b[start : start+clen(b[start:end])])
+			}
+			switch name {
+			case ".":
+			case "..":
+				parent = le.Uint64(e)
+			default:
+				entries = append(entries, dirent{name: name, nid: le.Uint64(e), typ: e[10]})
+			}
+		}
+	}
+	return entries, parent, nil
+}
+
+// clen returns the length of the zero-terminated string in b.
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,506 @@
+package erofs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/internal/fstree"
+)
+
+type config struct {
+	label     string
+	uuid      *[16]byte
+	timestamp time.Time
+}
+
+// Option is an option for Write.
+type Option func(*config) error
+
+// WithLabel sets the volume name, at most 16 bytes, which Linux can find
+// the file system by, e.g. root=LABEL=... on the kernel command line.
+func WithLabel(label string) Option {
+	return func(c *config) error {
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("erofs: volume name %q is longer than %d bytes", label, maxLabelLength)
+		}
+		c.label = label
+		return nil
+	}
+}
+
+// WithUUID sets the UUID of the file system. By default it is derived from
+// the names and metadata of the files, so the image only depends on them.
+func WithUUID(uuid [16]byte) Option {
+	return func(c *config) error {
+		c.uuid = &uuid
+		return nil
+	}
+}
+
+// WithTimestamp sets the build time of the file system. By default the
+// latest modification time of the files is used.
+func WithTimestamp(t time.Time) Option {
+	return func(c *config) error {
+		c.timestamp = t
+		return nil
+	}
+}
+
+// node is a file or directory to be written.
+type node struct {
+	*fstree.Node
+	nid      uint64
+	ino      uint32
+	parent   *node
+	children []*node // the entries of a directory, which may be hard links
+	nlink    uint32
+	xattrs   []byte // the extended attributes after the inode
+	data     []byte // the content of a directory or symbolic link
+	size     int64
+	layout   int
+	block    int64 // the first data block
+	blocks   int64 // the number of data blocks, without the inline one
+}
+
+// Write writes an EROFS image holding the files and directories of fsys to
+// w. Use os.DirFS to copy a directory of the host, or tarfs to copy a
+// container image.
+//
+// Files are owned by root and keep their permission bits, including setuid,
+// setgid and sticky bits, unless the Sys method of their fs.FileInfo returns
+// a *tar.Header, as tarfs does. Then its owner, mode, device numbers, hard
+// links and extended attributes from SCHILY.xattr PAX records are used.
+// Symbolic links are kept if fsys has the ReadLink and Lstat methods of
+// fs.ReadLinkFS, e.g. os.DirFS from Go 1.25 and tarfs. Otherwise symbolic
+// links to files are copied as regular files, and symbolic links to
+// directories return an error.
+//
+// Data which does not fill its last block is stored with the inode, like
+// mkfs.erofs does. The result only depends on fsys and the options.
+func Write(w io.Writer, fsys fs.FS, opts ...Option) error {
+	c := &config{}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return err
+		}
+	}
+	root, err := fstree.Read(fsys)
+	if err != nil {
+		return err
+	}
+	if c.timestamp.IsZero() {
+		c.timestamp = fstree.LatestModTime(root)
+	}
+	if c.uuid == nil {
+		uuid := fstree.UUID(root)
+		c.uuid = &uuid
+	}
+	b := &builder{c: c, fsys: fsys, nodes: make(map[*fstree.Node]*node)}
+	b.add(root, nil)
+	if err := b.layout(); err != nil {
+		return err
+	}
+	meta, err := b.metadata()
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(w, 1<<20)
+	if _, err := bw.Write(meta); err != nil {
+		return err
+	}
+	if err := b.writeData(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// WriteFile creates an EROFS image at path with Write. If path already
+// exists, WriteFile returns an error satisfying os.IsExist.
+func WriteFile(path string, fsys fs.FS, opts ...Option) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	return Write(f, fsys, opts...)
+}
+
+type builder struct {
+	c     *config
+	fsys  fs.FS
+	list  []*node // in the order of their inodes, the root first
+	nodes map[*fstree.Node]*node
+	meta  int64 // the number of metadata blocks
+	total int64 // the number of blocks
+}
+
+// add adds n and the nodes below it in depth-first order.
+func (b *builder) add(n *fstree.Node, parent *node) *node {
+	if n.Link != nil {
+		n = n.Link
+	}
+	if nd, ok := b.nodes[n]; ok {
+		return nd
+	}
+	nd := &node{Node: n, parent: parent, nlink: uint32(n.Nlink)}
+	if parent == nil {
+		nd.parent = nd
+	}
+	b.nodes[n] = nd
+	b.list = append(b.list, nd)
+	if n.IsDir() {
+		nd.nlink = 2
+		for _, c := range n.Children {
+			child := b.add(c, nd)
+			nd.children = append(nd.children, child)
+			if c.IsDir() {
+				nd.nlink++
+			}
+		}
+	}
+	return nd
+}
+
+// layout assigns the node ids and data blocks of the nodes.
+func (b *builder) layout() error {
+	pos := int64(superblockOffset + superblockSize)
+	for i, n := range b.list {
+		n.ino = uint32(i + 1)
+		if err := n.setXattrs(); err != nil {
+			return fmt.Errorf("erofs: %s: %w", n.Path, err)
+		}
+		switch n.Mode.Type() {
+		case 0:
+			n.size = n.Size
+		case fs.ModeDir:
+			n.size = n.dirSize()
+		case fs.ModeSymlink:
+			if n.Target == "" || len(n.Target) > blockSize {
+				return fmt.Errorf("erofs: %s: invalid symbolic link target %q", n.Path, n.Target)
+			}
+			n.size = int64(len(n.Target))
+		}
+		isize := int64(extendedInodeSize + len(n.xattrs))
+		if isize > blockSize {
+			return fmt.Errorf("erofs: %s: extended attributes do not fit into a block", n.Path)
+		}
+		n.blocks = (n.size + blockSize - 1) / blockSize
+		var tail int64
+		if n.size > 0 {
+			tail = n.size - (n.blocks-1)*blockSize
+		}
+		inline := n.size > 0 && isize+tail <= blockSize
+		if inline {
+			n.layout = layoutFlatInline
+			n.blocks--
+			isize += tail
+		}
+		// an inode and its inline data do not cross a block boundary.
+		if pos%blockSize+isize > blockSize {
+			pos = (pos + blockSize - 1) / blockSize * blockSize
+		}
+		n.nid = uint64(pos / slotSize)
+		pos = (pos + isize + slotSize - 1) / slotSize * slotSize
+	}
+	if b.list[0].nid > 1<<16-1 {
+		return fmt.Errorf("erofs: invalid root node id %d", b.list[0].nid)
+	}
+	b.meta = (pos + blockSize - 1) / blockSize
+	block := b.meta
+	for _, n := range b.list {
+		if n.blocks > 0 {
+			n.block = block
+			block += n.blocks
+		}
+	}
+	if block > 1<<32-1 {
+		return fmt.Errorf("erofs: image of %d blocks is too large", block)
+	}
+	b.total = block
+	return nil
+}
+
+// setXattrs encodes the extended attributes of n.
+func (n *node) setXattrs() error {
+	if len(n.Xattrs) == 0 {
+		return nil
+	}
+	x := make([]byte, xattrHeaderSize)
+	for _, a := range n.Xattrs {
+		index, name, ok := xattrIndex(a.Name)
+		if !ok {
+			return fmt.Errorf("unsupported extended attribute %s", a.Name)
+		}
+		if len(name) > maxNameLen || len(a.Value) > 1<<16-1 {
+			return fmt.Errorf("extended attribute %s is too long", a.Name)
+		}
+		x = append(x, byte(len(name)), index, 0, 0)
+		binary.LittleEndian.PutUint16(x[len(x)-2:], uint16(len(a.Value)))
+		x = append(x, name...)
+		x = append(x, a.Value...)
+		x = append(x, make([]byte, -len(x)&3)...)
+	}
+	n.xattrs = x
+	return nil
+}
+
+// xattrIndex returns the name index and the rest of the name of the
+// extended attribute name. Lustre attributes are not supported, as Linux
+// does not read them.
+func xattrIndex(name string) (byte, string, bool) {
+	for _, i := range []byte{1, 2, 3, 4, 6} {
+		prefix := xattrPrefixes[i]
+		if !strings.HasSuffix(prefix, ".") {
+			// a POSIX ACL.
+			if name == prefix {
+				return i, "", true
+			}
+			continue
+		}
+		if rest, ok := strings.CutPrefix(name, prefix); ok && rest != "" {
+			return i, rest, true
+		}
+	}
+	return 0, "", false
+}
+
+// dirents returns the entries of the directory n including "." and "..",
+// sorted by name as Linux looks them up.
+func (n *node) dirents() []dirent {
+	entries := []dirent{
+		{name: ".", nid: n.nid, typ: 2},
+		{name: "..", nid: n.parent.nid, typ: 2},
+	}
+	for i, c := range n.children {
+		entries = append(entries, dirent{name: n.Children[i].Name, nid: c.nid, typ: direntType(c.Mode)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries
+}
+
+// dirBlocks packs the entries of the directory n into blocks. Each block
+// holds the entries followed by their names, and all blocks but the last
+// are padded to the block size.
+func (n *node) dirBlocks() []byte {
+	entries := n.dirents()
+	var b []byte
+	for len(entries) > 0 {
+		count, size := 0, 0
+		for count < len(entries) && size+direntSize+len(entries[count].name) <= blockSize {
+			size += direntSize + len(entries[count].name)
+			count++
+		}
+		block := make([]byte, count*direntSize, size)
+		nameOff := count * direntSize
+		for i, e := range entries[:count] {
+			d := block[i*direntSize:]
+			binary.LittleEndian.PutUint64(d[0:], e.nid)
+			binary.LittleEndian.PutUint16(d[8:], uint16(nameOff))
+			d[10] = e.typ
+			nameOff += len(e.name)
+		}
+		for _, e := range entries[:count] {
+			block = append(block, e.name...)
+		}
+		entries = entries[count:]
+		if len(entries) > 0 {
+			block = append(block, make([]byte, blockSize-len(block))...)
+		}
+		b = append(b, block...)
+	}
+	return b
+}
+
+// dirSize returns the size of the directory n, which only depends on the
+// names of its entries.
+func (n *node) dirSize() int64 {
+	return int64(len(n.dirBlocks()))
+}
+
+// direntType returns the file type of a directory entry for mode.
+func direntType(mode fs.FileMode) byte {
+	switch mode.Type() {
+	case fs.ModeDir:
+		return 2
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return 3
+	case fs.ModeDevice:
+		return 4
+	case fs.ModeNamedPipe:
+		return 5
+	case fs.ModeSocket:
+		return 6
+	case fs.ModeSymlink:
+		return 7
+	}
+	return 1
+}
+
+// unixMode converts mode to the mode of an inode.
+func unixMode(mode fs.FileMode) uint16 {
+	m := uint16(mode.Perm())
+	switch mode.Type() {
+	case fs.ModeDir:
+		m |= modeDir
+	case fs.ModeSymlink:
+		m |= modeSymlink
+	case fs.ModeDevice | fs.ModeCharDevice:
+		m |= modeChar
+	case fs.ModeDevice:
+		m |= modeBlock
+	case fs.ModeNamedPipe:
+		m |= modeFIFO
+	case fs.ModeSocket:
+		m |= modeSocket
+	default:
+		m |= modeRegular
+	}
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	return m
+}
+
+// metadata returns the metadata blocks: the superblock, and the inodes with
+// their extended attributes and inline data.
+func (b *builder) metadata() ([]byte, error) {
+	le := binary.LittleEndian
+	meta := make([]byte, b.meta*blockSize)
+	for _, n := range b.list {
+		switch n.Mode.Type() {
+		case fs.ModeDir:
+			n.data = n.dirBlocks()
+		case fs.ModeSymlink:
+			n.data = []byte(n.Target)
+		}
+		in := meta[n.nid*slotSize:]
+		le.PutUint16(in[0:], uint16(n.layout<<1|1)) // an extended inode
+		if len(n.xattrs) > 0 {
+			le.PutUint16(in[2:], uint16(1+(len(n.xattrs)-xattrHeaderSize)/4))
+		}
+		le.PutUint16(in[4:], unixMode(n.Mode))
+		le.PutUint64(in[8:], uint64(n.size))
+		switch n.Mode.Type() {
+		case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+			if n.Major >= 1<<12 || n.Minor >= 1<<20 {
+				return nil, fmt.Errorf("erofs: %s: invalid device number %d:%d", n.Path, n.Major, n.Minor)
+			}
+			le.PutUint32(in[16:], n.Minor&0xff|n.Major<<8|(n.Minor&^0xff)<<12)
+		default:
+			le.PutUint32(in[16:], uint32(n.block))
+		}
+		le.PutUint32(in[20:], n.ino)
+		le.PutUint32(in[24:], n.UID)
+		le.PutUint32(in[28:], n.GID)
+		le.PutUint64(in[32:], uint64(n.ModTime.Unix()))
+		le.PutUint32(in[40:], uint32(n.ModTime.Nanosecond()))
+		le.PutUint32(in[44:], n.nlink)
+		copy(in[extendedInodeSize:], n.xattrs)
+		if n.layout != layoutFlatInline {
+			continue
+		}
+		tail := in[extendedInodeSize+len(n.xattrs) : extendedInodeSize+int64(len(n.xattrs))+n.size-n.blocks*blockSize]
+		if n.data != nil {
+			copy(tail, n.data[n.blocks*blockSize:])
+			continue
+		}
+		if err := b.readTail(n, tail); err != nil {
+			return nil, err
+		}
+	}
+
+	sb := meta[superblockOffset:]
+	le.PutUint32(sb[0:], magic)
+	le.PutUint32(sb[8:], featureCompatSbChksum)
+	sb[12] = blockSizeBits
+	le.PutUint16(sb[14:], uint16(b.list[0].nid))
+	le.PutUint64(sb[16:], uint64(len(b.list)))
+	le.PutUint64(sb[24:], uint64(b.c.timestamp.Unix()))
+	le.PutUint32(sb[32:], uint32(b.c.timestamp.Nanosecond()))
+	le.PutUint32(sb[36:], uint32(b.total))
+	copy(sb[48:], b.c.uuid[:])
+	copy(sb[64:], b.c.label)
+	le.PutUint32(sb[4:], sbChecksum(meta[:blockSize]))
+	return meta, nil
+}
+
+// readTail reads the end of the regular file n which is stored inline into
+// tail.
+func (b *builder) readTail(n *node, tail []byte) error {
+	f, err := b.fsys.Open(n.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(io.Discard, f, n.blocks*blockSize); err != nil {
+		return fmt.Errorf("erofs: %s: %w", n.Path, noEOF(err))
+	}
+	if _, err := io.ReadFull(f, tail); err != nil {
+		return fmt.Errorf("erofs: %s: %w", n.Path, noEOF(err))
+	}
+	return nil
+}
+
+// writeData writes the data blocks of the nodes.
+func (b *builder) writeData(w io.Writer) error {
+	for _, n := range b.list {
+		if n.blocks == 0 {
+			continue
+		}
+		size := min(n.size, n.blocks*blockSize)
+		if n.data != nil {
+			if _, err := w.Write(n.data[:size]); err != nil {
+				return err
+			}
+		} else if err := b.copyFile(w, n, size); err != nil {
+			return err
+		}
+		if pad := n.blocks*blockSize - size; pad > 0 {
+			if _, err := w.Write(make([]byte, pad)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *builder) copyFile(w io.Writer, n *node, size int64) error {
+	f, err := b.fsys.Open(n.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(w, f, size); err != nil {
+		return fmt.Errorf("erofs: %s: %w", n.Path, noEOF(err))
+	}
+	return nil
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for files which shrank after
+// they were measured.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -6,20 +6,25 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"runtime"
 	"time"
 
 	"github.com/Code-Hex/vz/v3"
+	"github.com/Code-Hex/vz/v3/nbd"
 )
 
 var install bool
 var nbdURL string
+var nbdImage string
 var asifDiskImage bool
 
 func init() {
 	flag.BoolVar(&install, "install", false, "run command as install mode")
 	flag.StringVar(&nbdURL, "nbd-url", "", "nbd url (e.g. nbd+unix:///export?socket=nbd.sock)")
+	flag.StringVar(&nbdImage, "nbd-image", "", "disk image served by the in-process NBD server instead of -nbd-url")
 	flag.BoolVar(&asifDiskImage, "asif", false, "use ASIF disk image instead of raw")
 }
 
@@ -189,6 +194,38 @@ func createNetworkBlockDeviceConfiguration(nbdURL string) (*vz.VirtioBlockDevice
 	return vz.NewVirtioBlockDeviceConfiguration(attachment)
 }
 
+// serveNetworkBlockDevice serves the disk image at path over a unix socket
+// and returns the URL of its export.
+func serveNetworkBlockDevice(path string) (string, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	srv := &nbd.Server{}
+	if err := srv.AddExport(nbd.Export{Name: "disk", Data: f}); err != nil {
+		f.Close()
+		return "", err
+	}
+	dir, err := os.MkdirTemp("", "nbd")
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	socket := filepath.Join(dir, "nbd.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			log.Printf("NBD server stopped: %v\n", err)
+		}
+	}()
+	u := &vz.NBDURL{Socket: socket, ExportName: "disk"}
+	return u.String(), nil
+}
+
 func createGraphicsDeviceConfiguration() (*vz.MacGraphicsDeviceConfiguration, error) {
 	graphicDeviceConfig, err := vz.NewMacGraphicsDeviceConfiguration()
 	if err != nil {
@@ -294,6 +331,12 @@ func setupVMConfiguration(ctx context.Context, platformConfig vz.PlatformConfigu
 		return nil, fmt.Errorf("failed to create block device configuration: %w", err)
 	}
 	sdconfigs := []vz.StorageDeviceConfiguration{blockDeviceConfig}
+	if nbdImage != "" {
+		nbdURL, err = serveNetworkBlockDevice(nbdImage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serve network block device: %w", err)
+		}
+	}
 	if nbdURL != "" {
 		ndbConfig, err := createNetworkBlockDeviceConfiguration(nbdURL)
 		if err != nil {
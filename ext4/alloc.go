@@ -0,0 +1,338 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// descField is the offsets of the low and high 16 bits of a group
+// descriptor field. The high bits only exist in 64-byte descriptors.
+type descField [2]int
+
+var (
+	descFreeBlocks      = descField{0x0c, 0x2c}
+	descFreeInodes      = descField{0x0e, 0x2e}
+	descUsedDirs        = descField{0x10, 0x30}
+	descBlockBitmapCsum = descField{0x18, 0x38}
+	descInodeBitmapCsum = descField{0x1a, 0x3a}
+	descItableUnused    = descField{0x1c, 0x32}
+)
+
+const (
+	descFlags    = 0x12
+	descChecksum = 0x1e
+)
+
+func (w *Writer) desc(g int64) []byte {
+	return w.descs[g*w.sb.descSize : (g+1)*w.sb.descSize]
+}
+
+func (w *Writer) descValue(g int64, field descField) uint32 {
+	le := binary.LittleEndian
+	d := w.desc(g)
+	v := uint32(le.Uint16(d[field[0]:]))
+	if w.sb.descSize >= 64 {
+		v |= uint32(le.Uint16(d[field[1]:])) << 16
+	}
+	return v
+}
+
+func (w *Writer) setDescValue(g int64, field descField, v uint32) {
+	le := binary.LittleEndian
+	d := w.desc(g)
+	le.PutUint16(d[field[0]:], uint16(v))
+	if w.sb.descSize >= 64 {
+		le.PutUint16(d[field[1]:], uint16(v>>16))
+	}
+	w.dirty[g] = true
+}
+
+func (w *Writer) addDescValue(g int64, field descField, delta int) {
+	w.setDescValue(g, field, uint32(int(w.descValue(g, field))+delta))
+}
+
+func (w *Writer) clearGroupFlag(g int64, flag uint16) {
+	d := w.desc(g)
+	binary.LittleEndian.PutUint16(d[descFlags:], binary.LittleEndian.Uint16(d[descFlags:])&^flag)
+	w.groups[g].flags &^= flag
+	w.dirty[g] = true
+}
+
+func (w *Writer) freeBlocks() int64 {
+	le := binary.LittleEndian
+	n := int64(le.Uint32(w.raw[0x0c:]))
+	if w.sb.incompat&incompat64Bit != 0 {
+		n |= int64(le.Uint32(w.raw[0x158:])) << 32
+	}
+	return n
+}
+
+func (w *Writer) addFreeBlocks(delta int64) {
+	le := binary.LittleEndian
+	n := w.freeBlocks() + delta
+	le.PutUint32(w.raw[0x0c:], uint32(n))
+	if w.sb.incompat&incompat64Bit != 0 {
+		le.PutUint32(w.raw[0x158:], uint32(n>>32))
+	}
+}
+
+func (w *Writer) addFreeInodes(delta int) {
+	le := binary.LittleEndian
+	le.PutUint32(w.raw[0x10:], uint32(int(le.Uint32(w.raw[0x10:]))+delta))
+}
+
+// blockBitmap returns the block bitmap of group g. The bitmap of a group
+// whose bitmap was never initialized is built the way Linux does it, from
+// the metadata in the group.
+func (w *Writer) blockBitmap(g int64) ([]byte, error) {
+	if b, ok := w.blockBitmaps[g]; ok {
+		return b, nil
+	}
+	sb := w.sb
+	b := make([]byte, sb.blockSize)
+	if w.groups[g].flags&groupBlockUninit == 0 {
+		if err := w.readBlocks(b, w.groups[g].blockBitmap); err != nil {
+			return nil, err
+		}
+		w.blockBitmaps[g] = b
+		return b, nil
+	}
+	first := sb.groupFirstBlock(g)
+	n := min(sb.blocksPerGroup, sb.blocks-first)
+	mark := func(block, count int64) {
+		for i := max(block, first); i < min(block+count, first+n); i++ {
+			setBit(b, i-first)
+		}
+	}
+	mark(first, w.baseMetaBlocks(g))
+	desc := w.groups[g]
+	mark(desc.blockBitmap, 1)
+	mark(desc.inodeBitmap, 1)
+	mark(desc.inodeTable, (int64(sb.inodesPerGroup)*sb.inodeSize+sb.blockSize-1)/sb.blockSize)
+	for i := n; i < sb.blockSize*8; i++ {
+		setBit(b, i)
+	}
+	w.clearGroupFlag(g, groupBlockUninit)
+	w.blockBitmaps[g] = b
+	return b, nil
+}
+
+// baseMetaBlocks returns the number of blocks at the start of group g which
+// hold the superblock and group descriptors, or their backups.
+func (w *Writer) baseMetaBlocks(g int64) int64 {
+	sb := w.sb
+	var n int64
+	if sb.hasSuper(g) {
+		n = 1
+	}
+	perBlock := sb.blockSize / sb.descSize
+	if sb.incompat&incompatMetaBG == 0 || g < int64(sb.firstMetaBG)*perBlock {
+		if n == 0 {
+			return 0
+		}
+		descBlocks := (sb.groups() + perBlock - 1) / perBlock
+		if sb.incompat&incompatMetaBG != 0 {
+			descBlocks = int64(sb.firstMetaBG)
+		}
+		return n + descBlocks + int64(binary.LittleEndian.Uint16(w.raw[0xce:]))
+	}
+	if i := g % perBlock; i == 0 || i == 1 || i == perBlock-1 {
+		n++
+	}
+	return n
+}
+
+// inodeBitmap returns the inode bitmap of group g, initializing it if it
+// was never used.
+func (w *Writer) inodeBitmap(g int64) ([]byte, error) {
+	if b, ok := w.inodeBitmaps[g]; ok {
+		return b, nil
+	}
+	b := make([]byte, w.sb.blockSize)
+	if w.groups[g].flags&groupInodeUninit == 0 {
+		if err := w.readBlocks(b, w.groups[g].inodeBitmap); err != nil {
+			return nil, err
+		}
+	} else {
+		for i := int64(w.sb.inodesPerGroup); i < w.sb.blockSize*8; i++ {
+			setBit(b, i)
+		}
+		w.clearGroupFlag(g, groupInodeUninit)
+	}
+	w.inodeBitmaps[g] = b
+	return b, nil
+}
+
+func bit(b []byte, i int64) bool { return b[i/8]&(1<<(i%8)) != 0 }
+func setBit(b []byte, i int64)   { b[i/8] |= 1 << (i % 8) }
+func clearBit(b []byte, i int64) { b[i/8] &^= 1 << (i % 8) }
+
+// allocBlocks allocates n blocks, preferring group goal, and returns them as
+// extents whose logical blocks are relative to the first one.
+func (w *Writer) allocBlocks(n, goal int64) ([]extent, error) {
+	sb := w.sb
+	if n > w.freeBlocks() {
+		return nil, ErrNoSpace
+	}
+	var extents []extent
+	groups := sb.groups()
+	for i := range groups {
+		if n == 0 {
+			break
+		}
+		g := (goal + i) % groups
+		if w.descValue(g, descFreeBlocks) == 0 {
+			continue
+		}
+		b, err := w.blockBitmap(g)
+		if err != nil {
+			return nil, err
+		}
+		first := sb.groupFirstBlock(g)
+		for j := int64(0); j < min(sb.blocksPerGroup, sb.blocks-first) && n > 0; j++ {
+			if bit(b, j) {
+				continue
+			}
+			setBit(b, j)
+			w.addDescValue(g, descFreeBlocks, -1)
+			w.addFreeBlocks(-1)
+			n--
+			if k := len(extents); k > 0 && extents[k-1].start+extents[k-1].length == first+j {
+				extents[k-1].length++
+				continue
+			}
+			var logical int64
+			if k := len(extents); k > 0 {
+				logical = extents[k-1].end()
+			}
+			extents = append(extents, extent{logical: logical, start: first + j, length: 1})
+		}
+	}
+	if n > 0 {
+		return nil, fmt.Errorf("%w: the free block counts are wrong", ErrCorrupt)
+	}
+	return extents, nil
+}
+
+// releaseBlocks releases length blocks starting at start.
+func (w *Writer) releaseBlocks(start, length int64) error {
+	sb := w.sb
+	for block := start; block < start+length; block++ {
+		g, i := (block-sb.firstDataBlock)/sb.blocksPerGroup, (block-sb.firstDataBlock)%sb.blocksPerGroup
+		if block < sb.firstDataBlock || block >= sb.blocks || w.groups[g].flags&groupBlockUninit != 0 {
+			return fmt.Errorf("%w: block %d is not in use", ErrCorrupt, block)
+		}
+		b, err := w.blockBitmap(g)
+		if err != nil {
+			return err
+		}
+		if !bit(b, i) {
+			return fmt.Errorf("%w: block %d is not in use", ErrCorrupt, block)
+		}
+		clearBit(b, i)
+		w.addDescValue(g, descFreeBlocks, 1)
+		w.addFreeBlocks(1)
+	}
+	return nil
+}
+
+// allocInode allocates an inode, preferring group goal.
+func (w *Writer) allocInode(dir bool, goal int64) (uint32, error) {
+	sb := w.sb
+	groups := sb.groups()
+	for i := range groups {
+		g := (goal + i) % groups
+		if w.descValue(g, descFreeInodes) == 0 {
+			continue
+		}
+		b, err := w.inodeBitmap(g)
+		if err != nil {
+			return 0, err
+		}
+		for j := range int64(sb.inodesPerGroup) {
+			ino := uint32(g)*sb.inodesPerGroup + uint32(j) + 1
+			if bit(b, j) || ino < w.firstIno {
+				continue
+			}
+			setBit(b, j)
+			w.addDescValue(g, descFreeInodes, -1)
+			w.addFreeInodes(-1)
+			if dir {
+				w.addDescValue(g, descUsedDirs, 1)
+			}
+			if w.groupCsum() {
+				// the inodes after itable_unused were never used.
+				if unused := int64(w.descValue(g, descItableUnused)); j >= int64(sb.inodesPerGroup)-unused {
+					w.setDescValue(g, descItableUnused, sb.inodesPerGroup-uint32(j)-1)
+				}
+			}
+			return ino, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no free inodes", ErrNoSpace)
+}
+
+func (w *Writer) metadataCsum() bool { return w.sb.roCompat&roCompatMetadataCsum != 0 }
+
+// groupCsum reports whether group descriptors have checksums and may have
+// uninitialized bitmaps and inode tables.
+func (w *Writer) groupCsum() bool {
+	return w.sb.roCompat&(roCompatGdtCsum|roCompatMetadataCsum) != 0
+}
+
+// flush writes the changed bitmaps and group descriptors, and the
+// superblock.
+func (w *Writer) flush() error {
+	sb := w.sb
+	le := binary.LittleEndian
+	groups := make([]int64, 0, len(w.dirty))
+	for g := range w.dirty {
+		groups = append(groups, g)
+	}
+	slices.Sort(groups)
+	for _, g := range groups {
+		if b, ok := w.blockBitmaps[g]; ok {
+			if _, err := w.w.WriteAt(b, w.groups[g].blockBitmap*sb.blockSize); err != nil {
+				return err
+			}
+			if w.metadataCsum() {
+				w.setDescValue(g, descBlockBitmapCsum, crc32c(w.csumSeed, b[:sb.clustersPerGroup/8]))
+			}
+		}
+		if b, ok := w.inodeBitmaps[g]; ok {
+			if _, err := w.w.WriteAt(b, w.groups[g].inodeBitmap*sb.blockSize); err != nil {
+				return err
+			}
+			if w.metadataCsum() {
+				w.setDescValue(g, descInodeBitmapCsum, crc32c(w.csumSeed, b[:sb.inodesPerGroup/8]))
+			}
+		}
+		d := w.desc(g)
+		switch {
+		case w.metadataCsum():
+			c := crc32c(w.csumSeed, le32(uint32(g)), d[:descChecksum], []byte{0, 0}, d[descChecksum+2:])
+			le.PutUint16(d[descChecksum:], uint16(c))
+		case w.groupCsum():
+			c := crc16(^uint16(0), sb.uuid[:], le32(uint32(g)), d[:descChecksum], d[descChecksum+2:])
+			le.PutUint16(d[descChecksum:], c)
+		}
+		if _, err := w.w.WriteAt(d, sb.descOffset(g)); err != nil {
+			return err
+		}
+	}
+	clear(w.dirty)
+	return w.writeSuperblock()
+}
+
+func (w *Writer) writeSuperblock() error {
+	le := binary.LittleEndian
+	now := w.now().Unix()
+	le.PutUint32(w.raw[0x30:], uint32(now)) // s_wtime
+	w.raw[0x274] = byte(now >> 32)
+	if w.metadataCsum() {
+		le.PutUint32(w.raw[0x3fc:], crc32c(^uint32(0), w.raw[:0x3fc]))
+	}
+	_, err := w.w.WriteAt(w.raw, superblockOffset)
+	return err
+}
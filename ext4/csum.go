@@ -0,0 +1,39 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c continues the CRC32C crc over p the way ext4 does, without the
+// inversion before and after which hash/crc32 applies.
+func crc32c(crc uint32, p ...[]byte) uint32 {
+	crc = ^crc
+	for _, b := range p {
+		crc = crc32.Update(crc, castagnoli, b)
+	}
+	return ^crc
+}
+
+// crc16 continues the CRC16 (ANSI, reflected) crc over p, which is used by
+// the group descriptor checksums of file systems with uninit_bg but without
+// metadata_csum.
+func crc16(crc uint16, p ...[]byte) uint16 {
+	for _, b := range p {
+		for _, c := range b {
+			crc ^= uint16(c)
+			for range 8 {
+				if crc&1 != 0 {
+					crc = crc>>1 ^ 0xa001
+				} else {
+					crc >>= 1
+				}
+			}
+		}
+	}
+	return crc
+}
+
+func le32(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
@@ -0,0 +1,206 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// maxLinks is the number of symbolic links followed while resolving a path,
+// the same limit as Linux.
+const maxLinks = 40
+
+var errLoop = errors.New("too many levels of symbolic links")
+
+// dirent is a directory entry.
+type dirent struct {
+	name string
+	ino  uint32
+	typ  byte // file type, or 0 if the file system does not record it
+}
+
+// readDir returns the entries of the directory in without "." and "..",
+// and the inode number of its parent.
+//
+// Hashed (htree) directories are read like linear ones: their index blocks
+// look like empty entries to older implementations, and the leaf blocks hold
+// every entry.
+func (f *FS) readDir(in *inode) ([]dirent, uint32, error) {
+	if in.flags&flagInlineData != 0 {
+		data, err := in.inlineData()
+		if err != nil {
+			return nil, 0, err
+		}
+		// the parent inode number replaces "." and "..", followed by
+		// the entries in i_block and in the extended attribute.
+		parent := binary.LittleEndian.Uint32(data)
+		entries, _, err := f.parseDir(nil, data[4:inlineSize])
+		if err != nil {
+			return nil, 0, err
+		}
+		entries, _, err = f.parseDir(entries, data[inlineSize:])
+		return entries, parent, err
+	}
+	if in.size > f.sb.blocks*f.sb.blockSize {
+		return nil, 0, fmt.Errorf("%w: invalid size of directory %d", ErrCorrupt, in.Ino)
+	}
+	r, err := f.newReader(in)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, in.size)
+	if _, err := r.ReadAt(data, 0); err != nil {
+		return nil, 0, err
+	}
+	var (
+		entries []dirent
+		parent  uint32
+	)
+	for off := int64(0); off < int64(len(data)); off += f.sb.blockSize {
+		var p uint32
+		entries, p, err = f.parseDir(entries, data[off:min(off+f.sb.blockSize, int64(len(data)))])
+		if err != nil {
+			return nil, 0, err
+		}
+		if p != 0 {
+			parent = p
+		}
+	}
+	return entries, parent, nil
+}
+
+// parseDir appends the entries of the directory block b, and returns the
+// inode number of ".." if b contains it.
+func (f *FS) parseDir(entries []dirent, b []byte) ([]dirent, uint32, error) {
+	le := binary.LittleEndian
+	var parent uint32
+	for off := 0; off+8 <= len(b); {
+		e := b[off:]
+		ino := le.Uint32(e[0:])
+		recLen := int(le.Uint16(e[4:]))
+		if f.sb.blockSize >= 1<<16 && (recLen == 0 || recLen == 1<<16-1) {
+			recLen = 1 << 16
+		}
+		nameLen, typ := int(e[6]), e[7]
+		if f.sb.incompat&incompatFiletype == 0 {
+			nameLen, typ = int(le.Uint16(e[6:])), 0
+		}
+		if recLen < 8 || recLen%4 != 0 || off+recLen > len(b) || 8+nameLen > recLen {
+			return nil, 0, fmt.Errorf("%w: invalid directory entry", ErrCorrupt)
+		}
+		off += recLen
+		if ino == 0 {
+			// an unused entry, an htree index node or the checksum tail.
+			continue
+		}
+		switch name := string(e[8 : 8+nameLen]); name {
+		case ".":
+		case "..":
+			parent = ino
+		default:
+			entries = append(entries, dirent{name: name, ino: ino, typ: typ})
+		}
+	}
+	return entries, parent, nil
+}
+
+// lookup returns the inode of the entry name in the directory dir, or nil
+// if there is no such entry. "." and ".." are resolved too.
+func (f *FS) lookup(dir *inode, name string) (*inode, error) {
+	entries, parent, err := f.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case ".":
+		return dir, nil
+	case "..":
+		if parent == 0 {
+			return nil, fmt.Errorf("%w: directory %d has no parent", ErrCorrupt, dir.Ino)
+		}
+		return f.inode(parent)
+	}
+	for _, e := range entries {
+		if e.name == name {
+			return f.inode(e.ino)
+		}
+	}
+	return nil, nil
+}
+
+// walk returns the inode of the file at name. Symbolic links are followed,
+// except for the last element of name if follow is false.
+func (f *FS) walk(op, name string, follow bool) (*inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	in, err := f.inode(rootIno)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	var elems []string
+	if name != "." {
+		elems = strings.Split(name, "/")
+	}
+	links := 0
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		if in.typ() != modeDir {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		next, err := f.lookup(in, elem)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if next == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if next.typ() == modeSymlink && (follow || len(elems) > 0) {
+			if links++; links > maxLinks {
+				return nil, &fs.PathError{Op: op, Path: name, Err: errLoop}
+			}
+			target, err := f.readLink(next)
+			if err != nil {
+				return nil, &fs.PathError{Op: op, Path: name, Err: err}
+			}
+			if target == "" {
+				return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+			}
+			if strings.HasPrefix(target, "/") {
+				// the guest's root is the root of the file system.
+				if in, err = f.inode(rootIno); err != nil {
+					return nil, &fs.PathError{Op: op, Path: name, Err: err}
+				}
+			}
+			var link []string
+			for _, e := range strings.Split(target, "/") {
+				if e != "" {
+					link = append(link, e)
+				}
+			}
+			elems = append(link, elems...)
+			continue
+		}
+		in = next
+	}
+	return in, nil
+}
+
+// readLink returns the target of the symbolic link in.
+func (f *FS) readLink(in *inode) (string, error) {
+	if in.size > f.sb.blockSize {
+		return "", fmt.Errorf("%w: invalid size of symbolic link %d", ErrCorrupt, in.Ino)
+	}
+	r, err := f.newReader(in)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, in.size)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,352 @@
+// Package ext4 reads ext2, ext3 and ext4 file systems, and changes ext4 file
+// systems in place.
+//
+// It is meant for inspecting the disk of a Linux guest without booting it,
+// e.g. to read /var/log or /etc/os-release after the guest failed to boot.
+// FS implements fs.FS over a file system in an io.ReaderAt, so it works on a
+// raw disk image, or on a partition of one with io.NewSectionReader:
+//
+//	table, err := gpt.ReadFile("disk.img")
+//	...
+//	offset, size := table.Bounds(&table.Partitions[1])
+//	fsys, err := ext4.Open(io.NewSectionReader(f, offset, size), size)
+//	...
+//	osRelease, err := fs.ReadFile(fsys, "etc/os-release")
+//
+// Extents, hashed (htree) directories, symbolic links, inline data and
+// 64-bit block numbers are supported. Checksums are not verified and the
+// journal is not replayed, so the files of a file system which was not
+// unmounted cleanly may be stale.
+//
+// Writer adds files, directories and symbolic links to an ext4 file system
+// which is not mounted, e.g. to provision a guest before its first boot
+// without loop-mounting its disk, which is not possible on macOS:
+//
+//	w, err := ext4.OpenWriter(f, size)
+//	...
+//	err = w.MkdirAll("root/.ssh", 0o700)
+//	...
+//	err = w.WriteFile("root/.ssh/authorized_keys", key, 0o600)
+//
+// Format creates a new ext4 file system holding the files of an fs.FS, e.g.
+// the root file system of a guest built from a container image:
+//
+//	fsys, err := tarfs.New(layer)
+//	...
+//	err = ext4.FormatFile("root.img", 1<<30, fsys, ext4.WithLabel("root"))
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrCorrupt is returned when an ext4 file system is damaged.
+var ErrCorrupt = errors.New("ext4: corrupt file system")
+
+const (
+	superblockOffset = 1024
+	superblockSize   = 1024
+	magic            = 0xef53
+
+	rootIno = 2
+
+	compatHasJournal   = 0x4
+	compatExtAttr      = 0x8
+	compatDirIndex     = 0x20
+	compatSparseSuper2 = 0x200
+
+	incompatCompression = 0x1
+	incompatFiletype    = 0x2
+	incompatRecover     = 0x4
+	incompatJournalDev  = 0x8
+	incompatMetaBG      = 0x10
+	incompatExtents     = 0x40
+	incompat64Bit       = 0x80
+	incompatMMP         = 0x100
+	incompatFlexBG      = 0x200
+	incompatEAInode     = 0x400
+	incompatDirData     = 0x1000
+	incompatCsumSeed    = 0x2000
+	incompatLargeDir    = 0x4000
+	incompatInlineData  = 0x8000
+	incompatEncrypt     = 0x10000
+	incompatCasefold    = 0x20000
+
+	// incompatSupported is the incompatible features which FS can read.
+	incompatSupported = incompatFiletype | incompatRecover | incompatMetaBG |
+		incompatExtents | incompat64Bit | incompatMMP | incompatFlexBG |
+		incompatEAInode | incompatCsumSeed | incompatLargeDir |
+		incompatInlineData | incompatCasefold
+
+	roCompatSparseSuper   = 0x1
+	roCompatLargeFile     = 0x2
+	roCompatHugeFile      = 0x8
+	roCompatGdtCsum       = 0x10
+	roCompatDirNlink      = 0x20
+	roCompatExtraIsize    = 0x40
+	roCompatBigAlloc      = 0x200
+	roCompatMetadataCsum  = 0x400
+	roCompatProject       = 0x2000
+	roCompatVerity        = 0x8000
+	roCompatOrphanPresent = 0x10000
+
+	stateValid = 0x1
+	stateError = 0x2
+)
+
+// superblock is the part of the ext4 superblock used by FS.
+type superblock struct {
+	inodes           uint32
+	blocks           int64
+	firstDataBlock   int64
+	blockSize        int64
+	clusterSize      int64
+	blocksPerGroup   int64
+	clustersPerGroup int64
+	inodesPerGroup   uint32
+	inodeSize        int64
+	descSize         int64
+	state            uint16
+	compat           uint32
+	incompat         uint32
+	roCompat         uint32
+	firstMetaBG      uint32
+	backupBGs        [2]uint32
+	uuid             [16]byte
+	label            string
+}
+
+func parseSuperblock(b []byte) (*superblock, error) {
+	le := binary.LittleEndian
+	if le.Uint16(b[0x38:]) != magic {
+		return nil, fmt.Errorf("%w: bad magic number", ErrCorrupt)
+	}
+	sb := &superblock{
+		inodes:           le.Uint32(b[0x00:]),
+		blocks:           int64(le.Uint32(b[0x04:])),
+		firstDataBlock:   int64(le.Uint32(b[0x14:])),
+		blocksPerGroup:   int64(le.Uint32(b[0x20:])),
+		clustersPerGroup: int64(le.Uint32(b[0x24:])),
+		inodesPerGroup:   le.Uint32(b[0x28:]),
+		state:            le.Uint16(b[0x3a:]),
+		inodeSize:        128,
+		descSize:         32,
+		compat:           le.Uint32(b[0x5c:]),
+		incompat:         le.Uint32(b[0x60:]),
+		roCompat:         le.Uint32(b[0x64:]),
+		firstMetaBG:      le.Uint32(b[0x104:]),
+		backupBGs:        [2]uint32{le.Uint32(b[0x24c:]), le.Uint32(b[0x250:])},
+	}
+	copy(sb.uuid[:], b[0x68:0x78])
+	sb.label, _, _ = strings.Cut(string(b[0x78:0x88]), "\x00")
+	if le.Uint32(b[0x4c:]) != 0 { // dynamic revision
+		sb.inodeSize = int64(le.Uint16(b[0x58:]))
+	}
+	if sb.incompat&incompat64Bit != 0 {
+		sb.blocks |= int64(le.Uint32(b[0x150:])) << 32
+		sb.descSize = int64(le.Uint16(b[0xfe:]))
+	}
+	if unsupported := sb.incompat &^ incompatSupported; unsupported != 0 {
+		return nil, fmt.Errorf("ext4: unsupported incompatible features %#x: %w", unsupported, errors.ErrUnsupported)
+	}
+
+	logBlockSize := le.Uint32(b[0x18:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("%w: invalid block size", ErrCorrupt)
+	}
+	sb.blockSize = 1024 << logBlockSize
+	sb.clusterSize = sb.blockSize
+	if sb.roCompat&roCompatBigAlloc != 0 {
+		logClusterSize := le.Uint32(b[0x1c:])
+		if logClusterSize < logBlockSize || logClusterSize > 16 {
+			return nil, fmt.Errorf("%w: invalid cluster size", ErrCorrupt)
+		}
+		sb.clusterSize = 1024 << logClusterSize
+	} else {
+		sb.clustersPerGroup = sb.blocksPerGroup
+	}
+	switch {
+	case sb.blocksPerGroup == 0 || sb.clustersPerGroup == 0 || sb.inodesPerGroup == 0:
+		return nil, fmt.Errorf("%w: invalid group size", ErrCorrupt)
+	case sb.clustersPerGroup > sb.blockSize*8:
+		return nil, fmt.Errorf("%w: block bitmap is larger than a block", ErrCorrupt)
+	case sb.inodeSize < 128 || sb.inodeSize > sb.blockSize || sb.inodeSize&(sb.inodeSize-1) != 0:
+		return nil, fmt.Errorf("%w: invalid inode size %d", ErrCorrupt, sb.inodeSize)
+	case sb.descSize < 32 || sb.descSize > sb.blockSize || sb.descSize&(sb.descSize-1) != 0:
+		return nil, fmt.Errorf("%w: invalid group descriptor size %d", ErrCorrupt, sb.descSize)
+	case sb.firstDataBlock >= sb.blocks:
+		return nil, fmt.Errorf("%w: no data blocks", ErrCorrupt)
+	}
+	return sb, nil
+}
+
+// groups returns the number of block groups.
+func (sb *superblock) groups() int64 {
+	return (sb.blocks - sb.firstDataBlock + sb.blocksPerGroup - 1) / sb.blocksPerGroup
+}
+
+// groupFirstBlock returns the first block of group g.
+func (sb *superblock) groupFirstBlock(g int64) int64 {
+	return sb.firstDataBlock + g*sb.blocksPerGroup
+}
+
+// hasSuper reports whether group g holds a copy of the superblock and the
+// group descriptors.
+func (sb *superblock) hasSuper(g int64) bool {
+	switch {
+	case g == 0:
+		return true
+	case sb.compat&compatSparseSuper2 != 0:
+		return g == int64(sb.backupBGs[0]) || g == int64(sb.backupBGs[1])
+	case g == 1 || sb.roCompat&roCompatSparseSuper == 0:
+		return true
+	}
+	for _, base := range []int64{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+// groupDesc is the part of a block group descriptor used by FS.
+type groupDesc struct {
+	blockBitmap int64
+	inodeBitmap int64
+	inodeTable  int64
+	flags       uint16
+}
+
+const (
+	groupInodeUninit = 0x1
+	groupBlockUninit = 0x2
+)
+
+// FS is a read-only ext2, ext3 or ext4 file system. It implements fs.FS,
+// fs.ReadDirFS and fs.StatFS. Symbolic links are followed within the file
+// system, and absolute link targets are resolved from its root.
+type FS struct {
+	r      io.ReaderAt
+	sb     *superblock
+	groups []groupDesc
+}
+
+// Open opens the ext2, ext3 or ext4 file system of size bytes in r.
+// File systems using features which can not be read, e.g. encryption, are
+// rejected with an error wrapping errors.ErrUnsupported.
+func Open(r io.ReaderAt, size int64) (*FS, error) {
+	b := make([]byte, superblockSize)
+	if _, err := r.ReadAt(b, superblockOffset); err != nil {
+		return nil, err
+	}
+	sb, err := parseSuperblock(b)
+	if err != nil {
+		return nil, err
+	}
+	if sb.blocks > size/sb.blockSize {
+		return nil, fmt.Errorf("%w: file system is larger than %d bytes", ErrCorrupt, size)
+	}
+	if int64(sb.inodes) > sb.groups()*int64(sb.inodesPerGroup) {
+		return nil, fmt.Errorf("%w: invalid inode count %d", ErrCorrupt, sb.inodes)
+	}
+	f := &FS{r: r, sb: sb}
+	if err := f.readGroupDescs(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// descOffset returns the byte offset of the descriptor of group g.
+//
+// Without META_BG, or before the first meta group, the descriptors are in
+// consecutive blocks after the superblock. Otherwise each meta group of
+// groups whose descriptors fill a block keeps them in its first group.
+func (sb *superblock) descOffset(g int64) int64 {
+	perBlock := sb.blockSize / sb.descSize
+	if sb.incompat&incompatMetaBG == 0 || g < int64(sb.firstMetaBG)*perBlock {
+		return (sb.firstDataBlock+1)*sb.blockSize + g*sb.descSize
+	}
+	first := g - g%perBlock
+	block := sb.groupFirstBlock(first)
+	if sb.hasSuper(first) {
+		block++
+	}
+	return block*sb.blockSize + g%perBlock*sb.descSize
+}
+
+// readDescs returns the raw descriptors of all groups.
+func (f *FS) readDescs() ([]byte, error) {
+	sb := f.sb
+	groups := sb.groups()
+	data := make([]byte, groups*sb.descSize)
+	// read the descriptors of a block, or of all groups before the first
+	// meta group, at once.
+	for g := int64(0); g < groups; {
+		n := int64(1)
+		for g+n < groups && sb.descOffset(g+n) == sb.descOffset(g)+n*sb.descSize {
+			n++
+		}
+		if _, err := f.r.ReadAt(data[g*sb.descSize:(g+n)*sb.descSize], sb.descOffset(g)); err != nil {
+			return nil, err
+		}
+		g += n
+	}
+	return data, nil
+}
+
+func (f *FS) readGroupDescs() error {
+	sb := f.sb
+	data, err := f.readDescs()
+	if err != nil {
+		return err
+	}
+	f.groups = make([]groupDesc, sb.groups())
+	for i := range f.groups {
+		g := parseGroupDesc(sb, data[int64(i)*sb.descSize:])
+		if g.inodeTable == 0 || g.inodeTable >= sb.blocks {
+			return fmt.Errorf("%w: invalid inode table of group %d", ErrCorrupt, i)
+		}
+		f.groups[i] = g
+	}
+	return nil
+}
+
+func parseGroupDesc(sb *superblock, d []byte) groupDesc {
+	le := binary.LittleEndian
+	g := groupDesc{
+		blockBitmap: int64(le.Uint32(d[0x00:])),
+		inodeBitmap: int64(le.Uint32(d[0x04:])),
+		inodeTable:  int64(le.Uint32(d[0x08:])),
+		flags:       le.Uint16(d[0x12:]),
+	}
+	if sb.descSize >= 64 {
+		g.blockBitmap |= int64(le.Uint32(d[0x20:])) << 32
+		g.inodeBitmap |= int64(le.Uint32(d[0x24:])) << 32
+		g.inodeTable |= int64(le.Uint32(d[0x28:])) << 32
+	}
+	return g
+}
+
+// Label returns the volume label, or an empty string if there is none.
+func (f *FS) Label() string { return f.sb.label }
+
+// UUID returns the UUID of the file system, which Linux uses to find it,
+// e.g. root=UUID=... on the kernel command line.
+func (f *FS) UUID() [16]byte { return f.sb.uuid }
+
+// readBlocks reads len(p) bytes starting at block.
+func (f *FS) readBlocks(p []byte, block int64) error {
+	if block <= 0 || block+(int64(len(p))+f.sb.blockSize-1)/f.sb.blockSize > f.sb.blocks {
+		return fmt.Errorf("%w: block %d is out of range", ErrCorrupt, block)
+	}
+	_, err := f.r.ReadAt(p, block*f.sb.blockSize)
+	return err
+}
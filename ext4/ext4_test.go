@@ -0,0 +1,707 @@
+package ext4_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/ext4"
+	"github.com/Code-Hex/vz/v3/gpt"
+)
+
+// The images in testdata were created by mke2fs -d from the same tree:
+//
+//   - ext4.img.gz: 4 KiB blocks with the default ext4 features of
+//     e2fsprogs 1.47, including 64bit and metadata_csum.
+//   - ext2.img.gz: 1 KiB blocks with block maps instead of extents.
+//   - inline.img.gz: ext4 with inline_data, which stores small files and
+//     directories in the inode.
+//
+// e2fsck -D turned var/cache/many into an htree directory in each of them.
+var images = []string{"ext4", "ext2", "inline"}
+
+var modTime = time.Unix(1700000000, 0)
+
+func testFiles() map[string][]byte {
+	var syslog, messages bytes.Buffer
+	for i := range 6000 {
+		fmt.Fprintf(&syslog, "Oct 17 12:00:%02d guest kernel: line %06d\n", i%60, i)
+	}
+	for i := range 8000 {
+		fmt.Fprintf(&messages, "Oct 17 12:00:%02d guest systemd[1]: message %06d\n", i%60, i)
+	}
+	sh := []byte("\x7fELF")
+	for range 40 {
+		for i := range 256 {
+			sh = append(sh, byte(i))
+		}
+	}
+	// a file with holes and more extents than fit into the inode.
+	sparse := make([]byte, 12*64*1024+10000)
+	for i := range 12 {
+		copy(sparse[i*64*1024:], bytes.Repeat([]byte{byte(i + 1)}, 5000))
+	}
+	copy(sparse[len(sparse)-4:], "end\n")
+	files := map[string][]byte{
+		"etc/os-release":         []byte("NAME=\"Debian GNU/Linux\"\nID=debian\nVERSION_ID=\"12\"\n"),
+		"etc/hostname":           []byte("guest\n"),
+		"usr/share/zoneinfo/UTC": append([]byte("TZif2"), make([]byte, 100)...),
+		"usr/bin/sh":             sh,
+		"usr/bin/sudo":           []byte("\x7fELF sudo"),
+		"var/log/syslog":         syslog.Bytes(),
+		"var/log/messages":       messages.Bytes(),
+		"var/log/empty.log":      {},
+		"var/lib/sparse.img":     sparse,
+		"opt/app/config":         []byte("key=value\n"),
+	}
+	for i := range 400 {
+		files[fmt.Sprintf("var/cache/many/file-with-a-fairly-long-name-%04d.txt", i)] = fmt.Appendf(nil, "%d\n", i)
+	}
+	return files
+}
+
+func readImage(t *testing.T, name string) []byte {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name+".img.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func open(t *testing.T, name string) *ext4.FS {
+	t.Helper()
+	b := readImage(t, name)
+	fsys, err := ext4.Open(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestOpen(t *testing.T) {
+	files := testFiles()
+	for _, image := range images {
+		t.Run(image, func(t *testing.T) {
+			fsys := open(t, image)
+			// etc holds dangling and looping symbolic links, which
+			// fstest.TestFS can not open.
+			for _, dir := range []string{"usr", "var", "opt"} {
+				var expected []string
+				for name := range files {
+					if rel, ok := strings.CutPrefix(name, dir+"/"); ok {
+						expected = append(expected, rel)
+					}
+				}
+				sub, err := fs.Sub(fsys, dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := fstest.TestFS(sub, expected...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, want := range files {
+				got, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(want, got) {
+					t.Fatalf("%s: content mismatch", name)
+				}
+			}
+			entries, err := fsys.ReadDir("var/cache/many")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 400 {
+				t.Fatalf("want 400 entries but got %d", len(entries))
+			}
+		})
+	}
+}
+
+func TestStat(t *testing.T) {
+	for _, image := range images {
+		t.Run(image, func(t *testing.T) {
+			fsys := open(t, image)
+			cases := []struct {
+				name string
+				mode fs.FileMode
+				size int64
+			}{
+				{name: ".", mode: fs.ModeDir | 0o755},
+				{name: "etc/hostname", mode: 0o644, size: 6},
+				{name: "usr/bin/sudo", mode: fs.ModeSetuid | 0o755, size: 9},
+				{name: "var/fifo", mode: fs.ModeNamedPipe | 0o644},
+				{name: "etc/localtime", mode: 0o644, size: 105},
+				{name: "bin", mode: fs.ModeDir | 0o755},
+			}
+			for _, tc := range cases {
+				info, err := fsys.Stat(tc.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode() != tc.mode {
+					t.Fatalf("%s: want mode %v but got %v", tc.name, tc.mode, info.Mode())
+				}
+				if !info.IsDir() && info.Size() != tc.size {
+					t.Fatalf("%s: want size %d but got %d", tc.name, tc.size, info.Size())
+				}
+				if !info.ModTime().Equal(modTime) {
+					t.Fatalf("%s: want mod time %v but got %v", tc.name, modTime, info.ModTime())
+				}
+				if st, ok := info.Sys().(*ext4.Stat); !ok || st.UID != 0 || st.Ino == 0 {
+					t.Fatalf("%s: want *ext4.Stat owned by root but got %+v", tc.name, info.Sys())
+				}
+			}
+		})
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	for _, image := range images {
+		t.Run(image, func(t *testing.T) {
+			fsys := open(t, image)
+			links := map[string]string{
+				"etc/localtime": "/usr/share/zoneinfo/UTC",
+				"bin":           "usr/bin",
+				"etc/dangling":  "nowhere",
+				// longer than the 60 bytes which fit into the inode.
+				"etc/slowlink": "../../xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx/../usr/share/zoneinfo/../zoneinfo/UTC",
+			}
+			for name, want := range links {
+				got, err := fsys.ReadLink(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Fatalf("%s: want %q but got %q", name, want, got)
+				}
+				info, err := fsys.Lstat(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Type() != fs.ModeSymlink {
+					t.Fatalf("%s: want symlink but got %v", name, info.Mode())
+				}
+			}
+
+			utc, err := fs.ReadFile(fsys, "usr/share/zoneinfo/UTC")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"etc/localtime", "etc/slowlink"} {
+				got, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(utc, got) {
+					t.Fatalf("%s: want content of the link target", name)
+				}
+			}
+			if _, err := fs.ReadFile(fsys, "bin/sh"); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := fsys.Stat("etc/dangling"); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("want fs.ErrNotExist but got %v", err)
+			}
+			if _, err := fsys.Stat("etc/loop1"); err == nil || errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("want symlink loop error but got %v", err)
+			}
+			if _, err := fsys.ReadLink("etc/hostname"); !errors.Is(err, fs.ErrInvalid) {
+				t.Fatalf("want fs.ErrInvalid but got %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenPartition(t *testing.T) {
+	const size = 32 << 20
+	table, err := gpt.New(size, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Add(gpt.TypeEFISystem, "EFI System Partition", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	root, err := table.Add(gpt.TypeLinuxFilesystem, "root", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Write(f, size); err != nil {
+		t.Fatal(err)
+	}
+	offset, partSize := table.Bounds(root)
+	if _, err := f.WriteAt(readImage(t, "ext4"), offset); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := ext4.Open(io.NewSectionReader(f, offset, partSize), partSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile(fsys, "etc/os-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testFiles()["etc/os-release"]; !bytes.Equal(want, got) {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+}
+
+func TestOpenError(t *testing.T) {
+	b := readImage(t, "ext4")
+	if _, err := ext4.Open(bytes.NewReader(b), int64(len(b))/2); !errors.Is(err, ext4.ErrCorrupt) {
+		t.Fatalf("want ErrCorrupt for a truncated file system but got %v", err)
+	}
+	if _, err := ext4.Open(bytes.NewReader(make([]byte, 4096)), 4096); !errors.Is(err, ext4.ErrCorrupt) {
+		t.Fatalf("want ErrCorrupt without a superblock but got %v", err)
+	}
+
+	encrypted := bytes.Clone(b)
+	encrypted[1024+0x62] |= 0x1 // INCOMPAT_ENCRYPT
+	if _, err := ext4.Open(bytes.NewReader(encrypted), int64(len(b))); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("want errors.ErrUnsupported but got %v", err)
+	}
+}
+
+func TestFreeExtents(t *testing.T) {
+	files := testFiles()
+	for _, image := range images {
+		t.Run(image, func(t *testing.T) {
+			b := readImage(t, image)
+			fsys, err := ext4.Open(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			extents, err := fsys.FreeExtents()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(extents) == 0 {
+				t.Fatal("want free extents")
+			}
+			var end int64
+			for _, e := range extents {
+				if e.Offset < end || e.Length <= 0 || e.Offset+e.Length > int64(len(b)) {
+					t.Fatalf("invalid extent %+v after %d", e, end)
+				}
+				end = e.Offset + e.Length
+			}
+
+			// overwriting the free extents must not change any file.
+			for _, e := range extents {
+				copy(b[e.Offset:e.Offset+e.Length], bytes.Repeat([]byte{0xff}, int(e.Length)))
+			}
+			fsys, err = ext4.Open(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range files {
+				got, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(want, got) {
+					t.Fatalf("%s: content mismatch", name)
+				}
+			}
+			if _, err := fsys.ReadDir("var/cache/many"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	b := readImage(t, "ext4")
+	b[1024+0x3a] &^= 0x1 // EXT4_VALID_FS
+	fsys, err := ext4.Open(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.FreeExtents(); !errors.Is(err, ext4.ErrNotClean) {
+		t.Fatalf("want ErrNotClean but got %v", err)
+	}
+}
+
+// writeImage writes the image name to a temporary file.
+func writeImage(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), name+".img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := f.Write(readImage(t, name)); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// fsck checks the file system in f with e2fsck if it is installed.
+func fsck(t *testing.T, f *os.File) {
+	t.Helper()
+	path, err := exec.LookPath("e2fsck")
+	if err != nil {
+		return
+	}
+	if out, err := exec.Command(path, "-fn", f.Name()).CombinedOutput(); err != nil {
+		t.Fatalf("e2fsck: %v\n%s", err, out)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	for _, image := range []string{"ext4", "inline"} {
+		t.Run(image, func(t *testing.T) {
+			f := writeImage(t, image)
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := ext4.OpenWriter(f, info.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files := testFiles()
+			write := func(name string, data []byte, perm fs.FileMode) {
+				t.Helper()
+				if err := w.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.WriteFile(name, data, perm); err != nil {
+					t.Fatal(err)
+				}
+				files[name] = data
+			}
+			// a new directory with a new file, owned by a user.
+			write("home/guest/.ssh/authorized_keys", []byte("ssh-ed25519 AAAA guest@host\n"), 0o600)
+			for _, name := range []string{"home/guest", "home/guest/.ssh", "home/guest/.ssh/authorized_keys"} {
+				if err := w.Lchown(name, 1000, 1000); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Chmod("home/guest/.ssh", 0o700); err != nil {
+				t.Fatal(err)
+			}
+			// replaced files, shrinking, growing and with inline data.
+			write("etc/hostname", []byte("vm\n"), 0o644)
+			write("var/lib/sparse.img", []byte("small"), 0o644)
+			write("var/log/syslog", bytes.Repeat([]byte("grown\n"), 100000), 0o644)
+			write("opt/app/config", bytes.Repeat([]byte("key=value\n"), 1000), 0o644)
+			write("opt/app/new", []byte("new\n"), 0o644)
+			// a new file in a hashed directory, and a directory which
+			// grows beyond a block.
+			write("var/cache/many/new.txt", []byte("new\n"), 0o644)
+			for i := range 300 {
+				write(fmt.Sprintf("var/spool/a-new-file-with-a-long-name-%04d", i), fmt.Appendf(nil, "%d\n", i), 0o644)
+			}
+			write("etc/systemd/system/firstboot.service", []byte("[Service]\nExecStart=/usr/bin/true\n"), 0o644)
+			if err := w.MkdirAll("etc/systemd/system/multi-user.target.wants", 0o755); err != nil {
+				t.Fatal(err)
+			}
+			links := map[string]string{
+				"etc/systemd/system/multi-user.target.wants/firstboot.service": "/etc/systemd/system/firstboot.service",
+				"home/guest/long": strings.Repeat("../", 30) + "etc/hostname",
+			}
+			for name, target := range links {
+				if err := w.Symlink(target, name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mtime := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+			if err := w.Chtimes("etc/hostname", time.Time{}, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := w.Mkdir("home", 0o755); !errors.Is(err, fs.ErrExist) {
+				t.Fatalf("want fs.ErrExist but got %v", err)
+			}
+			if err := w.Symlink("x", "etc/hostname"); !errors.Is(err, fs.ErrExist) {
+				t.Fatalf("want fs.ErrExist but got %v", err)
+			}
+			if err := w.WriteFile("var/log", nil, 0o644); err == nil {
+				t.Fatal("want an error for writing a directory")
+			}
+			if err := w.WriteFile("nowhere/file", nil, 0o644); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("want fs.ErrNotExist but got %v", err)
+			}
+
+			fsck(t, f)
+			fsys, err := ext4.Open(f, info.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range files {
+				got, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(want, got) {
+					t.Fatalf("%s: content mismatch", name)
+				}
+			}
+			for name, want := range links {
+				if got, err := fsys.ReadLink(name); err != nil || got != want {
+					t.Fatalf("%s: want %q but got %q, %v", name, want, got, err)
+				}
+			}
+			// etc holds looping symbolic links, which fstest.TestFS can
+			// not open.
+			for dir, name := range map[string]string{
+				"home": "guest/.ssh/authorized_keys",
+				"var":  "spool/a-new-file-with-a-long-name-0299",
+				"opt":  "app/new",
+			} {
+				sub, err := fs.Sub(fsys, dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := fstest.TestFS(sub, name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			entries, err := fsys.ReadDir("var/cache/many")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 401 {
+				t.Fatalf("want 401 entries but got %d", len(entries))
+			}
+
+			cases := []struct {
+				name string
+				mode fs.FileMode
+				uid  uint32
+			}{
+				{name: "home/guest/.ssh", mode: fs.ModeDir | 0o700, uid: 1000},
+				{name: "home/guest/.ssh/authorized_keys", mode: 0o600, uid: 1000},
+				{name: "var/spool", mode: fs.ModeDir | 0o755},
+				{name: "etc/hostname", mode: 0o644},
+			}
+			for _, tc := range cases {
+				info, err := fsys.Stat(tc.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode() != tc.mode {
+					t.Fatalf("%s: want mode %v but got %v", tc.name, tc.mode, info.Mode())
+				}
+				if st := info.Sys().(*ext4.Stat); st.UID != tc.uid || st.GID != tc.uid {
+					t.Fatalf("%s: want owner %d but got %d:%d", tc.name, tc.uid, st.UID, st.GID)
+				}
+			}
+			if info, err := fsys.Stat("etc/hostname"); err != nil || !info.ModTime().Equal(mtime) {
+				t.Fatalf("want mod time %v but got %v, %v", mtime, info.ModTime(), err)
+			}
+		})
+	}
+}
+
+func TestOpenWriterError(t *testing.T) {
+	b := readImage(t, "ext2")
+	if _, err := ext4.OpenWriter(&memFile{b}, int64(len(b))); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("want errors.ErrUnsupported for ext2 but got %v", err)
+	}
+	b = readImage(t, "ext4")
+	b[1024+0x3a] &^= 0x1 // EXT4_VALID_FS
+	if _, err := ext4.OpenWriter(&memFile{b}, int64(len(b))); !errors.Is(err, ext4.ErrNotClean) {
+		t.Fatalf("want ErrNotClean but got %v", err)
+	}
+}
+
+// memFile is an ext4.ReadWriterAt in memory.
+type memFile struct{ b []byte }
+
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(m.b).ReadAt(p, off)
+}
+
+func (m *memFile) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m.b[off:], p), nil
+}
+
+func TestFormat(t *testing.T) {
+	acl := []byte{
+		2, 0, 0, 0, // version
+		1, 0, 6, 0, 0xff, 0xff, 0xff, 0xff, // user::rw-
+		2, 0, 6, 0, 0xe8, 0x03, 0, 0, // user:1000:rw-
+		4, 0, 4, 0, 0xff, 0xff, 0xff, 0xff, // group::r--
+		0x10, 0, 6, 0, 0xff, 0xff, 0xff, 0xff, // mask::rw-
+		0x20, 0, 4, 0, 0xff, 0xff, 0xff, 0xff, // other::r--
+	}
+	header := func(typ byte, mode int64, uid int, xattrs map[string]string) *tar.Header {
+		hdr := &tar.Header{Typeflag: typ, Mode: mode, Uid: uid, Gid: uid, PAXRecords: make(map[string]string)}
+		for k, v := range xattrs {
+			hdr.PAXRecords["SCHILY.xattr."+k] = v
+		}
+		return hdr
+	}
+	files := testFiles()
+	fsys := fstest.MapFS{}
+	for name, data := range files {
+		fsys[name] = &fstest.MapFile{Data: data, Mode: 0o644, ModTime: modTime}
+	}
+	for name, f := range map[string]*fstest.MapFile{
+		"bin/busybox": {Data: []byte("busybox"), Mode: fs.ModeSetuid | 0o755, Sys: header(tar.TypeReg, 0o4755, 0, nil)},
+		"home/guest/notes": {
+			Data: []byte("notes\n"),
+			Mode: 0o640,
+			Sys: header(tar.TypeReg, 0o640, 1000, map[string]string{
+				"user.comment":            "hello",
+				"security.capability":     "\x01\x00\x00\x02",
+				"system.posix_acl_access": string(acl),
+			}),
+		},
+		"var/lib/big-xattr": {
+			Data: []byte("big\n"),
+			Mode: 0o644,
+			Sys:  header(tar.TypeReg, 0o644, 0, map[string]string{"user.big": strings.Repeat("x", 1000)}),
+		},
+		"dev/null":     {Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666, Sys: &tar.Header{Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3}},
+		"dev/big":      {Mode: fs.ModeDevice | 0o660, Sys: &tar.Header{Typeflag: tar.TypeBlock, Mode: 0o660, Devmajor: 259, Devminor: 300}},
+		"run/initctl":  {Mode: fs.ModeNamedPipe | 0o600},
+		"tmp":          {Mode: fs.ModeDir | fs.ModeSticky | 0o777},
+		"var/lib/many": {Mode: fs.ModeDir | 0o755},
+	} {
+		if f.ModTime.IsZero() {
+			f.ModTime = modTime
+		}
+		fsys[name] = f
+	}
+	for i := range 500 {
+		fsys[fmt.Sprintf("var/lib/many/file-with-a-long-name-%04d", i)] = &fstest.MapFile{Data: fmt.Appendf(nil, "%d\n", i), Mode: 0o644, ModTime: modTime}
+	}
+
+	const size = 64 << 20
+	path := filepath.Join(t.TempDir(), "root.img")
+	if err := ext4.FormatFile(path, size, fsys, ext4.WithLabel("root")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fsck(t, f)
+
+	got, err := ext4.Open(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Label() != "root" {
+		t.Fatalf("want label root but got %q", got.Label())
+	}
+	for name, want := range files {
+		data, err := fs.ReadFile(got, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, data) {
+			t.Fatalf("%s: content mismatch", name)
+		}
+	}
+	if err := fstest.TestFS(got, "bin/busybox", "home/guest/notes", "var/lib/many/file-with-a-long-name-0499", "lost+found"); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		mode fs.FileMode
+		uid  uint32
+	}{
+		{name: "bin/busybox", mode: fs.ModeSetuid | 0o755},
+		{name: "home/guest/notes", mode: 0o640, uid: 1000},
+		{name: "dev/null", mode: fs.ModeDevice | fs.ModeCharDevice | 0o666},
+		{name: "run/initctl", mode: fs.ModeNamedPipe | 0o600},
+		{name: "tmp", mode: fs.ModeDir | fs.ModeSticky | 0o777},
+		{name: "lost+found", mode: fs.ModeDir | 0o700},
+	}
+	for _, tc := range cases {
+		info, err := got.Stat(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != tc.mode {
+			t.Fatalf("%s: want mode %v but got %v", tc.name, tc.mode, info.Mode())
+		}
+		if st := info.Sys().(*ext4.Stat); st.UID != tc.uid || st.GID != tc.uid {
+			t.Fatalf("%s: want owner %d but got %d:%d", tc.name, tc.uid, st.UID, st.GID)
+		}
+		if !info.ModTime().Equal(modTime) && tc.name != "lost+found" {
+			t.Fatalf("%s: want mod time %v but got %v", tc.name, modTime, info.ModTime())
+		}
+	}
+
+	if path, err := exec.LookPath("debugfs"); err == nil {
+		for cmd, want := range map[string]string{
+			"ea_list /home/guest/notes":  `user.comment (5) = "hello"`,
+			"ea_list /var/lib/big-xattr": "user.big (1000)",
+			"stat /dev/big":              "Device major/minor number: 259:300",
+		} {
+			out, err := exec.Command(path, "-R", cmd, f.Name()).CombinedOutput()
+			if err != nil || !strings.Contains(string(out), want) {
+				t.Fatalf("debugfs %s: want %q but got %v\n%s", cmd, want, err, out)
+			}
+		}
+	}
+
+	// the image only depends on the files.
+	var a, b memFile
+	a.b, b.b = make([]byte, size), make([]byte, size)
+	for _, m := range []*memFile{&a, &b} {
+		if err := ext4.Format(m, size, fsys, ext4.WithLabel("root")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(a.b, b.b) {
+		t.Fatal("want the same image from the same files")
+	}
+	image, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys2, err := ext4.Open(bytes.NewReader(a.b), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsys2.UUID() != got.UUID() || len(image) != size {
+		t.Fatal("want the UUID of the files")
+	}
+
+	if err := ext4.Format(&memFile{make([]byte, 1<<20)}, 1<<20, fsys); !errors.Is(err, ext4.ErrNoSpace) {
+		t.Fatalf("want ErrNoSpace but got %v", err)
+	}
+	if err := ext4.FormatFile(path, size, fsys); !os.IsExist(err) {
+		t.Fatalf("want an error satisfying os.IsExist but got %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+var (
+	_ fs.FS        = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+)
+
+// Open opens the named file or directory, following symbolic links.
+func (f *FS) Open(name string) (fs.File, error) {
+	in, err := f.walk("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := &fileInfo{name: path.Base(name), in: in}
+	if in.typ() == modeDir {
+		entries, _, err := f.readDir(in)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dirFile{fileInfo: info, fs: f, entries: entries}, nil
+	}
+	r, err := f.newReader(in)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{fileInfo: info, r: r}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dir, ok := file.(*dirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Stat returns the fs.FileInfo of the named file, following symbolic links.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	in, err := f.walk("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), in: in}, nil
+}
+
+// Lstat returns the fs.FileInfo of the named file without following a
+// symbolic link at the end of name. Together with ReadLink, it makes FS
+// an fs.ReadLinkFS from Go 1.25.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	in, err := f.walk("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), in: in}, nil
+}
+
+// ReadLink returns the target of the named symbolic link.
+func (f *FS) ReadLink(name string) (string, error) {
+	in, err := f.walk("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if in.typ() != modeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := f.readLink(in)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+// fileInfo describes a file by its inode.
+type fileInfo struct {
+	name string
+	in   *inode
+}
+
+var _ fs.FileInfo = (*fileInfo)(nil)
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.in.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.in.fileMode() }
+func (fi *fileInfo) ModTime() time.Time { return fi.in.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.in.typ() == modeDir }
+func (fi *fileInfo) Sys() any           { return &fi.in.Stat }
+
+// dirEntry is an fs.DirEntry which reads the inode for Info.
+type dirEntry struct {
+	fs *FS
+	dirent
+	mode fs.FileMode
+}
+
+var _ fs.DirEntry = (*dirEntry)(nil)
+
+func (e *dirEntry) Name() string      { return e.name }
+func (e *dirEntry) IsDir() bool       { return e.mode.IsDir() }
+func (e *dirEntry) Type() fs.FileMode { return e.mode }
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	in, err := e.fs.inode(e.ino)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: e.name, in: in}, nil
+}
+
+// fileTypes maps the file type of directory entries to fs.FileMode.
+var fileTypes = [...]fs.FileMode{
+	1: 0,
+	2: fs.ModeDir,
+	3: fs.ModeDevice | fs.ModeCharDevice,
+	4: fs.ModeDevice,
+	5: fs.ModeNamedPipe,
+	6: fs.ModeSocket,
+	7: fs.ModeSymlink,
+}
+
+// newDirEntry returns the fs.DirEntry of e. If the file system does not
+// record file types in directory entries, the inode is read for it.
+func (f *FS) newDirEntry(e dirent) (*dirEntry, error) {
+	if e.typ != 0 && int(e.typ) < len(fileTypes) {
+		return &dirEntry{fs: f, dirent: e, mode: fileTypes[e.typ]}, nil
+	}
+	in, err := f.inode(e.ino)
+	if err != nil {
+		return nil, err
+	}
+	return &dirEntry{fs: f, dirent: e, mode: in.fileMode().Type()}, nil
+}
+
+type file struct {
+	*fileInfo
+	r   *reader
+	off int64
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.fileInfo, nil }
+func (f *file) Close() error               { return nil }
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.r.ReadAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *file) ReadAt(p []byte, off int64) (int, error) { return f.r.ReadAt(p, off) }
+
+// Seek implements io.Seeker.
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.r.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+type dirFile struct {
+	*fileInfo
+	fs      *FS
+	entries []dirent
+	off     int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.fileInfo, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.off:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	entries := make([]fs.DirEntry, 0, len(rest))
+	for _, e := range rest {
+		entry, err := d.fs.newDirEntry(e)
+		if err != nil {
+			return entries, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		entries = append(entries, entry)
+		d.off++
+	}
+	return entries, nil
+}
+
+// reader reads the data of an inode.
+type reader struct {
+	fs      *FS
+	size    int64
+	extents []extent
+	data    []byte // inline data or the target of a fast symbolic link
+}
+
+func (f *FS) newReader(in *inode) (*reader, error) {
+	r := &reader{fs: f, size: in.size}
+	switch {
+	case in.flags&flagInlineData != 0:
+		data, err := in.inlineData()
+		if err != nil {
+			return nil, err
+		}
+		r.data = data[:in.size]
+	case in.fastSymlink:
+		r.data = in.block[:in.size]
+	case in.typ() == modeRegular || in.typ() == modeDir || in.typ() == modeSymlink:
+		extents, err := f.extents(in)
+		if err != nil {
+			return nil, err
+		}
+		r.extents = extents
+	default:
+		// devices, named pipes and sockets have no data.
+		r.size = 0
+	}
+	return r, nil
+}
+
+// ReadAt implements io.ReaderAt. Holes and uninitialized extents read as zeros.
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("ext4: negative offset %d", off)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if r.data != nil {
+		n := copy(p, r.data[off:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	bs := r.fs.sb.blockSize
+	n := 0
+	for n < len(p) && off < r.size {
+		m := min(int64(len(p)-n), r.size-off)
+		block := off / bs
+		i := sort.Search(len(r.extents), func(i int) bool { return r.extents[i].end() > block })
+		if i == len(r.extents) || r.extents[i].logical > block {
+			// a hole up to the next extent.
+			if i < len(r.extents) {
+				m = min(m, r.extents[i].logical*bs-off)
+			}
+			clear(p[n : n+int(m)])
+		} else {
+			e := r.extents[i]
+			m = min(m, e.end()*bs-off)
+			if e.uninit {
+				clear(p[n : n+int(m)])
+			} else if _, err := r.fs.r.ReadAt(p[n:n+int(m)], (e.start+block-e.logical)*bs+off%bs); err != nil {
+				return n, err
+			}
+		}
+		n += int(m)
+		off += m
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,663 @@
+package ext4
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/internal/fstree"
+)
+
+const (
+	formatBlockSize  = 4096
+	formatInodeSize  = 256
+	formatExtraIsize = 32
+
+	// formatInodeRatio is the number of bytes per inode, like mke2fs uses
+	// for ext4.
+	formatInodeRatio = 16384
+
+	journalIno         = 8
+	journalMagic       = 0xc03b3998
+	journalSuperblock2 = 4
+
+	maxLabelLength = 16
+
+	groupItableZeroed = 0x4
+)
+
+type config struct {
+	label     string
+	uuid      *[16]byte
+	timestamp time.Time
+	journal   bool
+
+	// zeroed reports whether the storage reads as zeros, so that the
+	// journal does not need to be cleared.
+	zeroed bool
+}
+
+// Option is an option for Format.
+type Option func(*config) error
+
+// WithLabel sets the volume label, at most 16 bytes, which Linux can find
+// the file system by, e.g. root=LABEL=... on the kernel command line.
+func WithLabel(label string) Option {
+	return func(c *config) error {
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("ext4: volume label %q is longer than %d bytes", label, maxLabelLength)
+		}
+		c.label = label
+		return nil
+	}
+}
+
+// WithUUID sets the UUID of the file system. By default it is derived from
+// the names and metadata of the files, so the image only depends on them.
+func WithUUID(uuid [16]byte) Option {
+	return func(c *config) error {
+		c.uuid = &uuid
+		return nil
+	}
+}
+
+// WithTimestamp sets the creation time of the file system, which is also
+// the time of its last write and check. By default the latest modification
+// time of the files is used.
+func WithTimestamp(t time.Time) Option {
+	return func(c *config) error {
+		c.timestamp = t
+		return nil
+	}
+}
+
+// WithoutJournal omits the journal, e.g. for a file system which is only
+// mounted read-only. By default file systems of 8 MiB or more get a
+// journal of the size mke2fs chooses.
+func WithoutJournal() Option {
+	return func(c *config) error {
+		c.journal = false
+		return nil
+	}
+}
+
+// Format creates an ext4 file system of size bytes holding the files and
+// directories of fsys in w. Use os.DirFS to copy a directory of the host,
+// or tarfs to copy a container image.
+//
+// Files are owned by root and keep their permission bits, including setuid,
+// setgid and sticky bits, unless the Sys method of their fs.FileInfo returns
+// a *tar.Header, as tarfs does. Then its owner, mode, device numbers, hard
+// links and extended attributes from SCHILY.xattr PAX records are used.
+// Symbolic links are kept if fsys has the ReadLink and Lstat methods of
+// fs.ReadLinkFS, e.g. os.DirFS from Go 1.25 and tarfs. Otherwise symbolic
+// links to files are copied as regular files, and symbolic links to
+// directories return an error.
+//
+// The file system has 4 KiB blocks and 256-byte inodes, and uses extents and
+// metadata checksums. It is written without reading w, and only depends on
+// fsys and the options. ErrNoSpace is returned if the files do not fit.
+func Format(w io.WriterAt, size int64, fsys fs.FS, opts ...Option) error {
+	c := &config{journal: true}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return err
+		}
+	}
+	return format(w, size, fsys, c)
+}
+
+// FormatFile creates a file of size bytes at path holding an ext4 file
+// system with Format. If path already exists, FormatFile returns an error
+// satisfying os.IsExist.
+func FormatFile(path string, size int64, fsys fs.FS, opts ...Option) (err error) {
+	c := &config{journal: true, zeroed: true}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return format(f, size, fsys, c)
+}
+
+func format(w io.WriterAt, size int64, fsys fs.FS, c *config) error {
+	root, err := fstree.Read(fsys)
+	if err != nil {
+		return err
+	}
+	if c.timestamp.IsZero() {
+		c.timestamp = fstree.LatestModTime(root)
+	}
+	if c.uuid == nil {
+		uuid := fstree.UUID(root)
+		c.uuid = &uuid
+	}
+	files := 0
+	fstree.Walk(root, func(n *fstree.Node) error {
+		if n.Link == nil {
+			files++
+		}
+		return nil
+	})
+	fw, err := newFormatWriter(w, size, int64(files), c)
+	if err != nil {
+		return err
+	}
+	f := &formatter{Writer: fw, fsys: fsys, inos: make(map[*fstree.Node]uint32)}
+	if c.journal {
+		if blocks := journalBlocks(fw.sb.blocks); blocks > 0 {
+			if err := f.createJournal(blocks, c.zeroed); err != nil {
+				return err
+			}
+		}
+	}
+	if err := f.build(root); err != nil {
+		return err
+	}
+	if err := fw.flush(); err != nil {
+		return err
+	}
+	return fw.writeBackups()
+}
+
+// journalBlocks returns the number of journal blocks of a file system with
+// 4 KiB blocks, like ext2fs_default_journal_size.
+func journalBlocks(blocks int64) int64 {
+	switch {
+	case blocks < 2048:
+		return 0
+	case blocks < 32768:
+		return 1024
+	case blocks < 256*1024:
+		return 4096
+	case blocks < 512*1024:
+		return 8192
+	case blocks < 4096*1024:
+		return 16384
+	case blocks < 8192*1024:
+		return 32768
+	case blocks < 16384*1024:
+		return 65536
+	case blocks < 32768*1024:
+		return 131072
+	}
+	return 262144
+}
+
+// writeOnly is the storage of a file system which is being formatted, which
+// is never read.
+type writeOnly struct{}
+
+func (writeOnly) ReadAt([]byte, int64) (int, error) {
+	return 0, errors.New("ext4: file system is being formatted")
+}
+
+// newFormatWriter writes the superblock and the group descriptors of an
+// empty file system of size bytes in w, with room for at least files
+// inodes, and returns a Writer for it. The bitmaps and inode tables of the
+// groups are uninitialized, except for the reserved inodes.
+func newFormatWriter(w io.WriterAt, size, files int64, c *config) (*Writer, error) {
+	const (
+		bs       = formatBlockSize
+		perGroup = bs * 8
+		descSize = 32
+	)
+	blocks := size / bs
+	if blocks >= 1<<32 {
+		return nil, fmt.Errorf("ext4: file systems of %d bytes are not supported: %w", size, errors.ErrUnsupported)
+	}
+	sb := &superblock{
+		firstDataBlock: 0,
+		blockSize:      bs,
+		blocksPerGroup: perGroup,
+		inodeSize:      formatInodeSize,
+		descSize:       descSize,
+		roCompat:       roCompatSparseSuper,
+	}
+	need := files + 11
+	var (
+		groups  int64
+		ipg     int64
+		itable  int64
+		descBlk int64
+	)
+	overhead := func(g int64) int64 {
+		if sb.hasSuper(g) {
+			return 1 + descBlk + 2 + itable
+		}
+		return 2 + itable
+	}
+	// drop the last group if it is too small for its metadata, like mke2fs.
+	for {
+		groups = (blocks + perGroup - 1) / perGroup
+		if groups == 0 {
+			return nil, fmt.Errorf("%w: %d bytes are too small for a file system", ErrNoSpace, size)
+		}
+		inodes := max(blocks*bs/formatInodeRatio, need)
+		perBlock := int64(bs / formatInodeSize)
+		ipg = min(((inodes+groups-1)/groups+perBlock-1)/perBlock*perBlock, perGroup)
+		itable = ipg * formatInodeSize / bs
+		descBlk = (groups*descSize + bs - 1) / bs
+		last := blocks - (groups-1)*perGroup
+		if last >= overhead(groups-1)+50 || groups == 1 {
+			break
+		}
+		blocks -= last
+	}
+	if blocks < overhead(0)+16 {
+		return nil, fmt.Errorf("%w: %d bytes are too small for a file system", ErrNoSpace, size)
+	}
+	if ipg*groups < need {
+		return nil, fmt.Errorf("%w: too many files", ErrNoSpace)
+	}
+
+	le := binary.LittleEndian
+	now := uint32(c.timestamp.Unix())
+	raw := make([]byte, superblockSize)
+	le.PutUint32(raw[0x00:], uint32(ipg*groups))
+	le.PutUint32(raw[0x04:], uint32(blocks))
+	le.PutUint32(raw[0x10:], uint32(ipg*groups))
+	le.PutUint32(raw[0x18:], 2) // s_log_block_size
+	le.PutUint32(raw[0x1c:], 2) // s_log_cluster_size
+	le.PutUint32(raw[0x20:], perGroup)
+	le.PutUint32(raw[0x24:], perGroup)
+	le.PutUint32(raw[0x28:], uint32(ipg))
+	le.PutUint16(raw[0x36:], 0xffff) // s_max_mnt_count
+	le.PutUint16(raw[0x38:], magic)
+	le.PutUint16(raw[0x3a:], stateValid)
+	le.PutUint16(raw[0x3c:], 1) // s_errors: continue
+	le.PutUint32(raw[0x40:], now)
+	le.PutUint32(raw[0x4c:], 1) // s_rev_level: dynamic
+	le.PutUint32(raw[0x54:], 11)
+	le.PutUint16(raw[0x58:], formatInodeSize)
+	compat := uint32(compatExtAttr | compatDirIndex)
+	if c.journal && journalBlocks(blocks) > 0 {
+		compat |= compatHasJournal
+		le.PutUint32(raw[0xe0:], journalIno)
+		raw[0xfd] = 1 // s_jnl_backup_type: the journal inode
+	}
+	le.PutUint32(raw[0x5c:], compat)
+	le.PutUint32(raw[0x60:], incompatFiletype|incompatExtents)
+	le.PutUint32(raw[0x64:], roCompatSparseSuper|roCompatLargeFile|roCompatHugeFile|
+		roCompatDirNlink|roCompatExtraIsize|roCompatMetadataCsum)
+	copy(raw[0x68:], c.uuid[:])
+	copy(raw[0x78:], c.label)
+	seed := sha256.Sum256(c.uuid[:])
+	copy(raw[0xec:0xfc], seed[:])  // s_hash_seed
+	raw[0xfc] = 1                  // s_def_hash_version: half MD4
+	le.PutUint32(raw[0x100:], 0xc) // s_default_mount_opts: user_xattr, acl
+	le.PutUint32(raw[0x108:], now)
+	le.PutUint16(raw[0x15c:], formatExtraIsize)
+	le.PutUint16(raw[0x15e:], formatExtraIsize)
+	le.PutUint32(raw[0x160:], 0x2) // s_flags: unsigned directory hash
+	raw[0x175] = 1                 // s_checksum_type: crc32c
+	raw[0x274] = byte(c.timestamp.Unix() >> 32)
+	raw[0x276] = byte(c.timestamp.Unix() >> 32)
+	raw[0x277] = byte(c.timestamp.Unix() >> 32)
+
+	sb, err := parseSuperblock(raw)
+	if err != nil {
+		return nil, err
+	}
+	var free int64
+	descs := make([]byte, groups*descSize)
+	f := &FS{r: writeOnly{}, sb: sb, groups: make([]groupDesc, groups)}
+	for g := range groups {
+		d := descs[g*descSize:]
+		first := sb.groupFirstBlock(g)
+		meta := first + overhead(g) - 2 - itable
+		le.PutUint32(d[0x00:], uint32(meta))
+		le.PutUint32(d[0x04:], uint32(meta+1))
+		le.PutUint32(d[0x08:], uint32(meta+2))
+		n := min(perGroup, blocks-first) - overhead(g)
+		free += n
+		le.PutUint16(d[descFreeBlocks[0]:], uint16(n))
+		le.PutUint16(d[descFreeInodes[0]:], uint16(ipg))
+		flags := uint16(groupInodeUninit | groupBlockUninit)
+		if c.zeroed {
+			flags |= groupItableZeroed
+		}
+		le.PutUint16(d[descFlags:], flags)
+		le.PutUint16(d[descItableUnused[0]:], uint16(ipg))
+		f.groups[g] = parseGroupDesc(sb, d)
+	}
+	le.PutUint32(raw[0x0c:], uint32(free))
+
+	fw := &Writer{
+		FS:           f,
+		w:            w,
+		raw:          raw,
+		descs:        descs,
+		blockBitmaps: make(map[int64][]byte),
+		inodeBitmaps: make(map[int64][]byte),
+		dirty:        make(map[int64]bool),
+		csumSeed:     crc32c(^uint32(0), c.uuid[:]),
+		firstIno:     11,
+		extraIsize:   formatExtraIsize,
+		now:          func() time.Time { return c.timestamp },
+	}
+	// the block bitmaps are written, so that flush writes every group
+	// descriptor.
+	for g := range groups {
+		if _, err := fw.blockBitmap(g); err != nil {
+			return nil, err
+		}
+	}
+	// the inodes before the first one are reserved, including the root.
+	b, err := fw.inodeBitmap(0)
+	if err != nil {
+		return nil, err
+	}
+	reserved := int64(fw.firstIno - 1)
+	for i := range reserved {
+		setBit(b, i)
+	}
+	fw.addDescValue(0, descFreeInodes, -int(reserved))
+	fw.addFreeInodes(-int(reserved))
+	fw.setDescValue(0, descItableUnused, uint32(ipg-reserved))
+	fw.addDescValue(0, descUsedDirs, 1)
+	if _, err := w.WriteAt(make([]byte, reserved*formatInodeSize), f.groups[0].inodeTable*bs); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// writeBackups writes the backups of the superblock and of the group
+// descriptors.
+func (w *Writer) writeBackups() error {
+	sb := w.sb
+	le := binary.LittleEndian
+	for g := int64(1); g < sb.groups(); g++ {
+		if !sb.hasSuper(g) {
+			continue
+		}
+		b := slices.Clone(w.raw)
+		le.PutUint16(b[0x5a:], uint16(g)) // s_block_group_nr
+		le.PutUint32(b[0x3fc:], crc32c(^uint32(0), b[:0x3fc]))
+		block := sb.groupFirstBlock(g)
+		if _, err := w.w.WriteAt(b, block*sb.blockSize); err != nil {
+			return err
+		}
+		if _, err := w.w.WriteAt(w.descs, (block+1)*sb.blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatter writes the files of a tree to a new file system.
+type formatter struct {
+	*Writer
+	fsys fs.FS
+	inos map[*fstree.Node]uint32
+}
+
+// createJournal creates an empty journal of the given number of blocks.
+func (f *formatter) createJournal(blocks int64, zeroed bool) error {
+	sb := f.sb
+	in, err := f.blankInode(journalIno, modeRegular|0o600)
+	if err != nil {
+		return err
+	}
+	extents, err := f.allocBlocks(blocks, sb.groups()/2)
+	if err != nil {
+		return err
+	}
+	be := binary.BigEndian
+	jsb := make([]byte, sb.blockSize)
+	be.PutUint32(jsb[0x00:], journalMagic)
+	be.PutUint32(jsb[0x04:], journalSuperblock2)
+	be.PutUint32(jsb[0x0c:], uint32(sb.blockSize))
+	be.PutUint32(jsb[0x10:], uint32(blocks)) // s_maxlen
+	be.PutUint32(jsb[0x14:], 1)              // s_first
+	be.PutUint32(jsb[0x18:], 1)              // s_sequence
+	copy(jsb[0x30:], sb.uuid[:])
+	be.PutUint32(jsb[0x40:], 1) // s_nr_users
+	if _, err := f.w.WriteAt(jsb, extents[0].start*sb.blockSize); err != nil {
+		return err
+	}
+	if !zeroed {
+		// the rest of the journal is cleared, so that no stale transaction
+		// is replayed.
+		zero := make([]byte, 64*sb.blockSize)
+		for i, e := range extents {
+			start, end := e.start*sb.blockSize, (e.start+e.length)*sb.blockSize
+			if i == 0 {
+				start += sb.blockSize
+			}
+			for off := start; off < end; off += int64(len(zero)) {
+				if _, err := f.w.WriteAt(zero[:min(int64(len(zero)), end-off)], off); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	nodes, err := f.buildExtentTree(in, extents)
+	if err != nil {
+		return err
+	}
+	in.size = blocks * sb.blockSize
+	in.setBlocks(blocks+nodes, sb.blockSize)
+	if err := f.writeInode(in); err != nil {
+		return err
+	}
+	// the backup of i_block and i_size of the journal.
+	le := binary.LittleEndian
+	copy(f.raw[0x10c:], in.block)
+	le.PutUint32(f.raw[0x148:], uint32(in.size>>32))
+	le.PutUint32(f.raw[0x14c:], uint32(in.size))
+	return nil
+}
+
+// build writes the tree below root. The inodes are allocated before any
+// data, in depth-first order, and lost+found is created if root lacks it.
+func (f *formatter) build(root *fstree.Node) error {
+	i, found := slices.BinarySearchFunc(root.Children, "lost+found", func(n *fstree.Node, name string) int {
+		return cmpString(n.Name, name)
+	})
+	if !found {
+		lf := &fstree.Node{Name: "lost+found", Mode: fs.ModeDir | 0o700, ModTime: f.now()}
+		root.Children = slices.Insert(root.Children, i, lf)
+	}
+	lf := root.Children[i]
+	if !lf.IsDir() {
+		return errors.New("ext4: lost+found is not a directory")
+	}
+	if err := f.assign(lf, rootIno); err != nil {
+		return err
+	}
+	if err := f.assignChildren(root, rootIno); err != nil {
+		return err
+	}
+	in, err := f.newNode(root, rootIno)
+	if err != nil {
+		return err
+	}
+	return f.writeDir(root, in, rootIno)
+}
+
+func cmpString(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// assign allocates the inode of n, and of the nodes below it.
+func (f *formatter) assign(n *fstree.Node, dir uint32) error {
+	if _, ok := f.inos[n]; ok || n.Link != nil {
+		return nil
+	}
+	ino, err := f.allocInode(n.IsDir(), int64((dir-1)/f.sb.inodesPerGroup))
+	if err != nil {
+		return err
+	}
+	f.inos[n] = ino
+	return f.assignChildren(n, ino)
+}
+
+func (f *formatter) assignChildren(dir *fstree.Node, ino uint32) error {
+	for _, c := range dir.Children {
+		if err := f.assign(c, ino); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newNode returns the inode ino with the metadata and extended attributes of
+// n.
+func (f *formatter) newNode(n *fstree.Node, ino uint32) (*inode, error) {
+	in, err := f.blankInode(ino, fileType(n.Mode)|unixPerm(n.Mode))
+	if err != nil {
+		return nil, err
+	}
+	in.UID, in.GID = n.UID, n.GID
+	t := clampTime(n.ModTime)
+	for _, off := range []inodeTime{inodeAtime, inodeCtime, inodeMtime, inodeCrtime} {
+		in.setTime(off, t)
+	}
+	attrs := make([]xattr, 0, len(n.Xattrs))
+	for _, x := range n.Xattrs {
+		a, err := newXattr(x.Name, x.Value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, a)
+	}
+	if err := f.setXattrs(in, attrs); err != nil {
+		return nil, err
+	}
+	in.setBlocks(0, f.sb.blockSize)
+	return in, nil
+}
+
+// writeDir writes the directory n and the nodes below it.
+func (f *formatter) writeDir(n *fstree.Node, in *inode, parent uint32) error {
+	in.Nlink = 2
+	entries := make([]dirent, 0, len(n.Children))
+	for _, c := range n.Children {
+		target := c
+		if c.Link != nil {
+			target = c.Link
+		}
+		ino := f.inos[target]
+		entries = append(entries, dirent{name: c.Name, ino: ino, typ: direntType(fileType(target.Mode))})
+		if c.Link != nil {
+			continue
+		}
+		if err := f.writeNode(c, ino, in); err != nil {
+			return fmt.Errorf("ext4: %s: %w", c.Path, err)
+		}
+	}
+	if err := f.setDir(in, parent, entries); err != nil {
+		return err
+	}
+	return f.writeInode(in)
+}
+
+// writeNode writes the file or directory n in the directory dir.
+func (f *formatter) writeNode(n *fstree.Node, ino uint32, dir *inode) error {
+	in, err := f.newNode(n, ino)
+	if err != nil {
+		return err
+	}
+	switch n.Mode.Type() {
+	case fs.ModeDir:
+		switch {
+		case dir.Nlink == 1 || dir.Nlink >= maxDirLinks-1:
+			dir.Nlink = 1
+		default:
+			dir.Nlink++
+		}
+		return f.writeDir(n, in, dir.Ino)
+	case 0:
+		file, err := f.fsys.Open(n.Path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := f.setData(in, file, n.Size); err != nil {
+			return err
+		}
+	case fs.ModeSymlink:
+		if n.Target == "" || int64(len(n.Target)) >= f.sb.blockSize {
+			return fmt.Errorf("invalid symbolic link target %q", n.Target)
+		}
+		if err := f.setTarget(in, n.Target); err != nil {
+			return err
+		}
+	default:
+		// devices, named pipes and sockets have no data, and devices keep
+		// their number in i_block like Linux.
+		in.flags &^= flagExtents
+		clear(in.block)
+		le := binary.LittleEndian
+		if n.Mode&fs.ModeDevice != 0 {
+			if n.Major < 256 && n.Minor < 256 {
+				le.PutUint32(in.block[0:], n.Major<<8|n.Minor)
+			} else {
+				le.PutUint32(in.block[4:], n.Minor&0xff|n.Major<<8|(n.Minor&^0xff)<<12)
+			}
+		}
+	}
+	if n.Nlink > maxDirLinks {
+		return errors.New("too many links")
+	}
+	in.Nlink = uint16(max(n.Nlink, 1))
+	return f.writeInode(in)
+}
+
+// fileType returns the type bits of an inode for mode.
+func fileType(mode fs.FileMode) uint16 {
+	switch mode.Type() {
+	case fs.ModeDir:
+		return modeDir
+	case fs.ModeSymlink:
+		return modeSymlink
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return modeChar
+	case fs.ModeDevice:
+		return modeBlock
+	case fs.ModeNamedPipe:
+		return modeFIFO
+	case fs.ModeSocket:
+		return modeSocket
+	}
+	return modeRegular
+}
+
+// clampTime limits t to the times which inodes can hold, from 1901 to 2446.
+func clampTime(t time.Time) time.Time {
+	if first := time.Unix(-1<<31, 0); t.Before(first) {
+		return first
+	}
+	if last := time.Unix(1<<34-1<<31-1, 999999999); t.After(last) {
+		return last
+	}
+	return t
+}
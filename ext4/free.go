@@ -0,0 +1,55 @@
+package ext4
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotClean is returned by FreeExtents for a file system which was not
+// unmounted cleanly, or which has a journal to replay.
+var ErrNotClean = errors.New("ext4: file system was not unmounted cleanly")
+
+// Extent is a range of bytes relative to the start of the file system.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// FreeExtents returns the ranges of blocks which are not allocated to any
+// file, directory or metadata in ascending order, merging adjacent free
+// blocks. Their content is meaningless, so they can be discarded from the
+// storage while the file system is not mounted.
+//
+// The block bitmaps of a file system which was not unmounted cleanly may be
+// stale, so FreeExtents returns ErrNotClean for it. Block groups whose bitmap
+// was never initialized are left out.
+func (f *FS) FreeExtents() ([]Extent, error) {
+	sb := f.sb
+	if sb.state&stateValid == 0 || sb.incompat&incompatRecover != 0 {
+		return nil, ErrNotClean
+	}
+	clusters := (sb.blocks - sb.firstDataBlock) * sb.blockSize / sb.clusterSize
+	bitmap := make([]byte, sb.blockSize)
+	var extents []Extent
+	for g, desc := range f.groups {
+		if desc.flags&groupBlockUninit != 0 {
+			continue
+		}
+		if err := f.readBlocks(bitmap, desc.blockBitmap); err != nil {
+			return nil, fmt.Errorf("block bitmap of group %d: %w", g, err)
+		}
+		first := int64(g) * sb.clustersPerGroup
+		for i := range min(sb.clustersPerGroup, clusters-first) {
+			if bitmap[i/8]&(1<<(i%8)) != 0 {
+				continue
+			}
+			off := sb.firstDataBlock*sb.blockSize + (first+i)*sb.clusterSize
+			if n := len(extents); n > 0 && extents[n-1].Offset+extents[n-1].Length == off {
+				extents[n-1].Length += sb.clusterSize
+				continue
+			}
+			extents = append(extents, Extent{Offset: off, Length: sb.clusterSize})
+		}
+	}
+	return extents, nil
+}
@@ -0,0 +1,467 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+const (
+	modeTypeMask = 0xf000
+	modeFIFO     = 0x1000
+	modeChar     = 0x2000
+	modeDir      = 0x4000
+	modeBlock    = 0x6000
+	modeRegular  = 0x8000
+	modeSymlink  = 0xa000
+	modeSocket   = 0xc000
+
+	flagImmutable  = 0x10
+	flagAppend     = 0x20
+	flagIndex      = 0x1000
+	flagHugeFile   = 0x40000
+	flagExtents    = 0x80000
+	flagInlineData = 0x10000000
+	flagCasefold   = 0x40000000
+
+	extentMagic    = 0xf30a
+	maxExtentDepth = 5
+
+	// the maximum length of an initialized extent. Longer lengths mark
+	// uninitialized extents, which read as zeros.
+	maxInitExtentLen = 32768
+
+	// i_block holds 15 block numbers or 60 bytes of data.
+	inlineSize = 60
+)
+
+// Stat is the inode metadata of a file. The Sys method of the fs.FileInfo
+// returned by FS returns a *Stat.
+type Stat struct {
+	Ino   uint32
+	UID   uint32
+	GID   uint32
+	Nlink uint16
+}
+
+// inode is a decoded inode.
+type inode struct {
+	Stat
+	mode  uint16
+	size  int64
+	flags uint32
+	mtime time.Time
+	raw   []byte // the on-disk inode
+	block []byte // i_block
+	xattr []byte // in-inode extended attributes
+
+	// fastSymlink reports whether in is a symbolic link whose target is
+	// stored in i_block.
+	fastSymlink bool
+}
+
+func (in *inode) typ() uint16 { return in.mode & modeTypeMask }
+
+// inode reads the inode numbered ino.
+func (f *FS) inode(ino uint32) (*inode, error) {
+	sb := f.sb
+	if ino == 0 || ino > sb.inodes {
+		return nil, fmt.Errorf("%w: invalid inode %d", ErrCorrupt, ino)
+	}
+	group, index := (ino-1)/sb.inodesPerGroup, (ino-1)%sb.inodesPerGroup
+	b := make([]byte, sb.inodeSize)
+	off := f.groups[group].inodeTable*sb.blockSize + int64(index)*sb.inodeSize
+	if _, err := f.r.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	in := &inode{
+		Stat: Stat{
+			Ino:   ino,
+			UID:   uint32(le.Uint16(b[0x02:])) | uint32(le.Uint16(b[0x78:]))<<16,
+			GID:   uint32(le.Uint16(b[0x18:])) | uint32(le.Uint16(b[0x7a:]))<<16,
+			Nlink: le.Uint16(b[0x1a:]),
+		},
+		mode:  le.Uint16(b[0x00:]),
+		size:  int64(le.Uint32(b[0x04:])) | int64(le.Uint32(b[0x6c:]))<<32,
+		flags: le.Uint32(b[0x20:]),
+		raw:   b,
+		block: b[0x28 : 0x28+inlineSize],
+	}
+	if in.size < 0 {
+		return nil, fmt.Errorf("%w: invalid size of inode %d", ErrCorrupt, ino)
+	}
+	if in.typ() == modeSymlink && in.flags&flagInlineData == 0 {
+		// like Linux, tell fast symbolic links by having no data blocks
+		// other than an extended attribute block.
+		blocks := int64(le.Uint32(b[0x1c:])) | int64(le.Uint16(b[0x74:]))<<32
+		if le.Uint32(b[0x68:]) != 0 || le.Uint16(b[0x76:]) != 0 {
+			blocks -= sb.clusterSize / 512
+		}
+		in.fastSymlink = blocks == 0 && in.size < inlineSize
+	}
+	sec, nsec := int64(int32(le.Uint32(b[0x10:]))), int64(0)
+	if sb.inodeSize > 128 {
+		extra := int64(le.Uint16(b[0x80:]))
+		if 128+extra > sb.inodeSize {
+			return nil, fmt.Errorf("%w: invalid extra size of inode %d", ErrCorrupt, ino)
+		}
+		if extra >= 0x8c-0x80 {
+			// the low 2 bits extend the seconds beyond 2038.
+			t := le.Uint32(b[0x88:])
+			sec += int64(t&3) << 32
+			nsec = int64(t >> 2)
+		}
+		in.xattr = b[128+extra:]
+	}
+	in.mtime = time.Unix(sec, nsec)
+	return in, nil
+}
+
+// fits reports whether the inode has room for the fields before offset
+// end, which may be in the extra space after the first 128 bytes.
+func (in *inode) fits(end int) bool {
+	if end <= 128 {
+		return true
+	}
+	return len(in.raw) > 128 && 128+int(binary.LittleEndian.Uint16(in.raw[0x80:])) >= end
+}
+
+// csumSeed returns the seed of the checksums of in and its blocks, derived
+// from the seed of the file system.
+func (in *inode) csumSeed(seed uint32) uint32 {
+	return crc32c(seed, le32(in.Ino), in.raw[0x64:0x68])
+}
+
+// inodeTime is the offsets of the seconds and of the extra bits of a
+// timestamp in an inode.
+type inodeTime [2]int
+
+var (
+	inodeAtime  = inodeTime{0x08, 0x8c}
+	inodeCtime  = inodeTime{0x0c, 0x84}
+	inodeMtime  = inodeTime{0x10, 0x88}
+	inodeCrtime = inodeTime{0x90, 0x94}
+)
+
+// setTime sets the timestamp at off to t, with nanoseconds and the epoch
+// bits after 2038 if the inode has room for them.
+func (in *inode) setTime(off inodeTime, t time.Time) {
+	le := binary.LittleEndian
+	if !in.fits(off[0] + 4) {
+		return
+	}
+	sec := t.Unix()
+	le.PutUint32(in.raw[off[0]:], uint32(sec))
+	if in.fits(off[1] + 4) {
+		epoch := uint32((sec-int64(int32(sec)))>>32) & 3
+		le.PutUint32(in.raw[off[1]:], uint32(t.Nanosecond())<<2|epoch)
+	}
+	if off == inodeMtime {
+		in.mtime = time.Unix(sec, int64(t.Nanosecond()))
+	}
+}
+
+// chown changes the owner of in. An uid or gid of -1 is not changed.
+func (in *inode) chown(uid, gid int) {
+	if uid != -1 {
+		in.UID = uint32(uid)
+	}
+	if gid != -1 {
+		in.GID = uint32(gid)
+	}
+}
+
+// setBlocks sets the number of 512-byte sectors used by the blocks of in,
+// adding its extended attribute block.
+func (in *inode) setBlocks(blocks, blockSize int64) {
+	le := binary.LittleEndian
+	if le.Uint32(in.raw[0x68:]) != 0 || le.Uint16(in.raw[0x76:]) != 0 {
+		blocks++
+	}
+	sectors := blocks * blockSize / 512
+	le.PutUint32(in.raw[0x1c:], uint32(sectors))
+	le.PutUint16(in.raw[0x74:], uint16(sectors>>32))
+}
+
+// fileMode converts the mode of the inode to fs.FileMode.
+func (in *inode) fileMode() fs.FileMode {
+	mode := fs.FileMode(in.mode & 0o777)
+	if in.mode&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if in.mode&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if in.mode&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch in.typ() {
+	case modeDir:
+		mode |= fs.ModeDir
+	case modeSymlink:
+		mode |= fs.ModeSymlink
+	case modeChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case modeBlock:
+		mode |= fs.ModeDevice
+	case modeFIFO:
+		mode |= fs.ModeNamedPipe
+	case modeSocket:
+		mode |= fs.ModeSocket
+	}
+	return mode
+}
+
+// extent maps length blocks of a file starting at the logical block to the
+// physical block start. The blocks of an uninitialized extent read as zeros.
+type extent struct {
+	logical int64
+	start   int64
+	length  int64
+	uninit  bool
+}
+
+func (e extent) end() int64 { return e.logical + e.length }
+
+// extents returns the block mapping of in in ascending logical order.
+// Logical blocks which are not mapped are holes.
+func (f *FS) extents(in *inode) ([]extent, error) {
+	extents, _, err := f.mapping(in)
+	return extents, err
+}
+
+// mapping returns the block mapping of in like extents, and the blocks of
+// the extent tree or the indirect blocks which hold it.
+func (f *FS) mapping(in *inode) (extents []extent, meta []int64, err error) {
+	if in.flags&flagExtents != 0 {
+		extents, meta, err = f.extentTree(nil, nil, in.block, maxExtentDepth+1)
+	} else {
+		blocks := (in.size + f.sb.blockSize - 1) / f.sb.blockSize
+		extents, meta, err = f.blockMap(in.block, blocks)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("inode %d: %w", in.Ino, err)
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].logical < extents[j].logical })
+	for i, e := range extents {
+		if e.start <= 0 || e.start+e.length > f.sb.blocks || (i > 0 && extents[i-1].end() > e.logical) {
+			return nil, nil, fmt.Errorf("%w: invalid extent of inode %d", ErrCorrupt, in.Ino)
+		}
+	}
+	return extents, meta, nil
+}
+
+// extentTree appends the leaf extents of the extent tree node in b, and the
+// blocks of its child nodes.
+func (f *FS) extentTree(extents []extent, meta []int64, b []byte, depth int) ([]extent, []int64, error) {
+	le := binary.LittleEndian
+	if len(b) < 12 || le.Uint16(b[0:]) != extentMagic {
+		return nil, nil, fmt.Errorf("%w: bad extent header", ErrCorrupt)
+	}
+	entries, level := int(le.Uint16(b[2:])), int(le.Uint16(b[6:]))
+	if 12+entries*12 > len(b) || level >= depth {
+		return nil, nil, fmt.Errorf("%w: bad extent header", ErrCorrupt)
+	}
+	for i := range entries {
+		e := b[12+i*12:]
+		if level == 0 {
+			length := int64(le.Uint16(e[4:]))
+			uninit := length > maxInitExtentLen
+			if uninit {
+				length -= maxInitExtentLen
+			}
+			extents = append(extents, extent{
+				logical: int64(le.Uint32(e[0:])),
+				start:   int64(le.Uint16(e[6:]))<<32 | int64(le.Uint32(e[8:])),
+				length:  length,
+				uninit:  uninit,
+			})
+			continue
+		}
+		block := int64(le.Uint16(e[8:]))<<32 | int64(le.Uint32(e[4:]))
+		child := make([]byte, f.sb.blockSize)
+		if err := f.readBlocks(child, block); err != nil {
+			return nil, nil, err
+		}
+		var err error
+		extents, meta, err = f.extentTree(extents, append(meta, block), child, level)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return extents, meta, nil
+}
+
+// blockMap returns the extents of the first blocks logical blocks mapped by
+// the direct and indirect block pointers in b, as used by ext2 and ext3, and
+// the indirect blocks.
+func (f *FS) blockMap(b []byte, blocks int64) ([]extent, []int64, error) {
+	m := &blockMapper{fs: f, remaining: blocks}
+	le := binary.LittleEndian
+	for i := 0; i < 12 && m.remaining > 0; i++ {
+		m.add(int64(le.Uint32(b[i*4:])))
+	}
+	for level := 1; level <= 3 && m.remaining > 0; level++ {
+		if err := m.walk(int64(le.Uint32(b[(11+level)*4:])), level); err != nil {
+			return nil, nil, err
+		}
+	}
+	return m.extents, m.meta, nil
+}
+
+type blockMapper struct {
+	fs        *FS
+	extents   []extent
+	meta      []int64
+	logical   int64
+	remaining int64
+}
+
+// add maps the next logical block to block, which is a hole if zero.
+func (m *blockMapper) add(block int64) {
+	if block != 0 {
+		if n := len(m.extents); n > 0 && m.extents[n-1].end() == m.logical && m.extents[n-1].start+m.extents[n-1].length == block {
+			m.extents[n-1].length++
+		} else {
+			m.extents = append(m.extents, extent{logical: m.logical, start: block, length: 1})
+		}
+	}
+	m.logical++
+	m.remaining--
+}
+
+// walk maps the blocks of the indirect block at the given level.
+func (m *blockMapper) walk(block int64, level int) error {
+	perBlock := m.fs.sb.blockSize / 4
+	if block == 0 {
+		// a hole spanning the whole indirect block.
+		n := perBlock
+		for range level - 1 {
+			n *= perBlock
+		}
+		n = min(n, m.remaining)
+		m.logical += n
+		m.remaining -= n
+		return nil
+	}
+	b := make([]byte, m.fs.sb.blockSize)
+	if err := m.fs.readBlocks(b, block); err != nil {
+		return err
+	}
+	m.meta = append(m.meta, block)
+	for i := int64(0); i < perBlock && m.remaining > 0; i++ {
+		next := int64(binary.LittleEndian.Uint32(b[i*4:]))
+		if level == 1 {
+			m.add(next)
+			continue
+		}
+		if err := m.walk(next, level-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const xattrMagic = 0xea020000
+
+// xattrIndexSystem is the name index of the "system." prefix.
+const xattrIndexSystem = 7
+
+// inlineData returns the data of an inode with inline data, which is
+// stored in i_block and continues in the system.data extended attribute.
+func (in *inode) inlineData() ([]byte, error) {
+	rest, err := in.xattrValue(xattrIndexSystem, "data")
+	if err != nil {
+		return nil, err
+	}
+	data := append(append([]byte(nil), in.block...), rest...)
+	if in.size > int64(len(data)) {
+		return nil, fmt.Errorf("%w: inline data of inode %d is too short", ErrCorrupt, in.Ino)
+	}
+	return data, nil
+}
+
+// removeInlineData clears the inline data flag of in and removes the
+// system.data extended attribute, keeping the other in-inode attributes.
+func (in *inode) removeInlineData() error {
+	le := binary.LittleEndian
+	in.flags &^= flagInlineData
+	b := in.xattr
+	if len(b) < 4 || le.Uint32(b) != xattrMagic {
+		return nil
+	}
+	type attr struct {
+		entry []byte // the entry header and name
+		value []byte
+	}
+	var attrs []attr
+	entries := b[4:]
+	for off := 0; off+16 <= len(entries) && le.Uint32(entries[off:]) != 0; {
+		e := entries[off:]
+		nameLen := int(e[0])
+		valueOff, valueSize := int(le.Uint16(e[2:])), int(le.Uint32(e[8:]))
+		if off+16+nameLen > len(entries) {
+			return fmt.Errorf("%w: invalid extended attribute of inode %d", ErrCorrupt, in.Ino)
+		}
+		a := attr{entry: bytes.Clone(e[:16+nameLen])}
+		if le.Uint32(e[4:]) == 0 {
+			if valueOff+valueSize > len(entries) {
+				return fmt.Errorf("%w: invalid extended attribute of inode %d", ErrCorrupt, in.Ino)
+			}
+			a.value = bytes.Clone(entries[valueOff : valueOff+valueSize])
+		}
+		if e[1] != xattrIndexSystem || string(e[16:16+nameLen]) != "data" {
+			attrs = append(attrs, a)
+		}
+		off += (16 + nameLen + 3) &^ 3
+	}
+	clear(b)
+	if len(attrs) == 0 {
+		return nil
+	}
+	// the entries grow from the start and the values from the end.
+	le.PutUint32(b, xattrMagic)
+	off, end := 0, len(entries)
+	for _, a := range attrs {
+		if len(a.value) > 0 {
+			end -= (len(a.value) + 3) &^ 3
+			copy(entries[end:], a.value)
+			le.PutUint16(a.entry[2:], uint16(end))
+		}
+		copy(entries[off:], a.entry)
+		off += (len(a.entry) + 3) &^ 3
+	}
+	return nil
+}
+
+// xattrValue returns the value of the in-inode extended attribute with the
+// given name index and name, or nil if there is none.
+func (in *inode) xattrValue(index byte, name string) ([]byte, error) {
+	le := binary.LittleEndian
+	b := in.xattr
+	if len(b) < 4 || le.Uint32(b) != xattrMagic {
+		return nil, nil
+	}
+	entries := b[4:]
+	for off := 0; off+16 <= len(entries) && le.Uint32(entries[off:]) != 0; {
+		e := entries[off:]
+		nameLen := int(e[0])
+		if off+16+nameLen > len(entries) {
+			break
+		}
+		valueOff, valueSize := int(le.Uint16(e[2:])), int(le.Uint32(e[8:]))
+		if e[1] == index && string(e[16:16+nameLen]) == name {
+			if le.Uint32(e[4:]) != 0 || valueOff+valueSize > len(entries) {
+				return nil, fmt.Errorf("%w: invalid extended attribute of inode %d", ErrCorrupt, in.Ino)
+			}
+			return entries[valueOff : valueOff+valueSize], nil
+		}
+		off += (16 + nameLen + 3) &^ 3
+	}
+	return nil, nil
+}
@@ -0,0 +1,771 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNoSpace is returned when a file system has no free blocks or inodes
+// left for a change.
+var ErrNoSpace = errors.New("ext4: no space left on device")
+
+const (
+	// incompatWritable is the incompatible features which Writer can
+	// maintain.
+	incompatWritable = incompatFiletype | incompatMetaBG | incompatExtents |
+		incompat64Bit | incompatFlexBG | incompatEAInode | incompatCsumSeed |
+		incompatLargeDir | incompatInlineData | incompatCasefold
+
+	// roCompatWritable is the read-only compatible features which Writer
+	// can maintain.
+	roCompatWritable = roCompatSparseSuper | roCompatLargeFile | roCompatHugeFile |
+		roCompatGdtCsum | roCompatDirNlink | roCompatExtraIsize |
+		roCompatMetadataCsum | roCompatProject | roCompatVerity
+
+	// maxDirLinks is the maximum link count of a directory. With dir_nlink,
+	// a directory with more subdirectories has a link count of 1.
+	maxDirLinks = 65000
+
+	maxNameLen = 255
+
+	dirTailSize = 12
+)
+
+// ReadWriterAt is the storage of a file system opened by OpenWriter.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Writer changes an ext4 file system in place, e.g. to add SSH keys or
+// systemd units to the root file system of a guest before it boots. The
+// embedded FS reads the file system including the changes.
+//
+// Every change updates the bitmaps, group descriptors, superblock and
+// checksums before it returns. The journal is bypassed, so the file system
+// must have been unmounted cleanly and must not be mounted while it is
+// changed. While a change is in progress, the file system is marked as not
+// clean, so that an interrupted change is repaired by e2fsck.
+//
+// Directories which are changed are rewritten as linear directories, which
+// Linux reads like hashed ones. Writer is not safe for concurrent use.
+type Writer struct {
+	*FS
+	w            io.WriterAt
+	raw          []byte // the superblock
+	descs        []byte // the group descriptors
+	blockBitmaps map[int64][]byte
+	inodeBitmaps map[int64][]byte
+	dirty        map[int64]bool // groups whose descriptor changed
+	csumSeed     uint32
+	firstIno     uint32
+	extraIsize   int64
+	now          func() time.Time
+}
+
+// OpenWriter opens the ext4 file system of size bytes in rw for changes.
+// A partition of a disk image can be opened with
+//
+//	struct {
+//		io.ReaderAt
+//		io.WriterAt
+//	}{io.NewSectionReader(f, offset, size), io.NewOffsetWriter(f, offset)}
+//
+// File systems without extents, i.e. ext2 and ext3, and file systems using
+// features which Writer can not maintain, e.g. quotas or bigalloc, are
+// rejected with an error wrapping errors.ErrUnsupported. ErrNotClean is
+// returned for a file system which was not unmounted cleanly.
+func OpenWriter(rw ReadWriterAt, size int64) (*Writer, error) {
+	f, err := Open(rw, size)
+	if err != nil {
+		return nil, err
+	}
+	sb := f.sb
+	switch {
+	case sb.incompat&incompatExtents == 0:
+		return nil, fmt.Errorf("ext4: file systems without extents can not be written: %w", errors.ErrUnsupported)
+	case sb.incompat&^incompatWritable&^incompatRecover != 0:
+		return nil, fmt.Errorf("ext4: incompatible features %#x can not be written: %w", sb.incompat&^incompatWritable, errors.ErrUnsupported)
+	case sb.roCompat&^roCompatWritable&^roCompatOrphanPresent != 0:
+		return nil, fmt.Errorf("ext4: read-only compatible features %#x can not be written: %w", sb.roCompat&^roCompatWritable, errors.ErrUnsupported)
+	case sb.state&stateValid == 0, sb.state&stateError != 0, sb.incompat&incompatRecover != 0, sb.roCompat&roCompatOrphanPresent != 0:
+		return nil, ErrNotClean
+	}
+
+	le := binary.LittleEndian
+	w := &Writer{
+		FS:           f,
+		w:            rw,
+		raw:          make([]byte, superblockSize),
+		blockBitmaps: make(map[int64][]byte),
+		inodeBitmaps: make(map[int64][]byte),
+		dirty:        make(map[int64]bool),
+		firstIno:     11,
+		now:          time.Now,
+	}
+	if _, err := rw.ReadAt(w.raw, superblockOffset); err != nil {
+		return nil, err
+	}
+	if le.Uint32(w.raw[0x4c:]) != 0 {
+		w.firstIno = le.Uint32(w.raw[0x54:])
+	}
+	if sb.inodeSize > 128 {
+		// the extra inode fields up to i_projid, unless the file system
+		// asks for more.
+		w.extraIsize = max(32, int64(le.Uint16(w.raw[0x15e:])))
+		if 128+w.extraIsize > sb.inodeSize {
+			w.extraIsize = sb.inodeSize - 128
+		}
+	}
+	if w.metadataCsum() {
+		if w.raw[0x175] != 1 {
+			return nil, fmt.Errorf("ext4: checksum type %d can not be written: %w", w.raw[0x175], errors.ErrUnsupported)
+		}
+		w.csumSeed = crc32c(^uint32(0), sb.uuid[:])
+		if sb.incompat&incompatCsumSeed != 0 {
+			w.csumSeed = le.Uint32(w.raw[0x270:])
+		}
+	}
+	if w.descs, err = f.readDescs(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// update runs fn while the file system is marked as not clean, and writes
+// the metadata changed by fn. The file system stays marked as not clean if
+// fn fails.
+func (w *Writer) update(fn func() error) error {
+	if err := w.setState(w.sb.state &^ stateValid); err != nil {
+		return err
+	}
+	err := fn()
+	if ferr := w.flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return err
+	}
+	return w.setState(w.sb.state | stateValid)
+}
+
+func (w *Writer) setState(state uint16) error {
+	w.sb.state = state
+	binary.LittleEndian.PutUint16(w.raw[0x3a:], state)
+	return w.writeSuperblock()
+}
+
+// Mkdir creates the directory name with the permission bits of perm.
+func (w *Writer) Mkdir(name string, perm fs.FileMode) error {
+	dir, base, err := w.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	err = w.update(func() error { return w.mkdir(dir, base, perm) })
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+// MkdirAll creates the directory name and any missing parents with the
+// permission bits of perm, like os.MkdirAll.
+func (w *Writer) MkdirAll(name string, perm fs.FileMode) error {
+	info, err := w.Stat(name)
+	if err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if dir := path.Dir(name); dir != "." {
+		if err := w.MkdirAll(dir, perm); err != nil {
+			return err
+		}
+	}
+	return w.Mkdir(name, perm)
+}
+
+// WriteFile writes data to the named file, creating it with the permission
+// bits of perm if necessary, like os.WriteFile. An existing file keeps its
+// owner and mode, and a symbolic link is followed.
+func (w *Writer) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	dir, base, err := w.parent("open", name)
+	if err != nil {
+		return err
+	}
+	in, err := w.lookup(dir, base)
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if in != nil && in.typ() == modeSymlink {
+		if in, err = w.walk("open", name, true); err != nil {
+			return err
+		}
+	}
+	if in != nil {
+		switch {
+		case in.typ() == modeDir:
+			return &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+		case in.typ() != modeRegular:
+			return &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+		case in.flags&(flagImmutable|flagAppend) != 0:
+			return &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+	}
+	err = w.update(func() error {
+		if in != nil {
+			if err := w.setData(in, bytes.NewReader(data), int64(len(data))); err != nil {
+				return err
+			}
+			w.touch(in)
+			return w.writeInode(in)
+		}
+		in, err := w.newInode(dir, modeRegular|unixPerm(perm))
+		if err != nil {
+			return err
+		}
+		if err := w.setData(in, bytes.NewReader(data), int64(len(data))); err != nil {
+			return err
+		}
+		if err := w.writeInode(in); err != nil {
+			return err
+		}
+		return w.addEntry(dir, base, in)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Symlink creates newname as a symbolic link to oldname.
+func (w *Writer) Symlink(oldname, newname string) error {
+	dir, base, err := w.parent("symlink", newname)
+	if err != nil {
+		return err
+	}
+	if oldname == "" || int64(len(oldname)) >= w.sb.blockSize {
+		return &fs.PathError{Op: "symlink", Path: newname, Err: fs.ErrInvalid}
+	}
+	err = w.update(func() error {
+		if in, err := w.lookup(dir, base); err != nil || in != nil {
+			return cmpErr(err, fs.ErrExist)
+		}
+		in, err := w.newInode(dir, modeSymlink|0o777)
+		if err != nil {
+			return err
+		}
+		if err := w.setTarget(in, oldname); err != nil {
+			return err
+		}
+		if err := w.writeInode(in); err != nil {
+			return err
+		}
+		return w.addEntry(dir, base, in)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "symlink", Path: newname, Err: err}
+	}
+	return nil
+}
+
+// Chmod changes the mode of the named file to mode, following symbolic
+// links. The permission bits, setuid, setgid and sticky bits are used.
+func (w *Writer) Chmod(name string, mode fs.FileMode) error {
+	return w.change("chmod", name, true, func(in *inode) {
+		in.mode = in.typ() | unixPerm(mode)
+	})
+}
+
+// Chown changes the owner of the named file, following symbolic links.
+// A uid or gid of -1 is not changed, like os.Chown.
+func (w *Writer) Chown(name string, uid, gid int) error {
+	return w.change("chown", name, true, func(in *inode) { in.chown(uid, gid) })
+}
+
+// Lchown changes the owner of the named file without following a symbolic
+// link at the end of name.
+func (w *Writer) Lchown(name string, uid, gid int) error {
+	return w.change("lchown", name, false, func(in *inode) { in.chown(uid, gid) })
+}
+
+// Chtimes changes the access and modification times of the named file,
+// following symbolic links. A zero time.Time is not changed, like
+// os.Chtimes.
+func (w *Writer) Chtimes(name string, atime, mtime time.Time) error {
+	return w.change("chtimes", name, true, func(in *inode) {
+		if !atime.IsZero() {
+			in.setTime(inodeAtime, atime)
+		}
+		if !mtime.IsZero() {
+			in.setTime(inodeMtime, mtime)
+		}
+	})
+}
+
+// change applies fn to the inode of name and updates its change time.
+func (w *Writer) change(op, name string, follow bool, fn func(*inode)) error {
+	in, err := w.walk(op, name, follow)
+	if err != nil {
+		return err
+	}
+	err = w.update(func() error {
+		fn(in)
+		in.setTime(inodeCtime, w.now())
+		return w.writeInode(in)
+	})
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+var (
+	errNotDir = errors.New("not a directory")
+	errIsDir  = errors.New("is a directory")
+)
+
+// cmpErr returns err if it is not nil, and otherwise target.
+func cmpErr(err, target error) error {
+	if err != nil {
+		return err
+	}
+	return target
+}
+
+// parent returns the directory which holds name and the last element of
+// name.
+func (w *Writer) parent(op, name string) (*inode, string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	base := path.Base(name)
+	if len(base) > maxNameLen {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	dir, err := w.walk(op, path.Dir(name), true)
+	if err != nil {
+		return nil, "", err
+	}
+	if dir.typ() != modeDir {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return dir, base, nil
+}
+
+func (w *Writer) mkdir(dir *inode, name string, perm fs.FileMode) error {
+	if in, err := w.lookup(dir, name); err != nil || in != nil {
+		return cmpErr(err, fs.ErrExist)
+	}
+	switch {
+	case dir.Nlink >= maxDirLinks-1 && w.sb.roCompat&roCompatDirNlink != 0:
+		dir.Nlink = 1
+	case dir.Nlink >= maxDirLinks-1:
+		return errors.New("too many links")
+	case dir.Nlink > 1:
+		dir.Nlink++
+	}
+	in, err := w.newInode(dir, modeDir|unixPerm(perm))
+	if err != nil {
+		return err
+	}
+	in.Nlink = 2
+	if err := w.setDir(in, dir.Ino, nil); err != nil {
+		return err
+	}
+	if err := w.writeInode(in); err != nil {
+		return err
+	}
+	return w.addEntry(dir, name, in)
+}
+
+// newInode allocates an inode of the given mode owned by root near the
+// directory dir.
+func (w *Writer) newInode(dir *inode, mode uint16) (*inode, error) {
+	ino, err := w.allocInode(mode&modeTypeMask == modeDir, int64((dir.Ino-1)/w.sb.inodesPerGroup))
+	if err != nil {
+		return nil, err
+	}
+	return w.blankInode(ino, mode)
+}
+
+// blankInode returns the empty inode ino of the given mode owned by root.
+func (w *Writer) blankInode(ino uint32, mode uint16) (*inode, error) {
+	b := make([]byte, w.sb.inodeSize)
+	if w.extraIsize > 0 {
+		binary.LittleEndian.PutUint16(b[0x80:], uint16(w.extraIsize))
+	}
+	in := &inode{
+		Stat:  Stat{Ino: ino, Nlink: 1},
+		mode:  mode,
+		flags: flagExtents,
+		raw:   b,
+		block: b[0x28 : 0x28+inlineSize],
+		xattr: b[min(128+w.extraIsize, w.sb.inodeSize):],
+	}
+	if _, err := w.buildExtentTree(in, nil); err != nil {
+		return nil, err
+	}
+	now := w.now()
+	for _, t := range []inodeTime{inodeAtime, inodeCtime, inodeMtime, inodeCrtime} {
+		in.setTime(t, now)
+	}
+	return in, nil
+}
+
+// addEntry adds an entry for in named name to the directory dir, and
+// writes dir.
+func (w *Writer) addEntry(dir *inode, name string, in *inode) error {
+	if dir.flags&flagCasefold != 0 {
+		return fmt.Errorf("ext4: case-insensitive directories can not be written: %w", errors.ErrUnsupported)
+	}
+	entries, parent, err := w.readDir(dir)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, dirent{name: name, ino: in.Ino, typ: direntType(in.mode)})
+	if err := w.setDir(dir, parent, entries); err != nil {
+		return err
+	}
+	dir.flags &^= flagIndex
+	w.touch(dir)
+	return w.writeInode(dir)
+}
+
+// direntType returns the file type of a directory entry for mode.
+func direntType(mode uint16) byte {
+	switch mode & modeTypeMask {
+	case modeRegular:
+		return 1
+	case modeDir:
+		return 2
+	case modeChar:
+		return 3
+	case modeBlock:
+		return 4
+	case modeFIFO:
+		return 5
+	case modeSocket:
+		return 6
+	case modeSymlink:
+		return 7
+	}
+	return 0
+}
+
+// dirBlocks returns the blocks of a linear directory holding ".", "..",
+// which refers to parent, and entries.
+func (w *Writer) dirBlocks(in *inode, parent uint32, entries []dirent) []byte {
+	bs := int(w.sb.blockSize)
+	end := bs
+	if w.metadataCsum() {
+		end -= dirTailSize
+	}
+	entries = append([]dirent{{name: ".", ino: in.Ino, typ: 2}, {name: "..", ino: parent, typ: 2}}, entries...)
+	le := binary.LittleEndian
+	var (
+		data  []byte
+		start int // the offset of the current block
+		last  int // the offset of the last entry in the current block
+		off   int
+	)
+	for _, e := range entries {
+		size := (8 + len(e.name) + 3) &^ 3
+		if data == nil || off+size > start+end {
+			if data != nil {
+				le.PutUint16(data[last+4:], uint16(start+end-last))
+			}
+			start = len(data)
+			data = append(data, make([]byte, bs)...)
+			off = start
+		}
+		b := data[off:]
+		le.PutUint32(b[0:], e.ino)
+		le.PutUint16(b[4:], uint16(size))
+		b[6] = byte(len(e.name))
+		if w.sb.incompat&incompatFiletype != 0 {
+			b[7] = e.typ
+		}
+		copy(b[8:], e.name)
+		last = off
+		off += size
+	}
+	le.PutUint16(data[last+4:], uint16(start+end-last))
+	if w.metadataCsum() {
+		seed := in.csumSeed(w.csumSeed)
+		for off := 0; off < len(data); off += bs {
+			tail := data[off+end:]
+			le.PutUint16(tail[4:], dirTailSize)
+			tail[7] = 0xde
+			le.PutUint32(tail[8:], crc32c(seed, data[off:off+end]))
+		}
+	}
+	return data
+}
+
+// setDir replaces the content of the directory in with linear directory
+// blocks holding entries.
+func (w *Writer) setDir(in *inode, parent uint32, entries []dirent) error {
+	data := w.dirBlocks(in, parent, entries)
+	return w.setData(in, bytes.NewReader(data), int64(len(data)))
+}
+
+// setTarget sets the target of the symbolic link in, which is stored in
+// i_block if it is short enough.
+func (w *Writer) setTarget(in *inode, target string) error {
+	if len(target) < inlineSize {
+		// a fast symbolic link.
+		in.flags &^= flagExtents
+		clear(in.block)
+		copy(in.block, target)
+		in.size = int64(len(target))
+		in.setBlocks(0, w.sb.blockSize)
+		return nil
+	}
+	return w.setData(in, strings.NewReader(target), int64(len(target)))
+}
+
+// setData replaces the content of in with size bytes read from r, which are
+// stored in blocks mapped by extents. It does not write in.
+func (w *Writer) setData(in *inode, r io.Reader, size int64) error {
+	sb := w.sb
+	var (
+		keep []extent
+		free []extent
+		meta []int64
+		err  error
+	)
+	switch {
+	case in.flags&flagInlineData != 0:
+		if err := in.removeInlineData(); err != nil {
+			return err
+		}
+	case in.fastSymlink:
+		in.fastSymlink = false
+	default:
+		if keep, meta, err = w.mapping(in); err != nil {
+			return err
+		}
+	}
+	blocks := (size + sb.blockSize - 1) / sb.blockSize
+	var used int64
+	for _, e := range keep {
+		used += e.length
+	}
+	if blocks > w.freeBlocks()+used+int64(len(meta)) {
+		return ErrNoSpace
+	}
+
+	// keep the blocks of a file whose blocks are mapped from the start
+	// without holes, unless it shrinks.
+	var mapped int64
+	for _, e := range keep {
+		if e.logical != mapped || e.uninit || in.flags&flagExtents == 0 {
+			mapped = -1
+			break
+		}
+		mapped = e.end()
+	}
+	if mapped < 0 || mapped > blocks {
+		keep, free, mapped = nil, keep, 0
+	}
+	for _, e := range free {
+		if err := w.releaseBlocks(e.start, e.length); err != nil {
+			return err
+		}
+	}
+	for _, block := range meta {
+		if err := w.releaseBlocks(block, 1); err != nil {
+			return err
+		}
+	}
+
+	goal := int64((in.Ino - 1) / sb.inodesPerGroup)
+	if n := len(keep); n > 0 {
+		goal = (keep[n-1].start + keep[n-1].length - sb.firstDataBlock) / sb.blocksPerGroup
+	}
+	extents := keep
+	if n := blocks - mapped; n > 0 {
+		more, err := w.allocBlocks(n, goal)
+		if err != nil {
+			return err
+		}
+		for _, e := range more {
+			e.logical += mapped
+			extents = append(extents, e)
+		}
+	}
+
+	// the extents are contiguous from the start, and the end of the last
+	// block is filled with zeros.
+	for _, e := range extents {
+		n := min(e.length*sb.blockSize, size-e.logical*sb.blockSize)
+		ow := io.NewOffsetWriter(w.w, e.start*sb.blockSize)
+		if _, err := io.CopyN(ow, r, n); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if pad := e.length*sb.blockSize - n; pad > 0 {
+			if _, err := ow.Write(make([]byte, pad)); err != nil {
+				return err
+			}
+		}
+	}
+	nodes, err := w.buildExtentTree(in, extents)
+	if err != nil {
+		return err
+	}
+	in.flags = in.flags&^flagHugeFile | flagExtents
+	in.size = size
+	if in.size >= 1<<31 && sb.roCompat&roCompatLargeFile == 0 {
+		sb.roCompat |= roCompatLargeFile
+		binary.LittleEndian.PutUint32(w.raw[0x64:], sb.roCompat)
+	}
+	in.setBlocks(blocks+nodes, sb.blockSize)
+	return nil
+}
+
+// buildExtentTree stores extents in the extent tree of in, allocating the
+// blocks of the tree if they do not fit into i_block. It returns the
+// number of blocks of the tree.
+func (w *Writer) buildExtentTree(in *inode, extents []extent) (int64, error) {
+	le := binary.LittleEndian
+	type record struct {
+		logical int64
+		b       [12]byte
+	}
+	var records []record
+	for _, e := range extents {
+		for e.length > 0 {
+			n := min(e.length, maxInitExtentLen)
+			r := record{logical: e.logical}
+			le.PutUint32(r.b[0:], uint32(e.logical))
+			le.PutUint16(r.b[4:], uint16(n))
+			le.PutUint16(r.b[6:], uint16(e.start>>32))
+			le.PutUint32(r.b[8:], uint32(e.start))
+			records = append(records, r)
+			e.logical, e.start, e.length = e.logical+n, e.start+n, e.length-n
+		}
+	}
+
+	header := func(b []byte, entries, max, depth int) {
+		le.PutUint16(b[0:], extentMagic)
+		le.PutUint16(b[2:], uint16(entries))
+		le.PutUint16(b[4:], uint16(max))
+		le.PutUint16(b[6:], uint16(depth))
+		le.PutUint32(b[8:], 0)
+	}
+	bs := w.sb.blockSize
+	perNode := int((bs - 12) / 12)
+	rootMax := inlineSize/12 - 1
+	var nodes int64
+	depth := 0
+	for len(records) > rootMax {
+		if depth++; depth > maxExtentDepth {
+			return 0, fmt.Errorf("%w: too many extents", ErrNoSpace)
+		}
+		n := (len(records) + perNode - 1) / perNode
+		blocks, err := w.allocBlocks(int64(n), (extents[0].start-w.sb.firstDataBlock)/w.sb.blocksPerGroup)
+		if err != nil {
+			return 0, err
+		}
+		var upper []record
+		for _, e := range blocks {
+			for block := e.start; block < e.start+e.length; block++ {
+				chunk := records[:min(perNode, len(records))]
+				records = records[len(chunk):]
+				b := make([]byte, bs)
+				header(b, len(chunk), perNode, depth-1)
+				for i, r := range chunk {
+					copy(b[12+i*12:], r.b[:])
+				}
+				if w.metadataCsum() {
+					tail := 12 + perNode*12
+					le.PutUint32(b[tail:], crc32c(in.csumSeed(w.csumSeed), b[:tail]))
+				}
+				if _, err := w.w.WriteAt(b, block*bs); err != nil {
+					return 0, err
+				}
+				r := record{logical: chunk[0].logical}
+				le.PutUint32(r.b[0:], uint32(chunk[0].logical))
+				le.PutUint32(r.b[4:], uint32(block))
+				le.PutUint16(r.b[8:], uint16(block>>32))
+				upper = append(upper, r)
+				nodes++
+			}
+		}
+		records = upper
+	}
+	clear(in.block)
+	header(in.block, len(records), rootMax, depth)
+	for i, r := range records {
+		copy(in.block[12+i*12:], r.b[:])
+	}
+	return nodes, nil
+}
+
+// writeInode writes in with its checksum.
+func (w *Writer) writeInode(in *inode) error {
+	sb := w.sb
+	le := binary.LittleEndian
+	b := in.raw
+	le.PutUint16(b[0x00:], in.mode)
+	le.PutUint16(b[0x02:], uint16(in.UID))
+	le.PutUint32(b[0x04:], uint32(in.size))
+	le.PutUint16(b[0x18:], uint16(in.GID))
+	le.PutUint16(b[0x1a:], in.Nlink)
+	le.PutUint32(b[0x20:], in.flags)
+	le.PutUint32(b[0x6c:], uint32(in.size>>32))
+	le.PutUint16(b[0x78:], uint16(in.UID>>16))
+	le.PutUint16(b[0x7a:], uint16(in.GID>>16))
+	if w.metadataCsum() {
+		hi := in.fits(0x84)
+		le.PutUint16(b[0x7c:], 0)
+		if hi {
+			le.PutUint16(b[0x82:], 0)
+		}
+		c := crc32c(in.csumSeed(w.csumSeed), b)
+		le.PutUint16(b[0x7c:], uint16(c))
+		if hi {
+			le.PutUint16(b[0x82:], uint16(c>>16))
+		}
+	}
+	group, index := (in.Ino-1)/sb.inodesPerGroup, (in.Ino-1)%sb.inodesPerGroup
+	_, err := w.w.WriteAt(b, w.groups[group].inodeTable*sb.blockSize+int64(index)*sb.inodeSize)
+	return err
+}
+
+// touch updates the modification and change times of in.
+func (w *Writer) touch(in *inode) {
+	now := w.now()
+	in.setTime(inodeMtime, now)
+	in.setTime(inodeCtime, now)
+}
+
+// unixPerm converts the permission, setuid, setgid and sticky bits of mode.
+func unixPerm(mode fs.FileMode) uint16 {
+	perm := uint16(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= 0o1000
+	}
+	return perm
+}
@@ -0,0 +1,187 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	xattrIndexUser            = 1
+	xattrIndexPOSIXACLAccess  = 2
+	xattrIndexPOSIXACLDefault = 3
+	xattrIndexTrusted         = 4
+	xattrIndexSecurity        = 6
+
+	// xattrBlockHeaderSize is the size of the header of an extended
+	// attribute block, after which the entries start.
+	xattrBlockHeaderSize = 32
+
+	// posixACLVersion is the version of POSIX ACLs in extended attributes
+	// as Linux passes them, and ext4ACLVersion the one which ext4 stores.
+	posixACLVersion = 2
+	ext4ACLVersion  = 1
+)
+
+// xattrPrefixes maps the prefixes of extended attribute names to their
+// name index.
+var xattrPrefixes = []struct {
+	prefix string
+	index  byte
+}{
+	{"user.", xattrIndexUser},
+	{"trusted.", xattrIndexTrusted},
+	{"security.", xattrIndexSecurity},
+}
+
+// xattr is an extended attribute as ext4 stores it.
+type xattr struct {
+	index byte
+	name  string // without the prefix of index
+	value []byte
+}
+
+// newXattr returns the extended attribute name with value. POSIX ACLs are
+// converted to the format of ext4.
+func newXattr(name string, value []byte) (xattr, error) {
+	switch name {
+	case "system.posix_acl_access", "system.posix_acl_default":
+		acl, err := ext4ACL(value)
+		if err != nil {
+			return xattr{}, fmt.Errorf("ext4: extended attribute %s: %w", name, err)
+		}
+		index := byte(xattrIndexPOSIXACLAccess)
+		if name == "system.posix_acl_default" {
+			index = xattrIndexPOSIXACLDefault
+		}
+		return xattr{index: index, value: acl}, nil
+	}
+	for _, p := range xattrPrefixes {
+		if suffix, ok := strings.CutPrefix(name, p.prefix); ok && suffix != "" && len(suffix) <= maxNameLen {
+			return xattr{index: p.index, name: suffix, value: value}, nil
+		}
+	}
+	return xattr{}, fmt.Errorf("ext4: unsupported extended attribute %s", name)
+}
+
+// ext4ACL converts a POSIX ACL to the format of ext4, which leaves out the
+// id of the entries which do not refer to a user or group.
+func ext4ACL(v []byte) ([]byte, error) {
+	le := binary.LittleEndian
+	if len(v) < 4 || (len(v)-4)%8 != 0 || le.Uint32(v) != posixACLVersion {
+		return nil, errors.New("invalid POSIX ACL")
+	}
+	b := le.AppendUint32(nil, ext4ACLVersion)
+	for e := v[4:]; len(e) > 0; e = e[8:] {
+		tag := le.Uint16(e)
+		b = append(b, e[:4]...)
+		switch tag {
+		case 0x02, 0x08: // ACL_USER, ACL_GROUP
+			b = append(b, e[4:8]...)
+		case 0x01, 0x04, 0x10, 0x20: // ACL_USER_OBJ, ACL_GROUP_OBJ, ACL_MASK, ACL_OTHER
+		default:
+			return nil, fmt.Errorf("invalid POSIX ACL tag %#x", tag)
+		}
+	}
+	return b, nil
+}
+
+// hash returns the hash of the entry of x, like ext4_xattr_hash_entry.
+func (x *xattr) hash() uint32 {
+	var h uint32
+	for _, c := range []byte(x.name) {
+		h = h<<5 ^ h>>27 ^ uint32(c)
+	}
+	value := make([]byte, (len(x.value)+3)&^3)
+	copy(value, x.value)
+	for i := 0; i < len(value); i += 4 {
+		h = h<<16 ^ h>>16 ^ binary.LittleEndian.Uint32(value[i:])
+	}
+	return h
+}
+
+// putXattrs stores the entries of attrs starting at off in b, and their
+// values at the end of b, with value offsets relative to the start of b.
+// It reports whether they fit, including the 4 zero bytes which end the
+// entries.
+func putXattrs(b []byte, off int, attrs []xattr) bool {
+	size := off + 4
+	for _, x := range attrs {
+		size += (16+len(x.name)+3)&^3 + (len(x.value)+3)&^3
+	}
+	if size > len(b) {
+		return false
+	}
+	le := binary.LittleEndian
+	end := len(b)
+	for _, x := range attrs {
+		e := b[off:]
+		e[0] = byte(len(x.name))
+		e[1] = x.index
+		if len(x.value) > 0 {
+			end -= (len(x.value) + 3) &^ 3
+			copy(b[end:], x.value)
+			le.PutUint16(e[2:], uint16(end))
+		}
+		le.PutUint32(e[4:], 0) // e_value_inum
+		le.PutUint32(e[8:], uint32(len(x.value)))
+		le.PutUint32(e[12:], x.hash())
+		copy(e[16:], x.name)
+		off += (16 + len(x.name) + 3) &^ 3
+	}
+	return true
+}
+
+// setXattrs stores attrs in the inode in if they fit there, or otherwise in
+// a new extended attribute block. It is called before the data of in is
+// set, which counts the block.
+func (w *Writer) setXattrs(in *inode, attrs []xattr) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	// the order which Linux keeps in extended attribute blocks.
+	sort.Slice(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+	le := binary.LittleEndian
+	if len(in.xattr) > 4 && putXattrs(in.xattr[4:], 0, attrs) {
+		le.PutUint32(in.xattr, xattrMagic)
+		return nil
+	}
+	sb := w.sb
+	b := make([]byte, sb.blockSize)
+	if !putXattrs(b, xattrBlockHeaderSize, attrs) {
+		return fmt.Errorf("%w: extended attributes do not fit into a block", ErrNoSpace)
+	}
+	extents, err := w.allocBlocks(1, int64((in.Ino-1)/sb.inodesPerGroup))
+	if err != nil {
+		return err
+	}
+	block := extents[0].start
+	le.PutUint32(b[0:], xattrMagic)
+	le.PutUint32(b[4:], 1) // h_refcount
+	le.PutUint32(b[8:], 1) // h_blocks
+	var hash uint32
+	for _, x := range attrs {
+		hash = hash<<16 ^ hash>>16 ^ x.hash()
+	}
+	le.PutUint32(b[12:], hash)
+	if w.metadataCsum() {
+		le.PutUint32(b[16:], crc32c(w.csumSeed, binary.LittleEndian.AppendUint64(nil, uint64(block)), b))
+	}
+	if _, err := w.w.WriteAt(b, block*sb.blockSize); err != nil {
+		return err
+	}
+	le.PutUint32(in.raw[0x68:], uint32(block))
+	le.PutUint16(in.raw[0x76:], uint16(block>>32))
+	return nil
+}
@@ -0,0 +1,141 @@
+// Package fat creates FAT12, FAT16 and FAT32 file systems from an fs.FS
+// and reads them back.
+//
+// It is meant for building EFI System Partitions and other small volumes for
+// guests, e.g. a partition holding EFI/BOOT/BOOTAA64.EFI for an EFIBootLoader
+// guest. Use io.NewOffsetWriter and io.NewSectionReader to format and read a
+// partition inside a raw disk image.
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Type is the type of a FAT file system.
+type Type int
+
+const (
+	// TypeAuto chooses the type by the size of the file system.
+	TypeAuto Type = 0
+	FAT12    Type = 12
+	FAT16    Type = 16
+	FAT32    Type = 32
+)
+
+// String returns the name of t, e.g. "FAT32".
+func (t Type) String() string {
+	if t == TypeAuto {
+		return "auto"
+	}
+	return fmt.Sprintf("FAT%d", int(t))
+}
+
+// ErrNoSpace is returned by Format when the files do not fit into the file system.
+var ErrNoSpace = errors.New("fat: not enough space")
+
+const (
+	sectorSize     = 512
+	dirEntrySize   = 32
+	maxFileSize    = 1<<32 - 1
+	maxLabelLength = 11
+
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = attrReadOnly | attrHidden | attrSystem | attrVolumeID
+
+	// maximum number of clusters of each type.
+	maxClusters12 = 4084
+	maxClusters16 = 65524
+	maxClusters32 = 0x0ffffff4
+)
+
+type config struct {
+	typ         Type
+	label       string
+	clusterSize int
+	volumeID    *uint32
+}
+
+// Option is an option for Format.
+type Option func(*config) error
+
+// WithType sets the type of the file system. By default FAT32 is used for
+// file systems of 512 MiB or more, FAT16 from 16 MiB and FAT12 below.
+// The UEFI specification recommends FAT32 for EFI System Partitions.
+func WithType(t Type) Option {
+	return func(c *config) error {
+		switch t {
+		case TypeAuto, FAT12, FAT16, FAT32:
+			c.typ = t
+			return nil
+		}
+		return fmt.Errorf("fat: unknown type %d", int(t))
+	}
+}
+
+// WithLabel sets the volume label, at most 11 characters.
+// The label is stored in upper case.
+func WithLabel(label string) Option {
+	return func(c *config) error {
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("fat: volume label %q is longer than %d bytes", label, maxLabelLength)
+		}
+		for _, r := range label {
+			if r < 0x20 || r > 0x7e || strings.ContainsRune(`"*+,./:;<=>?[\]|`, r) {
+				return fmt.Errorf("fat: invalid character %q in volume label", r)
+			}
+		}
+		c.label = strings.ToUpper(label)
+		return nil
+	}
+}
+
+// WithClusterSize sets the cluster size in bytes, a power of two from 512 to
+// 65536. By default the cluster size is chosen by the size of the file system.
+func WithClusterSize(size int) Option {
+	return func(c *config) error {
+		if size < sectorSize || size > 128*sectorSize || size&(size-1) != 0 {
+			return fmt.Errorf("fat: invalid cluster size %d", size)
+		}
+		c.clusterSize = size
+		return nil
+	}
+}
+
+// WithVolumeID sets the volume serial number. By default a random one is used.
+func WithVolumeID(id uint32) Option {
+	return func(c *config) error {
+		c.volumeID = &id
+		return nil
+	}
+}
+
+// dosTime converts t to the DOS date and time format, which has
+// a resolution of two seconds and covers the years 1980 to 2107.
+func dosTime(t time.Time) (date, tim uint16) {
+	t = t.UTC()
+	switch {
+	case t.Year() < 1980:
+		return 1<<5 | 1, 0
+	case t.Year() > 2107:
+		return 127<<9 | 12<<5 | 31, 23<<11 | 59<<5 | 29
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tim = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tim
+}
+
+func fromDOSTime(date, tim uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0xf), int(date&0x1f),
+		int(tim>>11), int(tim>>5&0x3f), int(tim&0x1f)*2, 0, time.UTC)
+}
@@ -0,0 +1,269 @@
+package fat_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/fat"
+)
+
+var modTime = time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC)
+
+func testFS() fstest.MapFS {
+	m := fstest.MapFS{
+		"EFI/BOOT/BOOTAA64.EFI":             {Data: bytes.Repeat([]byte("MZ"), 40000), ModTime: modTime},
+		"EFI/BOOT/BOOTX64.EFI":              {Data: []byte("MZ"), ModTime: modTime},
+		"startup.nsh":                       {Data: []byte("FS0:\\EFI\\BOOT\\BOOTAA64.EFI\n"), ModTime: modTime},
+		"vmlinuz-6.1.0-arm64":               {Data: bytes.Repeat([]byte{0xaa}, 5000), ModTime: modTime},
+		"A Long File Name With Spaces":      {Data: []byte("long"), ModTime: modTime},
+		"日本語のファイル.txt":                      {Data: []byte("unicode"), ModTime: modTime},
+		"empty":                             {ModTime: modTime},
+		"readonly.txt":                      {Data: []byte("ro"), Mode: 0o444, ModTime: modTime},
+		"empty dir":                         {Mode: fs.ModeDir | 0o755, ModTime: modTime},
+		"deep/a/b/c/file.txt":               {Data: []byte("deep"), ModTime: modTime},
+		"deep/a/similar-name-1.txt":         {Data: []byte("1"), ModTime: modTime},
+		"deep/a/similar-name-2.txt":         {Data: []byte("2"), ModTime: modTime},
+		"deep/a/twenty-six-characters.name": {Data: []byte("26"), ModTime: modTime},
+	}
+	// enough entries to span several clusters.
+	for i := range 200 {
+		m[fmt.Sprintf("many/file number %03d.dat", i)] = &fstest.MapFile{Data: []byte{byte(i)}, ModTime: modTime}
+	}
+	return m
+}
+
+func format(t *testing.T, size int64, src fs.FS, opts ...fat.Option) *fat.FS {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fat.img")
+	if err := fat.FormatFile(path, size, src, opts...); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	fsys, err := fat.Open(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		name string
+		size int64
+		opts []fat.Option
+		want fat.Type
+	}{
+		{name: "FAT12", size: 8 << 20, want: fat.FAT12},
+		{name: "FAT16", size: 64 << 20, want: fat.FAT16},
+		{name: "FAT32", size: 512 << 20, want: fat.FAT32},
+		{name: "small FAT32", size: 40 << 20, opts: []fat.Option{fat.WithType(fat.FAT32)}, want: fat.FAT32},
+		{name: "large clusters", size: 64 << 20, opts: []fat.Option{fat.WithClusterSize(8192)}, want: fat.FAT16},
+	}
+	src := testFS()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fsys := format(t, tc.size, src, tc.opts...)
+			if got := fsys.Type(); got != tc.want {
+				t.Fatalf("want %s but got %s", tc.want, got)
+			}
+			var expected []string
+			for name := range src {
+				expected = append(expected, name)
+			}
+			if err := fstest.TestFS(fsys, expected...); err != nil {
+				t.Fatal(err)
+			}
+			for name, file := range src {
+				if file.Mode.IsDir() {
+					continue
+				}
+				got, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(file.Data, got) {
+					t.Fatalf("%s: content mismatch", name)
+				}
+				info, err := fs.Stat(fsys, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !info.ModTime().Equal(modTime) {
+					t.Fatalf("%s: want mod time %v but got %v", name, modTime, info.ModTime())
+				}
+				if file.Mode&0o222 == 0 && info.Mode()&0o222 != 0 {
+					t.Fatalf("%s: want read-only but got %v", name, info.Mode())
+				}
+			}
+			// FAT is case-insensitive.
+			if _, err := fs.Stat(fsys, "efi/boot/bootaa64.efi"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFormatLabel(t *testing.T) {
+	fsys := format(t, 4<<20, fstest.MapFS{}, fat.WithLabel("cidata"), fat.WithVolumeID(0x12345678))
+	if got := fsys.Label(); got != "CIDATA" {
+		t.Fatalf("want label %q but got %q", "CIDATA", got)
+	}
+	if got := fsys.VolumeID(); got != 0x12345678 {
+		t.Fatalf("want volume ID %#x but got %#x", 0x12345678, got)
+	}
+	if err := fstest.TestFS(fsys); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys = format(t, 4<<20, fstest.MapFS{})
+	if got := fsys.Label(); got != "" {
+		t.Fatalf("want no label but got %q", got)
+	}
+}
+
+func TestFormatPartition(t *testing.T) {
+	const offset, size = 1 << 20, 8 << 20
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(offset + size); err != nil {
+		t.Fatal(err)
+	}
+	src := fstest.MapFS{"EFI/BOOT/BOOTAA64.EFI": {Data: []byte("MZ")}}
+	if err := fat.Format(io.NewOffsetWriter(f, offset), size, src); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := fat.Open(io.NewSectionReader(f, offset, size), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "EFI/BOOT/BOOTAA64.EFI"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFreeExtents(t *testing.T) {
+	const size = 8 << 20
+	path := filepath.Join(t.TempDir(), "fat.img")
+	src := testFS()
+	if err := fat.FormatFile(path, size, src); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fsys, err := fat.Open(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extents := fsys.FreeExtents()
+	if len(extents) == 0 {
+		t.Fatal("want free extents")
+	}
+	var used int64
+	for _, file := range src {
+		used += int64(len(file.Data))
+	}
+	var free, end int64
+	for _, e := range extents {
+		if e.Offset < end || e.Length <= 0 || e.Offset+e.Length > size {
+			t.Fatalf("invalid extent %+v after %d", e, end)
+		}
+		end = e.Offset + e.Length
+		free += e.Length
+	}
+	if free > size-used {
+		t.Fatalf("want at most %d free bytes but got %d", size-used, free)
+	}
+
+	// overwriting the free extents must not change any file.
+	for _, e := range extents {
+		if _, err := f.WriteAt(bytes.Repeat([]byte{0xff}, int(e.Length)), e.Offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys, err = fat.Open(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, file := range src {
+		if file.Mode.IsDir() {
+			continue
+		}
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(file.Data, got) {
+			t.Fatalf("%s: content mismatch", name)
+		}
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	cases := []struct {
+		name string
+		size int64
+		src  fs.FS
+		opts []fat.Option
+		want error
+	}{
+		{
+			name: "no space",
+			size: 1 << 20,
+			src:  fstest.MapFS{"big": {Data: make([]byte, 2<<20)}},
+			want: fat.ErrNoSpace,
+		},
+		{
+			name: "names differ in case",
+			size: 1 << 20,
+			src:  fstest.MapFS{"a.txt": {}, "A.TXT": {}},
+		},
+		{
+			name: "invalid name",
+			size: 1 << 20,
+			src:  fstest.MapFS{"a:b": {}},
+		},
+		{
+			name: "too small for FAT32",
+			size: 16 << 20,
+			src:  fstest.MapFS{},
+			opts: []fat.Option{fat.WithType(fat.FAT32)},
+		},
+		{
+			name: "long label",
+			size: 1 << 20,
+			src:  fstest.MapFS{},
+			opts: []fat.Option{fat.WithLabel("a label too long")},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fat.img")
+			err := fat.FormatFile(path, tc.size, tc.src, tc.opts...)
+			if err == nil || tc.want != nil && !errors.Is(err, tc.want) {
+				t.Fatalf("want error %v but got %v", tc.want, err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("want %s to be removed but got %v", path, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package fat
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// geometry is the layout of a FAT file system.
+type geometry struct {
+	typ               Type
+	sectorSize        uint32
+	totalSectors      uint32
+	sectorsPerCluster uint32
+	reservedSectors   uint32
+	numFATs           uint32
+	fatSectors        uint32
+	rootEntries       uint32 // FAT12 and FAT16 only
+	rootCluster       uint32 // FAT32 only
+	clusters          uint32
+}
+
+func (g *geometry) clusterSize() int64 { return int64(g.sectorsPerCluster) * int64(g.sectorSize) }
+
+func (g *geometry) rootSectors() uint32 {
+	return (g.rootEntries*dirEntrySize + g.sectorSize - 1) / g.sectorSize
+}
+
+func (g *geometry) fatOffset(i uint32) int64 {
+	return int64(g.reservedSectors+i*g.fatSectors) * int64(g.sectorSize)
+}
+
+func (g *geometry) rootOffset() int64 { return g.fatOffset(g.numFATs) }
+
+func (g *geometry) dataStart() uint32 {
+	return g.reservedSectors + g.numFATs*g.fatSectors + g.rootSectors()
+}
+
+// clusterOffset returns the offset of the data cluster c, which starts at 2.
+func (g *geometry) clusterOffset(c uint32) int64 {
+	return (int64(g.dataStart()) + int64(c-2)*int64(g.sectorsPerCluster)) * int64(g.sectorSize)
+}
+
+// typeOf returns the FAT type determined by the number of clusters,
+// as the specification requires.
+func typeOf(clusters uint32) Type {
+	switch {
+	case clusters <= maxClusters12:
+		return FAT12
+	case clusters <= maxClusters16:
+		return FAT16
+	}
+	return FAT32
+}
+
+// fatBits returns the size of a FAT entry in bits.
+func (t Type) fatBits() uint64 {
+	switch t {
+	case FAT12:
+		return 12
+	case FAT16:
+		return 16
+	}
+	return 32
+}
+
+// endOfChain is the FAT entry marking the last cluster of a chain.
+func (t Type) endOfChain() uint32 {
+	switch t {
+	case FAT12:
+		return 0xfff
+	case FAT16:
+		return 0xffff
+	}
+	return 0x0fffffff
+}
+
+// layout computes the number of FAT sectors and clusters for the rest of g.
+func (g *geometry) layout() {
+	g.fatSectors = 1
+	for {
+		data := int64(g.totalSectors) - int64(g.reservedSectors) - int64(g.numFATs*g.fatSectors) - int64(g.rootSectors())
+		if data < int64(g.sectorsPerCluster) {
+			g.clusters = 0
+			return
+		}
+		g.clusters = uint32(data / int64(g.sectorsPerCluster))
+		need := uint32(((uint64(g.clusters)+2)*g.typ.fatBits()/8 + uint64(g.sectorSize) - 1) / uint64(g.sectorSize))
+		if need <= g.fatSectors {
+			return
+		}
+		g.fatSectors = need
+	}
+}
+
+// newGeometry chooses the layout of a file system of size bytes.
+// rootEntries is the number of entries needed in the root directory.
+func newGeometry(c *config, size int64, rootEntries int) (*geometry, error) {
+	totalSectors := size / sectorSize
+	if totalSectors > 0xffffffff {
+		return nil, fmt.Errorf("fat: size %d is too large", size)
+	}
+	typ := c.typ
+	if typ == TypeAuto {
+		switch {
+		case size >= 512<<20:
+			typ = FAT32
+		case size >= 16<<20:
+			typ = FAT16
+		default:
+			typ = FAT12
+		}
+	}
+	g := &geometry{
+		typ:             typ,
+		sectorSize:      sectorSize,
+		totalSectors:    uint32(totalSectors),
+		reservedSectors: 1,
+		numFATs:         2,
+	}
+	if typ == FAT32 {
+		g.reservedSectors = 32
+		g.rootCluster = 2
+	} else {
+		g.rootEntries = max(512, uint32(rootEntries+15)/16*16)
+	}
+
+	var candidates []uint32
+	switch {
+	case c.clusterSize != 0:
+		candidates = []uint32{uint32(c.clusterSize / sectorSize)}
+	case typ == FAT32:
+		// prefer the cluster sizes used by Windows, but go smaller
+		// if there would be too few clusters for FAT32.
+		preferred := uint32(8)
+		switch {
+		case size > 32<<30:
+			preferred = 64
+		case size > 16<<30:
+			preferred = 32
+		case size > 8<<30:
+			preferred = 16
+		}
+		for spc := preferred; spc >= 1; spc /= 2 {
+			candidates = append(candidates, spc)
+		}
+	default:
+		for spc := uint32(1); spc <= 128; spc *= 2 {
+			candidates = append(candidates, spc)
+		}
+	}
+	for _, spc := range candidates {
+		g.sectorsPerCluster = spc
+		g.layout()
+		if g.clusters > 0 && typeOf(g.clusters) == typ && g.clusters <= maxClusters32 {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("fat: can not create %s with %d bytes and the chosen cluster size", typ, size)
+}
+
+// setFAT sets the FAT entry of cluster c in fat to v.
+func setFAT(typ Type, fat []byte, c, v uint32) {
+	switch typ {
+	case FAT12:
+		off := c * 3 / 2
+		if c&1 != 0 {
+			fat[off] = fat[off]&0x0f | byte(v<<4)
+			fat[off+1] = byte(v >> 4)
+		} else {
+			fat[off] = byte(v)
+			fat[off+1] = fat[off+1]&0xf0 | byte(v>>8)&0x0f
+		}
+	case FAT16:
+		binary.LittleEndian.PutUint16(fat[c*2:], uint16(v))
+	default:
+		binary.LittleEndian.PutUint32(fat[c*4:], v&0x0fffffff)
+	}
+}
+
+// getFAT returns the FAT entry of cluster c in fat.
+func getFAT(typ Type, fat []byte, c uint32) uint32 {
+	switch typ {
+	case FAT12:
+		off := c * 3 / 2
+		v := uint32(binary.LittleEndian.Uint16(fat[off:]))
+		if c&1 != 0 {
+			return v >> 4
+		}
+		return v & 0xfff
+	case FAT16:
+		return uint32(binary.LittleEndian.Uint16(fat[c*2:]))
+	}
+	return binary.LittleEndian.Uint32(fat[c*4:]) & 0x0fffffff
+}
@@ -0,0 +1,170 @@
+package fat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	lfnCharsPerEntry = 13
+	maxLongName      = 255 // in UTF-16 code units
+	lfnLast          = 0x40
+)
+
+// lfnOffsets is the offsets of the characters in a long name entry.
+var lfnOffsets = [lfnCharsPerEntry]int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+func validLongName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("fat: invalid file name %q", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(`"*/:<>?\|`, r) {
+			return fmt.Errorf("fat: invalid character %q in file name %q", r, name)
+		}
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return fmt.Errorf("fat: file name %q must not end with a dot or a space", name)
+	}
+	if n := len(utf16.Encode([]rune(name))); n > maxLongName {
+		return fmt.Errorf("fat: file name %q is longer than %d characters", name, maxLongName)
+	}
+	return nil
+}
+
+func isShortNameChar(c byte) bool {
+	switch {
+	case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c >= 0x80:
+		return false
+	}
+	return strings.IndexByte("$%'-_@~`!(){}^#&", c) >= 0
+}
+
+// shortNameOf returns the 8.3 name of name if name is a valid upper case
+// 8.3 name, so it can be stored without a long name.
+func shortNameOf(name string) ([11]byte, bool) {
+	var short [11]byte
+	base, ext, _ := strings.Cut(name, ".")
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || strings.Contains(ext, ".") {
+		return short, false
+	}
+	if strings.Contains(name, ".") && ext == "" {
+		return short, false
+	}
+	for i := range len(name) {
+		if name[i] != '.' && !isShortNameChar(name[i]) {
+			return short, false
+		}
+	}
+	copy(short[:], fmt.Sprintf("%-8s%-3s", base, ext))
+	return short, true
+}
+
+// basisName returns the characters usable in a generated 8.3 name for name.
+func basisName(name string) (base, ext string) {
+	clean := func(s string, n int) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			if r == ' ' || r == '.' {
+				continue
+			}
+			c := byte('_')
+			if r < 0x80 && isShortNameChar(byte(r)) {
+				c = byte(r)
+			}
+			b.WriteByte(c)
+			if b.Len() == n {
+				break
+			}
+		}
+		return b.String()
+	}
+	name = strings.TrimLeft(name, ".")
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		return clean(name[:i], 8), clean(name[i+1:], 3)
+	}
+	return clean(name, 8), ""
+}
+
+// generateShortName returns a unique 8.3 name for a long name with
+// a numeric tail, e.g. "LONGFI~1TXT".
+func generateShortName(name string, used map[[11]byte]bool) ([11]byte, error) {
+	base, ext := basisName(name)
+	if base == "" {
+		base = "_"
+	}
+	for n := 1; n < 1000000; n++ {
+		tail := "~" + strconv.Itoa(n)
+		b := base
+		if len(b) > 8-len(tail) {
+			b = b[:8-len(tail)]
+		}
+		var short [11]byte
+		copy(short[:], fmt.Sprintf("%-8s%-3s", b+tail, ext))
+		if !used[short] {
+			return short, nil
+		}
+	}
+	return [11]byte{}, fmt.Errorf("fat: too many files similar to %q", name)
+}
+
+func shortNameChecksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// longNameEntries returns the directory entries storing name for the
+// entry with the given short name, in the order they are stored on disk.
+func longNameEntries(name string, short [11]byte) []byte {
+	chars := utf16.Encode([]rune(name))
+	if len(chars)%lfnCharsPerEntry != 0 {
+		chars = append(chars, 0)
+		for len(chars)%lfnCharsPerEntry != 0 {
+			chars = append(chars, 0xffff)
+		}
+	}
+	n := len(chars) / lfnCharsPerEntry
+	sum := shortNameChecksum(short)
+	b := make([]byte, n*dirEntrySize)
+	for i := range n {
+		e := b[(n-1-i)*dirEntrySize:]
+		e[0] = byte(i + 1)
+		if i == n-1 {
+			e[0] |= lfnLast
+		}
+		e[11] = attrLongName
+		e[13] = sum
+		for j, off := range lfnOffsets {
+			binary.LittleEndian.PutUint16(e[off:], chars[i*lfnCharsPerEntry+j])
+		}
+	}
+	return b
+}
+
+// decodeShortName returns the name of a short entry, honoring the
+// lower case flags set by Windows NT and Linux.
+func decodeShortName(e []byte) string {
+	base := strings.TrimRight(string(e[0:8]), " ")
+	ext := strings.TrimRight(string(e[8:11]), " ")
+	if base != "" && base[0] == 0x05 {
+		base = "\xe5" + base[1:]
+	}
+	if e[12]&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if e[12]&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
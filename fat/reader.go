@@ -0,0 +1,460 @@
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ErrCorrupt is returned when a FAT file system is damaged.
+var ErrCorrupt = errors.New("fat: corrupt file system")
+
+// FS is a read-only FAT file system. It implements fs.FS, fs.ReadDirFS and
+// fs.StatFS. File names are matched case-insensitively, as FAT does.
+type FS struct {
+	r        io.ReaderAt
+	g        *geometry
+	fat      []byte
+	label    string
+	volumeID uint32
+}
+
+var (
+	_ fs.FS        = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+)
+
+// Open opens the FAT file system of size bytes in r.
+func Open(r io.ReaderAt, size int64) (*FS, error) {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if boot[510] != 0x55 || boot[511] != 0xaa {
+		return nil, fmt.Errorf("%w: missing boot sector signature", ErrCorrupt)
+	}
+	g := &geometry{
+		sectorSize:        uint32(le.Uint16(boot[11:])),
+		sectorsPerCluster: uint32(boot[13]),
+		reservedSectors:   uint32(le.Uint16(boot[14:])),
+		numFATs:           uint32(boot[16]),
+		rootEntries:       uint32(le.Uint16(boot[17:])),
+		totalSectors:      uint32(le.Uint16(boot[19:])),
+		fatSectors:        uint32(le.Uint16(boot[22:])),
+	}
+	if g.totalSectors == 0 {
+		g.totalSectors = le.Uint32(boot[32:])
+	}
+	ext := boot[36:]
+	if g.fatSectors == 0 {
+		g.fatSectors = le.Uint32(boot[36:])
+		g.rootCluster = le.Uint32(boot[44:])
+		ext = boot[64:]
+	}
+	switch ss := g.sectorSize; {
+	case ss < 512 || ss > 4096 || ss&(ss-1) != 0:
+		return nil, fmt.Errorf("%w: invalid sector size %d", ErrCorrupt, ss)
+	case g.sectorsPerCluster == 0 || g.sectorsPerCluster&(g.sectorsPerCluster-1) != 0:
+		return nil, fmt.Errorf("%w: invalid sectors per cluster %d", ErrCorrupt, g.sectorsPerCluster)
+	case g.reservedSectors == 0 || g.numFATs == 0 || g.fatSectors == 0:
+		return nil, fmt.Errorf("%w: invalid boot sector", ErrCorrupt)
+	case int64(g.totalSectors)*int64(g.sectorSize) > size:
+		return nil, fmt.Errorf("%w: file system is larger than %d bytes", ErrCorrupt, size)
+	case g.dataStart() >= g.totalSectors:
+		return nil, fmt.Errorf("%w: no data area", ErrCorrupt)
+	}
+	g.clusters = (g.totalSectors - g.dataStart()) / g.sectorsPerCluster
+	g.typ = typeOf(g.clusters)
+	if (g.typ == FAT32) != (g.rootEntries == 0) {
+		return nil, fmt.Errorf("%w: root directory does not match %s", ErrCorrupt, g.typ)
+	}
+	if need := (uint64(g.clusters) + 2) * g.typ.fatBits() / 8; need > uint64(g.fatSectors)*uint64(g.sectorSize) {
+		return nil, fmt.Errorf("%w: FAT is too small for %d clusters", ErrCorrupt, g.clusters)
+	}
+
+	f := &FS{r: r, g: g}
+	if ext[2] == 0x29 {
+		f.volumeID = le.Uint32(ext[3:])
+		f.label = strings.TrimRight(string(ext[7:18]), " ")
+	}
+	f.fat = make([]byte, int64(g.fatSectors)*int64(g.sectorSize))
+	if _, err := r.ReadAt(f.fat, g.fatOffset(0)); err != nil {
+		return nil, err
+	}
+	if g.typ == FAT32 && (g.rootCluster < 2 || g.rootCluster >= g.clusters+2) {
+		return nil, fmt.Errorf("%w: invalid root cluster %d", ErrCorrupt, g.rootCluster)
+	}
+	// the volume label entry in the root directory takes precedence.
+	root, err := f.readDir(nil)
+	if err != nil {
+		return nil, err
+	}
+	if root.label != "" {
+		f.label = root.label
+	}
+	if f.label == "NO NAME" {
+		f.label = ""
+	}
+	return f, nil
+}
+
+// Type returns the type of the file system.
+func (f *FS) Type() Type { return f.g.typ }
+
+// Label returns the volume label, or an empty string if there is none.
+func (f *FS) Label() string { return f.label }
+
+// VolumeID returns the volume serial number.
+func (f *FS) VolumeID() uint32 { return f.volumeID }
+
+// Extent is a range of bytes relative to the start of the file system.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// FreeExtents returns the ranges of the data area which are not allocated to
+// any file or directory in ascending order, merging adjacent free clusters.
+// Their content is meaningless, so they can be discarded from the storage
+// while the file system is not mounted.
+func (f *FS) FreeExtents() []Extent {
+	var extents []Extent
+	size := f.g.clusterSize()
+	for c := uint32(2); c < f.g.clusters+2; c++ {
+		if getFAT(f.g.typ, f.fat, c) != 0 {
+			continue
+		}
+		off := f.g.clusterOffset(c)
+		if n := len(extents); n > 0 && extents[n-1].Offset+extents[n-1].Length == off {
+			extents[n-1].Length += size
+			continue
+		}
+		extents = append(extents, Extent{Offset: off, Length: size})
+	}
+	return extents
+}
+
+// chain returns the clusters of the chain starting at first.
+func (f *FS) chain(first uint32) ([]uint32, error) {
+	var clusters []uint32
+	eoc := f.g.typ.endOfChain() &^ 7
+	for c := first; ; {
+		if c < 2 || c >= f.g.clusters+2 {
+			return nil, fmt.Errorf("%w: invalid cluster %d", ErrCorrupt, c)
+		}
+		if len(clusters) >= int(f.g.clusters) {
+			return nil, fmt.Errorf("%w: cluster chain loops", ErrCorrupt)
+		}
+		clusters = append(clusters, c)
+		c = getFAT(f.g.typ, f.fat, c)
+		if c >= eoc {
+			return clusters, nil
+		}
+	}
+}
+
+// entry is a directory entry.
+type entry struct {
+	name    string
+	attr    byte
+	cluster uint32
+	size    int64
+	modTime time.Time
+}
+
+var (
+	_ fs.FileInfo = (*entry)(nil)
+	_ fs.DirEntry = (*entry)(nil)
+)
+
+func (e *entry) Name() string       { return e.name }
+func (e *entry) Size() int64        { return e.size }
+func (e *entry) ModTime() time.Time { return e.modTime }
+func (e *entry) IsDir() bool        { return e.attr&attrDirectory != 0 }
+func (e *entry) Sys() any           { return nil }
+
+func (e *entry) Mode() fs.FileMode {
+	mode := fs.FileMode(0o777)
+	if e.attr&attrReadOnly != 0 {
+		mode = 0o555
+	}
+	if e.IsDir() {
+		return mode | fs.ModeDir
+	}
+	return mode &^ 0o111
+}
+
+func (e *entry) Type() fs.FileMode          { return e.Mode().Type() }
+func (e *entry) Info() (fs.FileInfo, error) { return e, nil }
+
+type directory struct {
+	label   string
+	entries []*entry
+}
+
+// readDir reads the directory of e, or the root directory if e is nil.
+func (f *FS) readDir(e *entry) (*directory, error) {
+	var data []byte
+	if e == nil && f.g.typ != FAT32 {
+		data = make([]byte, f.g.rootEntries*dirEntrySize)
+		if _, err := f.r.ReadAt(data, f.g.rootOffset()); err != nil {
+			return nil, err
+		}
+	} else {
+		first := f.g.rootCluster
+		if e != nil {
+			first = e.cluster
+		}
+		if e != nil && first == 0 {
+			// an empty directory without "." and "..".
+			return &directory{}, nil
+		}
+		clusters, err := f.chain(first)
+		if err != nil {
+			return nil, err
+		}
+		data = make([]byte, int64(len(clusters))*f.g.clusterSize())
+		for i, c := range clusters {
+			if _, err := f.r.ReadAt(data[int64(i)*f.g.clusterSize():int64(i+1)*f.g.clusterSize()], f.g.clusterOffset(c)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return parseDir(data), nil
+}
+
+func parseDir(data []byte) *directory {
+	le := binary.LittleEndian
+	dir := &directory{}
+	var (
+		long     []uint16
+		longSum  byte
+		longOrd  int  // next expected ordinal of a long name entry
+		longDone bool // long holds the name of the next short entry
+	)
+	for off := 0; off+dirEntrySize <= len(data); off += dirEntrySize {
+		e := data[off : off+dirEntrySize]
+		switch {
+		case e[0] == 0x00:
+			return dir
+		case e[0] == 0xe5:
+			longOrd, longDone = 0, false
+			continue
+		case e[11]&0x3f == attrLongName:
+			ord := int(e[0] & 0x1f)
+			if e[0]&lfnLast != 0 {
+				long = make([]uint16, ord*lfnCharsPerEntry)
+				longSum, longOrd, longDone = e[13], ord, false
+			}
+			if ord == 0 || ord != longOrd || e[13] != longSum {
+				longOrd, longDone = 0, false
+				continue
+			}
+			for j, o := range lfnOffsets {
+				long[(ord-1)*lfnCharsPerEntry+j] = le.Uint16(e[o:])
+			}
+			longOrd--
+			longDone = longOrd == 0
+			continue
+		case e[11]&attrVolumeID != 0:
+			dir.label = strings.TrimRight(string(e[:11]), " ")
+			longOrd, longDone = 0, false
+			continue
+		}
+		var short [11]byte
+		copy(short[:], e)
+		name := decodeShortName(e)
+		if longDone && shortNameChecksum(short) == longSum {
+			for i, c := range long {
+				if c == 0 {
+					long = long[:i]
+					break
+				}
+			}
+			name = string(utf16.Decode(long))
+		}
+		longOrd, longDone = 0, false
+		if name == "." || name == ".." {
+			continue
+		}
+		dir.entries = append(dir.entries, &entry{
+			name:    name,
+			attr:    e[11],
+			cluster: uint32(le.Uint16(e[20:]))<<16 | uint32(le.Uint16(e[26:])),
+			size:    int64(le.Uint32(e[28:])),
+			modTime: fromDOSTime(le.Uint16(e[24:]), le.Uint16(e[22:])),
+		})
+	}
+	return dir
+}
+
+// lookup returns the entry of name, or nil for the root directory.
+func (f *FS) lookup(op, name string) (*entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return nil, nil
+	}
+	var cur *entry
+	for _, elem := range strings.Split(name, "/") {
+		if cur != nil && !cur.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		dir, err := f.readDir(cur)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		var next *entry
+		for _, e := range dir.entries {
+			if strings.EqualFold(e.name, elem) {
+				next = e
+				break
+			}
+		}
+		if next == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// Open opens the named file or directory.
+func (f *FS) Open(name string) (fs.File, error) {
+	e, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || e.IsDir() {
+		dir, err := f.readDir(e)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		if e == nil {
+			e = rootEntry()
+		}
+		return &dirFile{entry: e, entries: dir.entries}, nil
+	}
+	var clusters []uint32
+	if e.size > 0 {
+		clusters, err = f.chain(e.cluster)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		if int64(len(clusters))*f.g.clusterSize() < e.size {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("%w: cluster chain is shorter than the file", ErrCorrupt)}
+		}
+	}
+	return &file{entry: e, fs: f, clusters: clusters}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dir, ok := file.(*dirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Stat returns the fs.FileInfo of the named file.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	e, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return rootEntry(), nil
+	}
+	return e, nil
+}
+
+func rootEntry() *entry { return &entry{name: ".", attr: attrDirectory} }
+
+type file struct {
+	*entry
+	fs       *FS
+	clusters []uint32
+	off      int64
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.entry, nil }
+func (f *file) Close() error               { return nil }
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	cs := f.fs.g.clusterSize()
+	n := 0
+	for n < len(p) && off < f.size {
+		c := f.clusters[off/cs]
+		within := off % cs
+		m := int(min(int64(len(p)-n), cs-within, f.size-off))
+		if _, err := f.fs.r.ReadAt(p[n:n+m], f.fs.g.clusterOffset(c)+within); err != nil {
+			return n, err
+		}
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type dirFile struct {
+	*entry
+	entries []*entry
+	off     int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.entry, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.off:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.off += len(rest)
+	entries := make([]fs.DirEntry, len(rest))
+	for i, e := range rest {
+		entries[i] = e
+	}
+	return entries, nil
+}
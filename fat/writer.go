@@ -0,0 +1,399 @@
+package fat
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// node is a file or directory to be written.
+type node struct {
+	name     string
+	path     string
+	dir      bool
+	size     int64
+	mode     fs.FileMode
+	modTime  time.Time
+	short    [11]byte
+	long     bool
+	children []*node
+
+	cluster  uint32
+	clusters uint32
+}
+
+// entryCount returns the number of directory entries the node takes in its parent.
+func (n *node) entryCount() int {
+	if !n.long {
+		return 1
+	}
+	return 1 + len(longNameEntries(n.name, n.short))/dirEntrySize
+}
+
+// Format creates a FAT file system of size bytes on w holding the files and
+// directories of fsys. Use os.DirFS to copy a directory of the host.
+//
+// Symbolic links to files are copied as regular files. Files which are not
+// regular files or directories, and symbolic links to directories, return
+// an error. Directory entries are written in lexical order, so the result only
+// depends on fsys and the options.
+func Format(w io.WriterAt, size int64, fsys fs.FS, opts ...Option) error {
+	c := &config{}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return err
+		}
+	}
+	root := &node{path: ".", dir: true}
+	if err := readTree(fsys, root); err != nil {
+		return err
+	}
+	rootEntries := dirEntryCount(root, true, c.label != "")
+	g, err := newGeometry(c, size, rootEntries)
+	if err != nil {
+		return err
+	}
+	var volumeID uint32
+	if c.volumeID != nil {
+		volumeID = *c.volumeID
+	} else {
+		var b [4]byte
+		rand.Read(b[:])
+		volumeID = binary.LittleEndian.Uint32(b[:])
+	}
+
+	fw := &formatter{w: w, fsys: fsys, g: g, label: c.label, next: 2}
+	fw.fat = make([]byte, int64(g.fatSectors)*int64(g.sectorSize))
+	setFAT(g.typ, fw.fat, 0, g.typ.endOfChain()&^0xff|0xf8)
+	setFAT(g.typ, fw.fat, 1, g.typ.endOfChain())
+	if err := fw.allocate(root, true); err != nil {
+		return err
+	}
+	if err := fw.writeBootSectors(volumeID); err != nil {
+		return err
+	}
+	for i := range g.numFATs {
+		if _, err := w.WriteAt(fw.fat, g.fatOffset(i)); err != nil {
+			return err
+		}
+	}
+	return fw.writeTree(root, nil)
+}
+
+// FormatFile creates a file at path of size bytes and formats it with Format.
+// If path already exists, FormatFile returns an error satisfying os.IsExist.
+func FormatFile(path string, size int64, fsys fs.FS, opts ...Option) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return Format(f, size, fsys, opts...)
+}
+
+func readTree(fsys fs.FS, dir *node) error {
+	entries, err := fs.ReadDir(fsys, dir.path)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	seen := make(map[string]string, len(entries))
+	used := make(map[[11]byte]bool, len(entries))
+	var generate []*node
+	for _, e := range entries {
+		name := e.Name()
+		if err := validLongName(name); err != nil {
+			return fmt.Errorf("%s: %w", path.Join(dir.path, name), err)
+		}
+		key := strings.ToUpper(name)
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("fat: %q and %q only differ in case in %s", other, name, dir.path)
+		}
+		seen[key] = name
+
+		p := path.Join(dir.path, name)
+		info, err := fs.Stat(fsys, p)
+		if err != nil {
+			return err
+		}
+		n := &node{name: name, path: p, mode: info.Mode(), modTime: info.ModTime()}
+		switch {
+		case info.IsDir() && e.Type()&fs.ModeSymlink != 0:
+			return fmt.Errorf("fat: %s: symbolic links to directories are not supported", p)
+		case info.IsDir():
+			n.dir = true
+			if err := readTree(fsys, n); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if info.Size() > maxFileSize {
+				return fmt.Errorf("fat: %s: file is larger than 4 GiB", p)
+			}
+			n.size = info.Size()
+		default:
+			return fmt.Errorf("fat: %s: unsupported file type %s", p, info.Mode().Type())
+		}
+		if short, ok := shortNameOf(name); ok {
+			n.short = short
+			used[short] = true
+		} else {
+			n.long = true
+			generate = append(generate, n)
+		}
+		dir.children = append(dir.children, n)
+	}
+	for _, n := range generate {
+		short, err := generateShortName(n.name, used)
+		if err != nil {
+			return err
+		}
+		n.short = short
+		used[short] = true
+	}
+	return nil
+}
+
+// dirEntryCount returns the number of directory entries of dir.
+func dirEntryCount(dir *node, root, label bool) int {
+	count := 0
+	if !root {
+		count += 2 // "." and ".."
+	}
+	if root && label {
+		count++
+	}
+	for _, n := range dir.children {
+		count += n.entryCount()
+	}
+	return count
+}
+
+type formatter struct {
+	w     io.WriterAt
+	fsys  fs.FS
+	g     *geometry
+	label string
+	fat   []byte
+	next  uint32 // next free cluster
+}
+
+func (f *formatter) allocateClusters(bytes int64) (first, count uint32, err error) {
+	if bytes == 0 {
+		return 0, 0, nil
+	}
+	count64 := (bytes + f.g.clusterSize() - 1) / f.g.clusterSize()
+	if int64(f.next)-2+count64 > int64(f.g.clusters) {
+		return 0, 0, ErrNoSpace
+	}
+	count = uint32(count64)
+	first = f.next
+	for c := first; c < first+count-1; c++ {
+		setFAT(f.g.typ, f.fat, c, c+1)
+	}
+	setFAT(f.g.typ, f.fat, first+count-1, f.g.typ.endOfChain())
+	f.next += count
+	return first, count, nil
+}
+
+// allocate assigns clusters to dir and everything below it.
+func (f *formatter) allocate(dir *node, root bool) error {
+	var err error
+	if !root || f.g.typ == FAT32 {
+		size := int64(dirEntryCount(dir, root, f.label != "")) * dirEntrySize
+		dir.cluster, dir.clusters, err = f.allocateClusters(max(size, 1))
+		if err != nil {
+			return err
+		}
+	}
+	for _, n := range dir.children {
+		if n.dir {
+			err = f.allocate(n, false)
+		} else {
+			n.cluster, n.clusters, err = f.allocateClusters(n.size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shortEntry(short [11]byte, attr byte, cluster uint32, size uint32, modTime time.Time) []byte {
+	e := make([]byte, dirEntrySize)
+	copy(e, short[:])
+	e[11] = attr
+	le := binary.LittleEndian
+	date, tim := dosTime(modTime)
+	le.PutUint16(e[14:], tim)
+	le.PutUint16(e[16:], date)
+	le.PutUint16(e[18:], date)
+	le.PutUint16(e[20:], uint16(cluster>>16))
+	le.PutUint16(e[22:], tim)
+	le.PutUint16(e[24:], date)
+	le.PutUint16(e[26:], uint16(cluster))
+	le.PutUint32(e[28:], size)
+	return e
+}
+
+func (f *formatter) dirData(dir, parent *node) []byte {
+	var b []byte
+	if parent == nil {
+		if f.label != "" {
+			var label [11]byte
+			copy(label[:], fmt.Sprintf("%-11s", f.label))
+			b = append(b, shortEntry(label, attrVolumeID, 0, 0, time.Time{})...)
+		}
+	} else {
+		parentCluster := parent.cluster
+		if parent.path == "." {
+			// ".." refers to the root directory with cluster 0, even on FAT32.
+			parentCluster = 0
+		}
+		b = append(b, shortEntry([11]byte([]byte(".          ")), attrDirectory, dir.cluster, 0, dir.modTime)...)
+		b = append(b, shortEntry([11]byte([]byte("..         ")), attrDirectory, parentCluster, 0, parent.modTime)...)
+	}
+	for _, n := range dir.children {
+		if n.long {
+			b = append(b, longNameEntries(n.name, n.short)...)
+		}
+		attr := byte(attrArchive)
+		size := uint32(n.size)
+		if n.dir {
+			attr, size = attrDirectory, 0
+		}
+		if n.mode.Perm()&0o222 == 0 {
+			attr |= attrReadOnly
+		}
+		b = append(b, shortEntry(n.short, attr, n.cluster, size, n.modTime)...)
+	}
+	return b
+}
+
+func (f *formatter) writeTree(dir, parent *node) error {
+	data := f.dirData(dir, parent)
+	if parent == nil && f.g.typ != FAT32 {
+		buf := make([]byte, int64(f.g.rootSectors())*int64(f.g.sectorSize))
+		copy(buf, data)
+		if _, err := f.w.WriteAt(buf, f.g.rootOffset()); err != nil {
+			return err
+		}
+	} else {
+		buf := make([]byte, int64(dir.clusters)*f.g.clusterSize())
+		copy(buf, data)
+		if _, err := f.w.WriteAt(buf, f.g.clusterOffset(dir.cluster)); err != nil {
+			return err
+		}
+	}
+	for _, n := range dir.children {
+		var err error
+		if n.dir {
+			err = f.writeTree(n, dir)
+		} else {
+			err = f.writeFile(n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *formatter) writeFile(n *node) error {
+	if n.size == 0 {
+		return nil
+	}
+	src, err := f.fsys.Open(n.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	off := f.g.clusterOffset(n.cluster)
+	w := io.NewOffsetWriter(f.w, off)
+	copied, err := io.Copy(w, io.LimitReader(src, n.size))
+	if err != nil {
+		return err
+	}
+	if copied != n.size {
+		return fmt.Errorf("fat: %s: file changed size while copying", n.path)
+	}
+	// clear the rest of the last cluster.
+	if pad := int64(n.clusters)*f.g.clusterSize() - n.size; pad > 0 {
+		if _, err := f.w.WriteAt(make([]byte, pad), off+n.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *formatter) writeBootSectors(volumeID uint32) error {
+	g := f.g
+	le := binary.LittleEndian
+	b := make([]byte, int64(g.reservedSectors)*int64(g.sectorSize))
+	boot := b[:g.sectorSize]
+	copy(boot, []byte{0xeb, 0x3c, 0x90})
+	copy(boot[3:], "MSWIN4.1")
+	le.PutUint16(boot[11:], uint16(g.sectorSize))
+	boot[13] = byte(g.sectorsPerCluster)
+	le.PutUint16(boot[14:], uint16(g.reservedSectors))
+	boot[16] = byte(g.numFATs)
+	le.PutUint16(boot[17:], uint16(g.rootEntries))
+	if g.totalSectors < 0x10000 && g.typ != FAT32 {
+		le.PutUint16(boot[19:], uint16(g.totalSectors))
+	} else {
+		le.PutUint32(boot[32:], g.totalSectors)
+	}
+	boot[21] = 0xf8 // fixed disk
+	le.PutUint16(boot[24:], 63)
+	le.PutUint16(boot[26:], 255)
+
+	label := "NO NAME"
+	if f.label != "" {
+		label = f.label
+	}
+	ext := boot[36:]
+	if g.typ == FAT32 {
+		boot[1] = 0x58
+		le.PutUint32(boot[36:], g.fatSectors)
+		le.PutUint32(boot[44:], g.rootCluster)
+		le.PutUint16(boot[48:], 1) // FSInfo sector
+		le.PutUint16(boot[50:], 6) // backup boot sector
+		ext = boot[64:]
+	} else {
+		le.PutUint16(boot[22:], uint16(g.fatSectors))
+	}
+	ext[0] = 0x80 // drive number
+	ext[2] = 0x29 // extended boot signature
+	le.PutUint32(ext[3:], volumeID)
+	copy(ext[7:18], fmt.Sprintf("%-11s", label))
+	copy(ext[18:26], fmt.Sprintf("%-8s", g.typ.String()))
+	boot[510], boot[511] = 0x55, 0xaa
+
+	if g.typ == FAT32 {
+		info := b[g.sectorSize : 2*g.sectorSize]
+		le.PutUint32(info[0:], 0x41615252)
+		le.PutUint32(info[484:], 0x61417272)
+		le.PutUint32(info[488:], g.clusters-(f.next-2))
+		le.PutUint32(info[492:], f.next)
+		le.PutUint32(info[508:], 0xaa550000)
+		copy(b[6*g.sectorSize:9*g.sectorSize], b[:3*g.sectorSize])
+	}
+	_, err := f.w.WriteAt(b, 0)
+	return err
+}
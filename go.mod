@@ -6,6 +6,5 @@ require (
 	github.com/Code-Hex/go-infinity-channel v1.0.0
 	golang.org/x/crypto v0.46.0
 	golang.org/x/mod v0.22.0
+	golang.org/x/sys v0.39.0
 )
-
-require golang.org/x/sys v0.39.0 // indirect
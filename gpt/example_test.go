@@ -0,0 +1,53 @@
+package gpt_test
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/Code-Hex/vz/v3/gpt"
+)
+
+// This example partitions a blank disk image for an EFIBootLoader guest:
+// an EFI System Partition and a Linux root partition taking the rest.
+func Example() {
+	path := filepath.Join(os.TempDir(), "gpt-example.img")
+	defer os.Remove(path)
+
+	const size = 1 << 30
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		log.Fatal(err)
+	}
+	f.Close()
+
+	table, err := gpt.New(size, 512)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := table.Add(gpt.TypeEFISystem, "EFI System Partition", 100<<20); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := table.Add(gpt.TypeLinuxRootARM64, "root", 0); err != nil {
+		log.Fatal(err)
+	}
+	if err := table.WriteFile(path); err != nil {
+		log.Fatal(err)
+	}
+
+	table, err = gpt.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range table.Partitions {
+		offset, size := table.Bounds(&p)
+		fmt.Printf("%d %s offset=%d size=%d\n", p.Number, p.Name, offset, size)
+	}
+	// Output:
+	// 1 EFI System Partition offset=1048576 size=104857600
+	// 2 root offset=105906176 size=967818752
+}
@@ -0,0 +1,174 @@
+// Package gpt reads and writes GUID Partition Tables on raw disk images.
+package gpt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+var (
+	// ErrNotFound is returned by Read when the disk has no GUID Partition Table.
+	ErrNotFound = errors.New("gpt: no GUID partition table found")
+
+	// ErrCorrupt is returned by Read when both the primary and the backup
+	// tables are damaged.
+	ErrCorrupt = errors.New("gpt: corrupt GUID partition table")
+
+	// ErrDoesNotFit is returned when a partition does not fit into the usable
+	// area of the disk.
+	ErrDoesNotFit = errors.New("gpt: partition does not fit on the disk")
+)
+
+// GUID is a globally unique identifier. The bytes are stored in the order
+// they appear in the string form, not in the mixed-endian order used on disk.
+type GUID [16]byte
+
+// ParseGUID parses a GUID in the form "C12A7328-F81F-11D2-BA4B-00A0C93EC93B".
+// Upper and lower case letters are accepted.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return g, fmt.Errorf("gpt: invalid GUID %q", s)
+	}
+	src := []byte(s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:36])
+	if _, err := hex.Decode(g[:], src); err != nil {
+		return GUID{}, fmt.Errorf("gpt: invalid GUID %q", s)
+	}
+	return g, nil
+}
+
+// MustParseGUID is like ParseGUID but panics if s can not be parsed.
+func MustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// NewGUID returns a random version 4 GUID.
+func NewGUID() GUID {
+	var g GUID
+	rand.Read(g[:])
+	g[6] = g[6]&0x0f | 0x40
+	g[8] = g[8]&0x3f | 0x80
+	return g
+}
+
+// IsZero reports whether g is the all-zero GUID, which marks an unused
+// partition entry.
+func (g GUID) IsZero() bool { return g == GUID{} }
+
+// String returns g in the form "C12A7328-F81F-11D2-BA4B-00A0C93EC93B".
+func (g GUID) String() string {
+	var b [36]byte
+	hex.Encode(b[0:8], g[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], g[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], g[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], g[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:36], g[10:16])
+	for i, c := range b {
+		if c >= 'a' && c <= 'f' {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	return string(b[:])
+}
+
+// decodeGUID reads a GUID in the mixed-endian order used on disk.
+func decodeGUID(b []byte) GUID {
+	var g GUID
+	binary.BigEndian.PutUint32(g[0:], binary.LittleEndian.Uint32(b[0:]))
+	binary.BigEndian.PutUint16(g[4:], binary.LittleEndian.Uint16(b[4:]))
+	binary.BigEndian.PutUint16(g[6:], binary.LittleEndian.Uint16(b[6:]))
+	copy(g[8:], b[8:16])
+	return g
+}
+
+// encode writes g in the mixed-endian order used on disk.
+func (g GUID) encode(b []byte) {
+	binary.LittleEndian.PutUint32(b[0:], binary.BigEndian.Uint32(g[0:]))
+	binary.LittleEndian.PutUint16(b[4:], binary.BigEndian.Uint16(g[4:]))
+	binary.LittleEndian.PutUint16(b[6:], binary.BigEndian.Uint16(g[6:]))
+	copy(b[8:16], g[8:])
+}
+
+// Partition is an entry of the partition table.
+type Partition struct {
+	// Number is the 1-based index of the entry in the partition array.
+	// Linux names the partition after it, e.g. /dev/vda1.
+	Number int
+
+	Type     GUID
+	ID       GUID
+	FirstLBA uint64
+	LastLBA  uint64
+
+	// Attributes is the attribute flags of the partition.
+	Attributes uint64
+
+	// Name is the name of the partition, at most 36 UTF-16 code units.
+	Name string
+}
+
+// HasAttributes reports whether all of attrs are set on the partition.
+func (p *Partition) HasAttributes(attrs uint64) bool { return p.Attributes&attrs == attrs }
+
+// Sectors returns the number of sectors of the partition.
+func (p *Partition) Sectors() uint64 { return p.LastLBA - p.FirstLBA + 1 }
+
+const (
+	entryNameOffset = 56
+	entryNameLen    = 36 // in UTF-16 code units
+)
+
+func validName(name string) error {
+	if n := len(utf16.Encode([]rune(name))); n > entryNameLen {
+		return fmt.Errorf("gpt: partition name %q is %d UTF-16 code units long, the limit is %d", name, n, entryNameLen)
+	}
+	return nil
+}
+
+func decodeEntry(b []byte) Partition {
+	le := binary.LittleEndian
+	name := make([]uint16, 0, entryNameLen)
+	for i := range entryNameLen {
+		c := le.Uint16(b[entryNameOffset+i*2:])
+		if c == 0 {
+			break
+		}
+		name = append(name, c)
+	}
+	return Partition{
+		Type:       decodeGUID(b[0:]),
+		ID:         decodeGUID(b[16:]),
+		FirstLBA:   le.Uint64(b[32:]),
+		LastLBA:    le.Uint64(b[40:]),
+		Attributes: le.Uint64(b[48:]),
+		Name:       string(utf16.Decode(name)),
+	}
+}
+
+func (p *Partition) encode(b []byte) {
+	le := binary.LittleEndian
+	clear(b)
+	p.Type.encode(b[0:])
+	p.ID.encode(b[16:])
+	le.PutUint64(b[32:], p.FirstLBA)
+	le.PutUint64(b[40:], p.LastLBA)
+	le.PutUint64(b[48:], p.Attributes)
+	for i, c := range utf16.Encode([]rune(p.Name)) {
+		if i == entryNameLen {
+			break
+		}
+		le.PutUint16(b[entryNameOffset+i*2:], c)
+	}
+}
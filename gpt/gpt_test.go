@@ -0,0 +1,231 @@
+package gpt_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/gpt"
+)
+
+var (
+	typeLinux = gpt.GUID{0x0f, 0xc6, 0x3d, 0xaf, 0x84, 0x83, 0x47, 0x72, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+	typeESP   = gpt.GUID{0xc1, 0x2a, 0x73, 0x28, 0xf8, 0x1f, 0x11, 0xd2, 0xba, 0x4b, 0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b}
+)
+
+func testTable(sectorSize int, diskSize int64) *gpt.Table {
+	entrySectors := uint64(128 * 128 / sectorSize)
+	last := uint64(diskSize/int64(sectorSize)) - 2 - entrySectors
+	return &gpt.Table{
+		SectorSize:     sectorSize,
+		DiskGUID:       gpt.GUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		FirstUsableLBA: 2 + entrySectors,
+		LastUsableLBA:  last,
+		NumEntries:     128,
+		Partitions: []gpt.Partition{
+			{Number: 1, Type: typeESP, ID: gpt.GUID{0xaa}, FirstLBA: 2 + entrySectors, LastLBA: 2 + entrySectors + 99, Name: "EFI System"},
+			{Number: 3, Type: typeLinux, ID: gpt.GUID{0xbb}, FirstLBA: 2 + entrySectors + 100, LastLBA: last, Attributes: 1 << 60, Name: "ルート"},
+		},
+	}
+}
+
+func createDisk(t *testing.T, size int64) *os.File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, sectorSize := range []int{512, 4096} {
+		const size = 8 << 20
+		f := createDisk(t, size)
+		want := testTable(sectorSize, size)
+		if err := want.Write(f, size); err != nil {
+			t.Fatal(err)
+		}
+		got, err := gpt.Read(f, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("want %+v but got %+v", want, got)
+		}
+
+		// damage the primary header, the backup must be used.
+		if _, err := f.WriteAt([]byte{0xff}, int64(sectorSize)+20); err != nil {
+			t.Fatal(err)
+		}
+		got, err = gpt.Read(f, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want.Partitions, got.Partitions) {
+			t.Fatalf("want %+v but got %+v", want.Partitions, got.Partitions)
+		}
+	}
+}
+
+func TestReadCorrupt(t *testing.T) {
+	const size = 8 << 20
+	f := createDisk(t, size)
+	if _, err := gpt.Read(f, size); !errors.Is(err, gpt.ErrNotFound) {
+		t.Fatalf("want ErrNotFound but got %v", err)
+	}
+	if err := testTable(512, size).Write(f, size); err != nil {
+		t.Fatal(err)
+	}
+	// damage both partition arrays.
+	for _, off := range []int64{2 * 512, size - 33*512} {
+		if _, err := f.WriteAt([]byte{0xff}, off+100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := gpt.Read(f, size); !errors.Is(err, gpt.ErrCorrupt) {
+		t.Fatalf("want ErrCorrupt but got %v", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	const size = 8 << 20
+	table := testTable(512, size)
+	if err := table.Resize(16 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(16<<20/512) - 34; table.LastUsableLBA != want {
+		t.Fatalf("want last usable LBA %d but got %d", want, table.LastUsableLBA)
+	}
+	if err := table.Resize(4 << 20); !errors.Is(err, gpt.ErrDoesNotFit) {
+		t.Fatalf("want ErrDoesNotFit but got %v", err)
+	}
+}
+
+func TestWriteInvalid(t *testing.T) {
+	const size = 8 << 20
+	cases := []struct {
+		name   string
+		modify func(*gpt.Table)
+	}{
+		{name: "overlap", modify: func(t *gpt.Table) { t.Partitions[1].FirstLBA = t.Partitions[0].LastLBA }},
+		{name: "duplicate number", modify: func(t *gpt.Table) { t.Partitions[1].Number = 1 }},
+		{name: "beyond usable area", modify: func(t *gpt.Table) { t.Partitions[1].LastLBA++ }},
+		{name: "no type", modify: func(t *gpt.Table) { t.Partitions[0].Type = gpt.GUID{} }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			table := testTable(512, size)
+			tc.modify(table)
+			if err := table.Write(createDisk(t, size), size); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
+
+func TestGUIDString(t *testing.T) {
+	if got, want := typeESP.String(), "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"; got != want {
+		t.Fatalf("want %s but got %s", want, got)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	const size = 64 << 20
+	f := createDisk(t, size)
+	table, err := gpt.New(size, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	esp, err := table.Add(gpt.TypeEFISystem, "EFI System Partition", 16<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := table.Add(gpt.TypeLinuxRootARM64, "root", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Attributes |= gpt.AttrGrowFileSystem
+
+	if esp.Number != 1 || esp.FirstLBA != 2048 || esp.LastLBA != 2048+16<<20/512-1 {
+		t.Fatalf("unexpected ESP %+v", esp)
+	}
+	if root.Number != 2 || root.FirstLBA != esp.LastLBA+1 || root.LastLBA != table.LastUsableLBA {
+		t.Fatalf("unexpected root partition %+v", root)
+	}
+	if offset, size := table.Bounds(esp); offset != 1<<20 || size != 16<<20 {
+		t.Fatalf("want ESP at 1 MiB with 16 MiB but got %d, %d", offset, size)
+	}
+	if _, err := table.Add(gpt.TypeLinuxSwap, "swap", 1<<20); !errors.Is(err, gpt.ErrDoesNotFit) {
+		t.Fatalf("want ErrDoesNotFit but got %v", err)
+	}
+
+	if err := table.Write(f, size); err != nil {
+		t.Fatal(err)
+	}
+	got, err := gpt.Read(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(table.Partitions, got.Partitions) {
+		t.Fatalf("want %+v but got %+v", table.Partitions, got.Partitions)
+	}
+	if !got.Partition(2).HasAttributes(gpt.AttrGrowFileSystem) {
+		t.Fatal("want grow file system attribute")
+	}
+
+	mbr := make([]byte, 512)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if mbr[446+4] != 0xee || mbr[510] != 0x55 || mbr[511] != 0xaa {
+		t.Fatal("want protective MBR")
+	}
+
+	// the number of a removed partition is reused.
+	if err := table.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	p, err := table.Add(gpt.TypeMicrosoftBasicData, "data", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Number != 1 || p.FirstLBA != 2048 {
+		t.Fatalf("unexpected partition %+v", p)
+	}
+}
+
+func TestAddInvalidName(t *testing.T) {
+	table, err := gpt.New(8<<20, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Add(gpt.TypeLinuxFilesystem, "a name longer than thirty-six characters", 0); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+func TestParseGUID(t *testing.T) {
+	g, err := gpt.ParseGUID("c12a7328-f81f-11d2-ba4b-00a0c93ec93b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g != typeESP || g != gpt.TypeEFISystem {
+		t.Fatalf("want %s but got %s", typeESP, g)
+	}
+	for _, s := range []string{"", "C12A7328F81F11D2BA4B00A0C93EC93B", "C12A7328-F81F-11D2-BA4B-00A0C93EC93G"} {
+		if _, err := gpt.ParseGUID(s); err == nil {
+			t.Errorf("want error for %q", s)
+		}
+	}
+	g = gpt.NewGUID()
+	if g[6]>>4 != 4 || g[8]>>6 != 2 {
+		t.Fatalf("want version 4 GUID but got %s", g)
+	}
+}
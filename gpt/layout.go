@@ -0,0 +1,134 @@
+package gpt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Partition returns the partition with the given number, or nil if there is none.
+func (t *Table) Partition(number int) *Partition {
+	for i := range t.Partitions {
+		if t.Partitions[i].Number == number {
+			return &t.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// Bounds returns the offset and the size in bytes of p on the disk.
+func (t *Table) Bounds(p *Partition) (offset, size int64) {
+	ss := int64(t.SectorSize)
+	return int64(p.FirstLBA) * ss, int64(p.Sectors()) * ss
+}
+
+// Add adds a partition of size bytes with the given type and name, and
+// returns it. The partition gets the lowest free number and a random ID.
+//
+// The partition is placed at the first free space which can hold it, with
+// its start aligned to Alignment. The size is rounded up to whole sectors.
+// If size is zero, the partition takes the largest free space.
+func (t *Table) Add(typ GUID, name string, size int64) (*Partition, error) {
+	if typ.IsZero() {
+		return nil, fmt.Errorf("gpt: partition type must not be zero")
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("gpt: invalid partition size %d", size)
+	}
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	number := t.freeNumber()
+	if number == 0 {
+		return nil, fmt.Errorf("gpt: all %d partition entries are used", t.NumEntries)
+	}
+
+	ss := uint64(t.SectorSize)
+	sectors := (uint64(size) + ss - 1) / ss
+	var first, last uint64
+	found := false
+	for _, gap := range t.freeSpace() {
+		start := t.align(gap[0])
+		if start > gap[1] {
+			continue
+		}
+		if size == 0 {
+			if !found || gap[1]-start > last-first {
+				first, last, found = start, gap[1], true
+			}
+			continue
+		}
+		if gap[1]-start+1 >= sectors {
+			first, last, found = start, start+sectors-1, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: no free space for %d bytes", ErrDoesNotFit, size)
+	}
+	t.Partitions = append(t.Partitions, Partition{
+		Number:   number,
+		Type:     typ,
+		ID:       NewGUID(),
+		FirstLBA: first,
+		LastLBA:  last,
+		Name:     name,
+	})
+	sort.Slice(t.Partitions, func(i, j int) bool {
+		return t.Partitions[i].Number < t.Partitions[j].Number
+	})
+	return t.Partition(number), nil
+}
+
+// Remove removes the partition with the given number. The numbers of the
+// other partitions are not changed.
+func (t *Table) Remove(number int) error {
+	for i, p := range t.Partitions {
+		if p.Number == number {
+			t.Partitions = append(t.Partitions[:i], t.Partitions[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("gpt: partition %d not found", number)
+}
+
+func (t *Table) freeNumber() int {
+	used := make(map[int]bool, len(t.Partitions))
+	for _, p := range t.Partitions {
+		used[p.Number] = true
+	}
+	for n := 1; n <= int(t.NumEntries); n++ {
+		if !used[n] {
+			return n
+		}
+	}
+	return 0
+}
+
+// freeSpace returns the ranges of unpartitioned LBAs in ascending order.
+func (t *Table) freeSpace() [][2]uint64 {
+	parts := make([]Partition, len(t.Partitions))
+	copy(parts, t.Partitions)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].FirstLBA < parts[j].FirstLBA })
+	var free [][2]uint64
+	next := t.FirstUsableLBA
+	for _, p := range parts {
+		if p.FirstLBA > next {
+			free = append(free, [2]uint64{next, p.FirstLBA - 1})
+		}
+		next = max(next, p.LastLBA+1)
+	}
+	if next <= t.LastUsableLBA {
+		free = append(free, [2]uint64{next, t.LastUsableLBA})
+	}
+	return free
+}
+
+// align rounds lba up to the partition alignment.
+func (t *Table) align(lba uint64) uint64 {
+	alignment := t.Alignment
+	if alignment <= 0 {
+		alignment = DefaultAlignment
+	}
+	n := max(uint64(alignment)/uint64(t.SectorSize), 1)
+	return (lba + n - 1) / n * n
+}
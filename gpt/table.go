@@ -0,0 +1,428 @@
+package gpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	signature      = "EFI PART"
+	revision       = 0x00010000
+	headerSize     = 92
+	entrySize      = 128
+	defaultEntries = 128
+
+	// maxEntryArraySize limits the partition array read from a disk.
+	maxEntryArraySize = 1 << 20
+)
+
+// Table is a GUID Partition Table.
+type Table struct {
+	// SectorSize is the logical sector size of the disk, 512 or 4096.
+	SectorSize int
+
+	DiskGUID       GUID
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+
+	// Partitions is the used entries of the partition array ordered
+	// by Number.
+	Partitions []Partition
+
+	// NumEntries is the number of entries in the partition array.
+	NumEntries uint32
+
+	// Alignment is the alignment in bytes of the partitions created by Add.
+	// If it is zero, partitions are aligned to 1 MiB.
+	Alignment int64
+
+	entrySize  uint32
+	entriesLBA uint64
+}
+
+// DefaultAlignment is the partition alignment used when Table.Alignment is zero.
+const DefaultAlignment = 1 << 20
+
+// New returns an empty partition table for a disk of diskSize bytes with
+// a random disk GUID. sectorSize is the logical sector size of the disk,
+// 512 or 4096. Virtualization.framework uses 512 byte sectors for disk images.
+func New(diskSize int64, sectorSize int) (*Table, error) {
+	if sectorSize != 512 && sectorSize != 4096 {
+		return nil, fmt.Errorf("gpt: unsupported sector size %d", sectorSize)
+	}
+	t := &Table{
+		SectorSize: sectorSize,
+		DiskGUID:   NewGUID(),
+		NumEntries: defaultEntries,
+		entrySize:  entrySize,
+		entriesLBA: 2,
+	}
+	t.FirstUsableLBA = t.entriesLBA + t.entrySectors()
+	if err := t.Resize(diskSize); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ReadFile reads the partition table of the raw disk image at path.
+func ReadFile(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return Read(f, fi.Size())
+}
+
+// WriteFile writes t to the raw disk image at path, which must already have
+// the size of the disk.
+func (t *Table) WriteFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := t.Write(f, fi.Size()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+type header struct {
+	myLBA          uint64
+	alternateLBA   uint64
+	firstUsableLBA uint64
+	lastUsableLBA  uint64
+	diskGUID       GUID
+	entriesLBA     uint64
+	numEntries     uint32
+	entrySize      uint32
+	entriesCRC     uint32
+}
+
+// Read reads the partition table of a disk of diskSize bytes from r.
+// The primary table is used unless it is damaged, in which case the backup
+// table at the end of the disk is used.
+//
+// Read returns ErrNotFound if the disk has no GUID Partition Table.
+func Read(r io.ReaderAt, diskSize int64) (*Table, error) {
+	var firstErr error
+	for _, sectorSize := range []int{512, 4096} {
+		if diskSize < int64(3*sectorSize) || diskSize%int64(sectorSize) != 0 {
+			continue
+		}
+		sector := make([]byte, sectorSize)
+		if _, err := r.ReadAt(sector, int64(sectorSize)); err != nil {
+			return nil, err
+		}
+		if string(sector[:8]) != signature {
+			continue
+		}
+		lastLBA := uint64(diskSize/int64(sectorSize)) - 1
+		t, err := readTable(r, sectorSize, 1, lastLBA)
+		if err == nil {
+			return t, nil
+		}
+		firstErr = err
+		// the primary table is damaged, try the backup table.
+		if t, err := readTable(r, sectorSize, lastLBA, lastLBA); err == nil {
+			return t, nil
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrNotFound
+}
+
+func readTable(r io.ReaderAt, sectorSize int, lba, lastLBA uint64) (*Table, error) {
+	sector := make([]byte, sectorSize)
+	if _, err := r.ReadAt(sector, int64(lba)*int64(sectorSize)); err != nil {
+		return nil, err
+	}
+	h, err := parseHeader(sector, lba, lastLBA)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]byte, int(h.numEntries)*int(h.entrySize))
+	if _, err := r.ReadAt(entries, int64(h.entriesLBA)*int64(sectorSize)); err != nil {
+		return nil, fmt.Errorf("%w: reading partition entries: %w", ErrCorrupt, err)
+	}
+	if crc32.ChecksumIEEE(entries) != h.entriesCRC {
+		return nil, fmt.Errorf("%w: partition entries checksum mismatch", ErrCorrupt)
+	}
+	t := &Table{
+		SectorSize:     sectorSize,
+		DiskGUID:       h.diskGUID,
+		FirstUsableLBA: h.firstUsableLBA,
+		LastUsableLBA:  h.lastUsableLBA,
+		NumEntries:     h.numEntries,
+		entrySize:      h.entrySize,
+		entriesLBA:     h.entriesLBA,
+	}
+	if lba != 1 {
+		// the backup header points at the backup entries.
+		t.entriesLBA = 2
+	}
+	for i := range int(h.numEntries) {
+		p := decodeEntry(entries[i*int(h.entrySize):])
+		if p.Type.IsZero() {
+			continue
+		}
+		p.Number = i + 1
+		if p.FirstLBA > p.LastLBA || p.FirstLBA < t.FirstUsableLBA || p.LastLBA > t.LastUsableLBA {
+			return nil, fmt.Errorf("%w: partition %d spans LBA %d-%d outside of the usable LBA %d-%d",
+				ErrCorrupt, p.Number, p.FirstLBA, p.LastLBA, t.FirstUsableLBA, t.LastUsableLBA)
+		}
+		t.Partitions = append(t.Partitions, p)
+	}
+	return t, nil
+}
+
+func parseHeader(b []byte, lba, lastLBA uint64) (*header, error) {
+	le := binary.LittleEndian
+	if string(b[:8]) != signature {
+		return nil, fmt.Errorf("%w: missing signature at LBA %d", ErrCorrupt, lba)
+	}
+	size := le.Uint32(b[12:])
+	if size < headerSize || int(size) > len(b) {
+		return nil, fmt.Errorf("%w: invalid header size %d", ErrCorrupt, size)
+	}
+	hdr := bytes.Clone(b[:size])
+	want := le.Uint32(hdr[16:])
+	le.PutUint32(hdr[16:], 0)
+	if crc32.ChecksumIEEE(hdr) != want {
+		return nil, fmt.Errorf("%w: header checksum mismatch at LBA %d", ErrCorrupt, lba)
+	}
+	h := &header{
+		myLBA:          le.Uint64(b[24:]),
+		alternateLBA:   le.Uint64(b[32:]),
+		firstUsableLBA: le.Uint64(b[40:]),
+		lastUsableLBA:  le.Uint64(b[48:]),
+		diskGUID:       decodeGUID(b[56:]),
+		entriesLBA:     le.Uint64(b[72:]),
+		numEntries:     le.Uint32(b[80:]),
+		entrySize:      le.Uint32(b[84:]),
+		entriesCRC:     le.Uint32(b[88:]),
+	}
+	sectorSize := uint64(len(b))
+	arraySize := uint64(h.numEntries) * uint64(h.entrySize)
+	arraySectors := (arraySize + sectorSize - 1) / sectorSize
+	switch {
+	case h.myLBA != lba:
+		return nil, fmt.Errorf("%w: header at LBA %d claims to be at LBA %d", ErrCorrupt, lba, h.myLBA)
+	case h.entrySize < entrySize || h.entrySize&(h.entrySize-1) != 0:
+		return nil, fmt.Errorf("%w: invalid partition entry size %d", ErrCorrupt, h.entrySize)
+	case arraySize > maxEntryArraySize:
+		return nil, fmt.Errorf("%w: too many partition entries %d", ErrCorrupt, h.numEntries)
+	case h.firstUsableLBA > h.lastUsableLBA || h.lastUsableLBA >= lastLBA:
+		return nil, fmt.Errorf("%w: invalid usable LBA %d-%d", ErrCorrupt, h.firstUsableLBA, h.lastUsableLBA)
+	case h.entriesLBA < 2 || h.entriesLBA+arraySectors > lastLBA+1:
+		return nil, fmt.Errorf("%w: partition entries at LBA %d exceed the disk", ErrCorrupt, h.entriesLBA)
+	}
+	return h, nil
+}
+
+// entrySectors returns the number of sectors of the partition array.
+func (t *Table) entrySectors() uint64 {
+	size := uint64(t.NumEntries) * uint64(max(t.entrySize, entrySize))
+	return (size + uint64(t.SectorSize) - 1) / uint64(t.SectorSize)
+}
+
+// LastUsedLBA returns the last LBA used by a partition, or zero if there
+// is no partition.
+func (t *Table) LastUsedLBA() uint64 {
+	var last uint64
+	for _, p := range t.Partitions {
+		last = max(last, p.LastLBA)
+	}
+	return last
+}
+
+// Resize moves the end of the usable area to fit a disk of diskSize bytes,
+// leaving room for the backup table. It returns ErrDoesNotFit if a partition
+// would extend beyond the usable area.
+func (t *Table) Resize(diskSize int64) error {
+	if diskSize%int64(t.SectorSize) != 0 {
+		return fmt.Errorf("gpt: disk size %d is not a multiple of the sector size %d", diskSize, t.SectorSize)
+	}
+	sectors := uint64(diskSize / int64(t.SectorSize))
+	// the backup header and the backup partition array at the end.
+	reserved := 1 + t.entrySectors()
+	if sectors <= t.FirstUsableLBA+reserved {
+		return fmt.Errorf("%w: disk size %d is too small", ErrDoesNotFit, diskSize)
+	}
+	last := sectors - 1 - reserved
+	if used := t.LastUsedLBA(); used > last {
+		return fmt.Errorf("%w: a partition ends at LBA %d but the last usable LBA is %d", ErrDoesNotFit, used, last)
+	}
+	t.LastUsableLBA = last
+	return nil
+}
+
+// Write writes the primary and the backup partition tables of a disk of
+// diskSize bytes to w. The backup table is placed at the end of the disk.
+//
+// If w is also an io.ReaderAt, the MBR in sector 0 is made a protective MBR
+// covering the disk. The boot code of an existing MBR is kept, as are the other
+// partitions of a hybrid MBR.
+func (t *Table) Write(w io.WriterAt, diskSize int64) error {
+	if t.entrySize == 0 {
+		t.entrySize = entrySize
+	}
+	if t.entriesLBA == 0 {
+		t.entriesLBA = 2
+	}
+	if err := t.validate(diskSize); err != nil {
+		return err
+	}
+	ss := int64(t.SectorSize)
+	lastLBA := uint64(diskSize/ss) - 1
+
+	entries := make([]byte, t.entrySectors()*uint64(ss))
+	for _, p := range t.Partitions {
+		p.encode(entries[(p.Number-1)*int(t.entrySize) : p.Number*int(t.entrySize)])
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries[:int(t.NumEntries)*int(t.entrySize)])
+	backupEntriesLBA := lastLBA - t.entrySectors()
+
+	// The backup table is written first, so that an interrupted write
+	// leaves the disk with a valid primary table.
+	if _, err := w.WriteAt(entries, int64(backupEntriesLBA)*ss); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(t.header(lastLBA, 1, backupEntriesLBA, entriesCRC), int64(lastLBA)*ss); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(entries, int64(t.entriesLBA)*ss); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(t.header(1, lastLBA, t.entriesLBA, entriesCRC), ss); err != nil {
+		return err
+	}
+	return t.updateProtectiveMBR(w, lastLBA)
+}
+
+func (t *Table) validate(diskSize int64) error {
+	ss := int64(t.SectorSize)
+	if ss != 512 && ss != 4096 {
+		return fmt.Errorf("gpt: unsupported sector size %d", ss)
+	}
+	if diskSize%ss != 0 {
+		return fmt.Errorf("gpt: disk size %d is not a multiple of the sector size %d", diskSize, ss)
+	}
+	sectors := uint64(diskSize / ss)
+	if t.NumEntries == 0 {
+		return errors.New("gpt: no partition entries")
+	}
+	if uint64(t.NumEntries)*uint64(t.entrySize) > maxEntryArraySize {
+		return fmt.Errorf("gpt: too many partition entries %d", t.NumEntries)
+	}
+	if t.FirstUsableLBA < t.entriesLBA+t.entrySectors() {
+		return fmt.Errorf("gpt: first usable LBA %d overlaps the partition entries", t.FirstUsableLBA)
+	}
+	if sectors < 1+t.entrySectors() || t.LastUsableLBA >= sectors-1-t.entrySectors() {
+		return fmt.Errorf("%w: last usable LBA %d overlaps the backup table", ErrDoesNotFit, t.LastUsableLBA)
+	}
+	if t.FirstUsableLBA > t.LastUsableLBA {
+		return fmt.Errorf("%w: disk size %d is too small", ErrDoesNotFit, diskSize)
+	}
+	parts := make([]Partition, len(t.Partitions))
+	copy(parts, t.Partitions)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].FirstLBA < parts[j].FirstLBA })
+	numbers := make(map[int]bool, len(parts))
+	for i, p := range parts {
+		if err := validName(p.Name); err != nil {
+			return err
+		}
+		switch {
+		case p.Number < 1 || p.Number > int(t.NumEntries):
+			return fmt.Errorf("gpt: invalid partition number %d", p.Number)
+		case numbers[p.Number]:
+			return fmt.Errorf("gpt: duplicate partition number %d", p.Number)
+		case p.Type.IsZero():
+			return fmt.Errorf("gpt: partition %d has no type", p.Number)
+		case p.FirstLBA > p.LastLBA:
+			return fmt.Errorf("gpt: partition %d ends before it starts", p.Number)
+		case p.FirstLBA < t.FirstUsableLBA || p.LastLBA > t.LastUsableLBA:
+			return fmt.Errorf("%w: partition %d spans LBA %d-%d outside of the usable LBA %d-%d",
+				ErrDoesNotFit, p.Number, p.FirstLBA, p.LastLBA, t.FirstUsableLBA, t.LastUsableLBA)
+		case i > 0 && p.FirstLBA <= parts[i-1].LastLBA:
+			return fmt.Errorf("gpt: partition %d overlaps partition %d", p.Number, parts[i-1].Number)
+		}
+		numbers[p.Number] = true
+	}
+	return nil
+}
+
+func (t *Table) header(myLBA, alternateLBA, entriesLBA uint64, entriesCRC uint32) []byte {
+	le := binary.LittleEndian
+	b := make([]byte, t.SectorSize)
+	copy(b, signature)
+	le.PutUint32(b[8:], revision)
+	le.PutUint32(b[12:], headerSize)
+	le.PutUint64(b[24:], myLBA)
+	le.PutUint64(b[32:], alternateLBA)
+	le.PutUint64(b[40:], t.FirstUsableLBA)
+	le.PutUint64(b[48:], t.LastUsableLBA)
+	t.DiskGUID.encode(b[56:])
+	le.PutUint64(b[72:], entriesLBA)
+	le.PutUint32(b[80:], t.NumEntries)
+	le.PutUint32(b[84:], t.entrySize)
+	le.PutUint32(b[88:], entriesCRC)
+	le.PutUint32(b[16:], crc32.ChecksumIEEE(b[:headerSize]))
+	return b
+}
+
+const (
+	mbrPartitionTable = 446
+	mbrTypeProtective = 0xee
+)
+
+// updateProtectiveMBR makes sector 0 a protective MBR covering the disk.
+// Hybrid MBRs are left untouched apart from the size of the protective partition.
+func (t *Table) updateProtectiveMBR(w io.WriterAt, lastLBA uint64) error {
+	r, ok := w.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+	mbr := make([]byte, 512)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return err
+	}
+	size := uint32(min(lastLBA, 0xffffffff))
+	if mbr[510] == 0x55 && mbr[511] == 0xaa {
+		for i := range 4 {
+			entry := mbr[mbrPartitionTable+i*16 : mbrPartitionTable+(i+1)*16]
+			if entry[4] == mbrTypeProtective {
+				binary.LittleEndian.PutUint32(entry[12:], size)
+				_, err := w.WriteAt(mbr[mbrPartitionTable:mbrPartitionTable+64], mbrPartitionTable)
+				return err
+			}
+		}
+	}
+	clear(mbr[mbrPartitionTable:])
+	entry := mbr[mbrPartitionTable:]
+	copy(entry[1:4], []byte{0x00, 0x02, 0x00}) // CHS of LBA 1
+	entry[4] = mbrTypeProtective
+	copy(entry[5:8], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(entry[8:], 1)
+	binary.LittleEndian.PutUint32(entry[12:], size)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	_, err := w.WriteAt(mbr[mbrPartitionTable:], mbrPartitionTable)
+	return err
+}
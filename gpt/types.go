@@ -0,0 +1,67 @@
+package gpt
+
+// Partition types. See the UEFI specification and the Discoverable Partitions
+// Specification of the UAPI group for the Linux types.
+var (
+	// TypeEFISystem is the EFI System Partition, which holds the boot loaders
+	// started by the EFI firmware of an EFIBootLoader guest.
+	TypeEFISystem = MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+
+	// TypeBIOSBoot is the BIOS boot partition used by GRUB on legacy BIOS systems.
+	TypeBIOSBoot = MustParseGUID("21686148-6449-6E6F-744E-656564454649")
+
+	// TypeLinuxFilesystem is a generic Linux file system partition.
+	TypeLinuxFilesystem = MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+
+	// TypeLinuxRootAMD64 is the Linux root file system on x86-64.
+	TypeLinuxRootAMD64 = MustParseGUID("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+
+	// TypeLinuxRootARM64 is the Linux root file system on AArch64.
+	TypeLinuxRootARM64 = MustParseGUID("B921B045-1DF0-41C3-AF44-4C6F280D3FAE")
+
+	// TypeLinuxUsrAMD64 is the Linux /usr file system on x86-64.
+	TypeLinuxUsrAMD64 = MustParseGUID("8484680C-9521-48C6-9C11-B0720656F69E")
+
+	// TypeLinuxUsrARM64 is the Linux /usr file system on AArch64.
+	TypeLinuxUsrARM64 = MustParseGUID("B0E01050-EE5F-4390-949A-9101B17104E9")
+
+	// TypeLinuxHome is the Linux /home file system.
+	TypeLinuxHome = MustParseGUID("933AC7E1-2EB4-4F13-B844-0E14E2AEF915")
+
+	// TypeLinuxSwap is a Linux swap partition.
+	TypeLinuxSwap = MustParseGUID("0657FD6D-A4AB-43C4-84E5-0933C84B4F4F")
+
+	// TypeLinuxLVM is a Linux LVM physical volume.
+	TypeLinuxLVM = MustParseGUID("E6D6D379-F507-44C2-A23C-238F2A3DF928")
+
+	// TypeMicrosoftBasicData is a FAT, exFAT or NTFS data partition.
+	TypeMicrosoftBasicData = MustParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
+
+	// TypeAppleAPFS is an APFS container.
+	TypeAppleAPFS = MustParseGUID("7C3457EF-0000-11AA-AA11-00306543ECAC")
+)
+
+// Partition attributes.
+const (
+	// AttrRequired marks a partition required for the platform to function.
+	AttrRequired uint64 = 1 << 0
+
+	// AttrNoBlockIOProtocol hides the partition from the EFI block I/O protocol.
+	AttrNoBlockIOProtocol uint64 = 1 << 1
+
+	// AttrLegacyBIOSBootable marks the partition bootable by legacy BIOS firmware.
+	AttrLegacyBIOSBootable uint64 = 1 << 2
+
+	// AttrGrowFileSystem asks systemd-growfs to grow the file system to the
+	// size of the partition on boot.
+	AttrGrowFileSystem uint64 = 1 << 59
+
+	// AttrReadOnly mounts the partition read-only.
+	AttrReadOnly uint64 = 1 << 60
+
+	// AttrHidden hides the partition.
+	AttrHidden uint64 = 1 << 62
+
+	// AttrNoAutomount keeps the partition from being mounted automatically.
+	AttrNoAutomount uint64 = 1 << 63
+)
@@ -0,0 +1,97 @@
+package ignition
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Code-Hex/vz/v3/internal/memfs"
+	"github.com/Code-Hex/vz/v3/iso9660"
+)
+
+// Platform IDs for the ignition.platform.id kernel argument.
+const (
+	// PlatformMetal fetches the config from ignition.config.url.
+	PlatformMetal = "metal"
+
+	// PlatformOpenStack reads the config from a config drive.
+	PlatformOpenStack = "openstack"
+)
+
+// ConfigDriveLabel is the volume label of a config drive.
+const ConfigDriveLabel = "config-2"
+
+// configDrivePath is the path of the config in a config drive.
+const configDrivePath = "openstack/latest/user_data"
+
+// WriteConfigDrive writes an ISO 9660 config drive holding c to w. The
+// guest must boot with ignition.platform.id=openstack, see
+// KernelArguments.
+func (c *Config) WriteConfigDrive(w io.Writer) error {
+	b, err := c.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	fsys := memfs.FS{configDrivePath: b}
+	return iso9660.Write(w, fsys, iso9660.WithVolumeLabel(ConfigDriveLabel))
+}
+
+// WriteConfigDriveFile creates a config drive image at path with
+// WriteConfigDrive. The image can be attached with
+// vz.NewDiskImageStorageDeviceAttachment(path, true). If path already
+// exists, WriteConfigDriveFile returns an error satisfying os.IsExist.
+func (c *Config) WriteConfigDriveFile(path string) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	return c.WriteConfigDrive(f)
+}
+
+// DataURL returns c as a data URL, which can be passed to KernelArguments
+// as the config URL. The kernel command line is limited to 2048 bytes on
+// arm64, so this only suits small configs.
+func (c *Config) DataURL() (string, error) {
+	b, err := c.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	return "data:;base64," + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// KernelArguments returns the kernel arguments which make Ignition run on
+// the first boot of a guest on platformID, to be appended to the guest's
+// command line with vz.WithCommandLine. If configURL is not empty,
+// Ignition fetches the config from it.
+func KernelArguments(platformID, configURL string) (string, error) {
+	if platformID == "" || strings.ContainsFunc(platformID, isSpace) {
+		return "", fmt.Errorf("ignition: invalid platform ID %q", platformID)
+	}
+	args := []string{"ignition.firstboot", "ignition.platform.id=" + platformID}
+	if configURL != "" {
+		u, err := url.Parse(configURL)
+		if err != nil {
+			return "", fmt.Errorf("ignition: %w", err)
+		}
+		if !sourceSchemes[u.Scheme] || strings.ContainsFunc(configURL, isSpace) {
+			return "", fmt.Errorf("ignition: invalid config URL %q", configURL)
+		}
+		args = append(args, "ignition.config.url="+configURL)
+	}
+	return strings.Join(args, " "), nil
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
@@ -0,0 +1,195 @@
+// Package ignition generates Ignition configs for Fedora CoreOS and
+// Flatcar guests.
+//
+// A Config is delivered to the guest in one of two ways. WriteConfigDriveFile
+// creates a small disk image in the OpenStack config drive layout, which
+// Ignition reads when the guest boots with ignition.platform.id=openstack.
+// This works with both LinuxBootLoader and EFIBootLoader. Alternatively,
+// with LinuxBootLoader, KernelArguments points Ignition at a config URL,
+// e.g. a URL from DataURL, on the kernel command line.
+package ignition
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SpecVersion is the default Ignition spec version of a Config. It is
+// supported by Fedora CoreOS and Flatcar.
+const SpecVersion = "3.3.0"
+
+// Config is an Ignition config.
+type Config struct {
+	Ignition Ignition `json:"ignition"`
+	Passwd   Passwd   `json:"passwd,omitzero"`
+	Storage  Storage  `json:"storage,omitzero"`
+	Systemd  Systemd  `json:"systemd,omitzero"`
+}
+
+// Ignition is the metadata of a Config.
+type Ignition struct {
+	// Version is the spec version. The default is SpecVersion.
+	Version string `json:"version"`
+}
+
+// Passwd configures users and groups.
+type Passwd struct {
+	Users  []User  `json:"users,omitempty"`
+	Groups []Group `json:"groups,omitempty"`
+}
+
+// User is a user account. Existing users, such as "core", are modified.
+type User struct {
+	Name string `json:"name"`
+
+	// PasswordHash is a crypt(3) password hash.
+	PasswordHash      string   `json:"passwordHash,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	UID               *int     `json:"uid,omitempty"`
+	Gecos             string   `json:"gecos,omitempty"`
+	HomeDir           string   `json:"homeDir,omitempty"`
+	NoCreateHome      bool     `json:"noCreateHome,omitempty"`
+	PrimaryGroup      string   `json:"primaryGroup,omitempty"`
+
+	// Groups are supplementary groups, e.g. "wheel" or "sudo".
+	Groups []string `json:"groups,omitempty"`
+	Shell  string   `json:"shell,omitempty"`
+}
+
+// Group is a group.
+type Group struct {
+	Name         string `json:"name"`
+	GID          *int   `json:"gid,omitempty"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+	System       bool   `json:"system,omitempty"`
+}
+
+// Storage configures files, directories and links.
+type Storage struct {
+	Files       []File      `json:"files,omitempty"`
+	Directories []Directory `json:"directories,omitempty"`
+	Links       []Link      `json:"links,omitempty"`
+}
+
+// Node holds the fields common to files, directories and links.
+type Node struct {
+	// Path is the absolute path in the guest.
+	Path string `json:"path"`
+
+	// Overwrite replaces an existing node at Path.
+	Overwrite *bool     `json:"overwrite,omitempty"`
+	User      *NodeUser `json:"user,omitempty"`
+	Group     *NodeUser `json:"group,omitempty"`
+}
+
+// NodeUser is the owning user or group of a node, by ID or by name.
+type NodeUser struct {
+	ID   *int   `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// File is a regular file.
+type File struct {
+	Node
+
+	// Contents replaces the contents of the file. If it is nil the file
+	// is empty, or kept as it is when Overwrite is not set.
+	Contents *Resource `json:"contents,omitempty"`
+
+	// Append is appended to the file.
+	Append []Resource `json:"append,omitempty"`
+
+	// Mode is the permission bits, e.g. 0o644 which is also the default.
+	Mode *int `json:"mode,omitempty"`
+}
+
+// Directory is a directory.
+type Directory struct {
+	Node
+
+	// Mode is the permission bits. The default is 0o755.
+	Mode *int `json:"mode,omitempty"`
+}
+
+// Link is a symbolic or hard link.
+type Link struct {
+	Node
+	Target string `json:"target"`
+	Hard   bool   `json:"hard,omitempty"`
+}
+
+// Resource is the source of file contents.
+type Resource struct {
+	// Source is a URL. Ignition supports the http, https, tftp, s3, gs,
+	// arn and data schemes.
+	Source string `json:"source,omitempty"`
+
+	// Compression is "gzip" if Source is gzip compressed.
+	Compression string `json:"compression,omitempty"`
+
+	Verification Verification `json:"verification,omitzero"`
+}
+
+// Verification verifies fetched resources.
+type Verification struct {
+	// Hash is "sha512-" or "sha256-" followed by the hex digest of the
+	// resource before decompression.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Systemd configures systemd units.
+type Systemd struct {
+	Units []Unit `json:"units,omitempty"`
+}
+
+// Unit is a systemd unit.
+type Unit struct {
+	// Name is the unit name, e.g. "example.service".
+	Name string `json:"name"`
+
+	// Contents replaces the unit file.
+	Contents string `json:"contents,omitempty"`
+
+	// Enabled enables or disables the unit if it is set.
+	Enabled *bool    `json:"enabled,omitempty"`
+	Mask    bool     `json:"mask,omitempty"`
+	Dropins []Dropin `json:"dropins,omitempty"`
+}
+
+// Dropin is a unit drop-in.
+type Dropin struct {
+	// Name is the drop-in file name, e.g. "10-override.conf".
+	Name     string `json:"name"`
+	Contents string `json:"contents,omitempty"`
+}
+
+// MarshalJSON validates c and returns the config as JSON. An empty
+// Ignition.Version is SpecVersion.
+func (c *Config) MarshalJSON() ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	type config Config
+	cfg := config(*c)
+	if cfg.Ignition.Version == "" {
+		cfg.Ignition.Version = SpecVersion
+	}
+	return json.Marshal(&cfg)
+}
+
+// Validate reports whether c is a valid config.
+func (c *Config) Validate() error {
+	if v := c.Ignition.Version; v != "" {
+		var major, minor, patch int
+		if n, _ := fmt.Sscanf(v, "%d.%d.%d", &major, &minor, &patch); n != 3 || major != 3 || fmt.Sprintf("%d.%d.%d", major, minor, patch) != v {
+			return fmt.Errorf("ignition: unsupported spec version %q", v)
+		}
+	}
+	if err := c.Passwd.validate(); err != nil {
+		return err
+	}
+	if err := c.Storage.validate(); err != nil {
+		return err
+	}
+	return c.Systemd.validate()
+}
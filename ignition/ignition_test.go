@@ -0,0 +1,202 @@
+package ignition_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/ignition"
+	"github.com/Code-Hex/vz/v3/iso9660"
+)
+
+func intPtr(v int) *int    { return &v }
+func boolPtr(v bool) *bool { return &v }
+
+func testConfig() *ignition.Config {
+	return &ignition.Config{
+		Passwd: ignition.Passwd{
+			Users: []ignition.User{{
+				Name:              "core",
+				SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA"},
+			}},
+		},
+		Storage: ignition.Storage{
+			Files: []ignition.File{{
+				Node:     ignition.Node{Path: "/etc/hostname", Overwrite: boolPtr(true)},
+				Contents: &ignition.Resource{Source: "data:,vm1"},
+				Mode:     intPtr(0o644),
+			}},
+		},
+		Systemd: ignition.Systemd{
+			Units: []ignition.Unit{{
+				Name:     "hello.service",
+				Enabled:  boolPtr(true),
+				Contents: "[Service]\nExecStart=/usr/bin/echo hello\n",
+			}},
+		},
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	got, err := json.Marshal(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"ignition":{"version":"3.3.0"},` +
+		`"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["ssh-ed25519 AAAA"]}]},` +
+		`"storage":{"files":[{"path":"/etc/hostname","overwrite":true,"contents":{"source":"data:,vm1"},"mode":420}]},` +
+		`"systemd":{"units":[{"name":"hello.service","contents":"[Service]\nExecStart=/usr/bin/echo hello\n","enabled":true}]}}`
+	if string(got) != want {
+		t.Fatalf("want\n%s\nbut got\n%s", want, got)
+	}
+
+	got, err = json.Marshal(&ignition.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"ignition":{"version":"3.3.0"}}`; string(got) != want {
+		t.Fatalf("want %s but got %s", want, got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []ignition.Config{
+		{Ignition: ignition.Ignition{Version: "2.3.0"}},
+		{Ignition: ignition.Ignition{Version: "3.3"}},
+		{Passwd: ignition.Passwd{Users: []ignition.User{{}}}},
+		{Passwd: ignition.Passwd{Users: []ignition.User{{Name: "core"}, {Name: "core"}}}},
+		{Passwd: ignition.Passwd{Groups: []ignition.Group{{}}}},
+		{Storage: ignition.Storage{Files: []ignition.File{{Node: ignition.Node{Path: "etc/hostname"}}}}},
+		{Storage: ignition.Storage{Files: []ignition.File{{Node: ignition.Node{Path: "/etc/../hostname"}}}}},
+		{Storage: ignition.Storage{
+			Files:       []ignition.File{{Node: ignition.Node{Path: "/etc/a"}}},
+			Directories: []ignition.Directory{{Node: ignition.Node{Path: "/etc/a"}}},
+		}},
+		{Storage: ignition.Storage{Files: []ignition.File{{Node: ignition.Node{Path: "/a"}, Mode: intPtr(0o10000)}}}},
+		{Storage: ignition.Storage{Files: []ignition.File{{Node: ignition.Node{Path: "/a"}, Contents: &ignition.Resource{Source: "file:///a"}}}}},
+		{Storage: ignition.Storage{Files: []ignition.File{{Node: ignition.Node{Path: "/a"}, Contents: &ignition.Resource{Compression: "bzip2"}}}}},
+		{Storage: ignition.Storage{Files: []ignition.File{{Node: ignition.Node{Path: "/a"}, Append: []ignition.Resource{{Verification: ignition.Verification{Hash: "sha512-00"}}}}}}},
+		{Storage: ignition.Storage{Files: []ignition.File{{Node: ignition.Node{Path: "/a", User: &ignition.NodeUser{ID: intPtr(0), Name: "root"}}}}}},
+		{Storage: ignition.Storage{Links: []ignition.Link{{Node: ignition.Node{Path: "/a"}}}}},
+		{Storage: ignition.Storage{Links: []ignition.Link{{Node: ignition.Node{Path: "/a"}, Target: "b", Hard: true}}}},
+		{Systemd: ignition.Systemd{Units: []ignition.Unit{{Name: "hello"}}}},
+		{Systemd: ignition.Systemd{Units: []ignition.Unit{{Name: ".service"}}}},
+		{Systemd: ignition.Systemd{Units: []ignition.Unit{{Name: "a.service"}, {Name: "a.service"}}}},
+		{Systemd: ignition.Systemd{Units: []ignition.Unit{{Name: "a.service", Mask: true, Enabled: boolPtr(true)}}}},
+		{Systemd: ignition.Systemd{Units: []ignition.Unit{{Name: "a.service", Dropins: []ignition.Dropin{{Name: "override"}}}}}},
+	}
+	for i, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("config %d: want error", i)
+		}
+	}
+	if err := testConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteConfigDriveFile(t *testing.T) {
+	c := testConfig()
+	path := filepath.Join(t.TempDir(), "config.iso")
+	if err := c.WriteConfigDriveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteConfigDriveFile(path); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("want %v but got %v", os.ErrExist, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fsys, err := iso9660.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fsys.Label(); got != ignition.ConfigDriveLabel {
+		t.Fatalf("want label %q but got %q", ignition.ConfigDriveLabel, got)
+	}
+	got, err := fs.ReadFile(fsys, "openstack/latest/user_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := c.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("want\n%s\nbut got\n%s", want, got)
+	}
+
+	invalid := &ignition.Config{Passwd: ignition.Passwd{Users: []ignition.User{{}}}}
+	path = filepath.Join(t.TempDir(), "invalid.iso")
+	if err := invalid.WriteConfigDriveFile(path); err == nil {
+		t.Fatal("want error")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want %v but got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestKernelArguments(t *testing.T) {
+	c := testConfig()
+	dataURL, err := c.DataURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(dataURL, "data:;base64,"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := c.MarshalJSON(); !bytes.Equal(b, want) {
+		t.Fatalf("want %s but got %s", want, b)
+	}
+
+	cases := []struct {
+		platformID string
+		configURL  string
+		want       string
+	}{
+		{
+			platformID: ignition.PlatformOpenStack,
+			want:       "ignition.firstboot ignition.platform.id=openstack",
+		},
+		{
+			platformID: ignition.PlatformMetal,
+			configURL:  "http://192.168.64.1:8080/config.ign",
+			want:       "ignition.firstboot ignition.platform.id=metal ignition.config.url=http://192.168.64.1:8080/config.ign",
+		},
+		{
+			platformID: ignition.PlatformMetal,
+			configURL:  dataURL,
+			want:       "ignition.firstboot ignition.platform.id=metal ignition.config.url=" + dataURL,
+		},
+	}
+	for _, tc := range cases {
+		got, err := ignition.KernelArguments(tc.platformID, tc.configURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Fatalf("want %q but got %q", tc.want, got)
+		}
+	}
+
+	for _, tc := range [][2]string{
+		{"", ""},
+		{"metal openstack", ""},
+		{ignition.PlatformMetal, "file:///config.ign"},
+		{ignition.PlatformMetal, "http://host/a b.ign"},
+	} {
+		if _, err := ignition.KernelArguments(tc[0], tc[1]); err == nil {
+			t.Errorf("KernelArguments(%q, %q): want error", tc[0], tc[1])
+		}
+	}
+}
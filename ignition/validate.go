@@ -0,0 +1,169 @@
+package ignition
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+func (p *Passwd) validate() error {
+	users := make(map[string]bool)
+	for _, u := range p.Users {
+		if u.Name == "" {
+			return fmt.Errorf("ignition: user name is empty")
+		}
+		if users[u.Name] {
+			return fmt.Errorf("ignition: duplicate user %q", u.Name)
+		}
+		users[u.Name] = true
+		if u.HomeDir != "" && !path.IsAbs(u.HomeDir) {
+			return fmt.Errorf("ignition: user %q: home directory %q is not absolute", u.Name, u.HomeDir)
+		}
+	}
+	groups := make(map[string]bool)
+	for _, g := range p.Groups {
+		if g.Name == "" {
+			return fmt.Errorf("ignition: group name is empty")
+		}
+		if groups[g.Name] {
+			return fmt.Errorf("ignition: duplicate group %q", g.Name)
+		}
+		groups[g.Name] = true
+	}
+	return nil
+}
+
+func (s *Storage) validate() error {
+	paths := make(map[string]bool)
+	node := func(n *Node) error {
+		if !path.IsAbs(n.Path) || path.Clean(n.Path) != n.Path {
+			return fmt.Errorf("ignition: path %q is not a clean absolute path", n.Path)
+		}
+		if paths[n.Path] {
+			return fmt.Errorf("ignition: duplicate path %q", n.Path)
+		}
+		paths[n.Path] = true
+		for _, u := range []*NodeUser{n.User, n.Group} {
+			if u != nil && u.ID != nil && u.Name != "" {
+				return fmt.Errorf("ignition: %s: owner has both an ID and a name", n.Path)
+			}
+		}
+		return nil
+	}
+	for _, f := range s.Files {
+		if err := node(&f.Node); err != nil {
+			return err
+		}
+		if err := validMode(f.Path, f.Mode); err != nil {
+			return err
+		}
+		if f.Contents != nil {
+			if err := f.Contents.validate(f.Path); err != nil {
+				return err
+			}
+		}
+		for _, r := range f.Append {
+			if err := r.validate(f.Path); err != nil {
+				return err
+			}
+		}
+	}
+	for _, d := range s.Directories {
+		if err := node(&d.Node); err != nil {
+			return err
+		}
+		if err := validMode(d.Path, d.Mode); err != nil {
+			return err
+		}
+	}
+	for _, l := range s.Links {
+		if err := node(&l.Node); err != nil {
+			return err
+		}
+		if l.Target == "" {
+			return fmt.Errorf("ignition: %s: link target is empty", l.Path)
+		}
+		if l.Hard && !path.IsAbs(l.Target) {
+			return fmt.Errorf("ignition: %s: hard link target %q is not absolute", l.Path, l.Target)
+		}
+	}
+	return nil
+}
+
+func validMode(p string, mode *int) error {
+	if mode != nil && (*mode < 0 || *mode > 0o7777) {
+		return fmt.Errorf("ignition: %s: invalid mode %#o", p, *mode)
+	}
+	return nil
+}
+
+var sourceSchemes = map[string]bool{
+	"http": true, "https": true, "tftp": true, "s3": true,
+	"gs": true, "arn": true, "data": true,
+}
+
+func (r *Resource) validate(p string) error {
+	if r.Source != "" {
+		u, err := url.Parse(r.Source)
+		if err != nil {
+			return fmt.Errorf("ignition: %s: %w", p, err)
+		}
+		if !sourceSchemes[u.Scheme] {
+			return fmt.Errorf("ignition: %s: unsupported source scheme %q", p, u.Scheme)
+		}
+	}
+	switch r.Compression {
+	case "", "gzip":
+	default:
+		return fmt.Errorf("ignition: %s: unsupported compression %q", p, r.Compression)
+	}
+	if h := r.Verification.Hash; h != "" {
+		sizes := map[string]int{"sha256": 32, "sha512": 64}
+		fn, digest, _ := strings.Cut(h, "-")
+		b, err := hex.DecodeString(digest)
+		if err != nil || sizes[fn] == 0 || len(b) != sizes[fn] {
+			return fmt.Errorf("ignition: %s: invalid verification hash %q", p, h)
+		}
+	}
+	return nil
+}
+
+var unitTypes = []string{
+	".service", ".socket", ".device", ".mount", ".automount", ".swap",
+	".target", ".path", ".timer", ".slice", ".scope",
+}
+
+func (s *Systemd) validate() error {
+	units := make(map[string]bool)
+	for _, u := range s.Units {
+		valid := false
+		for _, typ := range unitTypes {
+			if len(u.Name) > len(typ) && strings.HasSuffix(u.Name, typ) {
+				valid = true
+			}
+		}
+		if !valid || strings.Contains(u.Name, "/") {
+			return fmt.Errorf("ignition: invalid unit name %q", u.Name)
+		}
+		if units[u.Name] {
+			return fmt.Errorf("ignition: duplicate unit %q", u.Name)
+		}
+		units[u.Name] = true
+		if u.Mask && u.Enabled != nil && *u.Enabled {
+			return fmt.Errorf("ignition: unit %q is both masked and enabled", u.Name)
+		}
+		dropins := make(map[string]bool)
+		for _, d := range u.Dropins {
+			if !strings.HasSuffix(d.Name, ".conf") || len(d.Name) == len(".conf") || strings.Contains(d.Name, "/") {
+				return fmt.Errorf("ignition: unit %q: invalid drop-in name %q", u.Name, d.Name)
+			}
+			if dropins[d.Name] {
+				return fmt.Errorf("ignition: unit %q: duplicate drop-in %q", u.Name, d.Name)
+			}
+			dropins[d.Name] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Package compact deallocates the blocks of raw disk images which are not in
+// use, so that the host storage they take can be reclaimed.
+package compact
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/Code-Hex/vz/v3/ext4"
+	"github.com/Code-Hex/vz/v3/fat"
+	"github.com/Code-Hex/vz/v3/gpt"
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+)
+
+// Options is the options of File.
+type Options struct {
+	// FileSystems makes File also deallocate the blocks which the file
+	// systems on the disk image mark as free, even if they still contain
+	// stale data. FAT and ext4 file systems are supported, either on the
+	// whole disk or in GPT partitions.
+	FileSystems bool
+}
+
+// chunkSize is the size of the reads when scanning for zero blocks.
+const chunkSize = 1 << 20
+
+// File punches holes into the raw disk image f for every aligned block of
+// sparse.BlockSize bytes which only contains zeros, so that the content of
+// the disk image does not change unless o.FileSystems is set.
+//
+// The disk image must not be in use while it is compacted.
+func File(ctx context.Context, f *os.File, o *Options) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if o.FileSystems {
+		extents, err := FreeExtents(f, size)
+		if err != nil {
+			return err
+		}
+		for _, e := range extents {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			start := (e.Offset + sparse.BlockSize - 1) &^ (sparse.BlockSize - 1)
+			end := e.End() &^ (sparse.BlockSize - 1)
+			if end > start {
+				if err := sparse.PunchHole(f, start, end-start); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return punchZeros(ctx, f, size)
+}
+
+// punchZeros punches holes for the zero blocks in the data extents of f.
+// A trailing partial block is kept.
+func punchZeros(ctx context.Context, f *os.File, size int64) error {
+	extents, err := sparse.DataExtents(f)
+	if err != nil {
+		return err
+	}
+	size &^= sparse.BlockSize - 1
+	buf := make([]byte, chunkSize)
+	for _, e := range extents {
+		off := e.Offset &^ (sparse.BlockSize - 1)
+		end := min((e.End()+sparse.BlockSize-1)&^(sparse.BlockSize-1), size)
+		hole := int64(-1) // start of the current run of zero blocks
+		for off < end {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n := min(int64(len(buf)), end-off)
+			if _, err := f.ReadAt(buf[:n], off); err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			for i := int64(0); i < n; i += sparse.BlockSize {
+				zero := sparse.IsZero(buf[i : i+sparse.BlockSize])
+				switch {
+				case zero && hole < 0:
+					hole = off + i
+				case !zero && hole >= 0:
+					if err := sparse.PunchHole(f, hole, off+i-hole); err != nil {
+						return err
+					}
+					hole = -1
+				}
+			}
+			off += n
+		}
+		if hole >= 0 {
+			if err := sparse.PunchHole(f, hole, end-hole); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FreeExtents returns the ranges of the raw disk image of size bytes in r
+// which the file systems on it mark as free. Partitions whose file system is
+// unknown or damaged are skipped.
+func FreeExtents(r io.ReaderAt, size int64) ([]sparse.Extent, error) {
+	t, err := gpt.Read(r, size)
+	if errors.Is(err, gpt.ErrNotFound) {
+		return fileSystemFreeExtents(r, 0, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var extents []sparse.Extent
+	for i := range t.Partitions {
+		off, n := t.Bounds(&t.Partitions[i])
+		if off+n > size {
+			continue
+		}
+		e, err := fileSystemFreeExtents(r, off, n)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, e...)
+	}
+	return extents, nil
+}
+
+// fileSystemFreeExtents returns the free extents of the file system of size
+// bytes at off in r, relative to the start of r.
+func fileSystemFreeExtents(r io.ReaderAt, off, size int64) ([]sparse.Extent, error) {
+	sr := io.NewSectionReader(r, off, size)
+	var extents []sparse.Extent
+	switch detect(sr) {
+	case fileSystemExt4:
+		fsys, err := ext4.Open(sr, size)
+		if errors.Is(err, ext4.ErrCorrupt) || errors.Is(err, errors.ErrUnsupported) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		free, err := fsys.FreeExtents()
+		if errors.Is(err, ext4.ErrCorrupt) || errors.Is(err, ext4.ErrNotClean) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range free {
+			extents = append(extents, sparse.Extent{Offset: e.Offset, Length: e.Length})
+		}
+	case fileSystemFAT:
+		fsys, err := fat.Open(sr, size)
+		if errors.Is(err, fat.ErrCorrupt) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range fsys.FreeExtents() {
+			extents = append(extents, sparse.Extent{Offset: e.Offset, Length: e.Length})
+		}
+	}
+	for i := range extents {
+		extents[i].Offset += off
+	}
+	return extents, nil
+}
+
+type fileSystem int
+
+const (
+	fileSystemUnknown fileSystem = iota
+	fileSystemExt4
+	fileSystemFAT
+)
+
+// detect returns the type of the file system in r by its signature.
+func detect(r io.ReaderAt) fileSystem {
+	b := make([]byte, 2048)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return fileSystemUnknown
+	}
+	switch {
+	case b[1024+0x38] == 0x53 && b[1024+0x39] == 0xef:
+		return fileSystemExt4
+	case b[510] != 0x55 || b[511] != 0xaa:
+		return fileSystemUnknown
+	case string(b[54:59]) == "FAT12" || string(b[54:59]) == "FAT16" || string(b[82:87]) == "FAT32":
+		return fileSystemFAT
+	}
+	return fileSystemUnknown
+}
@@ -0,0 +1,182 @@
+package compact_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Code-Hex/vz/v3/fat"
+	"github.com/Code-Hex/vz/v3/gpt"
+	"github.com/Code-Hex/vz/v3/internal/compact"
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+)
+
+// testdata/ext4.img.gz is an 8 MiB ext4 file system with keep.dat, which is
+// "KEEP" repeated, and the blocks of the deleted gone.dat, which still
+// contain "GONE".
+func readExt4(t *testing.T) []byte {
+	t.Helper()
+	f, err := os.Open("testdata/ext4.img.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func allocated(t *testing.T, f *os.File) int64 {
+	t.Helper()
+	n, err := sparse.AllocatedSize(f)
+	if err != nil {
+		t.Skip(err)
+	}
+	return n
+}
+
+func TestFileZeros(t *testing.T) {
+	const size = 4<<20 + 100
+	want := bytes.Repeat([]byte{0xaa}, size)
+	clear(want[sparse.BlockSize : 3*sparse.BlockSize])
+	clear(want[1<<20 : 3<<20+1])
+	clear(want[size-200:])
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, want, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	before := allocated(t, f)
+	if err := compact.File(context.Background(), f, &compact.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("compaction changed the content")
+	}
+	if reclaimed, min := before-allocated(t, f), int64(2*sparse.BlockSize+2<<20-sparse.BlockSize); reclaimed < min {
+		t.Fatalf("want at least %d bytes reclaimed but got %d", min, reclaimed)
+	}
+}
+
+func TestFileFileSystems(t *testing.T) {
+	const size = 16 << 20
+	table, err := gpt.New(size, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := table.Add(gpt.TypeLinuxFilesystem, "root", 8<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	esp, err := table.Add(gpt.TypeEFISystem, "EFI System Partition", 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Write(f, size); err != nil {
+		t.Fatal(err)
+	}
+	rootOff, _ := table.Bounds(root)
+	if _, err := f.WriteAt(readExt4(t), rootOff); err != nil {
+		t.Fatal(err)
+	}
+	espOff, espSize := table.Bounds(esp)
+	src := fstest.MapFS{
+		"EFI/BOOT/BOOTAA64.EFI": {Data: bytes.Repeat([]byte("MZ"), 40000)},
+		"startup.nsh":           {Data: []byte("FS0:\\EFI\\BOOT\\BOOTAA64.EFI\n")},
+	}
+	if err := fat.Format(io.NewOffsetWriter(f, espOff), espSize, src); err != nil {
+		t.Fatal(err)
+	}
+	// leave stale data in the blocks of the free clusters of the FAT file
+	// system. Only whole blocks can be discarded.
+	fsys, err := fat.Open(io.NewSectionReader(f, espOff, espSize), espSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := fsys.FreeExtents()
+	for _, e := range free {
+		start := (espOff + e.Offset + sparse.BlockSize - 1) &^ (sparse.BlockSize - 1)
+		end := (espOff + e.Offset + e.Length) &^ (sparse.BlockSize - 1)
+		if _, err := f.WriteAt(bytes.Repeat([]byte("GONE"), int(end-start)/4), start); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extents, err := compact.FreeExtents(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) <= len(free) {
+		t.Fatalf("want free extents of both file systems but got %d", len(extents))
+	}
+	if err := compact.File(context.Background(), f, &compact.Options{FileSystems: true}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only free blocks may change.
+	for i := range before {
+		if before[i] == after[i] {
+			continue
+		}
+		if j := sparse.FindExtent(extents, int64(i)); j == len(extents) || extents[j].Offset > int64(i) {
+			t.Fatalf("byte %d changed outside of the free extents", i)
+		}
+	}
+	if bytes.Contains(after, []byte("GONE")) {
+		t.Fatal("want the stale data in free blocks discarded")
+	}
+	ext4 := after[rootOff : rootOff+8<<20]
+	if got := bytes.Count(ext4, []byte("KEEP")); got != 64*1024 {
+		t.Fatalf("want keep.dat intact but got %d repetitions", got)
+	}
+	fsys, err = fat.Open(bytes.NewReader(after[espOff:espOff+espSize]), espSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, file := range src {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(file.Data, got) {
+			t.Fatalf("%s: content mismatch", name)
+		}
+	}
+}
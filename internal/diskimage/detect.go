@@ -0,0 +1,223 @@
+package diskimage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Code-Hex/vz/v3/internal/diskimage/qcow2"
+	"github.com/Code-Hex/vz/v3/internal/diskimage/vhdx"
+	"github.com/Code-Hex/vz/v3/internal/diskimage/vmdk"
+)
+
+// Format is the format of a disk image file.
+type Format int
+
+const (
+	FormatRaw Format = 1 + iota
+	FormatISO9660
+	FormatASIF
+	FormatQCOW2
+	FormatVMDK
+	FormatVHDX
+	FormatGzip
+	FormatXz
+	FormatZstd
+	FormatBzip2
+)
+
+// PartitionScheme is the partition table found in a raw disk image.
+type PartitionScheme int
+
+const (
+	PartitionSchemeNone PartitionScheme = iota
+	PartitionSchemeMBR
+	PartitionSchemeGPT
+)
+
+// Info describes a detected disk image.
+type Info struct {
+	Format          Format
+	PartitionScheme PartitionScheme
+
+	// VirtualSize is the size of the disk seen by the guest in bytes,
+	// or zero if it can not be determined without reading the whole file.
+	VirtualSize int64
+}
+
+var (
+	magicASIF  = []byte("shdw")
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicBzip2 = []byte("BZh")
+
+	vmdkDescriptor = []byte("# Disk DescriptorFile")
+	gptSignature   = []byte("EFI PART")
+)
+
+const (
+	isoDescriptorOffset = 16 * 2048
+	isoDescriptorSize   = 2048
+	isoMaxDescriptors   = 16
+
+	// detectSize is the number of bytes needed to detect any format.
+	detectSize = isoDescriptorOffset + isoMaxDescriptors*isoDescriptorSize
+)
+
+// Detect detects the format of the disk image at path by its magic bytes.
+// Any file which is not recognized is reported as FormatRaw.
+func Detect(path string) (*Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, detectSize)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	head = head[:n]
+
+	switch format := magicFormat(head); format {
+	case FormatQCOW2:
+		return &Info{
+			Format:      format,
+			VirtualSize: int64(binary.BigEndian.Uint64(head[24:])),
+		}, nil
+	case FormatVMDK:
+		if !bytes.HasPrefix(head, vmdk.Magic) {
+			return &Info{
+				Format:      format,
+				VirtualSize: vmdkDescriptorSize(head),
+			}, nil
+		}
+		return &Info{
+			Format:      format,
+			VirtualSize: int64(binary.LittleEndian.Uint64(head[12:])) * 512,
+		}, nil
+	case FormatVHDX:
+		info := &Info{Format: format}
+		if img, err := vhdx.Open(path); err == nil {
+			info.VirtualSize = img.Size()
+			img.Close()
+		}
+		return info, nil
+	case FormatASIF, FormatGzip, FormatXz, FormatZstd, FormatBzip2:
+		return &Info{Format: format}, nil
+	}
+
+	info := &Info{
+		Format:          FormatRaw,
+		PartitionScheme: detectPartitionScheme(head),
+		VirtualSize:     fi.Size(),
+	}
+	if isISO9660(head) {
+		info.Format = FormatISO9660
+	}
+	return info, nil
+}
+
+// magicFormat returns the format identified by the magic bytes at the
+// start of head, or FormatRaw if there are none.
+func magicFormat(head []byte) Format {
+	switch {
+	case bytes.HasPrefix(head, qcow2.Magic) && len(head) >= 32:
+		return FormatQCOW2
+	case bytes.HasPrefix(head, vmdk.Magic) && len(head) >= 20:
+		return FormatVMDK
+	case bytes.HasPrefix(head, vmdkDescriptor):
+		return FormatVMDK
+	case bytes.HasPrefix(head, vhdx.Magic):
+		return FormatVHDX
+	case bytes.HasPrefix(head, magicASIF):
+		return FormatASIF
+	case bytes.HasPrefix(head, magicGzip):
+		return FormatGzip
+	case bytes.HasPrefix(head, magicXz):
+		return FormatXz
+	case bytes.HasPrefix(head, magicZstd):
+		return FormatZstd
+	case bytes.HasPrefix(head, magicBzip2) && len(head) > 3 && head[3] >= '1' && head[3] <= '9':
+		return FormatBzip2
+	}
+	return FormatRaw
+}
+
+// vmdkDescriptorSize sums up the extent sizes of a VMDK descriptor file.
+func vmdkDescriptorSize(head []byte) int64 {
+	var sectors int64
+	sc := bufio.NewScanner(bytes.NewReader(head))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[0] {
+		case "RW", "RDONLY", "NOACCESS":
+			n, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			sectors += n
+		}
+	}
+	return sectors * 512
+}
+
+func isISO9660(head []byte) bool {
+	for i := range isoMaxDescriptors {
+		off := isoDescriptorOffset + i*isoDescriptorSize
+		if len(head) < off+isoDescriptorSize {
+			return false
+		}
+		desc := head[off:]
+		if string(desc[1:6]) != "CD001" {
+			return false
+		}
+		switch desc[0] {
+		case 1: // primary volume descriptor
+			return true
+		case 255: // volume descriptor set terminator
+			return false
+		}
+	}
+	return false
+}
+
+func detectPartitionScheme(head []byte) PartitionScheme {
+	for _, sectorSize := range []int{512, 4096} {
+		if len(head) >= 2*sectorSize && bytes.HasPrefix(head[sectorSize:], gptSignature) {
+			return PartitionSchemeGPT
+		}
+	}
+	if len(head) < 512 || head[510] != 0x55 || head[511] != 0xaa {
+		return PartitionSchemeNone
+	}
+	// A FAT or NTFS boot sector carries the same signature, so require
+	// plausible partition entries as well.
+	used := false
+	for i := range 4 {
+		entry := head[446+i*16:]
+		if entry[0] != 0x00 && entry[0] != 0x80 {
+			return PartitionSchemeNone
+		}
+		if entry[4] != 0 {
+			used = true
+		}
+	}
+	if !used {
+		return PartitionSchemeNone
+	}
+	return PartitionSchemeMBR
+}
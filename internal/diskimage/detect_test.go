@@ -0,0 +1,86 @@
+package diskimage_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/diskimage"
+)
+
+func TestDetect(t *testing.T) {
+	qcow2 := make([]byte, 512)
+	copy(qcow2, "QFI\xfb")
+	binary.BigEndian.PutUint64(qcow2[24:], 10<<30)
+
+	vmdk := make([]byte, 512)
+	copy(vmdk, "KDMV")
+	binary.LittleEndian.PutUint64(vmdk[12:], 2048)
+
+	vmdkDescriptor := []byte("# Disk DescriptorFile\nversion=1\n" +
+		"RW 4192256 SPARSE \"disk-s001.vmdk\"\nRW 8192 SPARSE \"disk-s002.vmdk\"\n")
+
+	mbr := make([]byte, 4096)
+	mbr[446] = 0x80
+	mbr[446+4] = 0x83
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	fat := make([]byte, 4096)
+	copy(fat, "\xeb\x3c\x90mkfs.fat")
+	fat[510], fat[511] = 0x55, 0xaa
+
+	gpt := make([]byte, 4096)
+	gpt[446+4] = 0xee
+	gpt[510], gpt[511] = 0x55, 0xaa
+	copy(gpt[512:], "EFI PART")
+
+	iso := make([]byte, 40*2048)
+	copy(iso[16*2048:], "\x00CD001") // boot record
+	copy(iso[17*2048:], "\x01CD001") // primary volume descriptor
+	copy(iso[18*2048:], "\xffCD001")
+
+	cases := []struct {
+		name   string
+		data   []byte
+		want   diskimage.Format
+		scheme diskimage.PartitionScheme
+		size   int64
+	}{
+		{name: "empty raw", data: make([]byte, 8192), want: diskimage.FormatRaw, size: 8192},
+		{name: "mbr", data: mbr, want: diskimage.FormatRaw, scheme: diskimage.PartitionSchemeMBR, size: 4096},
+		{name: "fat boot sector", data: fat, want: diskimage.FormatRaw, size: 4096},
+		{name: "gpt", data: gpt, want: diskimage.FormatRaw, scheme: diskimage.PartitionSchemeGPT, size: 4096},
+		{name: "iso9660", data: iso, want: diskimage.FormatISO9660, size: int64(len(iso))},
+		{name: "qcow2", data: qcow2, want: diskimage.FormatQCOW2, size: 10 << 30},
+		{name: "vmdk", data: vmdk, want: diskimage.FormatVMDK, size: 1 << 20},
+		{name: "vmdk descriptor", data: vmdkDescriptor, want: diskimage.FormatVMDK, size: (4192256 + 8192) * 512},
+		{name: "vhdx", data: []byte("vhdxfile"), want: diskimage.FormatVHDX},
+		{name: "asif", data: []byte("shdw\x00\x00\x00\x01"), want: diskimage.FormatASIF},
+		{name: "gzip", data: []byte{0x1f, 0x8b, 8, 0}, want: diskimage.FormatGzip},
+		{name: "xz", data: []byte("\xfd7zXZ\x00\x00\x04"), want: diskimage.FormatXz},
+		{name: "zstd", data: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x24}, want: diskimage.FormatZstd},
+		{name: "bzip2", data: []byte("BZh91AY&SY"), want: diskimage.FormatBzip2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk")
+			if err := os.WriteFile(path, tc.data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			info, err := diskimage.Detect(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Format != tc.want {
+				t.Errorf("want format %d but got %d", tc.want, info.Format)
+			}
+			if info.PartitionScheme != tc.scheme {
+				t.Errorf("want partition scheme %d but got %d", tc.scheme, info.PartitionScheme)
+			}
+			if info.VirtualSize != tc.size {
+				t.Errorf("want virtual size %d but got %d", tc.size, info.VirtualSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Package diskimage provides read access to the virtual disk stored in
+// disk image formats which Virtualization.framework can not open directly.
+package diskimage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Code-Hex/vz/v3/internal/diskimage/qcow2"
+	"github.com/Code-Hex/vz/v3/internal/diskimage/vhdx"
+	"github.com/Code-Hex/vz/v3/internal/diskimage/vmdk"
+)
+
+// ErrUnsupportedFormat is returned when the format of a disk image is not
+// supported by Open.
+var ErrUnsupportedFormat = errors.New("unsupported disk image format")
+
+// Image is a read-only view of the virtual disk stored in a disk image.
+type Image interface {
+	io.ReaderAt
+	io.Closer
+
+	// Size returns the virtual size of the disk in bytes.
+	Size() int64
+}
+
+// Options configures how a disk image is opened.
+type Options struct {
+	// NoBackingFile makes Open fail if the disk image refers to
+	// a backing file.
+	NoBackingFile bool
+}
+
+// Open opens the disk image at path.
+func Open(path string, opts *Options) (Image, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	head, err := readHead(path, 512)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(head, qcow2.Magic):
+		return qcow2.Open(path, &qcow2.Options{
+			NoBackingFile: opts.NoBackingFile,
+		})
+	case bytes.HasPrefix(head, vmdk.Magic):
+		return vmdk.Open(path)
+	case bytes.HasPrefix(head, vhdx.Magic):
+		return vhdx.Open(path)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, path)
+}
+
+func readHead(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, n)
+	n, err = io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// NewReader returns an io.Reader which reads the virtual disk of img
+// sequentially from the beginning. Reading fails with the error of ctx
+// once ctx is done.
+func NewReader(ctx context.Context, img Image) io.Reader {
+	return NewContextReader(ctx, io.NewSectionReader(img, 0, img.Size()))
+}
+
+// NewContextReader returns an io.Reader which reads from r until ctx is
+// done, and then fails with the error of ctx.
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,45 @@
+package diskimage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/diskimage"
+)
+
+type memImage struct {
+	*io.SectionReader
+}
+
+func (memImage) Close() error { return nil }
+
+func TestNewReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := make([]byte, 1<<20)
+	img := memImage{io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))}
+	r := diskimage.NewReader(ctx, img)
+	if _, err := r.Read(make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := io.ReadAll(r); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled but got %v", err)
+	}
+}
+
+func TestOpenUnsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unknown.img")
+	if err := os.WriteFile(path, []byte("unknown"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := diskimage.Open(path, nil); !errors.Is(err, diskimage.ErrUnsupportedFormat) {
+		t.Fatalf("want ErrUnsupportedFormat but got %v", err)
+	}
+}
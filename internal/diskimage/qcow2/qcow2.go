@@ -0,0 +1,613 @@
+// Package qcow2 implements a reader for the QEMU copy-on-write disk image
+// format (version 2 and 3), which also writes to existing images.
+//
+// see: https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Magic is the magic number at the start of every qcow2 image.
+var Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	headerV2Length = 72
+	headerV3Length = 104
+
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	// maxBackingChain limits the depth of backing file chains, which also
+	// protects against images which refer to themselves.
+	maxBackingChain = 16
+
+	// maxL2Cache is the number of L2 tables kept in memory.
+	maxL2Cache = 64
+)
+
+// Incompatible feature bits.
+const (
+	incompatDirty         = 1 << 0
+	incompatCorrupt       = 1 << 1
+	incompatDataFile      = 1 << 2
+	incompatCompression   = 1 << 3
+	incompatExtendedL2    = 1 << 4
+	knownIncompatFeatures = incompatDirty | incompatCorrupt | incompatDataFile | incompatCompression | incompatExtendedL2
+)
+
+// Header extension types.
+const (
+	extEnd           = 0x00000000
+	extBackingFormat = 0xe2792aca
+)
+
+const (
+	l1OffsetMask       = 0x00fffffffffffe00
+	l2OffsetMask       = 0x00fffffffffffe00
+	refcountOffsetMask = 0xfffffffffffffe00
+	copiedFlag         = 1 << 63
+	l2CompressedFlag   = 1 << 62
+	l2ZeroFlag         = 1 << 0
+)
+
+var (
+	// ErrBackingFile is returned when an image refers to a backing file
+	// although backing files are disallowed by Options.
+	ErrBackingFile = errors.New("qcow2: image has a backing file")
+
+	// ErrUnsupported is returned when an image uses a feature this package
+	// does not implement.
+	ErrUnsupported = errors.New("qcow2: unsupported feature")
+
+	// ErrReadOnly is returned by writes to an image which was not opened
+	// with Options.Writable.
+	ErrReadOnly = errors.New("qcow2: image is read-only")
+)
+
+// Options configures how an image is opened.
+type Options struct {
+	// NoBackingFile makes Open fail with ErrBackingFile if the image
+	// refers to a backing file.
+	NoBackingFile bool
+
+	// Writable opens the image for writing. Backing files are opened
+	// read-only.
+	Writable bool
+}
+
+// backingImage is the read-only view of a backing file.
+type backingImage interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// header is the parsed qcow2 image header.
+type header struct {
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	// Version 3 and later.
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+	CompressionType      uint8
+}
+
+// Image is a qcow2 disk image opened for reading, and for writing with
+// Options.Writable.
+//
+// Image is safe for concurrent use.
+type Image struct {
+	f   *os.File
+	hdr header
+
+	clusterSize int64
+	l2Entries   int64
+	l1          []uint64
+
+	backing       backingImage
+	backingFile   string
+	backingFormat string
+
+	mu       sync.Mutex
+	fileSize int64
+	l2Cache  map[uint64][]uint64
+	zcluster []byte
+	zoffset  uint64
+
+	// wmu serializes writes, which change the metadata of the image.
+	wmu           sync.Mutex
+	writable      bool
+	refcountBits  int64
+	refcountTable []uint64
+}
+
+// Open opens the qcow2 image at path.
+func Open(path string, opts *Options) (*Image, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return open(path, opts, 0)
+}
+
+func open(path string, opts *Options, depth int) (*Image, error) {
+	writable := opts.Writable && depth == 0
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	img, err := newImage(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if writable {
+		if err := img.initWrite(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if img.backingFile != "" {
+		if opts.NoBackingFile {
+			img.Close()
+			return nil, fmt.Errorf("%w: %q", ErrBackingFile, img.backingFile)
+		}
+		backing, err := openBacking(path, img.backingFile, img.backingFormat, opts, depth+1)
+		if err != nil {
+			img.Close()
+			return nil, fmt.Errorf("qcow2: failed to open backing file %q: %w", img.backingFile, err)
+		}
+		img.backing = backing
+	}
+	return img, nil
+}
+
+func openBacking(path, backingFile, format string, opts *Options, depth int) (backingImage, error) {
+	if depth > maxBackingChain {
+		return nil, fmt.Errorf("qcow2: backing file chain is longer than %d", maxBackingChain)
+	}
+	if !filepath.IsAbs(backingFile) {
+		backingFile = filepath.Join(filepath.Dir(path), backingFile)
+	}
+	switch format {
+	case "qcow2":
+		return open(backingFile, opts, depth)
+	case "raw":
+		return openRaw(backingFile)
+	case "":
+		ok, err := isQCOW2(backingFile)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return open(backingFile, opts, depth)
+		}
+		return openRaw(backingFile)
+	}
+	return nil, fmt.Errorf("%w: backing file format %q", ErrUnsupported, format)
+}
+
+func isQCOW2(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(magic, Magic), nil
+}
+
+func newImage(f *os.File) (*Image, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{
+		f:        f,
+		fileSize: fi.Size(),
+		l2Cache:  make(map[uint64][]uint64),
+	}
+	if err := img.readHeader(); err != nil {
+		return nil, err
+	}
+	if err := img.readL1(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func (img *Image) readHeader() error {
+	buf := make([]byte, headerV3Length+8)
+	n, err := img.f.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	buf = buf[:n]
+	if len(buf) < headerV2Length || !bytes.Equal(buf[:4], Magic) {
+		return errors.New("qcow2: not a qcow2 image")
+	}
+	be := binary.BigEndian
+	h := &img.hdr
+	h.Version = be.Uint32(buf[4:])
+	h.BackingFileOffset = be.Uint64(buf[8:])
+	h.BackingFileSize = be.Uint32(buf[16:])
+	h.ClusterBits = be.Uint32(buf[20:])
+	h.Size = be.Uint64(buf[24:])
+	h.CryptMethod = be.Uint32(buf[32:])
+	h.L1Size = be.Uint32(buf[36:])
+	h.L1TableOffset = be.Uint64(buf[40:])
+	h.RefcountTableOffset = be.Uint64(buf[48:])
+	h.RefcountTableClusters = be.Uint32(buf[56:])
+	h.NbSnapshots = be.Uint32(buf[60:])
+	h.SnapshotsOffset = be.Uint64(buf[64:])
+
+	switch h.Version {
+	case 2:
+		h.RefcountOrder = 4
+		h.HeaderLength = headerV2Length
+	case 3:
+		if len(buf) < headerV3Length {
+			return errors.New("qcow2: truncated header")
+		}
+		h.IncompatibleFeatures = be.Uint64(buf[72:])
+		h.CompatibleFeatures = be.Uint64(buf[80:])
+		h.AutoclearFeatures = be.Uint64(buf[88:])
+		h.RefcountOrder = be.Uint32(buf[96:])
+		h.HeaderLength = be.Uint32(buf[100:])
+		if h.HeaderLength < headerV3Length || h.HeaderLength%8 != 0 {
+			return fmt.Errorf("qcow2: invalid header length %d", h.HeaderLength)
+		}
+		if h.HeaderLength > headerV3Length && len(buf) > headerV3Length {
+			h.CompressionType = buf[headerV3Length]
+		}
+	default:
+		return fmt.Errorf("%w: version %d", ErrUnsupported, h.Version)
+	}
+
+	if h.ClusterBits < minClusterBits || h.ClusterBits > maxClusterBits {
+		return fmt.Errorf("qcow2: invalid cluster bits %d", h.ClusterBits)
+	}
+	if unknown := h.IncompatibleFeatures &^ knownIncompatFeatures; unknown != 0 {
+		return fmt.Errorf("%w: incompatible feature bits %#x", ErrUnsupported, unknown)
+	}
+	if h.IncompatibleFeatures&incompatCorrupt != 0 {
+		return errors.New("qcow2: image is marked as corrupt")
+	}
+	if h.IncompatibleFeatures&incompatDataFile != 0 {
+		return fmt.Errorf("%w: external data file", ErrUnsupported)
+	}
+	if h.IncompatibleFeatures&incompatExtendedL2 != 0 {
+		return fmt.Errorf("%w: extended L2 entries", ErrUnsupported)
+	}
+	if h.IncompatibleFeatures&incompatCompression != 0 && h.CompressionType != 0 {
+		return fmt.Errorf("%w: compression type %d", ErrUnsupported, h.CompressionType)
+	}
+	if h.CryptMethod != 0 {
+		return fmt.Errorf("%w: encryption method %d", ErrUnsupported, h.CryptMethod)
+	}
+	if h.Size > 1<<62 {
+		return fmt.Errorf("qcow2: invalid virtual size %d", h.Size)
+	}
+
+	img.clusterSize = 1 << h.ClusterBits
+	img.l2Entries = img.clusterSize / 8
+
+	if err := img.readExtensions(); err != nil {
+		return err
+	}
+	if h.BackingFileOffset != 0 {
+		if h.BackingFileSize == 0 || h.BackingFileSize > 1023 {
+			return fmt.Errorf("qcow2: invalid backing file name length %d", h.BackingFileSize)
+		}
+		name := make([]byte, h.BackingFileSize)
+		if _, err := img.f.ReadAt(name, int64(h.BackingFileOffset)); err != nil {
+			return fmt.Errorf("qcow2: failed to read backing file name: %w", err)
+		}
+		img.backingFile = string(name)
+	}
+	return nil
+}
+
+func (img *Image) readExtensions() error {
+	off := int64(img.hdr.HeaderLength)
+	end := img.clusterSize
+	var ext [8]byte
+	for off+8 <= end {
+		if _, err := img.f.ReadAt(ext[:], off); err != nil {
+			return fmt.Errorf("qcow2: failed to read header extension: %w", err)
+		}
+		typ := binary.BigEndian.Uint32(ext[0:])
+		length := int64(binary.BigEndian.Uint32(ext[4:]))
+		off += 8
+		if typ == extEnd {
+			return nil
+		}
+		if off+length > end {
+			return errors.New("qcow2: header extension exceeds first cluster")
+		}
+		if typ == extBackingFormat {
+			data := make([]byte, length)
+			if _, err := img.f.ReadAt(data, off); err != nil {
+				return fmt.Errorf("qcow2: failed to read backing file format: %w", err)
+			}
+			img.backingFormat = string(data)
+		}
+		off += (length + 7) &^ 7
+	}
+	return nil
+}
+
+func (img *Image) readL1() error {
+	h := &img.hdr
+	clusters := (int64(h.Size) + img.clusterSize - 1) / img.clusterSize
+	need := (clusters + img.l2Entries - 1) / img.l2Entries
+	if int64(h.L1Size) < need {
+		return fmt.Errorf("qcow2: L1 table has %d entries but %d are required", h.L1Size, need)
+	}
+	if need == 0 {
+		return nil
+	}
+	if int64(h.L1TableOffset)%img.clusterSize != 0 {
+		return fmt.Errorf("qcow2: L1 table offset %#x is not cluster aligned", h.L1TableOffset)
+	}
+	if int64(h.L1TableOffset)+need*8 > img.fileSize {
+		return errors.New("qcow2: L1 table exceeds end of file")
+	}
+	buf := make([]byte, need*8)
+	if _, err := img.f.ReadAt(buf, int64(h.L1TableOffset)); err != nil {
+		return fmt.Errorf("qcow2: failed to read L1 table: %w", err)
+	}
+	img.l1 = make([]uint64, need)
+	for i := range img.l1 {
+		img.l1[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return nil
+}
+
+// Size returns the virtual size of the disk in bytes.
+func (img *Image) Size() int64 { return int64(img.hdr.Size) }
+
+// Version returns the qcow2 format version of the image.
+func (img *Image) Version() int { return int(img.hdr.Version) }
+
+// ClusterSize returns the cluster size of the image in bytes.
+func (img *Image) ClusterSize() int64 { return img.clusterSize }
+
+// BackingFile returns the backing file name stored in the image, or an
+// empty string if the image has no backing file.
+func (img *Image) BackingFile() string { return img.backingFile }
+
+// Close closes the image and its backing files.
+func (img *Image) Close() error {
+	err := img.f.Close()
+	if img.backing != nil {
+		if berr := img.backing.Close(); err == nil {
+			err = berr
+		}
+	}
+	return err
+}
+
+// ReadAt reads len(p) bytes of the virtual disk starting at off.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("qcow2: negative offset")
+	}
+	size := img.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(p)) > size-off {
+		p = p[:size-off]
+		eof = io.EOF
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		chunk := min(int64(len(p)-n), img.clusterSize-pos%img.clusterSize)
+		if err := img.readCluster(p[n:n+int(chunk)], pos); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+	}
+	return n, eof
+}
+
+// readCluster reads p from the virtual disk at off. p must not cross a
+// cluster boundary.
+func (img *Image) readCluster(p []byte, off int64) error {
+	entry, err := img.l2Entry(off)
+	if err != nil {
+		return err
+	}
+	inCluster := off % img.clusterSize
+	switch {
+	case entry&l2CompressedFlag != 0:
+		return img.readCompressed(p, entry, inCluster)
+	case img.hdr.Version >= 3 && entry&l2ZeroFlag != 0:
+		clear(p)
+	case entry&l2OffsetMask == 0:
+		return img.readBacking(p, off)
+	default:
+		hostOff := int64(entry & l2OffsetMask)
+		if hostOff%img.clusterSize != 0 {
+			return fmt.Errorf("qcow2: data cluster offset %#x is not cluster aligned", hostOff)
+		}
+		img.mu.Lock()
+		fileSize := img.fileSize
+		img.mu.Unlock()
+		if hostOff+inCluster+int64(len(p)) > fileSize {
+			return fmt.Errorf("qcow2: data cluster %#x exceeds end of file", hostOff)
+		}
+		if _, err := img.f.ReadAt(p, hostOff+inCluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (img *Image) readBacking(p []byte, off int64) error {
+	if img.backing == nil {
+		clear(p)
+		return nil
+	}
+	n, err := img.backing.ReadAt(p, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	// The backing file may be smaller than this image.
+	clear(p[n:])
+	return nil
+}
+
+// l2Entry returns the L2 table entry which maps the guest offset off.
+// A zero entry means that the cluster is unallocated.
+func (img *Image) l2Entry(off int64) (uint64, error) {
+	cluster := off / img.clusterSize
+	l1Index := cluster / img.l2Entries
+	l2Index := cluster % img.l2Entries
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if l1Index >= int64(len(img.l1)) {
+		return 0, fmt.Errorf("qcow2: offset %d is not covered by L1 table", off)
+	}
+	l2Offset := img.l1[l1Index] & l1OffsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	l2, err := img.l2Table(l2Offset)
+	if err != nil {
+		return 0, err
+	}
+	return l2[l2Index], nil
+}
+
+// l2Table returns the L2 table at offset. img.mu must be held.
+func (img *Image) l2Table(offset uint64) ([]uint64, error) {
+	if l2, ok := img.l2Cache[offset]; ok {
+		return l2, nil
+	}
+	if int64(offset)%img.clusterSize != 0 {
+		return nil, fmt.Errorf("qcow2: L2 table offset %#x is not cluster aligned", offset)
+	}
+	if int64(offset)+img.clusterSize > img.fileSize {
+		return nil, fmt.Errorf("qcow2: L2 table %#x exceeds end of file", offset)
+	}
+	buf := make([]byte, img.clusterSize)
+	if _, err := img.f.ReadAt(buf, int64(offset)); err != nil {
+		return nil, fmt.Errorf("qcow2: failed to read L2 table: %w", err)
+	}
+	l2 := make([]uint64, img.l2Entries)
+	for i := range l2 {
+		l2[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	if len(img.l2Cache) >= maxL2Cache {
+		clear(img.l2Cache)
+	}
+	img.l2Cache[offset] = l2
+	return l2, nil
+}
+
+// readCompressed reads p from the compressed cluster described by the L2
+// entry, starting at inCluster bytes into the cluster.
+func (img *Image) readCompressed(p []byte, entry uint64, inCluster int64) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.zcluster == nil || img.zoffset != entry {
+		if err := img.decompress(entry); err != nil {
+			return err
+		}
+	}
+	copy(p, img.zcluster[inCluster:])
+	return nil
+}
+
+// decompress decompresses the cluster described by the L2 entry into
+// img.zcluster. img.mu must be held.
+func (img *Image) decompress(entry uint64) error {
+
+	x := 62 - (img.hdr.ClusterBits - 8)
+	desc := entry &^ (3 << 62)
+	hostOff := int64(desc & (1<<x - 1))
+	sectors := int64(desc >> x)
+	// The compressed data may span into the following sector.
+	length := (sectors+1)*512 - hostOff%512
+	if hostOff+length > img.fileSize {
+		length = img.fileSize - hostOff
+	}
+	if length <= 0 {
+		return fmt.Errorf("qcow2: compressed cluster %#x exceeds end of file", hostOff)
+	}
+	compressed := make([]byte, length)
+	if _, err := img.f.ReadAt(compressed, hostOff); err != nil {
+		return fmt.Errorf("qcow2: failed to read compressed cluster: %w", err)
+	}
+
+	data := img.zcluster
+	if data == nil {
+		data = make([]byte, img.clusterSize)
+	}
+	zr := flate.NewReader(bytes.NewReader(compressed))
+	defer zr.Close()
+	if _, err := io.ReadFull(zr, data); err != nil {
+		img.zcluster = nil
+		return fmt.Errorf("qcow2: failed to decompress cluster at %#x: %w", hostOff, err)
+	}
+	img.zcluster = data
+	img.zoffset = entry
+	return nil
+}
+
+// rawImage is a raw backing file.
+type rawImage struct {
+	*os.File
+	size int64
+}
+
+func openRaw(path string) (*rawImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rawImage{File: f, size: fi.Size()}, nil
+}
+
+func (r *rawImage) Size() int64 { return r.size }
@@ -0,0 +1,464 @@
+package qcow2_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/diskimage/qcow2"
+)
+
+type testImage struct {
+	version       uint32
+	clusterBits   uint32
+	size          uint64
+	data          map[int64][]byte // guest cluster index to content
+	compressed    map[int64]bool
+	zero          []int64
+	backingFile   string
+	backingFormat string
+	corruptL2     bool
+	refcounts     bool
+}
+
+// writeTestImage writes a minimal qcow2 image. It does not maintain refcounts
+// since they are not needed for reading.
+func writeTestImage(t *testing.T, path string, ti testImage) {
+	t.Helper()
+	be := binary.BigEndian
+	cs := int64(1) << ti.clusterBits
+	l2Entries := cs / 8
+	clusters := (int64(ti.size) + cs - 1) / cs
+	l1Size := (clusters + l2Entries - 1) / l2Entries
+
+	file := make([]byte, 2*cs) // header and L1 table
+	hdr := file[:cs]
+	copy(hdr, qcow2.Magic)
+	be.PutUint32(hdr[4:], ti.version)
+	be.PutUint32(hdr[20:], ti.clusterBits)
+	be.PutUint64(hdr[24:], ti.size)
+	be.PutUint32(hdr[36:], uint32(l1Size))
+	be.PutUint64(hdr[40:], uint64(cs))
+	extOff := 72
+	if ti.version == 3 {
+		be.PutUint32(hdr[96:], 4)
+		be.PutUint32(hdr[100:], 112)
+		extOff = 112
+	}
+	if ti.backingFormat != "" {
+		be.PutUint32(hdr[extOff:], 0xe2792aca)
+		be.PutUint32(hdr[extOff+4:], uint32(len(ti.backingFormat)))
+		copy(hdr[extOff+8:], ti.backingFormat)
+		extOff += 8 + (len(ti.backingFormat)+7)&^7
+	}
+	extOff += 8 // end of extensions
+	if ti.backingFile != "" {
+		be.PutUint64(hdr[8:], uint64(extOff))
+		be.PutUint32(hdr[16:], uint32(len(ti.backingFile)))
+		copy(hdr[extOff:], ti.backingFile)
+	}
+
+	l2Tables := map[int64]int64{} // L1 index to L2 table offset in file
+	setEntry := func(cluster int64, entry uint64) {
+		idx := cluster / l2Entries
+		off, ok := l2Tables[idx]
+		if !ok {
+			file = alignCluster(file, cs)
+			off = int64(len(file))
+			file = append(file, make([]byte, cs)...)
+			l2Off := uint64(off)
+			if ti.corruptL2 {
+				l2Off = uint64(cs * 1000)
+			}
+			be.PutUint64(file[cs+idx*8:], l2Off|1<<63)
+			l2Tables[idx] = off
+		}
+		be.PutUint64(file[off+(cluster%l2Entries)*8:], entry)
+	}
+
+	for cluster := int64(0); cluster < clusters; cluster++ {
+		content, ok := ti.data[cluster]
+		if !ok {
+			continue
+		}
+		if ti.compressed[cluster] {
+			var buf bytes.Buffer
+			zw, _ := flate.NewWriter(&buf, flate.BestCompression)
+			full := make([]byte, cs)
+			copy(full, content)
+			zw.Write(full)
+			zw.Close()
+			off := int64(len(file))
+			file = append(file, buf.Bytes()...)
+			x := 62 - (ti.clusterBits - 8)
+			sectors := (off+int64(buf.Len())-1)/512 - off/512
+			setEntry(cluster, 1<<62|uint64(sectors)<<x|uint64(off))
+			continue
+		}
+		file = alignCluster(file, cs)
+		off := int64(len(file))
+		full := make([]byte, cs)
+		copy(full, content)
+		file = append(file, full...)
+		setEntry(cluster, uint64(off)|1<<63)
+	}
+	for _, cluster := range ti.zero {
+		setEntry(cluster, 1)
+	}
+	if ti.refcounts {
+		// a refcount table and a block of 16 bit refcounts at the end.
+		file = alignCluster(file, cs)
+		table := int64(len(file))
+		file = append(file, make([]byte, 2*cs)...)
+		be.PutUint64(file[48:], uint64(table))
+		be.PutUint32(file[56:], 1)
+		be.PutUint64(file[table:], uint64(table+cs))
+		for cluster, refcount := range wantRefcounts(t, file) {
+			be.PutUint16(file[table+cs+cluster*2:], uint16(refcount))
+		}
+	}
+	if err := os.WriteFile(path, file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wantRefcounts returns the refcounts of the clusters of the qcow2 image
+// in file, counting the references of its metadata.
+func wantRefcounts(t *testing.T, file []byte) map[int64]int64 {
+	t.Helper()
+	be := binary.BigEndian
+	bits := be.Uint32(file[20:])
+	cs := int64(1) << bits
+	refs := map[int64]int64{0: 1}
+	ref := func(off, length int64) {
+		for c := off / cs; c <= (off+length-1)/cs; c++ {
+			refs[c]++
+		}
+	}
+	l1Size, l1Off := int64(be.Uint32(file[36:])), int64(be.Uint64(file[40:]))
+	ref(l1Off, l1Size*8)
+	tableOff, tableClusters := int64(be.Uint64(file[48:])), int64(be.Uint32(file[56:]))
+	ref(tableOff, tableClusters*cs)
+	for i := range tableClusters * cs / 8 {
+		if block := int64(be.Uint64(file[tableOff+i*8:]) & 0xfffffffffffffe00); block != 0 {
+			ref(block, cs)
+		}
+	}
+	x := 62 - (bits - 8)
+	for i := range l1Size {
+		l2 := int64(be.Uint64(file[l1Off+i*8:]) & 0x00fffffffffffe00)
+		if l2 == 0 {
+			continue
+		}
+		ref(l2, cs)
+		for j := range cs / 8 {
+			entry := be.Uint64(file[l2+j*8:])
+			if entry&(1<<62) != 0 {
+				desc := entry &^ (3 << 62)
+				start := int64(desc&(1<<x-1)) &^ 511
+				ref(start, (int64(desc>>x)+1)*512)
+			} else if off := int64(entry & 0x00fffffffffffe00); off != 0 {
+				ref(off, cs)
+			}
+		}
+	}
+	return refs
+}
+
+// checkRefcounts checks the refcounts of the image at path, like
+// qemu-img check.
+func checkRefcounts(t *testing.T, path string) {
+	t.Helper()
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := binary.BigEndian
+	cs := int64(1) << be.Uint32(file[20:])
+	if int64(len(file))%cs != 0 {
+		t.Fatalf("want whole clusters but the file has %d bytes", len(file))
+	}
+	want := wantRefcounts(t, file)
+	tableOff := int64(be.Uint64(file[48:]))
+	for c := range int64(len(file)) / cs {
+		var got int64
+		if block := int64(be.Uint64(file[tableOff+c/(cs/2)*8:])); block != 0 {
+			got = int64(be.Uint16(file[block+c%(cs/2)*2:]))
+		}
+		if got != want[c] {
+			t.Fatalf("cluster %d: want refcount %d but got %d", c, want[c], got)
+		}
+	}
+}
+
+func alignCluster(file []byte, cs int64) []byte {
+	if pad := int64(len(file)) % cs; pad != 0 {
+		file = append(file, make([]byte, cs-pad)...)
+	}
+	return file
+}
+
+func readAll(t *testing.T, img *qcow2.Image) []byte {
+	t.Helper()
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestRead(t *testing.T) {
+	const clusterBits = 12
+	const cs = 1 << clusterBits
+	for _, version := range []uint32{2, 3} {
+		path := filepath.Join(t.TempDir(), "disk.qcow2")
+		writeTestImage(t, path, testImage{
+			version:     version,
+			clusterBits: clusterBits,
+			size:        cs*1024 + 100, // spans two L2 tables
+			data: map[int64][]byte{
+				0:    []byte("boot sector"),
+				3:    bytes.Repeat([]byte{0xaa}, cs),
+				600:  []byte("compressed"),
+				1024: []byte("tail"),
+			},
+			compressed: map[int64]bool{600: true},
+		})
+		img, err := qcow2.Open(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+
+		if got := img.Version(); got != int(version) {
+			t.Fatalf("want version %d but got %d", version, got)
+		}
+		want := make([]byte, cs*1024+100)
+		copy(want, "boot sector")
+		copy(want[3*cs:], bytes.Repeat([]byte{0xaa}, cs))
+		copy(want[600*cs:], "compressed")
+		copy(want[1024*cs:], "tail")
+		if got := readAll(t, img); !bytes.Equal(want, got) {
+			t.Fatalf("version %d: content mismatch", version)
+		}
+
+		// unaligned read across a cluster boundary.
+		p := make([]byte, 10)
+		if _, err := img.ReadAt(p, 3*cs-5); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, want[3*cs-5:3*cs+5]) {
+			t.Fatalf("version %d: unaligned read mismatch", version)
+		}
+	}
+}
+
+func TestReadBackingFile(t *testing.T) {
+	const clusterBits = 16
+	const cs = 1 << clusterBits
+	dir := t.TempDir()
+
+	base := make([]byte, 3*cs)
+	copy(base, "base0")
+	copy(base[cs:], "base1")
+	copy(base[2*cs:], "base2")
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), base, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestImage(t, filepath.Join(dir, "mid.qcow2"), testImage{
+		version:       3,
+		clusterBits:   clusterBits,
+		size:          4 * cs,
+		data:          map[int64][]byte{1: []byte("mid1")},
+		backingFile:   "base.raw",
+		backingFormat: "raw",
+	})
+	top := filepath.Join(dir, "top.qcow2")
+	writeTestImage(t, top, testImage{
+		version:     3,
+		clusterBits: clusterBits,
+		size:        4 * cs,
+		data:        map[int64][]byte{3: []byte("top3")},
+		zero:        []int64{2},
+		backingFile: "mid.qcow2",
+	})
+
+	img, err := qcow2.Open(top, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	want := make([]byte, 4*cs)
+	copy(want, "base0")
+	copy(want[cs:], "mid1")
+	copy(want[3*cs:], "top3")
+	if got := readAll(t, img); !bytes.Equal(want, got) {
+		t.Fatal("content mismatch")
+	}
+
+	_, err = qcow2.Open(top, &qcow2.Options{NoBackingFile: true})
+	if !errors.Is(err, qcow2.ErrBackingFile) {
+		t.Fatalf("want ErrBackingFile but got %v", err)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	notQCOW2 := filepath.Join(dir, "raw.img")
+	if err := os.WriteFile(notQCOW2, make([]byte, 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := qcow2.Open(notQCOW2, nil); err == nil {
+		t.Fatal("want error for non qcow2 image")
+	}
+
+	self := filepath.Join(dir, "self.qcow2")
+	writeTestImage(t, self, testImage{
+		version:     3,
+		clusterBits: 16,
+		size:        1 << 20,
+		backingFile: "self.qcow2",
+	})
+	if _, err := qcow2.Open(self, nil); err == nil {
+		t.Fatal("want error for self referencing backing file")
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.qcow2")
+	writeTestImage(t, corrupt, testImage{
+		version:     3,
+		clusterBits: 16,
+		size:        1 << 20,
+		data:        map[int64][]byte{0: []byte("data")},
+		corruptL2:   true,
+	})
+	img, err := qcow2.Open(corrupt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.ReadAt(make([]byte, 512), 0); err == nil {
+		t.Fatal("want error for L2 table beyond end of file")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	const clusterBits = 12
+	const cs = 1 << clusterBits
+	const size = cs*2048 + 100 // the last L2 table is missing
+	for _, version := range []uint32{2, 3} {
+		path := filepath.Join(t.TempDir(), "disk.qcow2")
+		writeTestImage(t, path, testImage{
+			version:     version,
+			clusterBits: clusterBits,
+			size:        size,
+			data: map[int64][]byte{
+				0:    []byte("boot sector"),
+				3:    bytes.Repeat([]byte{0xaa}, cs),
+				4:    bytes.Repeat([]byte{0xbb}, cs),
+				600:  []byte("compressed"),
+				1024: []byte("tail"),
+			},
+			compressed: map[int64]bool{600: true},
+			refcounts:  true,
+		})
+		img, err := qcow2.Open(path, &qcow2.Options{Writable: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := readAll(t, img)
+		write := func(off int64, p []byte) {
+			t.Helper()
+			if _, err := img.WriteAt(p, off); err != nil {
+				t.Fatalf("version %d: %v", version, err)
+			}
+			copy(want[off:], p)
+		}
+		write(5, []byte("in place"))
+		write(10*cs+100, []byte("new cluster"))
+		write(600*cs-10, bytes.Repeat([]byte{1}, cs+20)) // over the compressed cluster
+		write(1600*cs, bytes.Repeat([]byte{2}, 3*cs))    // a new L2 table
+		write(size-50, bytes.Repeat([]byte{3}, 50))
+		if err := img.Trim(3*cs, cs+10); err != nil {
+			t.Fatal(err)
+		}
+		clear(want[3*cs : 4*cs+10])
+		if err := img.Trim(1601*cs, size-1601*cs); err != nil {
+			t.Fatal(err)
+		}
+		clear(want[1601*cs:])
+		write(1602*cs+7, []byte("after trim"))
+		if _, err := img.WriteAt([]byte{1}, size); err == nil {
+			t.Fatal("want an error for a write beyond the end")
+		}
+		if got := readAll(t, img); !bytes.Equal(want, got) {
+			t.Fatalf("version %d: content mismatch", version)
+		}
+		if err := img.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := img.Close(); err != nil {
+			t.Fatal(err)
+		}
+		checkRefcounts(t, path)
+
+		img, err = qcow2.Open(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		if got := readAll(t, img); !bytes.Equal(want, got) {
+			t.Fatalf("version %d: content mismatch after reopening", version)
+		}
+		if _, err := img.WriteAt([]byte{1}, 0); !errors.Is(err, qcow2.ErrReadOnly) {
+			t.Fatalf("want ErrReadOnly but got %v", err)
+		}
+	}
+}
+
+func TestWriteBackingFile(t *testing.T) {
+	const clusterBits = 16
+	const cs = 1 << clusterBits
+	for _, version := range []uint32{2, 3} {
+		dir := t.TempDir()
+		base := bytes.Repeat([]byte("base"), cs)
+		if err := os.WriteFile(filepath.Join(dir, "base.raw"), base, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		top := filepath.Join(dir, "top.qcow2")
+		writeTestImage(t, top, testImage{
+			version:     version,
+			clusterBits: clusterBits,
+			size:        4 * cs,
+			backingFile: "base.raw",
+			refcounts:   true,
+		})
+		img, err := qcow2.Open(top, &qcow2.Options{Writable: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		want := bytes.Clone(base)
+		if _, err := img.WriteAt([]byte("top"), cs+1); err != nil {
+			t.Fatal(err)
+		}
+		copy(want[cs+1:], "top")
+		if err := img.Trim(2*cs, cs); err != nil {
+			t.Fatal(err)
+		}
+		clear(want[2*cs : 3*cs])
+		if got := readAll(t, img); !bytes.Equal(want, got) {
+			t.Fatalf("version %d: content mismatch", version)
+		}
+		checkRefcounts(t, top)
+		if got, err := os.ReadFile(filepath.Join(dir, "base.raw")); err != nil || !bytes.Equal(got, base) {
+			t.Fatalf("version %d: want an unchanged backing file but got %v", version, err)
+		}
+	}
+}
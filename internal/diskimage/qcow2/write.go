@@ -0,0 +1,395 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+)
+
+// initWrite reads the refcount table of an image opened for writing.
+func (img *Image) initWrite() error {
+	h := &img.hdr
+	if h.IncompatibleFeatures&incompatDirty != 0 {
+		return fmt.Errorf("%w: writing to a dirty image with lazy refcounts", ErrUnsupported)
+	}
+	if h.NbSnapshots != 0 {
+		return fmt.Errorf("%w: writing to an image with internal snapshots", ErrUnsupported)
+	}
+	if h.RefcountOrder > 6 {
+		return fmt.Errorf("qcow2: invalid refcount order %d", h.RefcountOrder)
+	}
+	img.refcountBits = 1 << h.RefcountOrder
+	if h.RefcountTableOffset == 0 {
+		return errors.New("qcow2: image has no refcount table")
+	}
+	if int64(h.RefcountTableOffset)%img.clusterSize != 0 {
+		return fmt.Errorf("qcow2: refcount table offset %#x is not cluster aligned", h.RefcountTableOffset)
+	}
+	length := int64(h.RefcountTableClusters) * img.clusterSize
+	if int64(h.RefcountTableOffset)+length > img.fileSize {
+		return errors.New("qcow2: refcount table exceeds end of file")
+	}
+	buf := make([]byte, length)
+	if _, err := img.f.ReadAt(buf, int64(h.RefcountTableOffset)); err != nil {
+		return fmt.Errorf("qcow2: failed to read refcount table: %w", err)
+	}
+	img.refcountTable = make([]uint64, length/8)
+	for i := range img.refcountTable {
+		img.refcountTable[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	// the features of other implementations which this package does not
+	// keep consistent, like persistent dirty bitmaps, are cleared as the
+	// specification requires.
+	if h.AutoclearFeatures != 0 {
+		if _, err := img.f.WriteAt(make([]byte, 8), 88); err != nil {
+			return err
+		}
+		h.AutoclearFeatures = 0
+	}
+	img.writable = true
+	return nil
+}
+
+// WriteAt writes p to the virtual disk at off. Clusters which are not
+// allocated in the image, including zero and compressed clusters, are
+// allocated at the end of the file.
+//
+// The image must have been opened with Options.Writable.
+func (img *Image) WriteAt(p []byte, off int64) (int, error) {
+	if !img.writable {
+		return 0, ErrReadOnly
+	}
+	if off < 0 || int64(len(p)) > img.Size()-off {
+		return 0, errors.New("qcow2: write beyond the end of the disk")
+	}
+	img.wmu.Lock()
+	defer img.wmu.Unlock()
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		chunk := min(int64(len(p)-n), img.clusterSize-pos%img.clusterSize)
+		if err := img.writeCluster(p[n:n+int(chunk)], pos); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+	}
+	return n, nil
+}
+
+// writeCluster writes p to the virtual disk at off. p must not cross a
+// cluster boundary. img.wmu must be held.
+func (img *Image) writeCluster(p []byte, off int64) error {
+	l2Offset, err := img.l2TableForWrite(off)
+	if err != nil {
+		return err
+	}
+	entry, err := img.l2Entry(off)
+	if err != nil {
+		return err
+	}
+	inCluster := off % img.clusterSize
+	hostOff := int64(entry & l2OffsetMask)
+	zero := img.hdr.Version >= 3 && entry&l2ZeroFlag != 0
+	compressed := entry&l2CompressedFlag != 0
+	if !compressed && !zero && hostOff != 0 {
+		_, err := img.f.WriteAt(p, hostOff+inCluster)
+		return err
+	}
+
+	// the cluster gets a data cluster of its own, with its current
+	// content around p.
+	start := off - inCluster
+	buf := make([]byte, img.clusterSize)
+	if valid := min(img.clusterSize, img.Size()-start); int64(len(p)) < valid {
+		if err := img.readCluster(buf[:valid], start); err != nil {
+			return err
+		}
+	}
+	copy(buf[inCluster:], p)
+	if compressed || hostOff == 0 {
+		// an allocated zero cluster keeps its data cluster.
+		if hostOff, err = img.alloc(); err != nil {
+			return err
+		}
+	}
+	if _, err := img.f.WriteAt(buf, hostOff); err != nil {
+		return err
+	}
+	if err := img.setL2Entry(off, l2Offset, uint64(hostOff)|copiedFlag); err != nil {
+		return err
+	}
+	if compressed {
+		return img.freeCompressed(entry)
+	}
+	return nil
+}
+
+// Trim discards length bytes of the virtual disk at off, which then read
+// as zeros. Whole clusters are unmapped, which frees their data clusters;
+// the rest of the range is written with zeros.
+//
+// The image must have been opened with Options.Writable.
+func (img *Image) Trim(off, length int64) error {
+	if !img.writable {
+		return ErrReadOnly
+	}
+	if off < 0 || length < 0 || length > img.Size()-off {
+		return errors.New("qcow2: trim beyond the end of the disk")
+	}
+	img.wmu.Lock()
+	defer img.wmu.Unlock()
+	var zeros []byte
+	for length > 0 {
+		inCluster := off % img.clusterSize
+		n := min(length, img.clusterSize-inCluster)
+		whole := inCluster == 0 && (n == img.clusterSize || off+n == img.Size())
+		// version 2 has no zero clusters, and unallocated clusters read
+		// from the backing file.
+		if whole && (img.hdr.Version >= 3 || img.backing == nil) {
+			if err := img.zeroCluster(off); err != nil {
+				return err
+			}
+		} else {
+			if zeros == nil {
+				zeros = make([]byte, img.clusterSize)
+			}
+			if err := img.writeCluster(zeros[:n], off); err != nil {
+				return err
+			}
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+// zeroCluster makes the cluster at off read as zeros, as a zero cluster if
+// the image has a backing file, and unallocated otherwise. img.wmu must be
+// held.
+func (img *Image) zeroCluster(off int64) error {
+	entry, err := img.l2Entry(off)
+	if err != nil {
+		return err
+	}
+	// without a backing file, unallocated clusters read as zeros.
+	var want uint64
+	if img.backing != nil {
+		want = l2ZeroFlag
+	}
+	if entry == want {
+		return nil
+	}
+	l2Offset, err := img.l2TableForWrite(off)
+	if err != nil {
+		return err
+	}
+	if err := img.setL2Entry(off, l2Offset, want); err != nil {
+		return err
+	}
+	switch hostOff := int64(entry & l2OffsetMask); {
+	case entry&l2CompressedFlag != 0:
+		return img.freeCompressed(entry)
+	case hostOff != 0:
+		return img.free(hostOff, 1)
+	}
+	return nil
+}
+
+// Sync writes the image to storage.
+func (img *Image) Sync() error {
+	return img.f.Sync()
+}
+
+// l2TableForWrite returns the offset of the L2 table which maps off, and
+// allocates the table if there is none. img.wmu must be held.
+func (img *Image) l2TableForWrite(off int64) (uint64, error) {
+	l1Index := off / img.clusterSize / img.l2Entries
+	img.mu.Lock()
+	l2Offset := img.l1[l1Index] & l1OffsetMask
+	img.mu.Unlock()
+	if l2Offset != 0 {
+		return l2Offset, nil
+	}
+	table, err := img.alloc()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := img.f.WriteAt(make([]byte, img.clusterSize), table); err != nil {
+		return 0, err
+	}
+	entry := uint64(table) | copiedFlag
+	b := binary.BigEndian.AppendUint64(nil, entry)
+	if _, err := img.f.WriteAt(b, int64(img.hdr.L1TableOffset)+l1Index*8); err != nil {
+		return 0, err
+	}
+	img.mu.Lock()
+	img.l1[l1Index] = entry
+	img.mu.Unlock()
+	return uint64(table), nil
+}
+
+// setL2Entry sets the L2 entry of the cluster at off in the table at
+// l2Offset.
+func (img *Image) setL2Entry(off int64, l2Offset, entry uint64) error {
+	l2Index := off / img.clusterSize % img.l2Entries
+	b := binary.BigEndian.AppendUint64(nil, entry)
+	if _, err := img.f.WriteAt(b, int64(l2Offset)+l2Index*8); err != nil {
+		return err
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if l2, ok := img.l2Cache[l2Offset]; ok {
+		l2[l2Index] = entry
+	}
+	return nil
+}
+
+// alloc allocates a cluster at the end of the file. Its refcount is
+// written before the caller refers to it, so that a crash leaks the
+// cluster instead of corrupting the image. img.wmu must be held.
+func (img *Image) alloc() (int64, error) {
+	off := img.grow()
+	if err := img.addRef(off, 1); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+// grow reserves a cluster at the end of the file and returns its offset.
+func (img *Image) grow() int64 {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	off := (img.fileSize + img.clusterSize - 1) / img.clusterSize * img.clusterSize
+	img.fileSize = off + img.clusterSize
+	return off
+}
+
+// free drops a reference to each of the n clusters at hostOff. Clusters
+// which are no longer used become holes in the file.
+func (img *Image) free(hostOff, n int64) error {
+	for i := range n {
+		off := hostOff + i*img.clusterSize
+		if err := img.addRef(off, -1); err != nil {
+			return err
+		}
+		refcount, err := img.refcount(off)
+		if err != nil {
+			return err
+		}
+		if refcount == 0 {
+			// the space is released where the file system can.
+			sparse.PunchHole(img.f, off, img.clusterSize)
+		}
+	}
+	return nil
+}
+
+// freeCompressed drops the references to the clusters which hold the
+// compressed cluster of the L2 entry.
+func (img *Image) freeCompressed(entry uint64) error {
+	x := 62 - (img.hdr.ClusterBits - 8)
+	desc := entry &^ (3 << 62)
+	start := int64(desc&(1<<x-1)) &^ 511
+	end := start + (int64(desc>>x)+1)*512
+	first := start / img.clusterSize * img.clusterSize
+	return img.free(first, (end-first+img.clusterSize-1)/img.clusterSize)
+}
+
+// refcountEntry returns the offset of the refcount block for the cluster
+// at hostOff, allocating the block if create is true, and the index of
+// the cluster in it. The offset is zero if there is no block.
+func (img *Image) refcountEntry(hostOff int64, create bool) (int64, int64, error) {
+	perBlock := img.clusterSize * 8 / img.refcountBits
+	cluster := hostOff / img.clusterSize
+	index := cluster / perBlock
+	if index >= int64(len(img.refcountTable)) {
+		return 0, 0, fmt.Errorf("%w: growing the refcount table", ErrUnsupported)
+	}
+	block := int64(img.refcountTable[index] & refcountOffsetMask)
+	if block == 0 && create {
+		block = img.grow()
+		if _, err := img.f.WriteAt(make([]byte, img.clusterSize), block); err != nil {
+			return 0, 0, err
+		}
+		b := binary.BigEndian.AppendUint64(nil, uint64(block))
+		if _, err := img.f.WriteAt(b, int64(img.hdr.RefcountTableOffset)+index*8); err != nil {
+			return 0, 0, err
+		}
+		img.refcountTable[index] = uint64(block)
+		// the block is counted by itself, or by another block.
+		if err := img.addRef(block, 1); err != nil {
+			return 0, 0, err
+		}
+	}
+	return block, cluster % perBlock, nil
+}
+
+// refcount returns the refcount of the cluster at hostOff.
+func (img *Image) refcount(hostOff int64) (uint64, error) {
+	block, index, err := img.refcountEntry(hostOff, false)
+	if err != nil || block == 0 {
+		return 0, err
+	}
+	b, shift, err := img.readRefcount(block, index)
+	if err != nil {
+		return 0, err
+	}
+	return img.decodeRefcount(b, shift), nil
+}
+
+// addRef adds delta to the refcount of the cluster at hostOff.
+func (img *Image) addRef(hostOff, delta int64) error {
+	block, index, err := img.refcountEntry(hostOff, delta > 0)
+	if err != nil {
+		return err
+	}
+	if block == 0 {
+		return fmt.Errorf("qcow2: cluster %#x has no refcount", hostOff)
+	}
+	b, shift, err := img.readRefcount(block, index)
+	if err != nil {
+		return err
+	}
+	v := int64(img.decodeRefcount(b, shift)) + delta
+	limit := uint64(1)<<img.refcountBits - 1
+	if img.refcountBits == 64 {
+		limit = 1<<63 - 1
+	}
+	if v < 0 || uint64(v) > limit {
+		return fmt.Errorf("qcow2: refcount of cluster %#x out of range", hostOff)
+	}
+	if img.refcountBits < 8 {
+		mask := byte(limit) << shift
+		b[0] = b[0]&^mask | byte(v)<<shift
+	} else {
+		for i := range b {
+			b[i] = byte(uint64(v) >> (8 * (len(b) - 1 - i)))
+		}
+	}
+	_, err = img.f.WriteAt(b, block+index*img.refcountBits/8)
+	return err
+}
+
+// readRefcount reads the bytes which hold the refcount at index in the
+// refcount block at block. Refcounts narrower than a byte are at shift
+// bits of the byte, from the least significant bit.
+func (img *Image) readRefcount(block, index int64) ([]byte, uint, error) {
+	b := make([]byte, max(img.refcountBits/8, 1))
+	if _, err := img.f.ReadAt(b, block+index*img.refcountBits/8); err != nil {
+		return nil, 0, fmt.Errorf("qcow2: failed to read refcount block: %w", err)
+	}
+	return b, uint(index * img.refcountBits % 8), nil
+}
+
+func (img *Image) decodeRefcount(b []byte, shift uint) uint64 {
+	if img.refcountBits < 8 {
+		return uint64(b[0]>>shift) & (1<<img.refcountBits - 1)
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
@@ -0,0 +1,84 @@
+package diskimage
+
+import (
+	"io"
+	"os"
+
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+)
+
+// Raw is a raw disk image. Reading a hole of the file returns zeros
+// without touching the file system.
+type Raw struct {
+	f       *os.File
+	size    int64
+	extents []sparse.Extent
+}
+
+var _ Image = (*Raw)(nil)
+
+// OpenRaw opens the raw disk image at path. The holes of the file are
+// looked up once, so the file must not be modified while it is open.
+func OpenRaw(path string) (*Raw, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	extents, err := sparse.DataExtents(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Raw{f: f, size: fi.Size(), extents: extents}, nil
+}
+
+// Size returns the size of the disk image in bytes.
+func (r *Raw) Size() int64 { return r.size }
+
+// Extents returns the ranges of the disk image which contain data.
+func (r *Raw) Extents() []sparse.Extent { return r.extents }
+
+// Close closes the disk image.
+func (r *Raw) Close() error { return r.f.Close() }
+
+// ReadAt implements io.ReaderAt.
+func (r *Raw) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if rest := r.size - off; int64(n) > rest {
+		n = int(rest)
+	}
+	i := sparse.FindExtent(r.extents, off)
+	for pos := 0; pos < n; {
+		cur := off + int64(pos)
+		if i >= len(r.extents) || r.extents[i].Offset >= cur+int64(n-pos) {
+			// the rest is a hole.
+			clear(p[pos:n])
+			break
+		}
+		e := r.extents[i]
+		if cur < e.Offset {
+			hole := int(e.Offset - cur)
+			clear(p[pos : pos+hole])
+			pos += hole
+			continue
+		}
+		m := int(min(int64(n-pos), e.End()-cur))
+		if _, err := r.f.ReadAt(p[pos:pos+m], cur); err != nil {
+			return pos, err
+		}
+		pos += m
+		i++
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,63 @@
+package diskimage_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/diskimage"
+)
+
+func TestRaw(t *testing.T) {
+	const size = 3<<20 + 100
+	want := make([]byte, size)
+	copy(want, "head")
+	copy(want[1<<20+10:], bytes.Repeat([]byte{7}, 8192))
+	copy(want[size-3:], "end")
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{0, 1<<20 + 10, size - 3} {
+		end := min(off+8192, size)
+		if _, err := f.WriteAt(want[off:end], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := diskimage.OpenRaw(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if got := img.Size(); got != size {
+		t.Fatalf("want size %d but got %d", size, got)
+	}
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("content mismatch")
+	}
+
+	// reads across the end of the image
+	p := make([]byte, 10)
+	n, err := img.ReadAt(p, size-5)
+	if n != 5 || err != io.EOF {
+		t.Fatalf("want 5, io.EOF but got %d, %v", n, err)
+	}
+	if string(p[2:5]) != "end" {
+		t.Fatalf("want %q but got %q", "end", p[2:5])
+	}
+}
@@ -0,0 +1,76 @@
+package diskimage
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/Code-Hex/vz/v3/internal/xz"
+	"github.com/Code-Hex/vz/v3/internal/zstd"
+)
+
+// Stream is a disk image read sequentially from a stream, which may be
+// compressed.
+type Stream struct {
+	// Reader reads the uncompressed disk image.
+	io.Reader
+
+	// Compression is FormatGzip, FormatXz, FormatZstd or FormatBzip2 for
+	// compressed streams, and FormatRaw otherwise.
+	Compression Format
+
+	// Format is the format of the uncompressed disk image, detected by
+	// its magic bytes as Detect does.
+	Format Format
+}
+
+// NewStream detects the compression of r by its magic bytes and returns
+// a Stream which decompresses it. It reads the start of the disk image to
+// detect its format.
+func NewStream(r io.Reader) (*Stream, error) {
+	br := bufio.NewReaderSize(r, detectSize)
+	head, err := br.Peek(8)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	s := &Stream{Compression: FormatRaw}
+	var rd io.Reader = br
+	switch format := magicFormat(head); format {
+	case FormatGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		rd, s.Compression = zr, format
+	case FormatXz:
+		zr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		rd, s.Compression = zr, format
+	case FormatZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		rd, s.Compression = zr, format
+	case FormatBzip2:
+		rd, s.Compression = bzip2.NewReader(br), format
+	}
+
+	if s.Compression != FormatRaw {
+		br = bufio.NewReaderSize(rd, detectSize)
+		rd = br
+	}
+	head, err = br.Peek(detectSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	s.Format = magicFormat(head)
+	if s.Format == FormatRaw && isISO9660(head) {
+		s.Format = FormatISO9660
+	}
+	s.Reader = rd
+	return s, nil
+}
@@ -0,0 +1,111 @@
+package diskimage_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/diskimage"
+)
+
+// streamDisk returns the disk image which is compressed in
+// testdata/disk.raw.{xz,zst,bz2}.
+func streamDisk() []byte {
+	disk := make([]byte, 1<<20)
+	disk[446] = 0x80
+	disk[446+4] = 0x83
+	disk[510], disk[511] = 0x55, 0xaa
+	copy(disk[512<<10:], bytes.Repeat([]byte("vz"), 1000))
+	copy(disk[len(disk)-4:], "END!")
+	return disk
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewStream(t *testing.T) {
+	disk := streamDisk()
+	readFile := func(name string) []byte {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	cases := []struct {
+		name        string
+		src         []byte
+		compression diskimage.Format
+	}{
+		{"raw", disk, diskimage.FormatRaw},
+		{"gzip", gzipped(t, disk), diskimage.FormatGzip},
+		{"xz", readFile("testdata/disk.raw.xz"), diskimage.FormatXz},
+		{"zstd", readFile("testdata/disk.raw.zst"), diskimage.FormatZstd},
+		{"bzip2", readFile("testdata/disk.raw.bz2"), diskimage.FormatBzip2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := diskimage.NewStream(bytes.NewReader(tc.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Compression != tc.compression {
+				t.Fatalf("want compression %v but got %v", tc.compression, s.Compression)
+			}
+			if s.Format != diskimage.FormatRaw {
+				t.Fatalf("want format %v but got %v", diskimage.FormatRaw, s.Format)
+			}
+			got, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, disk) {
+				t.Fatalf("want %d bytes but got %d bytes which differ", len(disk), len(got))
+			}
+		})
+	}
+}
+
+func TestNewStreamFormat(t *testing.T) {
+	qcow2 := make([]byte, 4096)
+	copy(qcow2, "QFI\xfb")
+
+	iso := make([]byte, 40*2048)
+	copy(iso[16*2048:], "\x01CD001")
+
+	cases := []struct {
+		name   string
+		src    []byte
+		format diskimage.Format
+	}{
+		{"qcow2", qcow2, diskimage.FormatQCOW2},
+		{"gzip qcow2", gzipped(t, qcow2), diskimage.FormatQCOW2},
+		{"gzip iso", gzipped(t, iso), diskimage.FormatISO9660},
+		{"empty", nil, diskimage.FormatRaw},
+	}
+	for _, tc := range cases {
+		s, err := diskimage.NewStream(bytes.NewReader(tc.src))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if s.Format != tc.format {
+			t.Fatalf("%s: want format %v but got %v", tc.name, tc.format, s.Format)
+		}
+	}
+
+	if _, err := diskimage.NewStream(bytes.NewReader([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00})); err == nil {
+		t.Fatal("want error for a truncated xz header")
+	}
+}
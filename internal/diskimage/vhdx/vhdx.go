@@ -0,0 +1,410 @@
+// Package vhdx implements a reader for fixed and dynamic VHDX disk images.
+//
+// see: https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-vhdx
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Magic is the file type identifier signature at the start of every VHDX file.
+var Magic = []byte("vhdxfile")
+
+// ErrUnsupported is returned when an image uses a feature this package
+// does not implement.
+var ErrUnsupported = errors.New("vhdx: unsupported feature")
+
+const (
+	kiB = 1024
+	miB = 1024 * kiB
+
+	headerOffset1      = 64 * kiB
+	headerOffset2      = 128 * kiB
+	headerSize         = 4 * kiB
+	regionTableOffset1 = 192 * kiB
+	regionTableOffset2 = 256 * kiB
+	regionTableSize    = 64 * kiB
+
+	// The first MiB of the file holds the headers and region tables.
+	headerAreaSize = 1 * miB
+
+	maxRegionEntries   = 2047
+	maxMetadataEntries = 2047
+)
+
+// Payload block states of BAT entries.
+const (
+	blockNotPresent       = 0
+	blockUndefined        = 1
+	blockZero             = 2
+	blockUnmapped         = 3
+	blockFullyPresent     = 6
+	blockPartiallyPresent = 7
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type guid [16]byte
+
+// parseGUID parses the textual form of a GUID into its on-disk
+// representation, where the first three fields are little-endian.
+func parseGUID(s string) guid {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic("vhdx: invalid GUID " + s)
+	}
+	var g guid
+	copy(g[:], b)
+	slices.Reverse(g[0:4])
+	slices.Reverse(g[4:6])
+	slices.Reverse(g[6:8])
+	return g
+}
+
+var (
+	regionBAT      = parseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	regionMetadata = parseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	metaFileParameters    = parseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	metaVirtualDiskSize   = parseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	metaPage83Data        = parseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	metaLogicalSector     = parseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	metaPhysicalSector    = parseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+	metaParentLocator     = parseGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+	knownMetadataItemsIDs = []guid{
+		metaFileParameters,
+		metaVirtualDiskSize,
+		metaPage83Data,
+		metaLogicalSector,
+		metaPhysicalSector,
+		metaParentLocator,
+	}
+)
+
+type region struct {
+	offset int64
+	length int64
+}
+
+// Image is a VHDX disk image opened for reading.
+//
+// Image is safe for concurrent use.
+type Image struct {
+	f        *os.File
+	fileSize int64
+
+	blockSize         int64
+	logicalSectorSize int64
+	virtualSize       int64
+	chunkRatio        int64
+
+	bat []uint64
+}
+
+// Open opens the VHDX image at path and verifies its headers, region tables
+// and block allocation table.
+func Open(path string) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := newImage(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func newImage(f *os.File) (*Image, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{
+		f:        f,
+		fileSize: fi.Size(),
+	}
+	sig := make([]byte, len(Magic))
+	if _, err := f.ReadAt(sig, 0); err != nil || !bytes.Equal(sig, Magic) {
+		return nil, errors.New("vhdx: not a VHDX image")
+	}
+	if err := img.readHeader(); err != nil {
+		return nil, err
+	}
+	regions, err := img.readRegionTable()
+	if err != nil {
+		return nil, err
+	}
+	if err := img.readMetadata(regions[regionMetadata]); err != nil {
+		return nil, err
+	}
+	if err := img.readBAT(regions[regionBAT], regions); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// readChecked reads a structure of size bytes at off and verifies its
+// signature and CRC-32C checksum, which is stored at byte 4.
+func (img *Image) readChecked(off, size int64, signature string) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := img.f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	if string(buf[:len(signature)]) != signature {
+		return nil, fmt.Errorf("invalid signature %q", buf[:len(signature)])
+	}
+	want := binary.LittleEndian.Uint32(buf[4:])
+	binary.LittleEndian.PutUint32(buf[4:], 0)
+	if got := crc32.Checksum(buf, crc32c); got != want {
+		return nil, fmt.Errorf("checksum mismatch: %#08x != %#08x", got, want)
+	}
+	binary.LittleEndian.PutUint32(buf[4:], want)
+	return buf, nil
+}
+
+// readHeader selects the current header, which is the valid header with
+// the highest sequence number.
+func (img *Image) readHeader() error {
+	var (
+		current []byte
+		errs    []error
+	)
+	for _, off := range []int64{headerOffset1, headerOffset2} {
+		buf, err := img.readChecked(off, headerSize, "head")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("header at %#x: %w", off, err))
+			continue
+		}
+		if current == nil || binary.LittleEndian.Uint64(buf[8:]) > binary.LittleEndian.Uint64(current[8:]) {
+			current = buf
+		}
+	}
+	if current == nil {
+		return fmt.Errorf("vhdx: no valid header: %w", errors.Join(errs...))
+	}
+	if version := binary.LittleEndian.Uint16(current[66:]); version != 1 {
+		return fmt.Errorf("%w: version %d", ErrUnsupported, version)
+	}
+	var logGUID guid
+	copy(logGUID[:], current[48:64])
+	if logGUID != (guid{}) {
+		return fmt.Errorf("%w: the log must be replayed by Hyper-V before the image can be read", ErrUnsupported)
+	}
+	return nil
+}
+
+func (img *Image) readRegionTable() (map[guid]region, error) {
+	var (
+		buf  []byte
+		errs []error
+	)
+	for _, off := range []int64{regionTableOffset1, regionTableOffset2} {
+		b, err := img.readChecked(off, regionTableSize, "regi")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("region table at %#x: %w", off, err))
+			continue
+		}
+		buf = b
+		break
+	}
+	if buf == nil {
+		return nil, fmt.Errorf("vhdx: no valid region table: %w", errors.Join(errs...))
+	}
+	le := binary.LittleEndian
+	count := int(le.Uint32(buf[8:]))
+	if count > maxRegionEntries {
+		return nil, fmt.Errorf("vhdx: invalid region table entry count %d", count)
+	}
+	regions := make(map[guid]region, count)
+	for i := range count {
+		e := buf[16+i*32:]
+		var id guid
+		copy(id[:], e[:16])
+		r := region{
+			offset: int64(le.Uint64(e[16:])),
+			length: int64(le.Uint32(e[24:])),
+		}
+		required := le.Uint32(e[28:])&1 != 0
+		if id != regionBAT && id != regionMetadata {
+			if required {
+				return nil, fmt.Errorf("%w: required region %x", ErrUnsupported, id)
+			}
+			continue
+		}
+		if r.offset < headerAreaSize || r.offset%miB != 0 || r.length%miB != 0 ||
+			r.offset > img.fileSize || r.length > img.fileSize-r.offset {
+			return nil, fmt.Errorf("vhdx: region %x at %#x with length %d is out of bounds", id, r.offset, r.length)
+		}
+		regions[id] = r
+	}
+	for _, id := range []guid{regionBAT, regionMetadata} {
+		if _, ok := regions[id]; !ok {
+			return nil, fmt.Errorf("vhdx: missing region %x", id)
+		}
+	}
+	a, b := regions[regionBAT], regions[regionMetadata]
+	if a.offset < b.offset+b.length && b.offset < a.offset+a.length {
+		return nil, errors.New("vhdx: BAT and metadata regions overlap")
+	}
+	return regions, nil
+}
+
+func (img *Image) readMetadata(r region) error {
+	buf := make([]byte, r.length)
+	if _, err := img.f.ReadAt(buf, r.offset); err != nil {
+		return fmt.Errorf("vhdx: failed to read metadata region: %w", err)
+	}
+	if string(buf[:8]) != "metadata" {
+		return errors.New("vhdx: invalid metadata table signature")
+	}
+	le := binary.LittleEndian
+	count := int(le.Uint16(buf[10:]))
+	if count > maxMetadataEntries {
+		return fmt.Errorf("vhdx: invalid metadata entry count %d", count)
+	}
+	items := make(map[guid][]byte, count)
+	for i := range count {
+		e := buf[32+i*32:]
+		var id guid
+		copy(id[:], e[:16])
+		off := int64(le.Uint32(e[16:]))
+		length := int64(le.Uint32(e[20:]))
+		required := le.Uint32(e[24:])&(1<<2) != 0
+		if off+length > r.length || (length != 0 && off < 64*kiB) {
+			return fmt.Errorf("vhdx: metadata item %x is out of bounds", id)
+		}
+		if !slices.Contains(knownMetadataItemsIDs, id) {
+			if required {
+				return fmt.Errorf("%w: required metadata item %x", ErrUnsupported, id)
+			}
+			continue
+		}
+		items[id] = buf[off : off+length]
+	}
+
+	params := items[metaFileParameters]
+	size := items[metaVirtualDiskSize]
+	sector := items[metaLogicalSector]
+	if len(params) < 8 || len(size) < 8 || len(sector) < 4 {
+		return errors.New("vhdx: missing required metadata items")
+	}
+	img.blockSize = int64(le.Uint32(params[0:]))
+	if le.Uint32(params[4:])&(1<<1) != 0 {
+		return fmt.Errorf("%w: differencing disk with a parent", ErrUnsupported)
+	}
+	img.virtualSize = int64(le.Uint64(size))
+	img.logicalSectorSize = int64(le.Uint32(sector))
+
+	if img.blockSize < 1*miB || img.blockSize > 256*miB || img.blockSize&(img.blockSize-1) != 0 {
+		return fmt.Errorf("vhdx: invalid block size %d", img.blockSize)
+	}
+	if img.logicalSectorSize != 512 && img.logicalSectorSize != 4096 {
+		return fmt.Errorf("vhdx: invalid logical sector size %d", img.logicalSectorSize)
+	}
+	if img.virtualSize < 0 || img.virtualSize > 64<<40 || img.virtualSize%img.logicalSectorSize != 0 {
+		return fmt.Errorf("vhdx: invalid virtual disk size %d", img.virtualSize)
+	}
+	img.chunkRatio = (1 << 23) * img.logicalSectorSize / img.blockSize
+	return nil
+}
+
+func (img *Image) readBAT(r region, regions map[guid]region) error {
+	blocks := (img.virtualSize + img.blockSize - 1) / img.blockSize
+	var entries int64
+	if blocks > 0 {
+		// A sector bitmap entry follows every chunkRatio payload entries.
+		entries = blocks + (blocks-1)/img.chunkRatio
+	}
+	if entries*8 > r.length {
+		return fmt.Errorf("vhdx: BAT region holds %d entries but %d are required", r.length/8, entries)
+	}
+	buf := make([]byte, entries*8)
+	if _, err := img.f.ReadAt(buf, r.offset); err != nil {
+		return fmt.Errorf("vhdx: failed to read BAT: %w", err)
+	}
+
+	img.bat = make([]uint64, blocks)
+	var offsets []int64
+	for i := range blocks {
+		e := binary.LittleEndian.Uint64(buf[(i+i/img.chunkRatio)*8:])
+		img.bat[i] = e
+		switch e & 7 {
+		case blockNotPresent, blockUndefined, blockZero, blockUnmapped:
+			continue
+		case blockFullyPresent:
+		case blockPartiallyPresent:
+			return fmt.Errorf("%w: partially present block %d", ErrUnsupported, i)
+		default:
+			return fmt.Errorf("vhdx: invalid state %d of block %d", e&7, i)
+		}
+		off := int64(e>>20) * miB
+		if off < headerAreaSize || off > img.fileSize || img.blockSize > img.fileSize-off {
+			return fmt.Errorf("vhdx: block %d at %#x exceeds end of file", i, off)
+		}
+		for _, reg := range regions {
+			if off < reg.offset+reg.length && reg.offset < off+img.blockSize {
+				return fmt.Errorf("vhdx: block %d at %#x overlaps metadata", i, off)
+			}
+		}
+		offsets = append(offsets, off)
+	}
+	slices.Sort(offsets)
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i]-offsets[i-1] < img.blockSize {
+			return fmt.Errorf("vhdx: blocks at %#x and %#x overlap", offsets[i-1], offsets[i])
+		}
+	}
+	return nil
+}
+
+// Size returns the virtual size of the disk in bytes.
+func (img *Image) Size() int64 { return img.virtualSize }
+
+// BlockSize returns the payload block size of the image in bytes.
+func (img *Image) BlockSize() int64 { return img.blockSize }
+
+// Close closes the image.
+func (img *Image) Close() error { return img.f.Close() }
+
+// ReadAt reads len(p) bytes of the virtual disk starting at off.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vhdx: negative offset")
+	}
+	size := img.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(p)) > size-off {
+		p = p[:size-off]
+		eof = io.EOF
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		chunk := p[n : n+int(min(int64(len(p)-n), img.blockSize-pos%img.blockSize))]
+		e := img.bat[pos/img.blockSize]
+		if e&7 == blockFullyPresent {
+			hostOff := int64(e>>20)*miB + pos%img.blockSize
+			if _, err := img.f.ReadAt(chunk, hostOff); err != nil {
+				return n, err
+			}
+		} else {
+			clear(chunk)
+		}
+		n += len(chunk)
+	}
+	return n, eof
+}
@@ -0,0 +1,241 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testImage struct {
+	virtualSize int64
+	blocks      map[int64][]byte
+	hasParent   bool
+	// corrupt is called with the file content before it is written to disk.
+	corrupt func(file []byte)
+}
+
+const (
+	testBlockSize = 1 * miB
+	metadataAt    = 1 * miB
+	batAt         = 2 * miB
+	dataAt        = 3 * miB
+)
+
+func putChecksum(b []byte) {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, crc32c))
+}
+
+func writeTestImage(t *testing.T, path string, ti testImage) {
+	t.Helper()
+	le := binary.LittleEndian
+	file := make([]byte, dataAt)
+	copy(file, Magic)
+
+	for i, off := range []int{headerOffset1, headerOffset2} {
+		h := file[off : off+headerSize]
+		copy(h, "head")
+		le.PutUint64(h[8:], uint64(i+1)) // sequence number
+		le.PutUint16(h[66:], 1)          // version
+		putChecksum(h)
+	}
+	for _, off := range []int{regionTableOffset1, regionTableOffset2} {
+		rt := file[off : off+regionTableSize]
+		copy(rt, "regi")
+		le.PutUint32(rt[8:], 2)
+		copy(rt[16:], regionBAT[:])
+		le.PutUint64(rt[32:], batAt)
+		le.PutUint32(rt[40:], 1*miB)
+		le.PutUint32(rt[44:], 1)
+		copy(rt[48:], regionMetadata[:])
+		le.PutUint64(rt[64:], metadataAt)
+		le.PutUint32(rt[72:], 1*miB)
+		le.PutUint32(rt[76:], 1)
+		putChecksum(rt)
+	}
+
+	var paramFlags uint32
+	if ti.hasParent {
+		paramFlags |= 1 << 1
+	}
+	md := file[metadataAt : metadataAt+miB]
+	copy(md, "metadata")
+	items := []struct {
+		id   guid
+		data []byte
+	}{
+		{metaFileParameters, le.AppendUint32(le.AppendUint32(nil, testBlockSize), paramFlags)},
+		{metaVirtualDiskSize, le.AppendUint64(nil, uint64(ti.virtualSize))},
+		{metaLogicalSector, le.AppendUint32(nil, 512)},
+		{metaPhysicalSector, le.AppendUint32(nil, 4096)},
+	}
+	le.PutUint16(md[10:], uint16(len(items)))
+	itemOff := 64 * kiB
+	for i, item := range items {
+		e := md[32+i*32:]
+		copy(e, item.id[:])
+		le.PutUint32(e[16:], uint32(itemOff))
+		le.PutUint32(e[20:], uint32(len(item.data)))
+		le.PutUint32(e[24:], 1<<2)
+		copy(md[itemOff:], item.data)
+		itemOff += len(item.data)
+	}
+
+	chunkRatio := int64((1 << 23) * 512 / testBlockSize)
+	blocks := (ti.virtualSize + testBlockSize - 1) / testBlockSize
+	for i := range blocks {
+		entry := uint64(blockNotPresent)
+		if content, ok := ti.blocks[i]; ok {
+			off := len(file)
+			block := make([]byte, testBlockSize)
+			copy(block, content)
+			file = append(file, block...)
+			entry = uint64(off/miB)<<20 | blockFullyPresent
+		}
+		le.PutUint64(file[batAt+(i+i/chunkRatio)*8:], entry)
+	}
+	if ti.corrupt != nil {
+		ti.corrupt(file)
+	}
+	if err := os.WriteFile(path, file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRead(t *testing.T) {
+	const virtualSize = 5*miB + 512
+	blocks := map[int64][]byte{
+		0: []byte("first block"),
+		2: bytes.Repeat([]byte{0x77}, testBlockSize),
+		5: []byte("tail"),
+	}
+	path := filepath.Join(t.TempDir(), "disk.vhdx")
+	writeTestImage(t, path, testImage{virtualSize: virtualSize, blocks: blocks})
+
+	img, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if got := img.Size(); got != virtualSize {
+		t.Fatalf("want size %d but got %d", virtualSize, got)
+	}
+	want := make([]byte, virtualSize)
+	for i, content := range blocks {
+		copy(want[i*testBlockSize:], content)
+	}
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("content mismatch")
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	le := binary.LittleEndian
+	cases := []struct {
+		name    string
+		corrupt func(file []byte)
+		wantErr string
+	}{
+		{
+			name: "both headers damaged",
+			corrupt: func(file []byte) {
+				file[headerOffset1+100] ^= 1
+				file[headerOffset2+100] ^= 1
+			},
+			wantErr: "no valid header",
+		},
+		{
+			name: "both region tables damaged",
+			corrupt: func(file []byte) {
+				file[regionTableOffset1+20] ^= 1
+				file[regionTableOffset2+20] ^= 1
+			},
+			wantErr: "no valid region table",
+		},
+		{
+			name: "block beyond end of file",
+			corrupt: func(file []byte) {
+				le.PutUint64(file[batAt:], 1000<<20|blockFullyPresent)
+			},
+			wantErr: "exceeds end of file",
+		},
+		{
+			name: "block overlaps metadata",
+			corrupt: func(file []byte) {
+				le.PutUint64(file[batAt:], 1<<20|blockFullyPresent)
+			},
+			wantErr: "overlaps metadata",
+		},
+		{
+			name: "overlapping blocks",
+			corrupt: func(file []byte) {
+				le.PutUint64(file[batAt+8:], le.Uint64(file[batAt:]))
+			},
+			wantErr: "overlap",
+		},
+		{
+			name: "invalid block state",
+			corrupt: func(file []byte) {
+				le.PutUint64(file[batAt+8:], 4)
+			},
+			wantErr: "invalid state",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk.vhdx")
+			writeTestImage(t, path, testImage{
+				virtualSize: 4 * miB,
+				blocks:      map[int64][]byte{0: []byte("a"), 1: []byte("b")},
+				corrupt:     tc.corrupt,
+			})
+			_, err := Open(path)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want error containing %q but got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestOpenFallbackHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.vhdx")
+	writeTestImage(t, path, testImage{
+		virtualSize: 2 * miB,
+		blocks:      map[int64][]byte{1: []byte("data")},
+		corrupt: func(file []byte) {
+			// damage the newer header and the first region table.
+			file[headerOffset2+100] ^= 1
+			file[regionTableOffset1+20] ^= 1
+		},
+	})
+	img, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	p := make([]byte, 4)
+	if _, err := img.ReadAt(p, miB); err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "data" {
+		t.Fatalf("want %q but got %q", "data", p)
+	}
+}
+
+func TestOpenDifferencing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.vhdx")
+	writeTestImage(t, path, testImage{virtualSize: 2 * miB, hasParent: true})
+	if _, err := Open(path); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("want ErrUnsupported but got %v", err)
+	}
+}
@@ -0,0 +1,436 @@
+// Package vmdk implements a reader for VMware hosted sparse extents, which
+// are used by monolithicSparse and streamOptimized VMDK disk images.
+//
+// see: https://www.vmware.com/app/vmdk/?src=vmdk
+package vmdk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Magic is the magic number at the start of every hosted sparse extent.
+var Magic = []byte("KDMV")
+
+// ErrUnsupported is returned when an image uses a feature this package
+// does not implement.
+var ErrUnsupported = errors.New("vmdk: unsupported feature")
+
+const (
+	sectorSize = 512
+	headerSize = 512
+
+	// gdAtEnd is the grain directory offset of a streamOptimized image
+	// whose metadata is stored in the footer.
+	gdAtEnd = 0xffffffffffffffff
+
+	flagRedundantGT = 1 << 1
+	flagZeroedGTE   = 1 << 2
+	flagCompressed  = 1 << 16
+	flagMarkers     = 1 << 17
+
+	compressionNone    = 0
+	compressionDeflate = 1
+
+	// maxGrainSectors limits the grain size to 1 MiB.
+	maxGrainSectors = 2048
+	maxGTEsPerGT    = 4096
+)
+
+// header is the hosted sparse extent header.
+type header struct {
+	Version           uint32
+	Flags             uint32
+	Capacity          uint64
+	GrainSize         uint64
+	DescriptorOffset  uint64
+	DescriptorSize    uint64
+	NumGTEsPerGT      uint32
+	RGDOffset         uint64
+	GDOffset          uint64
+	OverHead          uint64
+	UncleanShutdown   uint8
+	CompressAlgorithm uint16
+}
+
+func parseHeader(buf []byte) (*header, error) {
+	if len(buf) < headerSize || !bytes.Equal(buf[:4], Magic) {
+		return nil, errors.New("vmdk: not a hosted sparse extent")
+	}
+	le := binary.LittleEndian
+	return &header{
+		Version:           le.Uint32(buf[4:]),
+		Flags:             le.Uint32(buf[8:]),
+		Capacity:          le.Uint64(buf[12:]),
+		GrainSize:         le.Uint64(buf[20:]),
+		DescriptorOffset:  le.Uint64(buf[28:]),
+		DescriptorSize:    le.Uint64(buf[36:]),
+		NumGTEsPerGT:      le.Uint32(buf[44:]),
+		RGDOffset:         le.Uint64(buf[48:]),
+		GDOffset:          le.Uint64(buf[56:]),
+		OverHead:          le.Uint64(buf[64:]),
+		UncleanShutdown:   buf[72],
+		CompressAlgorithm: le.Uint16(buf[77:]),
+	}, nil
+}
+
+// Image is a VMDK hosted sparse extent opened for reading.
+//
+// Image is safe for concurrent use.
+type Image struct {
+	f          *os.File
+	fileSize   int64
+	hdr        *header
+	createType string
+
+	grainSize  int64
+	compressed bool
+	// gts holds all grain tables. A nil table is not allocated.
+	gts [][]uint32
+
+	mu     sync.Mutex
+	zgrain []byte
+	zindex int64
+}
+
+// Open opens the VMDK image at path and verifies its grain directory and
+// grain tables.
+func Open(path string) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := newImage(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func newImage(f *os.File) (*Image, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{
+		f:        f,
+		fileSize: fi.Size(),
+		zindex:   -1,
+	}
+	buf := make([]byte, headerSize)
+	n, err := f.ReadAt(buf, 0)
+	if bytes.HasPrefix(buf[:n], []byte("# Disk DescriptorFile")) {
+		return nil, fmt.Errorf("%w: descriptor file without embedded extent", ErrUnsupported)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("vmdk: failed to read header: %w", err)
+	}
+	hdr, err := parseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.GDOffset == gdAtEnd {
+		// streamOptimized images written in a single pass store the final
+		// header in the footer, which precedes the end-of-stream marker.
+		if hdr.Flags&flagMarkers == 0 || img.fileSize < 3*sectorSize {
+			return nil, errors.New("vmdk: grain directory at end without footer")
+		}
+		if _, err := f.ReadAt(buf, img.fileSize-2*sectorSize); err != nil {
+			return nil, fmt.Errorf("vmdk: failed to read footer: %w", err)
+		}
+		footer, err := parseHeader(buf)
+		if err != nil {
+			return nil, fmt.Errorf("vmdk: invalid footer: %w", err)
+		}
+		if footer.GDOffset == gdAtEnd {
+			return nil, errors.New("vmdk: footer has no grain directory")
+		}
+		hdr = footer
+	}
+	img.hdr = hdr
+	if err := img.validateHeader(); err != nil {
+		return nil, err
+	}
+	if err := img.readDescriptor(); err != nil {
+		return nil, err
+	}
+	img.gts, err = img.readGrainTables(hdr.GDOffset)
+	if err != nil {
+		return nil, err
+	}
+	if err := img.verify(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func (img *Image) validateHeader() error {
+	h := img.hdr
+	if h.Version < 1 || h.Version > 3 {
+		return fmt.Errorf("%w: version %d", ErrUnsupported, h.Version)
+	}
+	if h.GrainSize < 8 || h.GrainSize > maxGrainSectors || h.GrainSize&(h.GrainSize-1) != 0 {
+		return fmt.Errorf("vmdk: invalid grain size %d sectors", h.GrainSize)
+	}
+	if h.NumGTEsPerGT == 0 || h.NumGTEsPerGT > maxGTEsPerGT {
+		return fmt.Errorf("vmdk: invalid number of grain table entries %d", h.NumGTEsPerGT)
+	}
+	if h.Capacity > 1<<62/sectorSize {
+		return fmt.Errorf("vmdk: invalid capacity %d sectors", h.Capacity)
+	}
+	if h.Flags&flagCompressed != 0 {
+		switch h.CompressAlgorithm {
+		case compressionDeflate:
+			img.compressed = true
+		case compressionNone:
+		default:
+			return fmt.Errorf("%w: compression algorithm %d", ErrUnsupported, h.CompressAlgorithm)
+		}
+	}
+	img.grainSize = int64(h.GrainSize) * sectorSize
+	return nil
+}
+
+// readDescriptor reads the embedded descriptor, which tells whether the
+// extent depends on a parent disk.
+func (img *Image) readDescriptor() error {
+	h := img.hdr
+	if h.DescriptorOffset == 0 || h.DescriptorSize == 0 {
+		return nil
+	}
+	if h.DescriptorOffset > uint64(img.fileSize) || h.DescriptorSize > 2048 {
+		return errors.New("vmdk: embedded descriptor exceeds end of file")
+	}
+	off := int64(h.DescriptorOffset) * sectorSize
+	size := int64(h.DescriptorSize) * sectorSize
+	if off+size > img.fileSize {
+		return errors.New("vmdk: embedded descriptor exceeds end of file")
+	}
+	buf := make([]byte, size)
+	if _, err := img.f.ReadAt(buf, off); err != nil {
+		return fmt.Errorf("vmdk: failed to read descriptor: %w", err)
+	}
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "createType":
+			img.createType = value
+		case "parentCID":
+			if !strings.EqualFold(value, "ffffffff") {
+				return fmt.Errorf("%w: delta disk with a parent", ErrUnsupported)
+			}
+		}
+	}
+	return nil
+}
+
+func (img *Image) readGrainTables(gdOffset uint64) ([][]uint32, error) {
+	h := img.hdr
+	grains := (int64(h.Capacity) + int64(h.GrainSize) - 1) / int64(h.GrainSize)
+	gtCount := (grains + int64(h.NumGTEsPerGT) - 1) / int64(h.NumGTEsPerGT)
+
+	gdOff := int64(gdOffset) * sectorSize
+	if gdOffset == 0 || gdOffset > uint64(img.fileSize) || gdOff+gtCount*4 > img.fileSize {
+		return nil, fmt.Errorf("vmdk: grain directory at sector %d exceeds end of file", gdOffset)
+	}
+	gd := make([]byte, gtCount*4)
+	if _, err := img.f.ReadAt(gd, gdOff); err != nil {
+		return nil, fmt.Errorf("vmdk: failed to read grain directory: %w", err)
+	}
+
+	gtSize := int64(h.NumGTEsPerGT) * 4
+	gts := make([][]uint32, gtCount)
+	buf := make([]byte, gtSize)
+	for i := range gts {
+		sector := int64(binary.LittleEndian.Uint32(gd[i*4:]))
+		if sector == 0 {
+			continue
+		}
+		if sector*sectorSize+gtSize > img.fileSize {
+			return nil, fmt.Errorf("vmdk: grain table %d at sector %d exceeds end of file", i, sector)
+		}
+		if _, err := img.f.ReadAt(buf, sector*sectorSize); err != nil {
+			return nil, fmt.Errorf("vmdk: failed to read grain table %d: %w", i, err)
+		}
+		gt := make([]uint32, h.NumGTEsPerGT)
+		for j := range gt {
+			gt[j] = binary.LittleEndian.Uint32(buf[j*4:])
+		}
+		gts[i] = gt
+	}
+	return gts, nil
+}
+
+// verify checks that every grain table entry refers to a distinct grain
+// inside the file, and that the redundant grain tables match if present.
+func (img *Image) verify() error {
+	h := img.hdr
+	var sectors []uint32
+	for i, gt := range img.gts {
+		for j, gte := range gt {
+			if !img.allocated(gte) {
+				continue
+			}
+			grain := int64(i)*int64(h.NumGTEsPerGT) + int64(j)
+			off := int64(gte) * sectorSize
+			end := off + img.grainSize
+			if img.compressed {
+				end = off + 12
+			}
+			if gte == 0 || end > img.fileSize {
+				return fmt.Errorf("vmdk: grain %d at sector %d exceeds end of file", grain, gte)
+			}
+			sectors = append(sectors, gte)
+		}
+	}
+	slices.Sort(sectors)
+	for i := 1; i < len(sectors); i++ {
+		if sectors[i] == sectors[i-1] {
+			return fmt.Errorf("vmdk: multiple grains refer to sector %d", sectors[i])
+		}
+		if !img.compressed && int64(sectors[i]-sectors[i-1]) < int64(h.GrainSize) {
+			return fmt.Errorf("vmdk: grains at sector %d and %d overlap", sectors[i-1], sectors[i])
+		}
+	}
+
+	if h.Flags&flagRedundantGT == 0 || h.RGDOffset == 0 || h.RGDOffset == gdAtEnd {
+		return nil
+	}
+	rgts, err := img.readGrainTables(h.RGDOffset)
+	if err != nil {
+		return fmt.Errorf("vmdk: redundant grain directory: %w", err)
+	}
+	for i := range img.gts {
+		if !slices.Equal(img.gts[i], rgts[i]) {
+			return fmt.Errorf("vmdk: grain table %d does not match its redundant copy", i)
+		}
+	}
+	return nil
+}
+
+// allocated reports whether gte refers to a grain stored in the file.
+func (img *Image) allocated(gte uint32) bool {
+	if gte == 0 {
+		return false
+	}
+	if gte == 1 && img.hdr.Flags&flagZeroedGTE != 0 {
+		return false
+	}
+	return true
+}
+
+// Size returns the virtual size of the disk in bytes.
+func (img *Image) Size() int64 { return int64(img.hdr.Capacity) * sectorSize }
+
+// CreateType returns the createType of the embedded descriptor, such as
+// "monolithicSparse" or "streamOptimized".
+func (img *Image) CreateType() string { return img.createType }
+
+// Close closes the image.
+func (img *Image) Close() error { return img.f.Close() }
+
+// ReadAt reads len(p) bytes of the virtual disk starting at off.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vmdk: negative offset")
+	}
+	size := img.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(p)) > size-off {
+		p = p[:size-off]
+		eof = io.EOF
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		chunk := min(int64(len(p)-n), img.grainSize-pos%img.grainSize)
+		if err := img.readGrain(p[n:n+int(chunk)], pos); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+	}
+	return n, eof
+}
+
+// readGrain reads p from the virtual disk at off. p must not cross a grain
+// boundary.
+func (img *Image) readGrain(p []byte, off int64) error {
+	grain := off / img.grainSize
+	perGT := int64(img.hdr.NumGTEsPerGT)
+	gt := img.gts[grain/perGT]
+	if gt == nil || !img.allocated(gt[grain%perGT]) {
+		clear(p)
+		return nil
+	}
+	gte := int64(gt[grain%perGT])
+	inGrain := off % img.grainSize
+	if !img.compressed {
+		_, err := img.f.ReadAt(p, gte*sectorSize+inGrain)
+		return err
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.zindex != grain {
+		if err := img.decompress(grain, gte); err != nil {
+			return err
+		}
+	}
+	copy(p, img.zgrain[inGrain:])
+	return nil
+}
+
+// decompress decompresses the grain stored at sector gte into img.zgrain.
+// img.mu must be held.
+func (img *Image) decompress(grain, gte int64) error {
+	var marker [12]byte
+	if _, err := img.f.ReadAt(marker[:], gte*sectorSize); err != nil {
+		return fmt.Errorf("vmdk: failed to read grain %d: %w", grain, err)
+	}
+	lba := binary.LittleEndian.Uint64(marker[0:])
+	size := int64(binary.LittleEndian.Uint32(marker[8:]))
+	if want := uint64(grain) * img.hdr.GrainSize; lba != want {
+		return fmt.Errorf("vmdk: compressed grain %d has LBA %d, want %d", grain, lba, want)
+	}
+	if gte*sectorSize+12+size > img.fileSize {
+		return fmt.Errorf("vmdk: compressed grain %d exceeds end of file", grain)
+	}
+	if img.zgrain == nil {
+		img.zgrain = make([]byte, img.grainSize)
+	}
+	img.zindex = -1
+	zr, err := zlib.NewReader(io.NewSectionReader(img.f, gte*sectorSize+12, size))
+	if err != nil {
+		return fmt.Errorf("vmdk: failed to decompress grain %d: %w", grain, err)
+	}
+	defer zr.Close()
+	n, err := io.ReadFull(zr, img.zgrain)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("vmdk: failed to decompress grain %d: %w", grain, err)
+	}
+	// The last grain of the disk may be shorter than the grain size.
+	clear(img.zgrain[n:])
+	img.zindex = grain
+	return nil
+}
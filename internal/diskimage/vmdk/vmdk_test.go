@@ -0,0 +1,338 @@
+package vmdk_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/diskimage/vmdk"
+)
+
+const (
+	sectorSize   = 512
+	grainSectors = 8
+	grainSize    = grainSectors * sectorSize
+	gtesPerGT    = 512
+)
+
+type testImage struct {
+	capacity  int64 // in bytes
+	grains    map[int64][]byte
+	stream    bool
+	parentCID string
+
+	// corrupt is called with the grain directory and the grain tables
+	// before they are written to disk.
+	corrupt func(gd []uint32, gts [][]uint32, rgts [][]uint32)
+}
+
+func putHeader(b []byte, flags uint32, capacity, descOff, descSize, rgd, gd, overhead uint64, compress uint16) {
+	le := binary.LittleEndian
+	copy(b, vmdk.Magic)
+	le.PutUint32(b[4:], 3)
+	le.PutUint32(b[8:], flags)
+	le.PutUint64(b[12:], capacity)
+	le.PutUint64(b[20:], grainSectors)
+	le.PutUint64(b[28:], descOff)
+	le.PutUint64(b[36:], descSize)
+	le.PutUint32(b[44:], gtesPerGT)
+	le.PutUint64(b[48:], rgd)
+	le.PutUint64(b[56:], gd)
+	le.PutUint64(b[64:], overhead)
+	copy(b[73:], "\n \r\n")
+	le.PutUint16(b[77:], compress)
+}
+
+func descriptor(createType, parentCID string) []byte {
+	if parentCID == "" {
+		parentCID = "ffffffff"
+	}
+	d := fmt.Sprintf("# Disk DescriptorFile\nversion=1\nCID=12345678\nparentCID=%s\ncreateType=%q\n", parentCID, createType)
+	b := make([]byte, sectorSize)
+	copy(b, d)
+	return b
+}
+
+func sectors(n int) []byte { return make([]byte, n*sectorSize) }
+
+func writeTestImage(t *testing.T, path string, ti testImage) {
+	t.Helper()
+	if ti.stream {
+		writeStreamOptimized(t, path, ti)
+		return
+	}
+	le := binary.LittleEndian
+	capSectors := ti.capacity / sectorSize
+	grains := (capSectors + grainSectors - 1) / grainSectors
+	gtCount := (grains + gtesPerGT - 1) / gtesPerGT
+	gtSectors := gtesPerGT * 4 / sectorSize
+	gdSectors := int((gtCount*4 + sectorSize - 1) / sectorSize)
+
+	// header, descriptor, rgd, rgts, gd, gts
+	rgd := int64(2)
+	rgtStart := rgd + int64(gdSectors)
+	gd := rgtStart + gtCount*int64(gtSectors)
+	gtStart := gd + int64(gdSectors)
+	overhead := gtStart + gtCount*int64(gtSectors)
+	overhead = (overhead + grainSectors - 1) / grainSectors * grainSectors
+
+	gdEntries := make([]uint32, gtCount)
+	gts := make([][]uint32, gtCount)
+	rgts := make([][]uint32, gtCount)
+	for i := range gts {
+		gdEntries[i] = uint32(gtStart + int64(i*gtSectors))
+		gts[i] = make([]uint32, gtesPerGT)
+		rgts[i] = make([]uint32, gtesPerGT)
+	}
+	var data []byte
+	next := overhead
+	for g := int64(0); g < grains; g++ {
+		content, ok := ti.grains[g]
+		if !ok {
+			continue
+		}
+		gts[g/gtesPerGT][g%gtesPerGT] = uint32(next)
+		rgts[g/gtesPerGT][g%gtesPerGT] = uint32(next)
+		grain := make([]byte, grainSize)
+		copy(grain, content)
+		data = append(data, grain...)
+		next += grainSectors
+	}
+	if ti.corrupt != nil {
+		ti.corrupt(gdEntries, gts, rgts)
+	}
+
+	file := sectors(int(overhead))
+	putHeader(file, 1|1<<1, uint64(capSectors), 1, 1, uint64(rgd), uint64(gd), uint64(overhead), 0)
+	copy(file[sectorSize:], descriptor("monolithicSparse", ti.parentCID))
+	for i := range gts {
+		le.PutUint32(file[rgd*sectorSize+int64(i*4):], uint32(rgtStart+int64(i*gtSectors)))
+		le.PutUint32(file[gd*sectorSize+int64(i*4):], gdEntries[i])
+		for j := range gts[i] {
+			le.PutUint32(file[(rgtStart+int64(i*gtSectors))*sectorSize+int64(j*4):], rgts[i][j])
+			le.PutUint32(file[(gtStart+int64(i*gtSectors))*sectorSize+int64(j*4):], gts[i][j])
+		}
+	}
+	file = append(file, data...)
+	if err := os.WriteFile(path, file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeStreamOptimized(t *testing.T, path string, ti testImage) {
+	t.Helper()
+	le := binary.LittleEndian
+	capSectors := ti.capacity / sectorSize
+	grains := (capSectors + grainSectors - 1) / grainSectors
+	gtCount := (grains + gtesPerGT - 1) / gtesPerGT
+
+	const flags = 1 | 1<<16 | 1<<17
+	file := sectors(128)
+	putHeader(file, flags, uint64(capSectors), 1, 1, 0, 0xffffffffffffffff, 128, 1)
+	copy(file[sectorSize:], descriptor("streamOptimized", ""))
+
+	marker := func(val uint64, typ uint32) []byte {
+		m := sectors(1)
+		le.PutUint64(m, val)
+		le.PutUint32(m[12:], typ)
+		return m
+	}
+
+	gts := make([][]uint32, gtCount)
+	for g := int64(0); g < grains; g++ {
+		content, ok := ti.grains[g]
+		if !ok {
+			continue
+		}
+		if gts[g/gtesPerGT] == nil {
+			gts[g/gtesPerGT] = make([]uint32, gtesPerGT)
+		}
+		grain := make([]byte, grainSize)
+		copy(grain, content)
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(grain)
+		zw.Close()
+
+		gts[g/gtesPerGT][g%gtesPerGT] = uint32(len(file) / sectorSize)
+		hdr := make([]byte, 12)
+		le.PutUint64(hdr, uint64(g*grainSectors))
+		le.PutUint32(hdr[8:], uint32(buf.Len()))
+		file = append(file, hdr...)
+		file = append(file, buf.Bytes()...)
+		if pad := len(file) % sectorSize; pad != 0 {
+			file = append(file, make([]byte, sectorSize-pad)...)
+		}
+	}
+	gd := make([]uint32, gtCount)
+	if ti.corrupt != nil {
+		ti.corrupt(gd, gts, nil)
+	}
+	gtSectors := gtesPerGT * 4 / sectorSize
+	for i, gt := range gts {
+		if gt == nil {
+			continue
+		}
+		file = append(file, marker(uint64(gtSectors), 1)...)
+		gd[i] = uint32(len(file) / sectorSize)
+		b := sectors(gtSectors)
+		for j, gte := range gt {
+			le.PutUint32(b[j*4:], gte)
+		}
+		file = append(file, b...)
+	}
+	gdSectors := (len(gd)*4 + sectorSize - 1) / sectorSize
+	file = append(file, marker(uint64(gdSectors), 2)...)
+	gdOffset := len(file) / sectorSize
+	b := sectors(gdSectors)
+	for i, e := range gd {
+		le.PutUint32(b[i*4:], e)
+	}
+	file = append(file, b...)
+
+	file = append(file, marker(1, 3)...)
+	footer := sectors(1)
+	putHeader(footer, flags, uint64(capSectors), 1, 1, 0, uint64(gdOffset), 128, 1)
+	file = append(file, footer...)
+	file = append(file, sectors(1)...) // end-of-stream marker
+	if err := os.WriteFile(path, file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRead(t *testing.T) {
+	const capacity = 5 << 20 // 3 grain tables
+	grains := map[int64][]byte{
+		0:    []byte("first grain"),
+		1:    bytes.Repeat([]byte{0x5a}, grainSize),
+		700:  []byte("second grain table"),
+		1279: append(bytes.Repeat([]byte{1}, grainSize-1), 2),
+	}
+	want := make([]byte, capacity)
+	for g, content := range grains {
+		copy(want[g*grainSize:], content)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		stream     bool
+		createType string
+	}{
+		{name: "monolithicSparse", createType: "monolithicSparse"},
+		{name: "streamOptimized", stream: true, createType: "streamOptimized"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk.vmdk")
+			writeTestImage(t, path, testImage{
+				capacity: capacity,
+				grains:   grains,
+				stream:   tc.stream,
+			})
+			img, err := vmdk.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+			if got := img.Size(); got != capacity {
+				t.Fatalf("want size %d but got %d", capacity, got)
+			}
+			if got := img.CreateType(); got != tc.createType {
+				t.Fatalf("want createType %q but got %q", tc.createType, got)
+			}
+			got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(want, got) {
+				t.Fatal("content mismatch")
+			}
+		})
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	cases := []struct {
+		name    string
+		ti      testImage
+		wantErr string
+	}{
+		{
+			name: "grain beyond end of file",
+			ti: testImage{
+				grains: map[int64][]byte{0: []byte("a")},
+				corrupt: func(gd []uint32, gts, rgts [][]uint32) {
+					gts[0][0] = 1 << 30
+					rgts[0][0] = 1 << 30
+				},
+			},
+			wantErr: "exceeds end of file",
+		},
+		{
+			name: "grain table beyond end of file",
+			ti: testImage{
+				corrupt: func(gd []uint32, gts, rgts [][]uint32) {
+					gd[1] = 1 << 30
+				},
+			},
+			wantErr: "grain table 1",
+		},
+		{
+			name: "overlapping grains",
+			ti: testImage{
+				grains: map[int64][]byte{0: []byte("a"), 1: []byte("b")},
+				corrupt: func(gd []uint32, gts, rgts [][]uint32) {
+					gts[0][1] = gts[0][0]
+					rgts[0][1] = rgts[0][0]
+				},
+			},
+			wantErr: "multiple grains",
+		},
+		{
+			name: "redundant grain table mismatch",
+			ti: testImage{
+				grains: map[int64][]byte{0: []byte("a"), 1: []byte("b")},
+				corrupt: func(gd []uint32, gts, rgts [][]uint32) {
+					rgts[0][1] = 0
+				},
+			},
+			wantErr: "redundant copy",
+		},
+		{
+			name: "compressed grain beyond end of file",
+			ti: testImage{
+				stream: true,
+				grains: map[int64][]byte{0: []byte("a")},
+				corrupt: func(gd []uint32, gts, rgts [][]uint32) {
+					gts[0][0] = 1 << 30
+				},
+			},
+			wantErr: "exceeds end of file",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk.vmdk")
+			tc.ti.capacity = 5 << 20
+			writeTestImage(t, path, tc.ti)
+			_, err := vmdk.Open(path)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want error containing %q but got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestOpenUnsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "delta.vmdk")
+	writeTestImage(t, path, testImage{capacity: 1 << 20, parentCID: "12345678"})
+	if _, err := vmdk.Open(path); !errors.Is(err, vmdk.ErrUnsupported) {
+		t.Fatalf("want ErrUnsupported but got %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+// Package fstree reads the files of an fs.FS with the metadata which file
+// system images store for them, such as owners and extended attributes.
+package fstree
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxNameLen is the maximum length of a file name in bytes.
+const MaxNameLen = 255
+
+// xattrPrefix is the prefix of the PAX records holding extended attributes.
+const xattrPrefix = "SCHILY.xattr."
+
+// Node is a file or directory.
+type Node struct {
+	Name string
+	Path string // in the fs.FS
+
+	// Mode is the type and permission bits, including setuid, setgid and
+	// sticky bits.
+	Mode         fs.FileMode
+	UID, GID     uint32
+	ModTime      time.Time
+	Size         int64
+	Target       string // of a symbolic link
+	Major, Minor uint32 // of a device
+	Xattrs       []Xattr
+	Children     []*Node // of a directory, sorted by name
+
+	// Link is the node of the first name of a hard link, whose metadata
+	// and content the node shares. Nlink is the number of names of a file
+	// other than a directory.
+	Link  *Node
+	Nlink int
+}
+
+// Xattr is an extended attribute.
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+// IsDir reports whether n is a directory.
+func (n *Node) IsDir() bool { return n.Mode.IsDir() }
+
+// readLinkFS is fs.ReadLinkFS from Go 1.25.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// Read reads the tree of files of fsys.
+//
+// Files are owned by root, unless Sys of their fs.FileInfo returns a
+// *tar.Header, whose owner, permission bits, device numbers, extended
+// attributes in SCHILY.xattr PAX records and hard links are used. Files
+// without a modification time were modified at the Unix epoch, so the tree
+// only depends on fsys.
+//
+// Symbolic links are kept if fsys has the ReadLink and Lstat methods of
+// fs.ReadLinkFS, like os.DirFS from Go 1.25. Otherwise symbolic links to
+// files are copied as regular files, and symbolic links to directories
+// return an error.
+func Read(fsys fs.FS) (*Node, error) {
+	info, err := fs.Stat(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	root := &Node{Name: ".", Path: "."}
+	if err := root.setInfo(info); err != nil {
+		return nil, err
+	}
+	if !root.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root.Path)
+	}
+	r := &reader{fsys: fsys, nodes: map[string]*Node{".": root}, links: make(map[*Node]string)}
+	if err := r.readTree(root); err != nil {
+		return nil, err
+	}
+	for n, target := range r.links {
+		// a link whose target is missing is copied like a file of its own.
+		t := r.nodes[target]
+		if _, isLink := r.links[t]; t != nil && t.Mode.IsRegular() && !isLink {
+			n.Link = t
+			n.Mode, n.UID, n.GID, n.ModTime, n.Xattrs = t.Mode, t.UID, t.GID, t.ModTime, t.Xattrs
+			t.Nlink++
+		}
+	}
+	return root, nil
+}
+
+type reader struct {
+	fsys  fs.FS
+	nodes map[string]*Node
+	links map[*Node]string // the hard links and their targets
+}
+
+func (r *reader) readTree(dir *Node) error {
+	fsys := r.fsys
+	entries, err := fs.ReadDir(fsys, dir.Path)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		p := path.Join(dir.Path, e.Name())
+		if len(e.Name()) > MaxNameLen {
+			return fmt.Errorf("%s: name is longer than %d bytes", p, MaxNameLen)
+		}
+		n := &Node{Name: e.Name(), Path: p}
+		rl, ok := fsys.(readLinkFS)
+		var info fs.FileInfo
+		switch {
+		case e.Type()&fs.ModeSymlink != 0 && ok:
+			if info, err = rl.Lstat(p); err != nil {
+				return err
+			}
+			if n.Target, err = rl.ReadLink(p); err != nil {
+				return err
+			}
+		default:
+			if info, err = fs.Stat(fsys, p); err != nil {
+				return err
+			}
+			if info.IsDir() && e.Type()&fs.ModeSymlink != 0 {
+				return fmt.Errorf("%s: symbolic links to directories are not supported", p)
+			}
+		}
+		if err := n.setInfo(info); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if hdr, ok := info.Sys().(*tar.Header); ok && hdr.Typeflag == tar.TypeLink {
+			r.links[n] = path.Clean(strings.TrimPrefix(hdr.Linkname, "/"))
+		}
+		r.nodes[p] = n
+		dir.Children = append(dir.Children, n)
+		if !n.IsDir() {
+			n.Nlink = 1
+			continue
+		}
+		if err := r.readTree(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Node) setInfo(info fs.FileInfo) error {
+	mode := info.Mode()
+	switch mode.Type() {
+	case 0, fs.ModeDir, fs.ModeSymlink, fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice, fs.ModeNamedPipe, fs.ModeSocket:
+	default:
+		return fmt.Errorf("unsupported file type %s", mode.Type())
+	}
+	n.Mode = mode & (fs.ModeType | fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	n.ModTime = info.ModTime()
+	if n.ModTime.IsZero() {
+		n.ModTime = time.Unix(0, 0)
+	}
+	if mode.IsRegular() {
+		n.Size = info.Size()
+	}
+	hdr, ok := info.Sys().(*tar.Header)
+	if !ok {
+		return nil
+	}
+	if hdr.Uid < 0 || hdr.Gid < 0 || int64(hdr.Uid) > 1<<32-1 || int64(hdr.Gid) > 1<<32-1 {
+		return errors.New("invalid owner")
+	}
+	n.UID, n.GID = uint32(hdr.Uid), uint32(hdr.Gid)
+	n.Mode = mode.Type() | fs.FileMode(hdr.Mode&0o777)
+	if hdr.Mode&0o4000 != 0 {
+		n.Mode |= fs.ModeSetuid
+	}
+	if hdr.Mode&0o2000 != 0 {
+		n.Mode |= fs.ModeSetgid
+	}
+	if hdr.Mode&0o1000 != 0 {
+		n.Mode |= fs.ModeSticky
+	}
+	n.Major, n.Minor = uint32(hdr.Devmajor), uint32(hdr.Devminor)
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, xattrPrefix); ok {
+			n.Xattrs = append(n.Xattrs, Xattr{Name: name, Value: []byte(v)})
+		}
+	}
+	sort.Slice(n.Xattrs, func(i, j int) bool { return n.Xattrs[i].Name < n.Xattrs[j].Name })
+	return nil
+}
+
+// Walk calls fn for n and the nodes below it in depth-first order.
+func Walk(n *Node, fn func(*Node) error) error {
+	if err := fn(n); err != nil {
+		return err
+	}
+	for _, c := range n.Children {
+		if err := Walk(c, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LatestModTime returns the latest modification time of n and the nodes
+// below it.
+func LatestModTime(n *Node) time.Time {
+	t := n.ModTime
+	for _, c := range n.Children {
+		if ct := LatestModTime(c); ct.After(t) {
+			t = ct
+		}
+	}
+	return t
+}
+
+// UUID returns a UUID derived from the names and metadata of n and the
+// nodes below it, so that images of the same files get the same UUID.
+func UUID(n *Node) [16]byte {
+	h := sha256.New()
+	Walk(n, func(n *Node) error {
+		var b []byte
+		b = append(b, n.Path...)
+		b = append(b, 0)
+		b = binary.LittleEndian.AppendUint32(b, uint32(n.Mode))
+		b = binary.LittleEndian.AppendUint32(b, n.UID)
+		b = binary.LittleEndian.AppendUint32(b, n.GID)
+		b = binary.LittleEndian.AppendUint64(b, uint64(n.ModTime.UnixNano()))
+		b = binary.LittleEndian.AppendUint64(b, uint64(n.Size))
+		b = append(b, n.Target...)
+		b = append(b, 0)
+		h.Write(b)
+		return nil
+	})
+	var uuid [16]byte
+	copy(uuid[:], h.Sum(nil))
+	// a version 8 UUID of the RFC 9562 variant.
+	uuid[6] = uuid[6]&0x0f | 0x80
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return uuid
+}
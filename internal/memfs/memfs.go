@@ -0,0 +1,156 @@
+// Package memfs provides a read-only in-memory fs.FS for generated
+// image contents.
+package memfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ModTime is the modification time of every file and directory, so
+// images built from an FS only depend on its contents.
+var ModTime = time.Unix(0, 0).UTC()
+
+// FS maps slash-separated file paths to their contents. Directories are
+// implied by the paths of the files they contain.
+type FS map[string][]byte
+
+var (
+	_ fs.ReadDirFS = FS(nil)
+	_ fs.StatFS    = FS(nil)
+)
+
+// Open implements fs.FS.
+func (m FS) Open(name string) (fs.File, error) {
+	info, err := m.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.dir {
+		entries, err := m.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &dir{info: info, entries: entries}, nil
+	}
+	return &file{info: info, Reader: bytes.NewReader(m[name])}, nil
+}
+
+// Stat implements fs.StatFS.
+func (m FS) Stat(name string) (fs.FileInfo, error) {
+	info, err := m.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (m FS) stat(op, name string) (fileInfo, error) {
+	if !fs.ValidPath(name) {
+		return fileInfo{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if b, ok := m[name]; ok {
+		return fileInfo{name: path.Base(name), size: int64(len(b))}, nil
+	}
+	if name == "." {
+		return fileInfo{name: ".", dir: true}, nil
+	}
+	for p := range m {
+		if strings.HasPrefix(p, name+"/") {
+			return fileInfo{name: path.Base(name), dir: true}, nil
+		}
+	}
+	return fileInfo{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir implements fs.ReadDirFS. The entries are sorted by name.
+func (m FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := m.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	children := make(map[string]fileInfo)
+	for p, b := range m {
+		rest, ok := strings.CutPrefix(p, prefix)
+		if !ok {
+			continue
+		}
+		if child, _, isDir := strings.Cut(rest, "/"); isDir {
+			children[child] = fileInfo{name: child, dir: true}
+		} else {
+			children[child] = fileInfo{name: child, size: int64(len(b))}
+		}
+	}
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, info := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) ModTime() time.Time { return ModTime }
+func (i fileInfo) IsDir() bool        { return i.dir }
+func (i fileInfo) Sys() any           { return nil }
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+type file struct {
+	info fileInfo
+	*bytes.Reader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Close() error               { return nil }
+
+type dir struct {
+	info    fileInfo
+	entries []fs.DirEntry
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
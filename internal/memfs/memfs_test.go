@@ -0,0 +1,20 @@
+package memfs_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/Code-Hex/vz/v3/internal/memfs"
+)
+
+func TestFS(t *testing.T) {
+	fsys := memfs.FS{
+		"user-data":                   []byte("#cloud-config\n"),
+		"openstack/latest/user_data":  []byte("{}"),
+		"openstack/latest/meta_data":  []byte("{}"),
+		"openstack/2012-08-10/vendor": nil,
+	}
+	if err := fstest.TestFS(fsys, "user-data", "openstack/latest/user_data", "openstack/2012-08-10/vendor"); err != nil {
+		t.Fatal(err)
+	}
+}
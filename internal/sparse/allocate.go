@@ -0,0 +1,54 @@
+package sparse
+
+import (
+	"io"
+	"os"
+)
+
+// Allocate extends f to size bytes and allocates blocks for the whole file
+// without writing them, using fallocate on Linux and F_PREALLOCATE on macOS.
+// The allocated blocks read as zeros.
+func Allocate(f *os.File, size int64) error {
+	return allocate(f, size)
+}
+
+// Fill extends f to size bytes by writing zeros from its current size, so
+// that every block of the file is allocated and written.
+func Fill(f *os.File, size int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	off := fi.Size()
+	if off >= size {
+		return nil
+	}
+	zeros := make([]byte, min(size-off, 1<<20))
+	w := io.NewOffsetWriter(f, off)
+	for n := size - off; n > 0; {
+		m, err := w.Write(zeros[:min(n, int64(len(zeros)))])
+		if err != nil {
+			return err
+		}
+		n -= int64(m)
+	}
+	return nil
+}
+
+// FreeSpace reports how many bytes are available to unprivileged users on
+// the file system containing dir.
+func FreeSpace(dir string) (int64, error) {
+	return freeSpace(dir)
+}
+
+// PunchHole deallocates length bytes of f at off, so that they read as zeros
+// without using storage. The size of f is not changed. off and length should
+// be multiples of BlockSize, since file systems only deallocate whole blocks.
+func PunchHole(f *os.File, off, length int64) error {
+	return punchHole(f, off, length)
+}
+
+// AllocatedSize returns the number of bytes of storage allocated for f.
+func AllocatedSize(f *os.File) (int64, error) {
+	return allocatedSize(f)
+}
@@ -0,0 +1,32 @@
+package sparse
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func allocate(f *os.File, size int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if n := size - fi.Size(); n > 0 {
+		// try to allocate contiguous space first, then fall back to
+		// allocating it in pieces.
+		fstore := &unix.Fstore_t{
+			Flags:   unix.F_ALLOCATECONTIG | unix.F_ALLOCATEALL,
+			Posmode: unix.F_PEOFPOSMODE,
+			Length:  n,
+		}
+		err := unix.FcntlFstore(f.Fd(), unix.F_PREALLOCATE, fstore)
+		if err != nil {
+			fstore.Flags = unix.F_ALLOCATEALL
+			err = unix.FcntlFstore(f.Fd(), unix.F_PREALLOCATE, fstore)
+		}
+		if err != nil {
+			return &os.PathError{Op: "fcntl F_PREALLOCATE", Path: f.Name(), Err: err}
+		}
+	}
+	return f.Truncate(size)
+}
@@ -0,0 +1,24 @@
+//go:build !darwin && !linux
+
+package sparse
+
+import (
+	"errors"
+	"os"
+)
+
+func allocate(f *os.File, size int64) error {
+	return &os.PathError{Op: "allocate", Path: f.Name(), Err: errors.ErrUnsupported}
+}
+
+func freeSpace(dir string) (int64, error) {
+	return 0, &os.PathError{Op: "statfs", Path: dir, Err: errors.ErrUnsupported}
+}
+
+func punchHole(f *os.File, off, length int64) error {
+	return &os.PathError{Op: "punch hole", Path: f.Name(), Err: errors.ErrUnsupported}
+}
+
+func allocatedSize(f *os.File) (int64, error) {
+	return 0, &os.PathError{Op: "stat", Path: f.Name(), Err: errors.ErrUnsupported}
+}
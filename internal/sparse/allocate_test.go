@@ -0,0 +1,134 @@
+//go:build darwin || linux
+
+package sparse_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+)
+
+func allocatedBytes(t *testing.T, f *os.File) int64 {
+	t.Helper()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		t.Skip("allocated blocks are not reported")
+	}
+	return st.Blocks * 512
+}
+
+func TestAllocate(t *testing.T) {
+	const size = 4 << 20
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := sparse.Allocate(f, size); err != nil {
+		if errors.Is(err, errors.ErrUnsupported) || errors.Is(err, syscall.EOPNOTSUPP) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != size {
+		t.Fatalf("want size %d but got %d", size, fi.Size())
+	}
+	if got := allocatedBytes(t, f); got < size {
+		t.Fatalf("want at least %d bytes allocated but got %d", size, got)
+	}
+}
+
+func TestFill(t *testing.T) {
+	const size = 3<<20 + 512
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("head")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sparse.Fill(f, size); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != size {
+		t.Fatalf("want size %d but got %d", size, len(got))
+	}
+	if string(got[:4]) != "head" {
+		t.Fatalf("want head preserved but got %q", got[:4])
+	}
+	for i, b := range got[4:] {
+		if b != 0 {
+			t.Fatalf("want zero at %d but got %#x", i+4, b)
+		}
+	}
+	if got := allocatedBytes(t, f); got < size {
+		t.Fatalf("want at least %d bytes allocated but got %d", size, got)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	n, err := sparse.FreeSpace(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n <= 0 {
+		t.Fatalf("want positive free space but got %d", n)
+	}
+}
+
+func TestPunchHole(t *testing.T) {
+	const size = 1 << 20
+	want := bytes.Repeat([]byte{1}, size)
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, want, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	before, err := sparse.AllocatedSize(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sparse.PunchHole(f, 64*sparse.BlockSize, 128*sparse.BlockSize); err != nil {
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	clear(want[64*sparse.BlockSize : 192*sparse.BlockSize])
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("want punched range to read as zeros")
+	}
+	after, err := sparse.AllocatedSize(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before-after < 128*sparse.BlockSize {
+		t.Fatalf("want at least %d bytes deallocated but got %d", 128*sparse.BlockSize, before-after)
+	}
+}
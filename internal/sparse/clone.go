@@ -0,0 +1,23 @@
+package sparse
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrCloneUnsupported is returned by CloneFile when the file system does not
+// support copy-on-write clones of files.
+var ErrCloneUnsupported = errors.New("copy-on-write clone is not supported")
+
+// CloneFile creates dst as a copy-on-write clone of src. dst must not exist.
+//
+// It returns an error wrapping ErrCloneUnsupported if the file system does not
+// support cloning, or src and dst are on different file systems. In that case
+// dst is not left behind.
+func CloneFile(src, dst string) error {
+	return cloneFile(src, dst)
+}
+
+func cloneError(op, path string, err error) error {
+	return &os.PathError{Op: op, Path: path, Err: errors.Join(ErrCloneUnsupported, err)}
+}
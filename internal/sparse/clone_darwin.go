@@ -0,0 +1,20 @@
+package sparse
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func cloneFile(src, dst string) error {
+	err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EXDEV) {
+		return cloneError("clonefile", dst, err)
+	}
+	return &os.PathError{Op: "clonefile", Path: dst, Err: err}
+}
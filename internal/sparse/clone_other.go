@@ -0,0 +1,9 @@
+//go:build !darwin && !linux
+
+package sparse
+
+import "errors"
+
+func cloneFile(src, dst string) error {
+	return cloneError("clone", dst, errors.ErrUnsupported)
+}
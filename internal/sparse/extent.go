@@ -0,0 +1,46 @@
+package sparse
+
+import (
+	"os"
+	"sort"
+)
+
+// Extent is a range of a file which contains data.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// End returns the offset just after the extent.
+func (e Extent) End() int64 { return e.Offset + e.Length }
+
+// DataExtents returns the ranges of f which contain data in ascending order.
+// Holes are found with SEEK_DATA and SEEK_HOLE. If the file system does not
+// support them, the whole file is reported as a single extent.
+func DataExtents(f *os.File) ([]Extent, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return nil, nil
+	}
+	extents, err := dataExtents(f, size)
+	if err != nil {
+		return nil, err
+	}
+	if extents == nil {
+		// the file system can not report holes.
+		return []Extent{{Offset: 0, Length: size}}, nil
+	}
+	return extents, nil
+}
+
+// FindExtent returns the index of the first extent in extents which ends
+// after off, or len(extents) if there is none.
+func FindExtent(extents []Extent, off int64) int {
+	return sort.Search(len(extents), func(i int) bool {
+		return extents[i].End() > off
+	})
+}
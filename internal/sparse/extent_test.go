@@ -0,0 +1,122 @@
+package sparse_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+)
+
+func writeSparseFile(t *testing.T, path string, size int64, data map[int64][]byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for off, b := range data {
+		if _, err := f.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataExtents(t *testing.T) {
+	const size = 4 << 20
+	data := map[int64][]byte{
+		0:        []byte("head"),
+		1 << 20:  bytes.Repeat([]byte{1}, 3*sparse.BlockSize),
+		size - 1: {0xff},
+	}
+	path := filepath.Join(t.TempDir(), "disk.img")
+	writeSparseFile(t, path, size, data)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	extents, err := sparse.DataExtents(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file system decides how holes are aligned, so only check that
+	// the extents are ordered, within the file and cover every byte written.
+	var prev int64
+	for _, e := range extents {
+		if e.Offset < prev || e.Length <= 0 || e.End() > size {
+			t.Fatalf("invalid extents %v", extents)
+		}
+		prev = e.End()
+	}
+	for off, b := range data {
+		end := off + int64(len(b))
+		i := sparse.FindExtent(extents, off)
+		if i == len(extents) || extents[i].Offset > off || extents[i].End() < end {
+			t.Fatalf("extents %v do not cover [%d, %d)", extents, off, end)
+		}
+	}
+}
+
+func TestDataExtentsEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	writeSparseFile(t, path, 0, nil)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	extents, err := sparse.DataExtents(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) != 0 {
+		t.Fatalf("want no extents but got %v", extents)
+	}
+}
+
+func TestCloneFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.img")
+	dst := filepath.Join(dir, "dst.img")
+	writeSparseFile(t, src, 1<<20, map[int64][]byte{4096: []byte("data")})
+
+	err := sparse.CloneFile(src, dst)
+	if errors.Is(err, sparse.ErrCloneUnsupported) {
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			t.Fatalf("want %q to be removed but got %v", dst, err)
+		}
+		t.Skipf("file system does not support clones: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("content mismatch")
+	}
+}
+
+func TestCloneFileExist(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.img")
+	dst := filepath.Join(dir, "dst.img")
+	writeSparseFile(t, src, 4096, nil)
+	writeSparseFile(t, dst, 0, nil)
+	if err := sparse.CloneFile(src, dst); !os.IsExist(err) && !errors.Is(err, os.ErrExist) {
+		t.Fatalf("want os.ErrExist but got %v", err)
+	}
+}
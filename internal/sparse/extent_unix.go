@@ -0,0 +1,45 @@
+//go:build darwin || linux
+
+package sparse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataExtents walks the file with SEEK_DATA and SEEK_HOLE. It returns nil
+// extents without an error if holes can not be detected.
+func dataExtents(f *os.File, size int64) ([]Extent, error) {
+	extents := []Extent{}
+	off := int64(0)
+	for off < size {
+		data, err := f.Seek(off, unix.SEEK_DATA)
+		if err != nil {
+			if errors.Is(err, syscall.ENXIO) {
+				// no more data after off.
+				break
+			}
+			if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTSUP) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		hole = min(hole, size)
+		if hole > data {
+			extents = append(extents, Extent{Offset: data, Length: hole - data})
+		}
+		off = hole
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
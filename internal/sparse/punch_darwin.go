@@ -0,0 +1,17 @@
+package sparse
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func punchHole(f *os.File, off, length int64) error {
+	// struct fpunchhole has the same layout as the beginning of struct
+	// fstore, which is the only fcntl argument type x/sys/unix provides.
+	arg := &unix.Fstore_t{Offset: off, Length: length}
+	if err := unix.FcntlFstore(f.Fd(), unix.F_PUNCHHOLE, arg); err != nil {
+		return &os.PathError{Op: "fcntl F_PUNCHHOLE", Path: f.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Package sparse provides helpers for writing disk images without
+// allocating host storage for blocks which only contain zeros.
+package sparse
+
+import (
+	"bytes"
+	"io"
+)
+
+// BlockSize is the granularity used to detect blocks which only contain zeros.
+const BlockSize = 4096
+
+var zeroBlock [BlockSize]byte
+
+// IsZero reports whether b only contains zeros.
+func IsZero(b []byte) bool {
+	for len(b) > 0 {
+		n := min(len(b), BlockSize)
+		if !bytes.Equal(b[:n], zeroBlock[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// File is the destination of a Writer.
+type File interface {
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// Writer is an io.Writer which writes sequentially to the underlying file
+// while leaving blocks which only contain zeros unwritten, so that they
+// remain holes in the file.
+//
+// The underlying file must be empty when the Writer is created.
+type Writer struct {
+	f   File
+	off int64
+}
+
+var _ io.Writer = (*Writer)(nil)
+
+// NewWriter creates a new Writer which writes to f.
+func NewWriter(f File) *Writer {
+	return &Writer{f: f}
+}
+
+// Write writes p at the current offset. Blocks of p which only contain
+// zeros are skipped.
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Split at BlockSize boundaries of the destination so that the
+		// skipped ranges always cover whole blocks.
+		n := min(len(p), BlockSize-int(w.off%BlockSize))
+		if IsZero(p[:n]) {
+			w.off += int64(n)
+			written += n
+			p = p[n:]
+			continue
+		}
+		// Coalesce consecutive non-zero blocks into one write.
+		for n < len(p) {
+			m := min(len(p)-n, BlockSize)
+			if IsZero(p[n : n+m]) {
+				break
+			}
+			n += m
+		}
+		if _, err := w.f.WriteAt(p[:n], w.off); err != nil {
+			return written, err
+		}
+		w.off += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Offset returns the number of bytes written so far.
+func (w *Writer) Offset() int64 { return w.off }
+
+// Close sets the size of the underlying file to the number of bytes written,
+// so that trailing zero blocks are kept as a hole. It does not close the
+// underlying file.
+func (w *Writer) Close() error {
+	return w.f.Truncate(w.off)
+}
@@ -0,0 +1,67 @@
+package sparse_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+)
+
+func TestIsZero(t *testing.T) {
+	cases := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{name: "empty", b: nil, want: true},
+		{name: "zeros", b: make([]byte, 3*sparse.BlockSize+7), want: true},
+		{name: "last byte", b: append(make([]byte, 2*sparse.BlockSize), 1), want: false},
+		{name: "first byte", b: append([]byte{1}, make([]byte, sparse.BlockSize)...), want: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sparse.IsZero(tc.b); got != tc.want {
+				t.Fatalf("want %v but got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	want := make([]byte, 16*sparse.BlockSize)
+	copy(want[sparse.BlockSize+10:], "hello")
+	copy(want[5*sparse.BlockSize:], bytes.Repeat([]byte{0xff}, 2*sparse.BlockSize+1))
+
+	w := sparse.NewWriter(f)
+	// Write with a chunk size which is not aligned to sparse.BlockSize.
+	for p := want; len(p) > 0; {
+		n := min(len(p), 1000)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Offset(); got != int64(len(want)) {
+		t.Fatalf("want offset %d but got %d", len(want), got)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("written content mismatch")
+	}
+}
@@ -0,0 +1,284 @@
+package xz
+
+const (
+	numStates       = 12
+	posStatesMax    = 1 << 4
+	lenToPosStates  = 4
+	endPosModel     = 14
+	numFullDistance = 1 << (endPosModel >> 1)
+	matchMinLen     = 2
+	literalCoderLen = 0x300
+)
+
+// dict is the sliding window of the LZMA decoder. Decoded bytes are
+// written at pos and read by the consumer from start.
+type dict struct {
+	buf   []byte
+	pos   int
+	start int
+	full  int    // number of valid bytes in buf
+	total uint32 // bytes decoded since the last reset, modulo 2^32
+}
+
+func (d *dict) reset() {
+	d.pos, d.start, d.full, d.total = 0, 0, 0, 0
+}
+
+func (d *dict) put(b byte) {
+	d.buf[d.pos] = b
+	d.pos++
+	d.total++
+	if d.full < len(d.buf) {
+		d.full++
+	}
+}
+
+// get returns the byte at distance dist+1 before pos, or zero if there
+// is none.
+func (d *dict) get(dist uint32) byte {
+	if int(dist) >= d.full {
+		return 0
+	}
+	i := d.pos - int(dist) - 1
+	if i < 0 {
+		i += len(d.buf)
+	}
+	return d.buf[i]
+}
+
+// repeat copies n bytes from distance dist+1 before pos, which must not
+// cross the end of buf.
+func (d *dict) repeat(dist uint32, n int) {
+	count := n
+	src := d.pos - int(dist) - 1
+	if src < 0 {
+		src += len(d.buf)
+	}
+	if src+n <= len(d.buf) && (src > d.pos || src+n <= d.pos) {
+		// The source does not overlap the bytes being written, or is
+		// read before they are written.
+		copy(d.buf[d.pos:d.pos+n], d.buf[src:src+n])
+		d.pos += n
+		n = 0
+	}
+	for range n {
+		d.buf[d.pos] = d.buf[src]
+		d.pos++
+		src++
+		if src == len(d.buf) {
+			src = 0
+		}
+	}
+	d.total += uint32(count)
+	d.full = min(d.full+count, len(d.buf))
+}
+
+type lenDecoder struct {
+	choice  prob
+	choice2 prob
+	low     [posStatesMax][1 << 3]prob
+	mid     [posStatesMax][1 << 3]prob
+	high    [1 << 8]prob
+}
+
+func (l *lenDecoder) reset() {
+	l.choice, l.choice2 = probInit, probInit
+	for i := range l.low {
+		initProbs(l.low[i][:])
+		initProbs(l.mid[i][:])
+	}
+	initProbs(l.high[:])
+}
+
+func (l *lenDecoder) decode(rc *rangeDecoder, posState uint32) int {
+	if rc.bit(&l.choice) == 0 {
+		return int(rc.bittree(l.low[posState][:], 3)) + matchMinLen
+	}
+	if rc.bit(&l.choice2) == 0 {
+		return int(rc.bittree(l.mid[posState][:], 3)) + matchMinLen + 8
+	}
+	return int(rc.bittree(l.high[:], 8)) + matchMinLen + 16
+}
+
+// lzmaDecoder holds the state of the LZMA decoder used by LZMA2 chunks.
+type lzmaDecoder struct {
+	lc, lp, pb uint
+
+	state int
+	rep   [4]uint32
+
+	// pending is the number of bytes of the current match which are
+	// not copied yet.
+	pending int
+
+	isMatch    [numStates * posStatesMax]prob
+	isRep      [numStates]prob
+	isRepG0    [numStates]prob
+	isRepG1    [numStates]prob
+	isRepG2    [numStates]prob
+	isRep0Long [numStates * posStatesMax]prob
+	posSlot    [lenToPosStates][1 << 6]prob
+	specPos    [numFullDistance - endPosModel + 1]prob // index 0 is unused
+	align      [1 << 4]prob
+	matchLen   lenDecoder
+	repLen     lenDecoder
+	literal    [literalCoderLen << 4]prob
+}
+
+// setProps sets lc, lp and pb from an LZMA2 properties byte.
+func (z *lzmaDecoder) setProps(b byte) bool {
+	if b > (4*5+4)*9+8 {
+		return false
+	}
+	z.pb = uint(b / 45)
+	b %= 45
+	z.lp = uint(b / 9)
+	z.lc = uint(b % 9)
+	return z.lc+z.lp <= 4
+}
+
+func (z *lzmaDecoder) reset() {
+	z.state = 0
+	z.rep = [4]uint32{}
+	z.pending = 0
+	initProbs(z.isMatch[:])
+	initProbs(z.isRep[:])
+	initProbs(z.isRepG0[:])
+	initProbs(z.isRepG1[:])
+	initProbs(z.isRepG2[:])
+	initProbs(z.isRep0Long[:])
+	for i := range z.posSlot {
+		initProbs(z.posSlot[i][:])
+	}
+	initProbs(z.specPos[:])
+	initProbs(z.align[:])
+	z.matchLen.reset()
+	z.repLen.reset()
+	initProbs(z.literal[:literalCoderLen<<(z.lc+z.lp)])
+}
+
+func (z *lzmaDecoder) decodeLiteral(d *dict, rc *rangeDecoder) {
+	prev := uint32(d.get(0))
+	lit := (d.total&(1<<z.lp-1))<<z.lc + prev>>(8-z.lc)
+	probs := z.literal[literalCoderLen*lit : literalCoderLen*(lit+1)]
+	sym := uint32(1)
+	if z.state < 7 {
+		for sym < 0x100 {
+			sym = sym<<1 | rc.bit(&probs[sym])
+		}
+	} else {
+		match := uint32(d.get(z.rep[0]))
+		offset := uint32(0x100)
+		for sym < 0x100 {
+			match <<= 1
+			matchBit := match & offset
+			bit := rc.bit(&probs[offset+matchBit+sym])
+			sym = sym<<1 | bit
+			if bit == 0 {
+				offset &^= matchBit
+			} else {
+				offset &= matchBit
+			}
+		}
+	}
+	d.put(byte(sym))
+	switch {
+	case z.state < 4:
+		z.state = 0
+	case z.state < 10:
+		z.state -= 3
+	default:
+		z.state -= 6
+	}
+}
+
+func (z *lzmaDecoder) decodeDistance(rc *rangeDecoder, length int) uint32 {
+	lenState := min(length-matchMinLen, lenToPosStates-1)
+	slot := rc.bittree(z.posSlot[lenState][:], 6)
+	if slot < 4 {
+		return slot
+	}
+	n := int(slot>>1) - 1
+	dist := (2 | slot&1) << n
+	if slot < endPosModel {
+		return dist + rc.bittreeReverse(z.specPos[dist-slot:], n)
+	}
+	dist += rc.direct(n-4) << 4
+	return dist + rc.bittreeReverse(z.align[:], 4)
+}
+
+// decode decodes until d.pos reaches limit.
+func (z *lzmaDecoder) decode(d *dict, rc *rangeDecoder, limit int) error {
+	for d.pos < limit {
+		if z.pending > 0 {
+			n := min(z.pending, limit-d.pos)
+			d.repeat(z.rep[0], n)
+			z.pending -= n
+			continue
+		}
+		if rc.overrun {
+			return errCorrupt
+		}
+
+		posState := d.total & (1<<z.pb - 1)
+		if rc.bit(&z.isMatch[z.state*posStatesMax+int(posState)]) == 0 {
+			z.decodeLiteral(d, rc)
+			continue
+		}
+
+		var length int
+		if rc.bit(&z.isRep[z.state]) == 0 {
+			length = z.matchLen.decode(rc, posState)
+			if z.state < 7 {
+				z.state = 7
+			} else {
+				z.state = 10
+			}
+			z.rep[3], z.rep[2], z.rep[1] = z.rep[2], z.rep[1], z.rep[0]
+			z.rep[0] = z.decodeDistance(rc, length)
+		} else {
+			if d.full == 0 {
+				return errCorrupt
+			}
+			if rc.bit(&z.isRepG0[z.state]) == 0 {
+				if rc.bit(&z.isRep0Long[z.state*posStatesMax+int(posState)]) == 0 {
+					if z.state < 7 {
+						z.state = 9
+					} else {
+						z.state = 11
+					}
+					d.put(d.get(z.rep[0]))
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&z.isRepG1[z.state]) == 0 {
+					dist = z.rep[1]
+				} else {
+					if rc.bit(&z.isRepG2[z.state]) == 0 {
+						dist = z.rep[2]
+					} else {
+						dist = z.rep[3]
+						z.rep[3] = z.rep[2]
+					}
+					z.rep[2] = z.rep[1]
+				}
+				z.rep[1] = z.rep[0]
+				z.rep[0] = dist
+			}
+			length = z.repLen.decode(rc, posState)
+			if z.state < 7 {
+				z.state = 8
+			} else {
+				z.state = 11
+			}
+		}
+		// LZMA2 has no end of payload marker, so the distance
+		// 0xffffffff is invalid as well.
+		if int64(z.rep[0]) >= int64(d.full) {
+			return errCorrupt
+		}
+		z.pending = length
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package xz
+
+import (
+	"bufio"
+	"io"
+)
+
+// input counts the bytes consumed from a stream.
+type input struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (in *input) Read(p []byte) (int, error) {
+	n, err := in.r.Read(p)
+	in.n += int64(n)
+	return n, err
+}
+
+func (in *input) ReadByte() (byte, error) {
+	b, err := in.r.ReadByte()
+	if err == nil {
+		in.n++
+	}
+	return b, err
+}
+
+// readFull is io.ReadFull which reports a truncated stream as
+// io.ErrUnexpectedEOF.
+func (in *input) readFull(p []byte) error {
+	_, err := io.ReadFull(in, p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// lzma2Reader decodes LZMA2 chunks up to the end of payload marker.
+type lzma2Reader struct {
+	in   *input
+	dict dict
+	lzma lzmaDecoder
+	rc   rangeDecoder
+
+	packed []byte
+
+	// remaining is the number of bytes left in the current chunk.
+	remaining  int
+	compressed bool
+
+	needDictReset bool
+	needProps     bool
+	eof           bool
+}
+
+// reset prepares r for a new block.
+func (r *lzma2Reader) reset(in *input, dictSize uint32) {
+	if uint32(cap(r.dict.buf)) < dictSize {
+		r.dict.buf = make([]byte, dictSize)
+	}
+	r.dict.buf = r.dict.buf[:dictSize]
+	r.dict.reset()
+	if r.packed == nil {
+		r.packed = make([]byte, 1<<16)
+	}
+	r.in = in
+	r.remaining = 0
+	r.compressed = false
+	r.needDictReset = true
+	r.needProps = true
+	r.eof = false
+}
+
+func (r *lzma2Reader) Read(p []byte) (int, error) {
+	d := &r.dict
+	for {
+		if d.start < d.pos {
+			n := copy(p, d.buf[d.start:d.pos])
+			d.start += n
+			return n, nil
+		}
+		if d.pos == len(d.buf) {
+			d.pos, d.start = 0, 0
+		}
+		if r.remaining == 0 {
+			if r.compressed && (r.lzma.pending > 0 || !r.rc.finished()) {
+				return 0, errCorrupt
+			}
+			if r.eof {
+				return 0, io.EOF
+			}
+			if err := r.nextChunk(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		limit := min(len(d.buf), d.pos+r.remaining)
+		before := d.pos
+		if r.compressed {
+			if err := r.lzma.decode(d, &r.rc, limit); err != nil {
+				return 0, err
+			}
+		} else {
+			if err := r.in.readFull(d.buf[d.pos:limit]); err != nil {
+				return 0, err
+			}
+			n := limit - d.pos
+			d.pos = limit
+			d.total += uint32(n)
+			d.full = min(d.full+n, len(d.buf))
+		}
+		r.remaining -= d.pos - before
+	}
+}
+
+func (r *lzma2Reader) nextChunk() error {
+	var hdr [5]byte
+	if err := r.in.readFull(hdr[:1]); err != nil {
+		return err
+	}
+	control := hdr[0]
+	if control == 0x00 {
+		r.eof = true
+		r.compressed = false
+		return nil
+	}
+	if control >= 0xe0 || control == 0x01 {
+		r.needProps = true
+		r.needDictReset = false
+		r.dict.reset()
+	} else if r.needDictReset {
+		return errCorrupt
+	}
+
+	if control < 0x80 {
+		if control > 0x02 {
+			return errCorrupt
+		}
+		if err := r.in.readFull(hdr[:2]); err != nil {
+			return err
+		}
+		r.remaining = (int(hdr[0])<<8 | int(hdr[1])) + 1
+		r.compressed = false
+		return nil
+	}
+
+	if err := r.in.readFull(hdr[:4]); err != nil {
+		return err
+	}
+	r.remaining = (int(control&0x1f)<<16 | int(hdr[0])<<8 | int(hdr[1])) + 1
+	packed := r.packed[:(int(hdr[2])<<8|int(hdr[3]))+1]
+	switch {
+	case control >= 0xc0:
+		if err := r.in.readFull(hdr[:1]); err != nil {
+			return err
+		}
+		if !r.lzma.setProps(hdr[0]) {
+			return errCorrupt
+		}
+		r.needProps = false
+		r.lzma.reset()
+	case r.needProps:
+		return errCorrupt
+	case control >= 0xa0:
+		r.lzma.reset()
+	}
+	if err := r.in.readFull(packed); err != nil {
+		return err
+	}
+	if !r.rc.init(packed) {
+		return errCorrupt
+	}
+	r.compressed = true
+	return nil
+}
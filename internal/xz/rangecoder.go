@@ -0,0 +1,108 @@
+package xz
+
+const (
+	probBits = 11
+	probInit = 1 << probBits / 2
+	moveBits = 5
+	topValue = 1 << 24
+)
+
+type prob uint16
+
+func initProbs(p []prob) {
+	for i := range p {
+		p[i] = probInit
+	}
+}
+
+// rangeDecoder decodes the range coded data of one LZMA2 chunk, which is
+// read into memory as a whole.
+type rangeDecoder struct {
+	in   []byte
+	pos  int
+	rng  uint32
+	code uint32
+
+	// overrun is set when the decoder reads beyond the end of in.
+	overrun bool
+}
+
+func (rc *rangeDecoder) init(in []byte) bool {
+	*rc = rangeDecoder{in: in, rng: 0xffffffff}
+	if len(in) < 5 || in[0] != 0 {
+		return false
+	}
+	rc.code = uint32(in[1])<<24 | uint32(in[2])<<16 | uint32(in[3])<<8 | uint32(in[4])
+	rc.pos = 5
+	// The code must be less than the range.
+	return rc.code != 0xffffffff
+}
+
+// finished reports whether all input was consumed by a complete stream.
+func (rc *rangeDecoder) finished() bool {
+	rc.normalize()
+	return !rc.overrun && rc.pos == len(rc.in) && rc.code == 0
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < topValue {
+		rc.rng <<= 8
+		var b byte
+		if rc.pos < len(rc.in) {
+			b = rc.in[rc.pos]
+		} else {
+			rc.overrun = true
+		}
+		rc.pos++
+		rc.code = rc.code<<8 | uint32(b)
+	}
+}
+
+func (rc *rangeDecoder) bit(p *prob) uint32 {
+	rc.normalize()
+	bound := (rc.rng >> probBits) * uint32(*p)
+	if rc.code < bound {
+		rc.rng = bound
+		*p += (1<<probBits - *p) >> moveBits
+		return 0
+	}
+	rc.rng -= bound
+	rc.code -= bound
+	*p -= *p >> moveBits
+	return 1
+}
+
+// bittree decodes n bits most significant bit first.
+func (rc *rangeDecoder) bittree(probs []prob, n int) uint32 {
+	m := uint32(1)
+	for range n {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<n
+}
+
+// bittreeReverse decodes n bits least significant bit first.
+func (rc *rangeDecoder) bittreeReverse(probs []prob, n int) uint32 {
+	m := uint32(1)
+	var sym uint32
+	for i := range n {
+		bit := rc.bit(&probs[m])
+		m = m<<1 | bit
+		sym |= bit << i
+	}
+	return sym
+}
+
+// direct decodes n bits with fixed probabilities.
+func (rc *rangeDecoder) direct(n int) uint32 {
+	var v uint32
+	for range n {
+		rc.normalize()
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		mask := 0 - (rc.code >> 31)
+		rc.code += rc.rng & mask
+		v = v<<1 + mask + 1
+	}
+	return v
+}
@@ -0,0 +1,407 @@
+// Package xz implements a decoder for the xz file format with the LZMA2
+// filter, as produced by xz(1) for disk images.
+package xz
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+var (
+	headerMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	footerMagic = []byte{'Y', 'Z'}
+)
+
+var errCorrupt = errors.New("xz: corrupt data")
+
+const (
+	checkNone   = 0x00
+	checkCRC32  = 0x01
+	checkCRC64  = 0x04
+	checkSHA256 = 0x0a
+
+	filterLZMA2 = 0x21
+
+	// maxDictSize limits the memory used by a stream.
+	maxDictSize = 1 << 30
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// record is an index record of a block.
+type record struct {
+	unpadded     int64
+	uncompressed int64
+}
+
+// Reader decompresses an xz stream. Concatenated streams and stream
+// padding are supported.
+type Reader struct {
+	in    *input
+	lzma2 lzma2Reader
+
+	flags [2]byte
+	check hash.Hash
+
+	// inBlock is set while the data of a block is read.
+	inBlock bool
+
+	blockStart   int64 // input offset of the block header
+	headerSize   int64
+	compressed   int64 // -1 if unknown
+	uncompressed int64 // -1 if unknown
+	written      int64
+
+	records []record
+	err     error
+}
+
+// NewReader returns a Reader which decompresses r. It reads the stream
+// header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{in: &input{r: bufio.NewReaderSize(r, 1<<16)}}
+	if err := z.readStreamHeader(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *Reader) readStreamHeader() error {
+	var hdr [12]byte
+	if _, err := io.ReadFull(z.in, hdr[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:6], headerMagic) {
+		return errors.New("xz: invalid header magic")
+	}
+	if binary.LittleEndian.Uint32(hdr[8:]) != crc32.ChecksumIEEE(hdr[6:8]) {
+		return errCorrupt
+	}
+	if hdr[6] != 0 || hdr[7] > 0x0f {
+		return fmt.Errorf("xz: unsupported stream flags %#x", hdr[6:8])
+	}
+	copy(z.flags[:], hdr[6:8])
+	switch hdr[7] {
+	case checkNone:
+		z.check = nil
+	case checkCRC32:
+		z.check = crc32.NewIEEE()
+	case checkCRC64:
+		z.check = crc64.New(crc64Table)
+	case checkSHA256:
+		z.check = sha256.New()
+	default:
+		return fmt.Errorf("xz: unsupported check type %#x", hdr[7])
+	}
+	z.records = z.records[:0]
+	return nil
+}
+
+// Read implements io.Reader.
+func (z *Reader) Read(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n, err := z.read(p)
+	if err != nil {
+		z.err = err
+	}
+	return n, err
+}
+
+func (z *Reader) read(p []byte) (int, error) {
+	for {
+		if z.inBlock {
+			n, err := z.lzma2.Read(p)
+			if n > 0 {
+				if z.check != nil {
+					z.check.Write(p[:n])
+				}
+				z.written += int64(n)
+				if z.uncompressed >= 0 && z.written > z.uncompressed {
+					return 0, errCorrupt
+				}
+				return n, nil
+			}
+			if err == io.EOF {
+				err = z.finishBlock()
+			}
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		b, err := z.in.r.Peek(1)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if b[0] != 0 {
+			if err := z.readBlockHeader(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := z.readIndex(); err != nil {
+			return 0, err
+		}
+		if err := z.nextStream(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readMultibyte reads a variable length integer.
+func readMultibyte(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := range 9 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if i > 0 && b == 0 {
+			return 0, errCorrupt
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, errCorrupt
+}
+
+func (z *Reader) readBlockHeader() error {
+	z.blockStart = z.in.n
+	size, err := z.in.ReadByte()
+	if err != nil {
+		return err
+	}
+	hdr := make([]byte, (int(size)+1)*4)
+	hdr[0] = size
+	if err := z.in.readFull(hdr[1:]); err != nil {
+		return err
+	}
+	body := hdr[:len(hdr)-4]
+	if binary.LittleEndian.Uint32(hdr[len(hdr)-4:]) != crc32.ChecksumIEEE(body) {
+		return errCorrupt
+	}
+	flags := body[1]
+	if flags&0x3c != 0 {
+		return errCorrupt
+	}
+	r := bytes.NewReader(body[2:])
+	z.compressed, z.uncompressed = -1, -1
+	if flags&0x40 != 0 {
+		v, err := readMultibyte(r)
+		if err != nil || v == 0 || v > 1<<62 {
+			return errCorrupt
+		}
+		z.compressed = int64(v)
+	}
+	if flags&0x80 != 0 {
+		v, err := readMultibyte(r)
+		if err != nil || v > 1<<62 {
+			return errCorrupt
+		}
+		z.uncompressed = int64(v)
+	}
+	if flags&0x03 != 0 {
+		return errors.New("xz: filter chains are not supported")
+	}
+	id, err := readMultibyte(r)
+	if err != nil {
+		return errCorrupt
+	}
+	if id != filterLZMA2 {
+		return fmt.Errorf("xz: unsupported filter %#x", id)
+	}
+	propsSize, err := readMultibyte(r)
+	if err != nil || propsSize != 1 {
+		return errCorrupt
+	}
+	props, err := r.ReadByte()
+	if err != nil || props > 40 {
+		return errCorrupt
+	}
+	for r.Len() > 0 {
+		if b, _ := r.ReadByte(); b != 0 {
+			return errCorrupt
+		}
+	}
+
+	dictSize := uint32(0xffffffff)
+	if props < 40 {
+		dictSize = (2 | uint32(props)&1) << (props/2 + 11)
+	}
+	if dictSize > maxDictSize {
+		return fmt.Errorf("xz: dictionary size %d is too large", dictSize)
+	}
+	if z.uncompressed >= 0 {
+		// The dictionary need not be larger than the block.
+		dictSize = uint32(min(int64(dictSize), max(z.uncompressed, 4096)))
+	}
+	z.lzma2.reset(z.in, dictSize)
+	if z.check != nil {
+		z.check.Reset()
+	}
+	z.headerSize = int64(len(hdr))
+	z.written = 0
+	z.inBlock = true
+	return nil
+}
+
+func (z *Reader) finishBlock() error {
+	z.inBlock = false
+	compressed := z.in.n - z.blockStart - z.headerSize
+	if z.compressed >= 0 && compressed != z.compressed {
+		return errCorrupt
+	}
+	if z.uncompressed >= 0 && z.written != z.uncompressed {
+		return errCorrupt
+	}
+	var pad [3]byte
+	padding := pad[:(4-compressed%4)%4]
+	if err := z.in.readFull(padding); err != nil {
+		return err
+	}
+	for _, b := range padding {
+		if b != 0 {
+			return errCorrupt
+		}
+	}
+	if z.check != nil {
+		want := make([]byte, z.check.Size())
+		if err := z.in.readFull(want); err != nil {
+			return err
+		}
+		got := z.check.Sum(nil)
+		if z.flags[1] != checkSHA256 {
+			// CRC32 and CRC64 are stored in little endian.
+			for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+				got[i], got[j] = got[j], got[i]
+			}
+		}
+		if !bytes.Equal(got, want) {
+			return errors.New("xz: checksum mismatch")
+		}
+	}
+	checkSize := int64(0)
+	if z.check != nil {
+		checkSize = int64(z.check.Size())
+	}
+	z.records = append(z.records, record{
+		unpadded:     z.headerSize + compressed + checkSize,
+		uncompressed: z.written,
+	})
+	return nil
+}
+
+func (z *Reader) readIndex() error {
+	start := z.in.n
+	crc := crc32.NewIEEE()
+	r := &hashByteReader{r: z.in, h: crc}
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return errCorrupt
+	}
+	count, err := readMultibyte(r)
+	if err != nil {
+		return errCorrupt
+	}
+	if count != uint64(len(z.records)) {
+		return errCorrupt
+	}
+	for _, rec := range z.records {
+		unpadded, err := readMultibyte(r)
+		if err != nil {
+			return errCorrupt
+		}
+		uncompressed, err := readMultibyte(r)
+		if err != nil {
+			return errCorrupt
+		}
+		if int64(unpadded) != rec.unpadded || int64(uncompressed) != rec.uncompressed {
+			return errCorrupt
+		}
+	}
+	for (z.in.n-start)%4 != 0 {
+		if b, err := r.ReadByte(); err != nil || b != 0 {
+			return errCorrupt
+		}
+	}
+	var sum [4]byte
+	if err := z.in.readFull(sum[:]); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != crc.Sum32() {
+		return errCorrupt
+	}
+	indexSize := z.in.n - start
+
+	var footer [12]byte
+	if err := z.in.readFull(footer[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(footer[10:], footerMagic) ||
+		binary.LittleEndian.Uint32(footer[:4]) != crc32.ChecksumIEEE(footer[4:10]) ||
+		!bytes.Equal(footer[8:10], z.flags[:]) ||
+		(int64(binary.LittleEndian.Uint32(footer[4:8]))+1)*4 != indexSize {
+		return errCorrupt
+	}
+	return nil
+}
+
+// nextStream skips stream padding and reads the header of the next
+// stream. It returns io.EOF at the end of the input.
+func (z *Reader) nextStream() error {
+	for {
+		b, err := z.in.r.Peek(4)
+		if len(b) == 0 && err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if !bytes.Equal(b, []byte{0, 0, 0, 0}) {
+			break
+		}
+		z.in.r.Discard(4)
+		z.in.n += 4
+	}
+	if err := z.readStreamHeader(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+type hashByteReader struct {
+	r io.ByteReader
+	h hash.Hash32
+}
+
+func (r *hashByteReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{b})
+	}
+	return b, err
+}
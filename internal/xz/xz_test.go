@@ -0,0 +1,128 @@
+package xz_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/xz"
+)
+
+// testData returns the uncompressed content of the files in testdata.
+// They were created with xz 5.6, e.g. "xz --check=crc32 -0".
+func testData() []byte {
+	r := rand.New(rand.NewPCG(1, 2))
+	var b bytes.Buffer
+	for i := 0; b.Len() < 256<<10; i++ {
+		switch r.IntN(3) {
+		case 0:
+			b.Write(make([]byte, r.IntN(4096)))
+		case 1:
+			for range r.IntN(32) {
+				fmt.Fprintf(&b, "line %d of block %d\n", r.IntN(100), i)
+			}
+		case 2:
+			for range r.IntN(64) {
+				b.WriteByte(byte(r.IntN(16)))
+			}
+		}
+	}
+	// Random data is stored in uncompressed LZMA2 chunks.
+	for range 64 << 10 {
+		b.WriteByte(byte(r.Uint32()))
+	}
+	return b.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	want := testData()
+	files := []string{
+		"testdata/data.xz",
+		"testdata/data-crc32.xz",
+		"testdata/data-sha256-blocks.xz",
+		"testdata/data-none-lp2.xz",
+	}
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			f, err := os.Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			r, err := xz.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("want %d bytes but got %d bytes which differ", len(want), len(got))
+			}
+		})
+	}
+}
+
+func TestReaderConcatenated(t *testing.T) {
+	a, err := os.ReadFile("testdata/data.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile("testdata/data-crc32.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Streams may be separated by stream padding.
+	src := bytes.Join([][]byte{a, b, make([]byte, 8)}, make([]byte, 4))
+	r, err := xz.NewReader(bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat(testData(), 2)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("want %d bytes but got %d bytes which differ", len(want), len(got))
+	}
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	src, err := os.ReadFile("testdata/data-crc32.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string][]byte{
+		"truncated":      src[:len(src)/2],
+		"no footer":      src[:len(src)-12],
+		"bad padding":    append(append([]byte{}, src...), 0, 0),
+		"trailing bytes": append(append([]byte{}, src...), 1, 2, 3, 4),
+	}
+	for _, off := range []int{len(src) / 3, len(src) / 2, len(src) - 20} {
+		b := append([]byte{}, src...)
+		b[off] ^= 0x10
+		cases[fmt.Sprintf("flipped bit at %d", off)] = b
+	}
+	for name, b := range cases {
+		r, err := xz.NewReader(bytes.NewReader(b))
+		if err == nil {
+			_, err = io.Copy(io.Discard, r)
+		}
+		if err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+
+	if _, err := xz.NewReader(bytes.NewReader([]byte("not xz data"))); err == nil {
+		t.Fatal("want error for invalid magic")
+	}
+	if _, err := xz.NewReader(bytes.NewReader(src[:6])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("want %v but got %v", io.ErrUnexpectedEOF, err)
+	}
+}
@@ -0,0 +1,100 @@
+package zstd
+
+import "math/bits"
+
+// forwardBitReader reads a little endian bit stream from the start,
+// least significant bit first. It is used for FSE table descriptions.
+type forwardBitReader struct {
+	in  []byte
+	off int // offset in bits
+}
+
+func (r *forwardBitReader) read(n uint) (uint32, bool) {
+	var v uint32
+	for i := range n {
+		byteOff := r.off >> 3
+		if byteOff >= len(r.in) {
+			return 0, false
+		}
+		v |= uint32(r.in[byteOff]>>(r.off&7)&1) << i
+		r.off++
+	}
+	return v, true
+}
+
+// bytes returns the number of bytes consumed, rounded up.
+func (r *forwardBitReader) bytes() int { return (r.off + 7) >> 3 }
+
+// backwardBitReader reads a bit stream from the end, as used for Huffman
+// and FSE coded data. The last byte holds a marker bit above the first
+// bits of the stream. Reading beyond the start of the stream returns
+// zero bits.
+type backwardBitReader struct {
+	in    []byte
+	off   int    // bytes in[:off] are not loaded yet
+	value uint64 // the low nbits bits are unread
+	nbits uint
+
+	// overread is the number of zero bits read beyond the start.
+	overread uint
+}
+
+func (r *backwardBitReader) init(in []byte) bool {
+	if len(in) == 0 || in[len(in)-1] == 0 {
+		return false
+	}
+	last := in[len(in)-1]
+	*r = backwardBitReader{
+		in:    in,
+		off:   len(in) - 1,
+		value: uint64(last),
+		nbits: uint(bits.Len8(last)) - 1,
+	}
+	return true
+}
+
+func (r *backwardBitReader) fill() {
+	for r.nbits <= 56 && r.off > 0 {
+		r.off--
+		r.value = r.value<<8 | uint64(r.in[r.off])
+		r.nbits += 8
+	}
+}
+
+// peek returns the next n bits without consuming them.
+func (r *backwardBitReader) peek(n uint) uint32 {
+	if r.nbits < n {
+		r.fill()
+		if r.nbits < n {
+			// Pad with zeros beyond the start of the stream.
+			return uint32(r.value<<(n-r.nbits)) & (1<<n - 1)
+		}
+	}
+	return uint32(r.value>>(r.nbits-n)) & (1<<n - 1)
+}
+
+func (r *backwardBitReader) skip(n uint) {
+	if r.nbits < n {
+		r.overread += n - r.nbits
+		r.nbits = 0
+		return
+	}
+	r.nbits -= n
+}
+
+func (r *backwardBitReader) read(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+	v := r.peek(n)
+	r.skip(n)
+	return v
+}
+
+// overflow reports whether more bits were read than the stream has.
+func (r *backwardBitReader) overflow() bool { return r.overread > 0 }
+
+// finished reports whether the stream was consumed exactly.
+func (r *backwardBitReader) finished() bool {
+	return r.off == 0 && r.nbits == 0 && r.overread == 0
+}
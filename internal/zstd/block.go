@@ -0,0 +1,310 @@
+package zstd
+
+const (
+	literalsRaw        = 0
+	literalsRLE        = 1
+	literalsCompressed = 2
+	literalsTreeless   = 3
+)
+
+// readLiterals decodes the literals section at the start of block into
+// z.literals and returns its size.
+func (z *Reader) readLiterals(block []byte) (int, error) {
+	if len(block) == 0 {
+		return 0, errCorrupt
+	}
+	typ := block[0] & 3
+	sizeFormat := (block[0] >> 2) & 3
+
+	if typ == literalsRaw || typ == literalsRLE {
+		var regenerated, hdrSize int
+		switch sizeFormat {
+		case 0, 2:
+			regenerated = int(block[0] >> 3)
+			hdrSize = 1
+		case 1:
+			if len(block) < 2 {
+				return 0, errCorrupt
+			}
+			regenerated = int(block[0]>>4) | int(block[1])<<4
+			hdrSize = 2
+		case 3:
+			if len(block) < 3 {
+				return 0, errCorrupt
+			}
+			regenerated = int(block[0]>>4) | int(block[1])<<4 | int(block[2])<<12
+			hdrSize = 3
+		}
+		if regenerated > maxBlockSize {
+			return 0, errCorrupt
+		}
+		z.literals = z.literals[:0]
+		if typ == literalsRaw {
+			if len(block) < hdrSize+regenerated {
+				return 0, errCorrupt
+			}
+			z.literals = append(z.literals, block[hdrSize:hdrSize+regenerated]...)
+			return hdrSize + regenerated, nil
+		}
+		if len(block) < hdrSize+1 {
+			return 0, errCorrupt
+		}
+		for range regenerated {
+			z.literals = append(z.literals, block[hdrSize])
+		}
+		return hdrSize + 1, nil
+	}
+
+	var hdrSize, sizeBits, streams int
+	switch sizeFormat {
+	case 0:
+		hdrSize, sizeBits, streams = 3, 10, 1
+	case 1:
+		hdrSize, sizeBits, streams = 3, 10, 4
+	case 2:
+		hdrSize, sizeBits, streams = 4, 14, 4
+	case 3:
+		hdrSize, sizeBits, streams = 5, 18, 4
+	}
+	if len(block) < hdrSize {
+		return 0, errCorrupt
+	}
+	var v uint64
+	for i := hdrSize - 1; i >= 0; i-- {
+		v = v<<8 | uint64(block[i])
+	}
+	v >>= 4
+	regenerated := int(v & (1<<sizeBits - 1))
+	compressed := int(v >> sizeBits & (1<<sizeBits - 1))
+	if regenerated > maxBlockSize || len(block) < hdrSize+compressed {
+		return 0, errCorrupt
+	}
+	data := block[hdrSize : hdrSize+compressed]
+	if typ == literalsCompressed {
+		n, err := z.huffman.read(data)
+		if err != nil {
+			return 0, err
+		}
+		data = data[n:]
+		z.hasHuffman = true
+	} else if !z.hasHuffman {
+		return 0, errCorrupt
+	}
+	if cap(z.literals) < regenerated {
+		z.literals = make([]byte, maxBlockSize)
+	}
+	z.literals = z.literals[:regenerated]
+	if err := z.huffman.decode(data, z.literals, streams); err != nil {
+		return 0, err
+	}
+	return hdrSize + compressed, nil
+}
+
+const (
+	modePredefined = 0
+	modeRLE        = 1
+	modeCompressed = 2
+	modeRepeat     = 3
+)
+
+// Baselines and extra bits of literal length and match length codes.
+var (
+	literalLengthBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	literalLengthBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	matchLengthBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	matchLengthBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// readTable sets *current to the table selected by mode, reading a table
+// description into t if needed, and returns the number of bytes used.
+func readTable(in []byte, mode byte, t *fseTable, current **fseTable, def *fseTable, maxSymbol int, maxLog uint) (int, error) {
+	switch mode {
+	case modePredefined:
+		*current = def
+		return 0, nil
+	case modeRLE:
+		if len(in) < 1 || int(in[0]) > maxSymbol {
+			return 0, errCorrupt
+		}
+		t.rle(in[0])
+		*current = t
+		return 1, nil
+	case modeCompressed:
+		n, err := t.read(in, maxSymbol, maxLog)
+		if err != nil {
+			return 0, err
+		}
+		*current = t
+		return n, nil
+	}
+	if *current == nil {
+		return 0, errCorrupt
+	}
+	return 0, nil
+}
+
+// readSequences decodes the sequences section and executes the sequences,
+// appending the output to z.hist.
+func (z *Reader) readSequences(in []byte) error {
+	if len(in) == 0 {
+		return errCorrupt
+	}
+	var count int
+	switch b := int(in[0]); {
+	case b == 0:
+		if len(in) != 1 {
+			return errCorrupt
+		}
+		z.hist = append(z.hist, z.literals...)
+		return nil
+	case b < 128:
+		count = b
+		in = in[1:]
+	case b < 255:
+		if len(in) < 2 {
+			return errCorrupt
+		}
+		count = (b-128)<<8 | int(in[1])
+		in = in[2:]
+	default:
+		if len(in) < 3 {
+			return errCorrupt
+		}
+		count = int(in[1]) | int(in[2])<<8 + 0x7f00
+		in = in[3:]
+	}
+	if len(in) < 1 {
+		return errCorrupt
+	}
+	modes := in[0]
+	if modes&3 != 0 {
+		return errCorrupt
+	}
+	in = in[1:]
+	for _, t := range []struct {
+		mode      byte
+		t         *fseTable
+		current   **fseTable
+		def       *fseTable
+		maxSymbol int
+		maxLog    uint
+	}{
+		{modes >> 6, &z.llTable, &z.llCurrent, &defaultLiteralLengthTable, 35, 9},
+		{modes >> 4 & 3, &z.ofTable, &z.ofCurrent, &defaultOffsetTable, 31, 8},
+		{modes >> 2 & 3, &z.mlTable, &z.mlCurrent, &defaultMatchLengthTable, 52, 9},
+	} {
+		n, err := readTable(in, t.mode, t.t, t.current, t.def, t.maxSymbol, t.maxLog)
+		if err != nil {
+			return err
+		}
+		in = in[n:]
+	}
+
+	var br backwardBitReader
+	if !br.init(in) {
+		return errCorrupt
+	}
+	var ll, of, ml fseState
+	ll.init(z.llCurrent, &br)
+	of.init(z.ofCurrent, &br)
+	ml.init(z.mlCurrent, &br)
+
+	literals := z.literals
+	blockStart := len(z.hist)
+	for i := range count {
+		llCode, ofCode, mlCode := ll.symbol(), of.symbol(), ml.symbol()
+		if llCode > 35 || mlCode > 52 || ofCode > 31 {
+			return errCorrupt
+		}
+		offset := uint32(1)<<ofCode + br.read(uint(ofCode))
+		matchLen := int(matchLengthBase[mlCode] + br.read(uint(matchLengthBits[mlCode])))
+		litLen := int(literalLengthBase[llCode] + br.read(uint(literalLengthBits[llCode])))
+
+		// Offsets 1 to 3 select a repeated offset, shifted by one if
+		// there are no literals.
+		if offset > 3 {
+			offset -= 3
+			z.repeatOffset = [3]uint32{offset, z.repeatOffset[0], z.repeatOffset[1]}
+		} else {
+			idx := int(offset) - 1
+			if litLen == 0 {
+				idx++
+			}
+			switch idx {
+			case 0:
+				offset = z.repeatOffset[0]
+			case 3:
+				offset = z.repeatOffset[0] - 1
+				if offset == 0 {
+					return errCorrupt
+				}
+				z.repeatOffset = [3]uint32{offset, z.repeatOffset[0], z.repeatOffset[1]}
+			default:
+				offset = z.repeatOffset[idx]
+				if idx == 2 {
+					z.repeatOffset[2] = z.repeatOffset[1]
+				}
+				z.repeatOffset[1] = z.repeatOffset[0]
+				z.repeatOffset[0] = offset
+			}
+		}
+
+		if i != count-1 {
+			ll.update(&br)
+			ml.update(&br)
+			of.update(&br)
+		}
+		if br.overflow() {
+			return errCorrupt
+		}
+
+		if litLen > len(literals) || len(z.hist)-blockStart+litLen+matchLen > maxBlockSize {
+			return errCorrupt
+		}
+		z.hist = append(z.hist, literals[:litLen]...)
+		literals = literals[litLen:]
+		if int(offset) > len(z.hist) {
+			return errCorrupt
+		}
+		z.hist = appendMatch(z.hist, int(offset), matchLen)
+	}
+	if !br.finished() {
+		return errCorrupt
+	}
+	z.hist = append(z.hist, literals...)
+	if len(z.hist)-blockStart > maxBlockSize {
+		return errCorrupt
+	}
+	return nil
+}
+
+// appendMatch appends n bytes copied from offset bytes before the end of b.
+func appendMatch(b []byte, offset, n int) []byte {
+	start := len(b) - offset
+	for n > 0 {
+		// Copying offset bytes at a time repeats overlapping matches.
+		chunk := min(n, offset)
+		b = append(b, b[start:start+chunk]...)
+		start += chunk
+		n -= chunk
+	}
+	return b
+}
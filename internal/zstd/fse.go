@@ -0,0 +1,209 @@
+package zstd
+
+import "math/bits"
+
+// fseEntry is an entry of an FSE decoding table.
+type fseEntry struct {
+	symbol   uint8
+	nbBits   uint8
+	newState uint16
+}
+
+// fseTable is an FSE decoding table.
+type fseTable struct {
+	accuracyLog uint
+	entries     []fseEntry
+}
+
+// readFSETable reads an FSE table description from the start of in and
+// returns the number of bytes it used.
+func (t *fseTable) read(in []byte, maxSymbol int, maxAccuracyLog uint) (int, error) {
+	r := forwardBitReader{in: in}
+	v, ok := r.read(4)
+	if !ok {
+		return 0, errCorrupt
+	}
+	accuracyLog := uint(v) + 5
+	if accuracyLog > maxAccuracyLog {
+		return 0, errCorrupt
+	}
+
+	var counts [maxFSESymbols]int16
+	remaining := int32(1<<accuracyLog) + 1
+	threshold := int32(1 << accuracyLog)
+	nbBits := accuracyLog + 1
+	symbol := 0
+	for remaining > 1 {
+		if symbol > maxSymbol {
+			return 0, errCorrupt
+		}
+		limit := 2*threshold - 1 - remaining
+		low, ok := r.read(nbBits - 1)
+		if !ok {
+			return 0, errCorrupt
+		}
+		value := int32(low)
+		if value >= limit {
+			high, ok := r.read(1)
+			if !ok {
+				return 0, errCorrupt
+			}
+			value += int32(high) << (nbBits - 1)
+			if value >= threshold {
+				value -= limit
+			}
+		}
+		count := value - 1
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		counts[symbol] = int16(count)
+		symbol++
+		if count == 0 {
+			// A zero probability is followed by 2 bit repeat flags for
+			// more zero probabilities.
+			for {
+				repeat, ok := r.read(2)
+				if !ok {
+					return 0, errCorrupt
+				}
+				symbol += int(repeat)
+				if repeat != 3 {
+					break
+				}
+			}
+		}
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || symbol > maxSymbol+1 {
+		return 0, errCorrupt
+	}
+	if err := t.build(counts[:symbol], accuracyLog); err != nil {
+		return 0, err
+	}
+	return r.bytes(), nil
+}
+
+const maxFSESymbols = 256
+
+// build builds the decoding table from normalized counts, where -1 is a
+// probability of less than one.
+func (t *fseTable) build(counts []int16, accuracyLog uint) error {
+	size := 1 << accuracyLog
+	if cap(t.entries) < size {
+		t.entries = make([]fseEntry, size)
+	}
+	t.entries = t.entries[:size]
+	t.accuracyLog = accuracyLog
+
+	var next [maxFSESymbols]uint16
+	high := size - 1
+	for s, c := range counts {
+		if c == -1 {
+			t.entries[high].symbol = uint8(s)
+			high--
+			next[s] = 1
+		} else {
+			next[s] = uint16(c)
+		}
+	}
+
+	mask := size - 1
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, c := range counts {
+		for range max(c, 0) {
+			t.entries[pos].symbol = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	if pos != 0 {
+		return errCorrupt
+	}
+
+	for i := range t.entries {
+		e := &t.entries[i]
+		n := next[e.symbol]
+		next[e.symbol]++
+		if n == 0 {
+			return errCorrupt
+		}
+		nb := accuracyLog - uint(bits.Len16(n)-1)
+		e.nbBits = uint8(nb)
+		e.newState = uint16(int(n)<<nb - size)
+	}
+	return nil
+}
+
+// rle makes t a table which always decodes symbol.
+func (t *fseTable) rle(symbol uint8) {
+	t.accuracyLog = 0
+	t.entries = append(t.entries[:0], fseEntry{symbol: symbol})
+}
+
+// fseState is the state of an FSE decoder.
+type fseState struct {
+	t     *fseTable
+	state uint32
+}
+
+func (s *fseState) init(t *fseTable, br *backwardBitReader) {
+	s.t = t
+	s.state = br.read(t.accuracyLog)
+}
+
+func (s *fseState) symbol() uint8 { return s.t.entries[s.state].symbol }
+
+func (s *fseState) update(br *backwardBitReader) {
+	e := s.t.entries[s.state]
+	s.state = uint32(e.newState) + br.read(uint(e.nbBits))
+}
+
+// Predefined distributions of the sequence codes.
+var (
+	defaultLiteralLengths = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	defaultMatchLengths = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	defaultOffsets = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+)
+
+var (
+	defaultLiteralLengthTable fseTable
+	defaultMatchLengthTable   fseTable
+	defaultOffsetTable        fseTable
+)
+
+func init() {
+	for _, d := range []struct {
+		t           *fseTable
+		counts      []int16
+		accuracyLog uint
+	}{
+		{&defaultLiteralLengthTable, defaultLiteralLengths, 6},
+		{&defaultMatchLengthTable, defaultMatchLengths, 6},
+		{&defaultOffsetTable, defaultOffsets, 5},
+	} {
+		if err := d.t.build(d.counts, d.accuracyLog); err != nil {
+			panic("zstd: invalid predefined distribution")
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package zstd
+
+import "math/bits"
+
+const maxHuffmanBits = 11
+
+type huffmanEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+// huffmanTable is a Huffman decoding table indexed by the next maxBits
+// bits of a stream.
+type huffmanTable struct {
+	maxBits uint
+	entries []huffmanEntry
+}
+
+// read reads a Huffman tree description from the start of in and returns
+// the number of bytes it used.
+func (t *huffmanTable) read(in []byte) (int, error) {
+	if len(in) == 0 {
+		return 0, errCorrupt
+	}
+	var weights [256]uint8
+	var n int
+	header := int(in[0])
+	used := 1
+	if header >= 128 {
+		// The weights are stored directly, 4 bits each.
+		n = header - 127
+		size := (n + 1) / 2
+		if len(in) < 1+size {
+			return 0, errCorrupt
+		}
+		for i := range n {
+			b := in[1+i/2]
+			if i%2 == 0 {
+				weights[i] = b >> 4
+			} else {
+				weights[i] = b & 0x0f
+			}
+		}
+		used += size
+	} else {
+		if len(in) < 1+header {
+			return 0, errCorrupt
+		}
+		var err error
+		n, err = decodeWeights(in[1:1+header], &weights)
+		if err != nil {
+			return 0, err
+		}
+		used += header
+	}
+	if err := t.build(weights[:n]); err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+// decodeWeights decodes FSE compressed Huffman weights.
+func decodeWeights(in []byte, weights *[256]uint8) (int, error) {
+	var table fseTable
+	size, err := table.read(in, maxHuffmanBits+1, 6)
+	if err != nil {
+		return 0, err
+	}
+	var br backwardBitReader
+	if !br.init(in[size:]) {
+		return 0, errCorrupt
+	}
+	// Two interleaved states share the stream. Decoding ends when the
+	// stream is exhausted, with the symbol of the other state.
+	var s1, s2 fseState
+	s1.init(&table, &br)
+	s2.init(&table, &br)
+	n := 0
+	for {
+		if n+2 > len(weights) {
+			return 0, errCorrupt
+		}
+		weights[n] = s1.symbol()
+		n++
+		s1.update(&br)
+		if br.overflow() {
+			weights[n] = s2.symbol()
+			n++
+			break
+		}
+		weights[n] = s2.symbol()
+		n++
+		s2.update(&br)
+		if br.overflow() {
+			weights[n] = s1.symbol()
+			n++
+			break
+		}
+	}
+	return n, nil
+}
+
+// build builds the table from the weights of all but the last symbol.
+func (t *huffmanTable) build(weights []uint8) error {
+	if len(weights) == 0 || len(weights) > 255 {
+		return errCorrupt
+	}
+	var total uint32
+	for _, w := range weights {
+		if w > maxHuffmanBits {
+			return errCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return errCorrupt
+	}
+	maxBits := uint(bits.Len32(total))
+	if maxBits > maxHuffmanBits {
+		return errCorrupt
+	}
+	// The weight of the last symbol completes the total to a power of two.
+	rest := uint32(1)<<maxBits - total
+	if rest&(rest-1) != 0 {
+		return errCorrupt
+	}
+	last := uint8(bits.Len32(rest))
+
+	var counts [maxHuffmanBits + 2]uint32
+	for _, w := range weights {
+		counts[w]++
+	}
+	counts[last]++
+	// Lower weights have longer codes and come first in the table.
+	var starts [maxHuffmanBits + 2]uint32
+	var pos uint32
+	for w := 1; w <= maxHuffmanBits; w++ {
+		starts[w] = pos
+		pos += counts[w] << (w - 1)
+	}
+
+	size := 1 << maxBits
+	if cap(t.entries) < size {
+		t.entries = make([]huffmanEntry, size)
+	}
+	t.entries = t.entries[:size]
+	t.maxBits = maxBits
+	put := func(symbol int, w uint8) {
+		if w == 0 {
+			return
+		}
+		e := huffmanEntry{symbol: uint8(symbol), nbBits: uint8(maxBits + 1 - uint(w))}
+		start := starts[w]
+		for i := range uint32(1) << (w - 1) {
+			t.entries[start+i] = e
+		}
+		starts[w] += 1 << (w - 1)
+	}
+	for s, w := range weights {
+		put(s, w)
+	}
+	put(len(weights), last)
+	return nil
+}
+
+// decodeStream decodes len(out) symbols from one Huffman coded stream.
+func (t *huffmanTable) decodeStream(in []byte, out []byte) error {
+	var br backwardBitReader
+	if !br.init(in) {
+		return errCorrupt
+	}
+	for i := range out {
+		e := t.entries[br.peek(t.maxBits)]
+		out[i] = e.symbol
+		br.skip(uint(e.nbBits))
+	}
+	if !br.finished() {
+		return errCorrupt
+	}
+	return nil
+}
+
+// decode decodes len(out) symbols from one or four streams.
+func (t *huffmanTable) decode(in []byte, out []byte, streams int) error {
+	if streams == 1 {
+		return t.decodeStream(in, out)
+	}
+	if len(in) < 6 {
+		return errCorrupt
+	}
+	sizes := [4]int{
+		int(in[0]) | int(in[1])<<8,
+		int(in[2]) | int(in[3])<<8,
+		int(in[4]) | int(in[5])<<8,
+	}
+	in = in[6:]
+	sizes[3] = len(in) - sizes[0] - sizes[1] - sizes[2]
+	if sizes[3] < 0 {
+		return errCorrupt
+	}
+	segment := (len(out) + 3) / 4
+	for i, size := range sizes {
+		n := min(segment, len(out))
+		if i == 3 {
+			n = len(out)
+		}
+		if err := t.decodeStream(in[:size], out[:n]); err != nil {
+			return err
+		}
+		in = in[size:]
+		out = out[n:]
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxh64 computes the XXH64 hash with seed 0, which is used for frame
+// content checksums.
+type xxh64 struct {
+	v     [4]uint64
+	buf   [32]byte
+	n     int // bytes in buf
+	total uint64
+}
+
+const (
+	prime64_1 = 11400714785074694791
+	prime64_2 = 14029467366897019727
+	prime64_3 = 1609587929392839161
+	prime64_4 = 9650029242287828579
+	prime64_5 = 2870177450012600261
+)
+
+func (x *xxh64) reset() {
+	*x = xxh64{}
+	p1 := uint64(prime64_1)
+	x.v = [4]uint64{p1 + prime64_2, prime64_2, 0, -p1}
+}
+
+func xxhRound(acc, lane uint64) uint64 {
+	return bits.RotateLeft64(acc+lane*prime64_2, 31) * prime64_1
+}
+
+func (x *xxh64) stripe(b []byte) {
+	for i := range x.v {
+		x.v[i] = xxhRound(x.v[i], binary.LittleEndian.Uint64(b[8*i:]))
+	}
+}
+
+func (x *xxh64) write(b []byte) {
+	x.total += uint64(len(b))
+	if x.n > 0 {
+		n := copy(x.buf[x.n:], b)
+		x.n += n
+		b = b[n:]
+		if x.n < len(x.buf) {
+			return
+		}
+		x.stripe(x.buf[:])
+		x.n = 0
+	}
+	for len(b) >= 32 {
+		x.stripe(b)
+		b = b[32:]
+	}
+	x.n = copy(x.buf[:], b)
+}
+
+func (x *xxh64) sum64() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		v := x.v
+		h = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) +
+			bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, lane := range v {
+			h = (h^xxhRound(0, lane))*prime64_1 + prime64_4
+		}
+	} else {
+		h = prime64_5
+	}
+	h += x.total
+
+	b := x.buf[:x.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*prime64_1 + prime64_4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * prime64_1
+		h = bits.RotateLeft64(h, 23)*prime64_2 + prime64_3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * prime64_5
+		h = bits.RotateLeft64(h, 11) * prime64_1
+	}
+	h ^= h >> 33
+	h *= prime64_2
+	h ^= h >> 29
+	h *= prime64_3
+	h ^= h >> 32
+	return h
+}
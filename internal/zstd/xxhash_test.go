@@ -0,0 +1,41 @@
+package zstd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestXXH64(t *testing.T) {
+	cases := []struct {
+		in   string
+		want uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+	}
+	for _, tc := range cases {
+		var h xxh64
+		h.reset()
+		h.write([]byte(tc.in))
+		if got := h.sum64(); got != tc.want {
+			t.Fatalf("%q: want %#x but got %#x", tc.in, tc.want, got)
+		}
+	}
+
+	// Longer inputs are covered by the content checksums in testdata.
+	// Writing in pieces must not change the hash.
+	in := []byte(strings.Repeat("0123456789", 10))
+	var whole, pieces xxh64
+	whole.reset()
+	whole.write(in)
+	pieces.reset()
+	for len(in) > 0 {
+		n := min(len(in), 7)
+		pieces.write(in[:n])
+		in = in[n:]
+	}
+	if whole.sum64() != pieces.sum64() {
+		t.Fatalf("want %#x but got %#x", whole.sum64(), pieces.sum64())
+	}
+}
@@ -0,0 +1,300 @@
+// Package zstd implements a decoder for the Zstandard compression format
+// described in RFC 8878. Dictionaries are not supported.
+package zstd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errCorrupt = errors.New("zstd: corrupt data")
+
+const (
+	frameMagic         = 0xfd2fb528
+	skippableMagicMask = 0xfffffff0
+	skippableMagic     = 0x184d2a50
+
+	maxBlockSize = 128 << 10
+
+	// maxWindowSize limits the memory used by a frame.
+	maxWindowSize = 1 << 30
+)
+
+// Reader decompresses a zstd stream. Concatenated and skippable frames
+// are supported.
+type Reader struct {
+	r *bufio.Reader
+
+	// hist holds the decoded data of the current frame which may be
+	// referenced by matches, followed by data not read yet.
+	hist []byte
+	// out is the offset in hist of data not read yet.
+	out int
+
+	windowSize  int
+	contentSize int64 // -1 if unknown
+	decoded     int64
+	checksum    bool
+	lastBlock   bool
+	inFrame     bool
+	hash        xxh64
+
+	block    []byte
+	literals []byte
+
+	huffman      huffmanTable
+	hasHuffman   bool
+	llTable      fseTable
+	ofTable      fseTable
+	mlTable      fseTable
+	llCurrent    *fseTable
+	ofCurrent    *fseTable
+	mlCurrent    *fseTable
+	repeatOffset [3]uint32
+
+	err error
+}
+
+// NewReader returns a Reader which decompresses r. It reads the first
+// frame header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{r: bufio.NewReaderSize(r, 1<<16)}
+	if err := z.readFrameHeader(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *Reader) readFull(p []byte) error {
+	_, err := io.ReadFull(z.r, p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readFrameHeader reads the next frame header, skipping skippable frames.
+// It returns io.EOF if there are no more frames.
+func (z *Reader) readFrameHeader() error {
+	var magic [4]byte
+	for {
+		if _, err := io.ReadFull(z.r, magic[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return errCorrupt
+			}
+			return err
+		}
+		m := binary.LittleEndian.Uint32(magic[:])
+		if m == frameMagic {
+			break
+		}
+		if m&skippableMagicMask != skippableMagic {
+			return errors.New("zstd: invalid frame magic")
+		}
+		if err := z.readFull(magic[:]); err != nil {
+			return err
+		}
+		size := int64(binary.LittleEndian.Uint32(magic[:]))
+		if n, err := io.CopyN(io.Discard, z.r, size); n != size {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	desc, err := z.r.ReadByte()
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	fcsFlag := desc >> 6
+	singleSegment := desc&0x20 != 0
+	if desc&0x08 != 0 {
+		return errCorrupt
+	}
+	z.checksum = desc&0x04 != 0
+	didSize := [4]int{0, 1, 2, 4}[desc&0x03]
+	fcsSize := [4]int{0, 2, 4, 8}[fcsFlag]
+	if fcsFlag == 0 && singleSegment {
+		fcsSize = 1
+	}
+	windowDescSize := 1
+	if singleSegment {
+		windowDescSize = 0
+	}
+	var buf [14]byte
+	hdr := buf[:windowDescSize+didSize+fcsSize]
+	if err := z.readFull(hdr); err != nil {
+		return err
+	}
+
+	var windowSize uint64
+	if !singleSegment {
+		exp := hdr[0] >> 3
+		base := uint64(1) << (10 + exp)
+		windowSize = base + base/8*uint64(hdr[0]&7)
+	}
+	hdr = hdr[windowDescSize:]
+	var did uint32
+	for i := range didSize {
+		did |= uint32(hdr[i]) << (8 * i)
+	}
+	if did != 0 {
+		return errors.New("zstd: dictionaries are not supported")
+	}
+	hdr = hdr[didSize:]
+	z.contentSize = -1
+	switch fcsSize {
+	case 1:
+		z.contentSize = int64(hdr[0])
+	case 2:
+		z.contentSize = int64(binary.LittleEndian.Uint16(hdr)) + 256
+	case 4:
+		z.contentSize = int64(binary.LittleEndian.Uint32(hdr))
+	case 8:
+		v := binary.LittleEndian.Uint64(hdr)
+		if v > 1<<62 {
+			return errCorrupt
+		}
+		z.contentSize = int64(v)
+	}
+	if singleSegment {
+		windowSize = uint64(z.contentSize)
+	}
+	if windowSize > maxWindowSize {
+		return fmt.Errorf("zstd: window size %d is too large", windowSize)
+	}
+
+	z.windowSize = int(windowSize)
+	z.hist = z.hist[:0]
+	z.out = 0
+	z.decoded = 0
+	z.lastBlock = false
+	z.inFrame = true
+	z.hasHuffman = false
+	z.llCurrent, z.ofCurrent, z.mlCurrent = nil, nil, nil
+	z.repeatOffset = [3]uint32{1, 4, 8}
+	z.hash.reset()
+	return nil
+}
+
+// Read implements io.Reader.
+func (z *Reader) Read(p []byte) (int, error) {
+	for z.err == nil {
+		if z.out < len(z.hist) {
+			n := copy(p, z.hist[z.out:])
+			z.out += n
+			return n, nil
+		}
+		if z.inFrame && !z.lastBlock {
+			z.err = z.readBlock()
+			continue
+		}
+		if z.inFrame {
+			z.err = z.finishFrame()
+			continue
+		}
+		z.err = z.readFrameHeader()
+	}
+	return 0, z.err
+}
+
+func (z *Reader) finishFrame() error {
+	z.inFrame = false
+	if z.contentSize >= 0 && z.decoded != z.contentSize {
+		return errCorrupt
+	}
+	if z.checksum {
+		var sum [4]byte
+		if err := z.readFull(sum[:]); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(sum[:]) != uint32(z.hash.sum64()) {
+			return errors.New("zstd: checksum mismatch")
+		}
+	}
+	return nil
+}
+
+func (z *Reader) readBlock() error {
+	var hdr [3]byte
+	if err := z.readFull(hdr[:]); err != nil {
+		return err
+	}
+	v := uint32(hdr[0]) | uint32(hdr[1])<<8 | uint32(hdr[2])<<16
+	z.lastBlock = v&1 != 0
+	blockType := (v >> 1) & 3
+	size := int(v >> 3)
+	if size > min(maxBlockSize, z.windowSize) {
+		return errCorrupt
+	}
+
+	// All data in hist was read, so only one window of history has to
+	// be kept before the block is decoded.
+	if cap(z.hist)-len(z.hist) < maxBlockSize {
+		keep := min(len(z.hist), z.windowSize)
+		tail := z.hist[len(z.hist)-keep:]
+		if cap(z.hist) < keep+maxBlockSize {
+			h := make([]byte, 0, max(2*z.windowSize, keep)+maxBlockSize)
+			z.hist = append(h, tail...)
+		} else {
+			z.hist = z.hist[:copy(z.hist, tail)]
+		}
+		z.out = len(z.hist)
+	}
+	start := len(z.hist)
+
+	switch blockType {
+	case 0: // raw
+		z.hist = z.hist[:start+size]
+		if err := z.readFull(z.hist[start:]); err != nil {
+			return err
+		}
+	case 1: // RLE
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		z.hist = z.hist[:start+size]
+		for i := start; i < len(z.hist); i++ {
+			z.hist[i] = b
+		}
+	case 2: // compressed
+		if cap(z.block) < size {
+			z.block = make([]byte, maxBlockSize)
+		}
+		block := z.block[:size]
+		if err := z.readFull(block); err != nil {
+			return err
+		}
+		if err := z.decompressBlock(block); err != nil {
+			return err
+		}
+		if len(z.hist)-start > maxBlockSize {
+			return errCorrupt
+		}
+	default:
+		return errCorrupt
+	}
+
+	z.hash.write(z.hist[start:])
+	z.decoded += int64(len(z.hist) - start)
+	if z.contentSize >= 0 && z.decoded > z.contentSize {
+		return errCorrupt
+	}
+	return nil
+}
+
+func (z *Reader) decompressBlock(block []byte) error {
+	n, err := z.readLiterals(block)
+	if err != nil {
+		return err
+	}
+	return z.readSequences(block[n:])
+}
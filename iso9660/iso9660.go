@@ -0,0 +1,154 @@
+// Package iso9660 creates ISO 9660 images with the Joliet and Rock Ridge
+// extensions from an fs.FS, and reads them back.
+//
+// A typical use is a cloud-init seed image labelled "cidata", attached to
+// a Linux guest as a read-only block device or USB mass storage device.
+package iso9660
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 2048
+
+	// systemAreaSectors is the number of unused sectors at the start.
+	systemAreaSectors = 16
+
+	maxFileSize      = 1<<32 - 1
+	maxLabelLength   = 32
+	maxJolietLabel   = 16 // in UCS-2 characters
+	maxJolietName    = 64 // in UCS-2 characters
+	maxIdentifierLen = 30 // level 2, without ";1"
+)
+
+// ErrCorrupt is returned when an ISO 9660 image is damaged.
+var ErrCorrupt = errors.New("iso9660: corrupt image")
+
+type config struct {
+	label      string
+	joliet     bool
+	rockRidge  bool
+	volumeTime time.Time
+}
+
+// Option is an option for Write.
+type Option func(*config) error
+
+// WithVolumeLabel sets the volume label, at most 32 ASCII characters. The label
+// is stored as it is, so "cidata" is found by cloud-init as well as by blkid.
+// The Joliet volume label is limited to 16 characters, longer labels are
+// truncated there.
+func WithVolumeLabel(label string) Option {
+	return func(c *config) error {
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("iso9660: volume label %q is longer than %d characters", label, maxLabelLength)
+		}
+		for _, r := range label {
+			if r < 0x20 || r > 0x7e {
+				return fmt.Errorf("iso9660: invalid character %q in volume label", r)
+			}
+		}
+		c.label = label
+		return nil
+	}
+}
+
+// WithoutJoliet omits the Joliet extension, which Windows uses to show long
+// file names.
+func WithoutJoliet() Option {
+	return func(c *config) error {
+		c.joliet = false
+		return nil
+	}
+}
+
+// WithoutRockRidge omits the Rock Ridge extension, which Linux and macOS use
+// for long file names and POSIX file modes.
+func WithoutRockRidge() Option {
+	return func(c *config) error {
+		c.rockRidge = false
+		return nil
+	}
+}
+
+// WithVolumeTime sets the creation and modification time of the volume.
+// By default the latest modification time of the files is used, so the image
+// only depends on its content.
+func WithVolumeTime(t time.Time) Option {
+	return func(c *config) error {
+		c.volumeTime = t
+		return nil
+	}
+}
+
+// recordingTime encodes t in the 7 byte format of directory records.
+func recordingTime(b []byte, t time.Time) {
+	if t.IsZero() {
+		clear(b[:7])
+		return
+	}
+	t = t.UTC()
+	year := min(max(t.Year()-1900, 0), 255)
+	b[0] = byte(year)
+	b[1] = byte(t.Month())
+	b[2] = byte(t.Day())
+	b[3] = byte(t.Hour())
+	b[4] = byte(t.Minute())
+	b[5] = byte(t.Second())
+	b[6] = 0 // UTC
+}
+
+func fromRecordingTime(b []byte) time.Time {
+	if b[1] == 0 {
+		return time.Time{}
+	}
+	t := time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, time.UTC)
+	return t.Add(-time.Duration(int8(b[6])) * 15 * time.Minute)
+}
+
+// volumeTime encodes t in the 17 byte format of volume descriptors.
+func volumeTime(b []byte, t time.Time) {
+	if t.IsZero() {
+		copy(b, "0000000000000000")
+		b[16] = 0
+		return
+	}
+	t = t.UTC()
+	copy(b, fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d",
+		t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/10_000_000))
+	b[16] = 0
+}
+
+// ucs2 encodes s in big-endian UCS-2 as used by Joliet.
+func ucs2(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		b[2*i] = byte(c >> 8)
+		b[2*i+1] = byte(c)
+	}
+	return b
+}
+
+func fromUCS2(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return string(utf16.Decode(u))
+}
+
+// putBoth32 encodes v in both byte orders as ISO 9660 requires.
+func putBoth32(b []byte, v uint32) {
+	b[0], b[1], b[2], b[3] = byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+	b[4], b[5], b[6], b[7] = byte(v>>24), byte(v>>16), byte(v>>8), byte(v)
+}
+
+func putBoth16(b []byte, v uint16) {
+	b[0], b[1] = byte(v), byte(v>>8)
+	b[2], b[3] = byte(v>>8), byte(v)
+}
@@ -0,0 +1,158 @@
+package iso9660_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/iso9660"
+)
+
+var modTime = time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+func testFS() fstest.MapFS {
+	m := fstest.MapFS{
+		"user-data":      {Data: []byte("#cloud-config\nhostname: vz\n"), Mode: 0o644, ModTime: modTime},
+		"meta-data":      {Data: []byte("instance-id: i-1\n"), Mode: 0o644, ModTime: modTime},
+		"network-config": {Data: []byte("version: 2\n"), Mode: 0o600, ModTime: modTime},
+		"a file name longer than thirty characters.tar.gz": {Data: bytes.Repeat([]byte{1}, 3*2048+5), Mode: 0o644, ModTime: modTime},
+		strings.Repeat("x", 200) + ".txt":                  {Data: []byte("very long"), Mode: 0o644, ModTime: modTime},
+		"日本語.txt":                                          {Data: []byte("unicode"), Mode: 0o644, ModTime: modTime},
+		"empty":                                            {Mode: 0o644, ModTime: modTime},
+		"bin/run.sh":                                       {Data: []byte("#!/bin/sh\n"), Mode: 0o755, ModTime: modTime},
+		"deep/a/b/c/d/e/f/g/h/file":                        {Data: []byte("deep"), Mode: 0o644, ModTime: modTime},
+		"Same.txt":                                         {Data: []byte("1"), Mode: 0o644, ModTime: modTime},
+		"same.txt":                                         {Data: []byte("2"), Mode: 0o644, ModTime: modTime},
+	}
+	// enough records to span several sectors.
+	for i := range 100 {
+		name := fmt.Sprintf("many/a rather long file name number %03d.json", i)
+		m[name] = &fstest.MapFile{Data: []byte(name), Mode: 0o644, ModTime: modTime}
+	}
+	return m
+}
+
+func write(t *testing.T, src fs.FS, opts ...iso9660.Option) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := iso9660.Write(&buf, src, opts...); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%2048 != 0 {
+		t.Fatalf("image size %d is not a multiple of the sector size", buf.Len())
+	}
+	return buf.Bytes()
+}
+
+func TestWrite(t *testing.T) {
+	src := testFS()
+	for _, tc := range []struct {
+		name string
+		opts []iso9660.Option
+	}{
+		{name: "rock ridge"},
+		{name: "joliet", opts: []iso9660.Option{iso9660.WithoutRockRidge()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := write(t, src, tc.opts...)
+			fsys, err := iso9660.Open(bytes.NewReader(img))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected []string
+			for name := range src {
+				expected = append(expected, jolietName(name, tc.opts != nil))
+			}
+			if err := fstest.TestFS(fsys, expected...); err != nil {
+				t.Fatal(err)
+			}
+			for name, file := range src {
+				name = jolietName(name, tc.opts != nil)
+				got, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(file.Data, got) {
+					t.Fatalf("%s: content mismatch", name)
+				}
+				info, err := fs.Stat(fsys, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !info.ModTime().Equal(modTime) {
+					t.Fatalf("%s: want mod time %v but got %v", name, modTime, info.ModTime())
+				}
+				if tc.opts == nil && info.Mode() != file.Mode {
+					t.Fatalf("%s: want mode %v but got %v", name, file.Mode, info.Mode())
+				}
+			}
+		})
+	}
+}
+
+// jolietName returns name as stored by Joliet, which truncates names to
+// 64 characters but keeps the extension.
+func jolietName(name string, joliet bool) string {
+	if joliet && len(name) > 64 {
+		ext := filepath.Ext(name)
+		return name[:64-len(ext)] + ext
+	}
+	return name
+}
+
+func TestWriteISO9660Names(t *testing.T) {
+	src := fstest.MapFS{
+		"user-data":       {Data: []byte("a")},
+		"meta-data":       {Data: []byte("b")},
+		"README":          {Data: []byte("c")},
+		"lower.case.name": {Data: []byte("d")},
+		"dir.with.dots/x": {Data: []byte("e")},
+	}
+	img := write(t, src, iso9660.WithoutRockRidge(), iso9660.WithoutJoliet())
+	fsys, err := iso9660.Open(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"DIR_WITH_DOTS/X", "LOWER_CASE.NAME", "META_DATA", "README", "USER_DATA"}
+	if err := fstest.TestFS(fsys, want...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteVolumeLabel(t *testing.T) {
+	img := write(t, fstest.MapFS{"meta-data": {}}, iso9660.WithVolumeLabel("cidata"))
+	fsys, err := iso9660.Open(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fsys.Label(); got != "cidata" {
+		t.Fatalf("want label %q but got %q", "cidata", got)
+	}
+	if err := iso9660.Write(&bytes.Buffer{}, fstest.MapFS{}, iso9660.WithVolumeLabel(strings.Repeat("a", 33))); err == nil {
+		t.Fatal("want error for a long label")
+	}
+}
+
+func TestWriteDeterministic(t *testing.T) {
+	a := write(t, testFS(), iso9660.WithVolumeLabel("cidata"))
+	b := write(t, testFS(), iso9660.WithVolumeLabel("cidata"))
+	if !bytes.Equal(a, b) {
+		t.Fatal("images differ")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seed.iso")
+	if err := iso9660.WriteFile(path, fstest.MapFS{"meta-data": {}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := iso9660.WriteFile(path, fstest.MapFS{}); !os.IsExist(err) {
+		t.Fatalf("want os.ErrExist but got %v", err)
+	}
+}
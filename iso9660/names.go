@@ -0,0 +1,133 @@
+package iso9660
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+func isDChar(r rune) bool {
+	return r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_'
+}
+
+func dChars(s string, n int) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if b.Len() == n {
+			break
+		}
+		if !isDChar(r) {
+			r = '_'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isoName returns the level 2 identifier for name, without the version.
+// Files always have a dot separating the extension, which may be empty.
+func isoName(name string, dir bool) (base, ext string) {
+	if dir {
+		return dChars(name, maxIdentifierLen+1), ""
+	}
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		ext = dChars(name[i+1:], 8)
+		name = name[:i]
+	}
+	return dChars(name, maxIdentifierLen-1-len(ext)), ext
+}
+
+// uniqueISONames assigns an identifier to every child of a directory,
+// appending a number to the base name where identifiers would collide.
+func uniqueISONames(children []*node) error {
+	used := make(map[string]bool, len(children))
+	for _, n := range children {
+		base, ext := isoName(n.name, n.dir)
+		limit := maxIdentifierLen - 1 - len(ext)
+		if n.dir {
+			limit = maxIdentifierLen + 1
+		}
+		id := identifier(base, ext, n.dir)
+		for i := 1; used[id]; i++ {
+			if i == 100000 {
+				return fmt.Errorf("iso9660: too many files similar to %q", n.name)
+			}
+			tail := "_" + strconv.Itoa(i)
+			b := base
+			if len(b) > limit-len(tail) {
+				b = b[:limit-len(tail)]
+			}
+			id = identifier(b+tail, ext, n.dir)
+		}
+		used[id] = true
+		n.isoID = []byte(id)
+	}
+	return nil
+}
+
+func identifier(base, ext string, dir bool) string {
+	if dir {
+		return base
+	}
+	return base + "." + ext + ";1"
+}
+
+// uniqueJolietNames assigns a Joliet identifier to every child of a directory,
+// inserting a number before the extension where identifiers would collide.
+func uniqueJolietNames(children []*node) error {
+	used := make(map[string]bool, len(children))
+	for _, n := range children {
+		u := utf16.Encode([]rune(n.name))
+		for i, c := range u {
+			if c < 0x20 || strings.ContainsRune(`*/:;?\`, rune(c)) {
+				u[i] = '_'
+			}
+		}
+		base, ext := u, []uint16(nil)
+		if dot := lastDot(u); dot > 0 && !n.dir && len(u)-dot <= 16 {
+			base, ext = u[:dot], u[dot:]
+		}
+		id := jolietID(truncate(base, maxJolietName-len(ext)), ext, n.dir)
+		for i := 1; used[string(id)]; i++ {
+			if i == 100000 {
+				return fmt.Errorf("iso9660: too many files similar to %q", n.name)
+			}
+			tail := utf16.Encode([]rune("_" + strconv.Itoa(i)))
+			b := append(truncate(base, maxJolietName-len(ext)-len(tail)), tail...)
+			id = jolietID(b, ext, n.dir)
+		}
+		used[string(id)] = true
+		n.jolietID = id
+	}
+	return nil
+}
+
+func truncate(u []uint16, n int) []uint16 {
+	if len(u) > n {
+		u = u[:n]
+	}
+	return u[:len(u):len(u)]
+}
+
+func lastDot(u []uint16) int {
+	for i := len(u) - 1; i >= 0; i-- {
+		if u[i] == '.' {
+			return i
+		}
+	}
+	return -1
+}
+
+func jolietID(base, ext []uint16, dir bool) []byte {
+	u := append(base[:len(base):len(base)], ext...)
+	if !dir {
+		u = append(u, ';', '1')
+	}
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		b[2*i] = byte(c >> 8)
+		b[2*i+1] = byte(c)
+	}
+	return b
+}
@@ -0,0 +1,376 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FS is a read-only ISO 9660 image. It implements fs.FS, fs.ReadDirFS and
+// fs.StatFS.
+//
+// Names and modes are taken from the Rock Ridge extension if the image has
+// it, otherwise from the Joliet extension, and from the ISO 9660 identifiers
+// as a last resort.
+type FS struct {
+	r         io.ReaderAt
+	label     string
+	joliet    bool
+	rockRidge bool
+	root      *entry
+}
+
+var (
+	_ fs.FS        = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+)
+
+// maxDescriptors limits the volume descriptors read before the terminator.
+const maxDescriptors = 64
+
+// Open opens the ISO 9660 image in r.
+func Open(r io.ReaderAt) (*FS, error) {
+	f := &FS{r: r}
+	var primary, joliet []byte
+descriptors:
+	for i := range maxDescriptors {
+		d := make([]byte, sectorSize)
+		if _, err := r.ReadAt(d, int64(systemAreaSectors+i)*sectorSize); err != nil {
+			return nil, err
+		}
+		if string(d[1:6]) != "CD001" {
+			return nil, fmt.Errorf("%w: missing volume descriptor", ErrCorrupt)
+		}
+		switch d[0] {
+		case 1:
+			primary = d
+		case 2:
+			switch string(d[88:91]) {
+			case "%/@", "%/C", "%/E":
+				joliet = d
+			}
+		case 255:
+			break descriptors
+		}
+	}
+	if primary == nil {
+		return nil, fmt.Errorf("%w: no primary volume descriptor", ErrCorrupt)
+	}
+	if binary.LittleEndian.Uint16(primary[128:]) != sectorSize {
+		return nil, fmt.Errorf("%w: unsupported block size %d", ErrCorrupt, binary.LittleEndian.Uint16(primary[128:]))
+	}
+	f.label = strings.TrimRight(string(primary[40:72]), " ")
+	f.root = parseRecord(primary[156:190], false)
+
+	// Rock Ridge is announced by an SP entry in the first record of the root.
+	first := make([]byte, 255)
+	if _, err := r.ReadAt(first, int64(f.root.lba)*sectorSize); err != nil {
+		return nil, err
+	}
+	if n := int(first[0]); n >= 34+7 && n <= len(first) {
+		su := first[34:n]
+		f.rockRidge = string(su[:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef
+	}
+	if !f.rockRidge && joliet != nil {
+		f.joliet = true
+		f.root = parseRecord(joliet[156:190], true)
+	}
+	f.root.name = "."
+	return f, nil
+}
+
+// Label returns the volume label.
+func (f *FS) Label() string { return f.label }
+
+// entry is a directory record.
+type entry struct {
+	name    string
+	dir     bool
+	lba     uint32
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode // from Rock Ridge, zero if unknown
+}
+
+var (
+	_ fs.FileInfo = (*entry)(nil)
+	_ fs.DirEntry = (*entry)(nil)
+)
+
+func (e *entry) Name() string       { return e.name }
+func (e *entry) Size() int64        { return e.size }
+func (e *entry) ModTime() time.Time { return e.modTime }
+func (e *entry) IsDir() bool        { return e.dir }
+func (e *entry) Sys() any           { return nil }
+
+func (e *entry) Mode() fs.FileMode {
+	mode := e.mode
+	if mode == 0 {
+		mode = 0o444
+		if e.dir {
+			mode = 0o555
+		}
+	}
+	if e.dir {
+		return mode | fs.ModeDir
+	}
+	return mode
+}
+
+func (e *entry) Type() fs.FileMode          { return e.Mode().Type() }
+func (e *entry) Info() (fs.FileInfo, error) { return e, nil }
+
+func parseRecord(b []byte, joliet bool) *entry {
+	id := b[33 : 33+int(b[32])]
+	e := &entry{
+		dir:     b[25]&0x02 != 0,
+		lba:     binary.LittleEndian.Uint32(b[2:]),
+		size:    int64(binary.LittleEndian.Uint32(b[10:])),
+		modTime: fromRecordingTime(b[18:25]),
+	}
+	name := string(id)
+	if joliet {
+		name = fromUCS2(id)
+	}
+	if !e.dir {
+		name, _, _ = strings.Cut(name, ";")
+		name = strings.TrimSuffix(name, ".")
+	}
+	e.name = name
+	return e
+}
+
+// readDir returns the entries of the directory e.
+func (f *FS) readDir(e *entry) ([]*entry, error) {
+	data := make([]byte, e.size)
+	if _, err := f.r.ReadAt(data, int64(e.lba)*sectorSize); err != nil {
+		return nil, err
+	}
+	var entries []*entry
+	for pos := 0; pos < len(data); {
+		n := int(data[pos])
+		if n == 0 {
+			// records do not cross sectors, continue with the next one.
+			pos += sectorSize - pos%sectorSize
+			continue
+		}
+		if n < 34 || pos+n > len(data) || 33+int(data[pos+32]) > n {
+			return nil, fmt.Errorf("%w: invalid directory record", ErrCorrupt)
+		}
+		rec := data[pos : pos+n]
+		pos += n
+		idLen := int(rec[32])
+		if idLen == 1 && rec[33] <= 1 {
+			continue // "." and ".."
+		}
+		child := parseRecord(rec, f.joliet)
+		if f.rockRidge {
+			if err := f.applyRockRidge(child, rec[33+idLen+(idLen+1)%2:]); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, child)
+	}
+	return entries, nil
+}
+
+// maxContinuations limits the continuation areas followed for one record.
+const maxContinuations = 16
+
+func (f *FS) applyRockRidge(e *entry, su []byte) error {
+	var name []byte
+	hasName := false
+	for range maxContinuations {
+		var next []byte
+		for len(su) >= 4 {
+			n := int(su[2])
+			if n < 4 || n > len(su) {
+				break
+			}
+			body := su[4:n]
+			switch string(su[:2]) {
+			case "NM":
+				if len(body) >= 1 && body[0]&0x06 == 0 {
+					name = append(name, body[1:]...)
+					hasName = true
+				}
+			case "PX":
+				if len(body) >= 8 {
+					e.mode = fs.FileMode(binary.LittleEndian.Uint32(body) & 0o777)
+				}
+			case "TF":
+				if t, ok := modifyTime(body); ok {
+					e.modTime = t
+				}
+			case "CE":
+				if len(body) >= 24 {
+					lba := binary.LittleEndian.Uint32(body[0:])
+					off := binary.LittleEndian.Uint32(body[8:])
+					length := binary.LittleEndian.Uint32(body[16:])
+					if off+length > sectorSize {
+						return fmt.Errorf("%w: invalid continuation area", ErrCorrupt)
+					}
+					next = make([]byte, length)
+					if _, err := f.r.ReadAt(next, int64(lba)*sectorSize+int64(off)); err != nil {
+						return err
+					}
+				}
+			case "ST":
+				su = nil
+				continue
+			}
+			su = su[n:]
+		}
+		if next == nil {
+			break
+		}
+		su = next
+	}
+	if hasName {
+		e.name = string(name)
+	}
+	return nil
+}
+
+// modifyTime returns the modification time of a TF entry.
+func modifyTime(body []byte) (time.Time, bool) {
+	if len(body) < 1 {
+		return time.Time{}, false
+	}
+	flags := body[0]
+	size := 7
+	if flags&0x80 != 0 {
+		size = 17
+	}
+	if flags&0x02 == 0 {
+		return time.Time{}, false
+	}
+	off := 1
+	if flags&0x01 != 0 { // creation time comes first
+		off += size
+	}
+	if size != 7 || len(body) < off+size {
+		return time.Time{}, false
+	}
+	return fromRecordingTime(body[off:]), true
+}
+
+func (f *FS) lookup(op, name string) (*entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	cur := f.root
+	if name == "." {
+		return cur, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !cur.dir {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		entries, err := f.readDir(cur)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		var next *entry
+		for _, e := range entries {
+			if e.name == elem {
+				next = e
+				break
+			}
+		}
+		if next == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// Open opens the named file or directory.
+func (f *FS) Open(name string) (fs.File, error) {
+	e, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.dir {
+		entries, err := f.readDir(e)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dirFile{entry: e, entries: entries}, nil
+	}
+	return &file{entry: e, r: io.NewSectionReader(f.r, int64(e.lba)*sectorSize, e.size)}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := f.readDir(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	list := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		list[i] = e
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// Stat returns the fs.FileInfo of the named file.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	return f.lookup("stat", name)
+}
+
+type file struct {
+	*entry
+	r *io.SectionReader
+}
+
+func (f *file) Stat() (fs.FileInfo, error)                   { return f.entry, nil }
+func (f *file) Close() error                                 { return nil }
+func (f *file) Read(p []byte) (int, error)                   { return f.r.Read(p) }
+func (f *file) ReadAt(p []byte, off int64) (int, error)      { return f.r.ReadAt(p, off) }
+func (f *file) Seek(offset int64, whence int) (int64, error) { return f.r.Seek(offset, whence) }
+
+type dirFile struct {
+	*entry
+	entries []*entry
+	off     int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.entry, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.off:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.off += len(rest)
+	entries := make([]fs.DirEntry, len(rest))
+	for i, e := range rest {
+		entries[i] = e
+	}
+	return entries, nil
+}
@@ -0,0 +1,679 @@
+package iso9660
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// node is a file or directory to be written.
+type node struct {
+	name     string
+	path     string
+	dir      bool
+	size     int64
+	mode     fs.FileMode
+	modTime  time.Time
+	parent   *node
+	children []*node
+
+	isoID    []byte
+	jolietID []byte
+
+	// extent and size in the primary and the Joliet hierarchy. Files
+	// share their extent.
+	lba, jolietLBA    uint32
+	dirSize           uint32
+	jolietDirSize     uint32
+	pathNum, jPathNum uint16
+}
+
+// Write writes an ISO 9660 image holding the files and directories of fsys
+// to w. Use os.DirFS to copy a directory of the host.
+//
+// Symbolic links to files are copied as regular files. Files which are not
+// regular files or directories, and symbolic links to directories, return
+// an error. The result only depends on fsys and the options.
+func Write(w io.Writer, fsys fs.FS, opts ...Option) error {
+	c := &config{joliet: true, rockRidge: true}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return err
+		}
+	}
+	root := &node{name: ".", path: ".", dir: true, mode: fs.ModeDir | 0o555}
+	root.parent = root
+	if info, err := fs.Stat(fsys, "."); err == nil {
+		root.modTime = info.ModTime()
+	}
+	if err := readTree(fsys, root); err != nil {
+		return err
+	}
+	b := &builder{c: c, fsys: fsys, root: root}
+	if b.c.volumeTime.IsZero() {
+		b.c.volumeTime = latestModTime(root)
+	}
+	if err := b.layout(); err != nil {
+		return err
+	}
+	return b.write(w)
+}
+
+// WriteFile creates an ISO 9660 image at path with Write. If path already
+// exists, WriteFile returns an error satisfying os.IsExist.
+func WriteFile(path string, fsys fs.FS, opts ...Option) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	return Write(f, fsys, opts...)
+}
+
+func readTree(fsys fs.FS, dir *node) error {
+	entries, err := fs.ReadDir(fsys, dir.path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := path.Join(dir.path, e.Name())
+		info, err := fs.Stat(fsys, p)
+		if err != nil {
+			return err
+		}
+		n := &node{name: e.Name(), path: p, parent: dir, mode: info.Mode(), modTime: info.ModTime()}
+		switch {
+		case info.IsDir() && e.Type()&fs.ModeSymlink != 0:
+			return fmt.Errorf("iso9660: %s: symbolic links to directories are not supported", p)
+		case info.IsDir():
+			n.dir = true
+			if err := readTree(fsys, n); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if info.Size() > maxFileSize {
+				return fmt.Errorf("iso9660: %s: file is larger than 4 GiB", p)
+			}
+			n.size = info.Size()
+		default:
+			return fmt.Errorf("iso9660: %s: unsupported file type %s", p, info.Mode().Type())
+		}
+		dir.children = append(dir.children, n)
+	}
+	if err := uniqueISONames(dir.children); err != nil {
+		return err
+	}
+	return uniqueJolietNames(dir.children)
+}
+
+func latestModTime(n *node) time.Time {
+	t := n.modTime
+	for _, c := range n.children {
+		if ct := latestModTime(c); ct.After(t) {
+			t = ct
+		}
+	}
+	return t
+}
+
+// record is a directory record before the extents are known.
+type record struct {
+	id     []byte
+	target *node
+	dir    bool
+	susp   []byte // system use entries stored in the record
+	ce     []byte // system use entries stored in a continuation area
+
+	ceLBA    uint32
+	ceOffset uint32
+}
+
+func (r *record) len() int {
+	n := 33 + len(r.id)
+	if len(r.id)%2 == 0 {
+		n++
+	}
+	n += len(r.susp)
+	if len(r.ce) > 0 {
+		n += ceLen
+	}
+	return n + n%2
+}
+
+type builder struct {
+	c    *config
+	fsys fs.FS
+	root *node
+
+	dirs, jolietDirs []*node // in path table order
+	records          map[*node][]*record
+	jolietRecords    map[*node][]*record
+	pathTable        []byte // little endian, the big endian copy is derived
+	jolietPathTable  []byte
+	files            []*node
+	sectors          uint32
+
+	// LBAs of the structures
+	pathTableLBA       [2]uint32
+	jolietPathTableLBA [2]uint32
+}
+
+// pathTableOrder returns the directories sorted by level, parent and
+// identifier as the path table requires.
+func pathTableOrder(root *node, id func(*node) []byte) []*node {
+	order := []*node{root}
+	for i := 0; i < len(order); i++ {
+		var subdirs []*node
+		for _, c := range order[i].children {
+			if c.dir {
+				subdirs = append(subdirs, c)
+			}
+		}
+		sort.Slice(subdirs, func(a, b int) bool { return bytes.Compare(id(subdirs[a]), id(subdirs[b])) < 0 })
+		order = append(order, subdirs...)
+	}
+	return order
+}
+
+func sectorsOf(size int) uint32 { return uint32((size + sectorSize - 1) / sectorSize) }
+
+func (b *builder) layout() error {
+	b.dirs = pathTableOrder(b.root, func(n *node) []byte { return n.isoID })
+	if len(b.dirs) > 0xffff {
+		return fmt.Errorf("iso9660: too many directories")
+	}
+	for i, d := range b.dirs {
+		d.pathNum = uint16(i + 1)
+	}
+	b.records = make(map[*node][]*record, len(b.dirs))
+	for _, d := range b.dirs {
+		b.records[d] = b.dirRecords(d, false)
+		d.dirSize = dirSize(b.records[d])
+	}
+	b.pathTable = pathTable(b.dirs, func(n *node) ([]byte, uint32, uint16) { return n.isoID, n.lba, n.parent.pathNum })
+
+	lba := uint32(systemAreaSectors + 2) // primary descriptor and terminator
+	if b.c.joliet {
+		lba++
+		b.jolietDirs = pathTableOrder(b.root, func(n *node) []byte { return n.jolietID })
+		for i, d := range b.jolietDirs {
+			d.jPathNum = uint16(i + 1)
+		}
+		b.jolietRecords = make(map[*node][]*record, len(b.jolietDirs))
+		for _, d := range b.jolietDirs {
+			b.jolietRecords[d] = b.dirRecords(d, true)
+			d.jolietDirSize = dirSize(b.jolietRecords[d])
+		}
+		b.jolietPathTable = pathTable(b.jolietDirs, func(n *node) ([]byte, uint32, uint16) { return n.jolietID, n.jolietLBA, n.parent.jPathNum })
+	}
+
+	// path tables
+	for i := range b.pathTableLBA {
+		b.pathTableLBA[i] = lba
+		lba += sectorsOf(len(b.pathTable))
+	}
+	if b.c.joliet {
+		for i := range b.jolietPathTableLBA {
+			b.jolietPathTableLBA[i] = lba
+			lba += sectorsOf(len(b.jolietPathTable))
+		}
+	}
+	// primary directories and their continuation areas
+	for _, d := range b.dirs {
+		d.lba = lba
+		lba += d.dirSize / sectorSize
+	}
+	offset := uint32(0)
+	ceStart := lba
+	for _, d := range b.dirs {
+		for _, r := range b.records[d] {
+			if len(r.ce) == 0 {
+				continue
+			}
+			if offset+uint32(len(r.ce)) > sectorSize {
+				lba++
+				offset = 0
+			}
+			r.ceLBA, r.ceOffset = lba, offset
+			offset += uint32(len(r.ce))
+		}
+	}
+	if offset > 0 || lba > ceStart {
+		lba++
+	}
+	// Joliet directories
+	for _, d := range b.jolietDirs {
+		d.jolietLBA = lba
+		lba += d.jolietDirSize / sectorSize
+	}
+	// file data
+	b.files = nil
+	var collect func(d *node)
+	collect = func(d *node) {
+		for _, c := range sortedChildren(d, func(n *node) []byte { return n.isoID }) {
+			if c.dir {
+				collect(c)
+			} else if c.size > 0 {
+				b.files = append(b.files, c)
+			}
+		}
+	}
+	collect(b.root)
+	for _, f := range b.files {
+		f.lba = lba
+		lba += sectorsOf(int(f.size))
+	}
+	b.sectors = lba
+
+	// the path tables can only be built once the extents are known.
+	b.pathTable = pathTable(b.dirs, func(n *node) ([]byte, uint32, uint16) { return n.isoID, n.lba, n.parent.pathNum })
+	if b.c.joliet {
+		b.jolietPathTable = pathTable(b.jolietDirs, func(n *node) ([]byte, uint32, uint16) { return n.jolietID, n.jolietLBA, n.parent.jPathNum })
+	}
+	return nil
+}
+
+func sortedChildren(d *node, id func(*node) []byte) []*node {
+	children := append([]*node(nil), d.children...)
+	sort.Slice(children, func(a, b int) bool { return bytes.Compare(id(children[a]), id(children[b])) < 0 })
+	return children
+}
+
+func dirSize(records []*record) uint32 {
+	pos := 0
+	for _, r := range records {
+		n := r.len()
+		if pos%sectorSize+n > sectorSize {
+			pos += sectorSize - pos%sectorSize
+		}
+		pos += n
+	}
+	return sectorsOf(pos) * sectorSize
+}
+
+// pathTable returns the little endian path table of dirs.
+func pathTable(dirs []*node, entry func(*node) (id []byte, lba uint32, parent uint16)) []byte {
+	var t []byte
+	for i, d := range dirs {
+		id, lba, parent := entry(d)
+		if i == 0 {
+			id, parent = []byte{0}, 1
+		}
+		e := make([]byte, 8+len(id)+len(id)%2)
+		e[0] = byte(len(id))
+		binary.LittleEndian.PutUint32(e[2:], lba)
+		binary.LittleEndian.PutUint16(e[6:], parent)
+		copy(e[8:], id)
+		t = append(t, e...)
+	}
+	return t
+}
+
+// bigEndianPathTable converts a little endian path table.
+func bigEndianPathTable(t []byte) []byte {
+	m := bytes.Clone(t)
+	for off := 0; off < len(m); {
+		idLen := int(m[off])
+		binary.BigEndian.PutUint32(m[off+2:], binary.LittleEndian.Uint32(t[off+2:]))
+		binary.BigEndian.PutUint16(m[off+6:], binary.LittleEndian.Uint16(t[off+6:]))
+		off += 8 + idLen + idLen%2
+	}
+	return m
+}
+
+// dirRecords returns the records of directory d sorted by identifier.
+func (b *builder) dirRecords(d *node, joliet bool) []*record {
+	rr := b.c.rockRidge && !joliet
+	self := &record{id: []byte{0}, target: d, dir: true}
+	parent := &record{id: []byte{1}, target: d.parent, dir: true}
+	records := []*record{self, parent}
+	if rr {
+		if d == b.root {
+			// the SP entry must come first, the CE entry pointing
+			// at the ER entry is inserted after it.
+			self.susp = suspSP()
+			self.ce = suspER()
+		}
+		self.susp = append(self.susp, suspPX(d)...)
+		self.susp = append(self.susp, suspTF(d.modTime)...)
+		parent.susp = append(suspPX(d.parent), suspTF(d.parent.modTime)...)
+	}
+	id := func(n *node) []byte { return n.isoID }
+	if joliet {
+		id = func(n *node) []byte { return n.jolietID }
+	}
+	for _, c := range sortedChildren(d, id) {
+		r := &record{id: id(c), target: c, dir: c.dir}
+		if rr {
+			r.susp = append(suspPX(c), suspTF(c.modTime)...)
+			nm := suspNM(c.name)
+			base := 33 + len(r.id) + (len(r.id)+1)%2
+			if base+len(r.susp)+len(nm) <= 254 {
+				r.susp = append(r.susp, nm...)
+			} else {
+				r.ce = nm
+			}
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+const ceLen = 28
+
+func suspSP() []byte { return []byte{'S', 'P', 7, 1, 0xbe, 0xef, 0} }
+
+func suspCE(lba, offset, length uint32) []byte {
+	b := make([]byte, ceLen)
+	copy(b, "CE")
+	b[2], b[3] = ceLen, 1
+	putBoth32(b[4:], lba)
+	putBoth32(b[12:], offset)
+	putBoth32(b[20:], length)
+	return b
+}
+
+func suspER() []byte {
+	const (
+		id     = "RRIP_1991A"
+		desc   = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+		source = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+	)
+	b := []byte{'E', 'R', byte(8 + len(id) + len(desc) + len(source)), 1, byte(len(id)), byte(len(desc)), byte(len(source)), 1}
+	return append(append(append(b, id...), desc...), source...)
+}
+
+func suspPX(n *node) []byte {
+	b := make([]byte, 36)
+	copy(b, "PX")
+	b[2], b[3] = 36, 1
+	mode := uint32(n.mode.Perm())
+	nlink := uint32(1)
+	if n.dir {
+		mode |= 0o040000
+		nlink = 2
+		for _, c := range n.children {
+			if c.dir {
+				nlink++
+			}
+		}
+	} else {
+		mode |= 0o100000
+	}
+	putBoth32(b[4:], mode)
+	putBoth32(b[12:], nlink)
+	return b // uid and gid are 0
+}
+
+func suspTF(t time.Time) []byte {
+	b := make([]byte, 5+2*7)
+	copy(b, "TF")
+	b[2], b[3] = byte(len(b)), 1
+	b[4] = 0x02 | 0x04 // modify and access time
+	recordingTime(b[5:], t)
+	recordingTime(b[12:], t)
+	return b
+}
+
+// suspNM returns NM entries holding name, split where it does not fit into one.
+func suspNM(name string) []byte {
+	var b []byte
+	for {
+		chunk := name
+		flags := byte(0)
+		if len(chunk) > 250 {
+			chunk, flags = chunk[:250], 0x01 // continue
+		}
+		b = append(b, 'N', 'M', byte(5+len(chunk)), 1, flags)
+		b = append(b, chunk...)
+		name = name[len(chunk):]
+		if name == "" {
+			return b
+		}
+	}
+}
+
+func (b *builder) write(dst io.Writer) error {
+	w := &sectorWriter{w: bufio.NewWriterSize(dst, 1<<20)}
+	if err := w.seek(systemAreaSectors); err != nil {
+		return err
+	}
+	w.write(b.volumeDescriptor(false))
+	if b.c.joliet {
+		w.write(b.volumeDescriptor(true))
+	}
+	term := make([]byte, sectorSize)
+	term[0] = 255
+	copy(term[1:], "CD001")
+	term[6] = 1
+	w.write(term)
+
+	tables := [][]byte{b.pathTable, bigEndianPathTable(b.pathTable)}
+	lbas := b.pathTableLBA[:]
+	if b.c.joliet {
+		tables = append(tables, b.jolietPathTable, bigEndianPathTable(b.jolietPathTable))
+		lbas = append(lbas, b.jolietPathTableLBA[:]...)
+	}
+	for i, t := range tables {
+		if err := w.seek(lbas[i]); err != nil {
+			return err
+		}
+		w.write(t)
+	}
+
+	for _, d := range b.dirs {
+		if err := w.seek(d.lba); err != nil {
+			return err
+		}
+		w.write(b.dirData(b.records[d], d.dirSize, false))
+	}
+	for _, d := range b.dirs {
+		for _, r := range b.records[d] {
+			if len(r.ce) == 0 {
+				continue
+			}
+			w.skipTo(int64(r.ceLBA)*sectorSize + int64(r.ceOffset))
+			w.write(r.ce)
+		}
+	}
+	for _, d := range b.jolietDirs {
+		if err := w.seek(d.jolietLBA); err != nil {
+			return err
+		}
+		w.write(b.dirData(b.jolietRecords[d], d.jolietDirSize, true))
+	}
+	for _, f := range b.files {
+		if err := w.seek(f.lba); err != nil {
+			return err
+		}
+		if err := b.copyFile(w, f); err != nil {
+			return err
+		}
+	}
+	if err := w.seek(b.sectors); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+func (b *builder) copyFile(w *sectorWriter, f *node) error {
+	src, err := b.fsys.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	n, err := io.Copy(w, io.LimitReader(src, f.size))
+	if err != nil {
+		return err
+	}
+	if n != f.size {
+		return fmt.Errorf("iso9660: %s: file changed size while copying", f.path)
+	}
+	return nil
+}
+
+func (b *builder) dirData(records []*record, size uint32, joliet bool) []byte {
+	data := make([]byte, size)
+	pos := 0
+	for _, r := range records {
+		n := r.len()
+		if pos%sectorSize+n > sectorSize {
+			pos += sectorSize - pos%sectorSize
+		}
+		e := data[pos : pos+n]
+		e[0] = byte(n)
+		t := r.target
+		lba, length := t.lba, uint32(t.size)
+		switch {
+		case r.dir && joliet:
+			lba, length = t.jolietLBA, t.jolietDirSize
+		case r.dir:
+			length = t.dirSize
+		case length == 0:
+			lba = 0
+		}
+		putBoth32(e[2:], lba)
+		putBoth32(e[10:], length)
+		recordingTime(e[18:], t.modTime)
+		if r.dir {
+			e[25] = 0x02
+		}
+		putBoth16(e[28:], 1) // volume sequence number
+		e[32] = byte(len(r.id))
+		copy(e[33:], r.id)
+		su := e[33+len(r.id)+(len(r.id)+1)%2:]
+		if len(r.ce) > 0 && t == b.root && r.id[0] == 0 {
+			// the CE entry of the root follows the SP entry.
+			copy(su, r.susp[:7])
+			copy(su[7:], suspCE(r.ceLBA, r.ceOffset, uint32(len(r.ce))))
+			copy(su[7+ceLen:], r.susp[7:])
+		} else {
+			copy(su, r.susp)
+			if len(r.ce) > 0 {
+				copy(su[len(r.susp):], suspCE(r.ceLBA, r.ceOffset, uint32(len(r.ce))))
+			}
+		}
+		pos += n
+	}
+	return data
+}
+
+func (b *builder) volumeDescriptor(joliet bool) []byte {
+	d := make([]byte, sectorSize)
+	d[0] = 1
+	copy(d[1:], "CD001")
+	d[6] = 1
+
+	text := func(field []byte, s string) {
+		if joliet {
+			for i := 0; i+1 < len(field); i += 2 {
+				field[i], field[i+1] = 0, ' '
+			}
+			copy(field, ucs2(s))
+			return
+		}
+		copy(field, s+strings.Repeat(" ", len(field)-len(s)))
+	}
+	label := b.c.label
+	if joliet {
+		d[0] = 2
+		copy(d[88:], "%/E") // UCS-2 level 3
+		if len(label) > maxJolietLabel {
+			label = label[:maxJolietLabel]
+		}
+	}
+	text(d[8:40], "")
+	text(d[40:72], label)
+	putBoth32(d[80:], b.sectors)
+	putBoth16(d[120:], 1)
+	putBoth16(d[124:], 1)
+	putBoth16(d[128:], sectorSize)
+
+	table, lbas := b.pathTable, b.pathTableLBA
+	root, rootSize := b.root.lba, b.root.dirSize
+	if joliet {
+		table, lbas = b.jolietPathTable, b.jolietPathTableLBA
+		root, rootSize = b.root.jolietLBA, b.root.jolietDirSize
+	}
+	putBoth32(d[132:], uint32(len(table)))
+	binary.LittleEndian.PutUint32(d[140:], lbas[0])
+	binary.BigEndian.PutUint32(d[148:], lbas[1])
+
+	r := d[156:190]
+	r[0] = 34
+	putBoth32(r[2:], root)
+	putBoth32(r[10:], rootSize)
+	recordingTime(r[18:], b.root.modTime)
+	r[25] = 0x02
+	putBoth16(r[28:], 1)
+	r[32] = 1
+
+	for _, f := range [][2]int{{190, 318}, {318, 446}, {446, 574}, {574, 702}, {702, 739}, {739, 776}, {776, 813}} {
+		text(d[f[0]:f[1]], "")
+	}
+	volumeTime(d[813:], b.c.volumeTime)
+	volumeTime(d[830:], b.c.volumeTime)
+	volumeTime(d[847:], time.Time{})
+	volumeTime(d[864:], time.Time{})
+	d[881] = 1
+	return d
+}
+
+// sectorWriter writes an image sequentially.
+type sectorWriter struct {
+	w   *bufio.Writer
+	off int64
+	err error
+}
+
+func (s *sectorWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.w.Write(p)
+	s.off += int64(n)
+	s.err = err
+	return n, err
+}
+
+func (s *sectorWriter) write(p []byte) { s.Write(p) }
+
+// skipTo writes zeros up to off.
+func (s *sectorWriter) skipTo(off int64) {
+	for s.err == nil && s.off < off {
+		n := min(off-s.off, sectorSize)
+		s.Write(make([]byte, n))
+	}
+}
+
+// seek writes zeros up to the start of sector lba.
+func (s *sectorWriter) seek(lba uint32) error {
+	off := int64(lba) * sectorSize
+	if s.off > off {
+		return fmt.Errorf("iso9660: internal error: sector %d is already written", lba)
+	}
+	s.skipTo(off)
+	return s.err
+}
+
+func (s *sectorWriter) flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.w.Flush()
+}
@@ -0,0 +1,64 @@
+package nbd
+
+import (
+	"io"
+	"os"
+)
+
+// bitmapPageSize is the unit in which a bitmap is stored and written.
+const bitmapPageSize = 4096
+
+// bitmap is a bitmap of blocks stored in a file. Only the pages which
+// changed since the last flush are written.
+type bitmap struct {
+	b     []byte
+	dirty map[int64]struct{}
+}
+
+func newBitmap(blocks int64) *bitmap {
+	return &bitmap{
+		b:     make([]byte, roundUp((blocks+7)/8, bitmapPageSize)),
+		dirty: make(map[int64]struct{}),
+	}
+}
+
+// size returns the size of the bitmap in the file.
+func (m *bitmap) size() int64 { return int64(len(m.b)) }
+
+func (m *bitmap) has(blk int64) bool { return m.b[blk/8]&(1<<(blk%8)) != 0 }
+
+func (m *bitmap) set(blk int64) {
+	if !m.has(blk) {
+		m.b[blk/8] |= 1 << (blk % 8)
+		m.dirty[blk/8/bitmapPageSize] = struct{}{}
+	}
+}
+
+// reset clears the bitmap without marking it dirty, for a file whose
+// bitmap was cleared too.
+func (m *bitmap) reset() {
+	clear(m.b)
+	clear(m.dirty)
+}
+
+// read reads the bitmap stored in f at off.
+func (m *bitmap) read(f *os.File, off int64) error {
+	_, err := io.ReadFull(io.NewSectionReader(f, off, m.size()), m.b)
+	return err
+}
+
+// flush writes the pages which changed to the bitmap stored in f at off.
+// It reports whether there were any.
+func (m *bitmap) flush(f *os.File, off int64) (bool, error) {
+	if len(m.dirty) == 0 {
+		return false, nil
+	}
+	for page := range m.dirty {
+		b := m.b[page*bitmapPageSize : (page+1)*bitmapPageSize]
+		if _, err := f.WriteAt(b, off+page*bitmapPageSize); err != nil {
+			return true, err
+		}
+		delete(m.dirty, page)
+	}
+	return true, nil
+}
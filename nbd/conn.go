@@ -0,0 +1,569 @@
+package nbd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+)
+
+var be = binary.BigEndian
+
+// maxInFlight is the number of requests of a connection served at once.
+const maxInFlight = 16
+
+var errReadOnly = errors.New("export is read-only")
+
+// conn is a connection of a client.
+type conn struct {
+	srv *Server
+	c   net.Conn
+	r   *bufio.Reader
+
+	// mu guards w, which is shared by the goroutines serving requests,
+	// and err.
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+
+	noZeroes   bool
+	structured bool
+	tls        bool
+
+	// done is closed when no more requests are read, which ends the
+	// delays of the requests in flight.
+	done chan struct{}
+}
+
+func newConn(s *Server, c net.Conn) *conn {
+	return &conn{
+		srv:  s,
+		c:    c,
+		r:    bufio.NewReader(c),
+		w:    bufio.NewWriter(c),
+		done: make(chan struct{}),
+	}
+}
+
+// handshake negotiates an export with the client. It returns a nil export
+// without an error if the client aborts the negotiation.
+func (c *conn) handshake() (*export, error) {
+	var b [18]byte
+	be.PutUint64(b[0:], nbdMagic)
+	be.PutUint64(b[8:], optMagic)
+	be.PutUint16(b[16:], flagFixedNewstyle|flagNoZeroes)
+	if _, err := c.w.Write(b[:]); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c.r, b[:4]); err != nil {
+		return nil, err
+	}
+	flags := be.Uint32(b[:])
+	if flags&^(flagFixedNewstyle|flagNoZeroes) != 0 {
+		return nil, fmt.Errorf("unknown client flags %#x", flags)
+	}
+	c.noZeroes = flags&flagNoZeroes != 0
+
+	for {
+		var h [16]byte
+		if _, err := io.ReadFull(c.r, h[:]); err != nil {
+			return nil, err
+		}
+		if be.Uint64(h[0:]) != optMagic {
+			return nil, errors.New("bad option magic")
+		}
+		opt, length := be.Uint32(h[8:]), be.Uint32(h[12:])
+		if length > maxOptionSize {
+			if _, err := io.CopyN(io.Discard, c.r, int64(length)); err != nil {
+				return nil, err
+			}
+			if err := c.optionError(opt, repErrTooBig, "option of %d bytes is too large", length); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		e, done, err := c.option(opt, data)
+		if err != nil || done {
+			return e, err
+		}
+	}
+}
+
+// option replies to the option opt. done reports whether the negotiation
+// has ended, with e as the export to serve.
+func (c *conn) option(opt uint32, data []byte) (e *export, done bool, err error) {
+	if opt == optStartTLS {
+		return nil, false, c.startTLS(data)
+	}
+	if c.srv.TLSConfig != nil && !c.tls && opt != optAbort {
+		if opt == optExportName {
+			return nil, true, errors.New("client did not negotiate TLS")
+		}
+		return nil, false, c.optionError(opt, repErrTLSReqd, "TLS is required")
+	}
+	switch opt {
+	case optExportName:
+		e := c.srv.export(string(data))
+		if e == nil {
+			// the client cannot be told about the error, but by
+			// closing the connection.
+			return nil, true, fmt.Errorf("unknown export %q", data)
+		}
+		var b [10 + exportNameZero]byte
+		be.PutUint64(b[0:], uint64(e.Size))
+		be.PutUint16(b[8:], c.transmissionFlags(e))
+		n := len(b)
+		if c.noZeroes {
+			n = 10
+		}
+		if _, err := c.w.Write(b[:n]); err != nil {
+			return nil, true, err
+		}
+		return e, true, c.w.Flush()
+	case optAbort:
+		return nil, true, c.optionReply(opt, repAck, nil)
+	case optList:
+		if len(data) != 0 {
+			return nil, false, c.optionError(opt, repErrInvalid, "NBD_OPT_LIST has no data")
+		}
+		for _, e := range c.srv.exportList() {
+			b := be.AppendUint32(nil, uint32(len(e.Name)))
+			b = append(b, e.Name...)
+			b = append(b, e.Description...)
+			if err := c.optionReply(opt, repServer, b); err != nil {
+				return nil, true, err
+			}
+		}
+		return nil, false, c.optionReply(opt, repAck, nil)
+	case optInfo, optGo:
+		return c.info(opt, data)
+	case optStructuredReply:
+		if len(data) != 0 {
+			return nil, false, c.optionError(opt, repErrInvalid, "NBD_OPT_STRUCTURED_REPLY has no data")
+		}
+		c.structured = true
+		return nil, false, c.optionReply(opt, repAck, nil)
+	}
+	return nil, false, c.optionError(opt, repErrUnsup, "option %d is not supported", opt)
+}
+
+// startTLS replies to NBD_OPT_STARTTLS, and then runs the TLS handshake
+// over which the negotiation continues.
+func (c *conn) startTLS(data []byte) error {
+	switch {
+	case c.srv.TLSConfig == nil:
+		return c.optionError(optStartTLS, repErrUnsup, "TLS is not supported")
+	case c.tls:
+		return c.optionError(optStartTLS, repErrInvalid, "TLS is already negotiated")
+	case len(data) != 0:
+		return c.optionError(optStartTLS, repErrInvalid, "NBD_OPT_STARTTLS has no data")
+	}
+	if err := c.optionReply(optStartTLS, repAck, nil); err != nil {
+		return err
+	}
+	// anything sent before the handshake would be taken as sent over TLS.
+	if c.r.Buffered() > 0 {
+		return errors.New("client sent data before the TLS handshake")
+	}
+	tc := tls.Server(c.c, c.srv.TLSConfig)
+	if err := tc.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake: %w", err)
+	}
+	c.c, c.tls = tc, true
+	c.r.Reset(tc)
+	c.w.Reset(tc)
+	return nil
+}
+
+// info replies to NBD_OPT_INFO and NBD_OPT_GO.
+func (c *conn) info(opt uint32, data []byte) (*export, bool, error) {
+	if len(data) < 4 || uint64(len(data)) < 4+uint64(be.Uint32(data))+2 {
+		return nil, false, c.optionError(opt, repErrInvalid, "option is too short")
+	}
+	name := string(data[4 : 4+be.Uint32(data)])
+	reqs := data[4+len(name):]
+	n := be.Uint16(reqs)
+	reqs = reqs[2:]
+	if len(reqs) != 2*int(n) {
+		return nil, false, c.optionError(opt, repErrInvalid, "want %d information requests but got %d bytes", n, len(reqs))
+	}
+	e := c.srv.export(name)
+	if e == nil {
+		return nil, false, c.optionError(opt, repErrUnknown, "unknown export %q", name)
+	}
+
+	b := be.AppendUint16(nil, infoExport)
+	b = be.AppendUint64(b, uint64(e.Size))
+	b = be.AppendUint16(b, c.transmissionFlags(e))
+	if err := c.optionReply(opt, repInfo, b); err != nil {
+		return nil, true, err
+	}
+	for i := 0; i < len(reqs); i += 2 {
+		var b []byte
+		switch be.Uint16(reqs[i:]) {
+		case infoName:
+			b = append(be.AppendUint16(nil, infoName), e.Name...)
+		case infoDesc:
+			b = append(be.AppendUint16(nil, infoDesc), e.Description...)
+		default:
+			continue
+		}
+		if err := c.optionReply(opt, repInfo, b); err != nil {
+			return nil, true, err
+		}
+	}
+	// the block sizes are sent whether the client asks for them or not,
+	// as any client obeys a minimum of 1 byte.
+	b = be.AppendUint16(nil, infoBlockSize)
+	b = be.AppendUint32(b, minBlockSize)
+	b = be.AppendUint32(b, preferredBlockSize)
+	b = be.AppendUint32(b, maxPayload)
+	if err := c.optionReply(opt, repInfo, b); err != nil {
+		return nil, true, err
+	}
+	if err := c.optionReply(opt, repAck, nil); err != nil {
+		return nil, true, err
+	}
+	if opt == optGo {
+		return e, true, nil
+	}
+	return nil, false, nil
+}
+
+func (c *conn) transmissionFlags(e *export) uint16 {
+	flags := uint16(transHasFlags)
+	if e.w == nil {
+		flags |= transReadOnly
+	} else {
+		flags |= transSendFlush | transSendFUA | transSendWriteZeroes
+		if e.trimmer != nil {
+			flags |= transSendTrim
+		}
+	}
+	if c.structured {
+		flags |= transSendDF
+	}
+	return flags
+}
+
+func (c *conn) optionReply(opt, typ uint32, data []byte) error {
+	var h [20]byte
+	be.PutUint64(h[0:], optReplyMagic)
+	be.PutUint32(h[8:], opt)
+	be.PutUint32(h[12:], typ)
+	be.PutUint32(h[16:], uint32(len(data)))
+	if _, err := c.w.Write(h[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *conn) optionError(opt, typ uint32, format string, args ...any) error {
+	return c.optionReply(opt, typ, fmt.Appendf(nil, format, args...))
+}
+
+// request is a command of a client.
+type request struct {
+	flags  uint16
+	typ    uint16
+	cookie uint64
+	off    uint64
+	length uint32
+	data   []byte
+}
+
+// transmit serves the requests of the client for e until it disconnects.
+func (c *conn) transmit(e *export) error {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxInFlight)
+	err := func() error {
+		var h [28]byte
+		for {
+			if _, err := io.ReadFull(c.r, h[:]); err != nil {
+				if err == io.EOF {
+					// the client has gone between requests.
+					return nil
+				}
+				return err
+			}
+			if be.Uint32(h[0:]) != requestMagic {
+				return errors.New("bad request magic")
+			}
+			req := &request{
+				flags:  be.Uint16(h[4:]),
+				typ:    be.Uint16(h[6:]),
+				cookie: be.Uint64(h[8:]),
+				off:    be.Uint64(h[16:]),
+				length: be.Uint32(h[24:]),
+			}
+			switch req.typ {
+			case cmdDisc:
+				return nil
+			case cmdWrite:
+				if req.length > maxPayload {
+					return fmt.Errorf("write of %d bytes is larger than %d bytes", req.length, maxPayload)
+				}
+				req.data = make([]byte, req.length)
+				if _, err := io.ReadFull(c.r, req.data); err != nil {
+					return err
+				}
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				c.serve(e, req)
+			}()
+		}
+	}()
+	// requests in flight are finished before the connection is closed.
+	close(c.done)
+	wg.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
+
+// serve serves req and sends its reply.
+func (c *conn) serve(e *export, req *request) {
+	start := time.Now()
+	c.throttle(e, req)
+	var (
+		errno uint32
+		reply [][]byte
+	)
+	if req.typ == cmdRead {
+		errno, reply = c.read(e, req)
+	} else {
+		var err error
+		errno, err = c.do(e, req)
+		if err != nil && errno == errIO {
+			c.srv.logf("nbd: export %q: %v", e.Name, err)
+		}
+		h := make([]byte, 16)
+		be.PutUint32(h[0:], simpleReplyMagic)
+		be.PutUint32(h[4:], errno)
+		be.PutUint64(h[8:], req.cookie)
+		reply = [][]byte{h}
+	}
+	// the request is counted before the client sees its reply.
+	e.stats.record(req, errno, time.Since(start))
+	c.send(reply...)
+}
+
+// throttle delays req by the Limits of e, or until the connection ends.
+func (c *conn) throttle(e *export, req *request) {
+	var n int64
+	if req.typ == cmdRead || req.typ == cmdWrite {
+		n = int64(req.length)
+	}
+	d := e.limiter.delay(n)
+	if d <= 0 {
+		return
+	}
+	e.stats.throttled(d)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-c.done:
+	}
+}
+
+// inRange reports whether req is within e.
+func inRange(e *export, req *request) bool {
+	return req.off <= uint64(e.Size) && uint64(req.length) <= uint64(e.Size)-req.off
+}
+
+// do executes the commands other than reads.
+func (c *conn) do(e *export, req *request) (uint32, error) {
+	off, length := int64(req.off), int64(req.length)
+	switch req.typ {
+	case cmdWrite, cmdWriteZeroes, cmdTrim:
+		if e.w == nil {
+			return errPerm, errReadOnly
+		}
+		if !inRange(e, req) {
+			if req.typ == cmdTrim {
+				return errInval, errors.New("trim beyond the end of the export")
+			}
+			return errNoSpc, errors.New("write beyond the end of the export")
+		}
+		var err error
+		switch req.typ {
+		case cmdWrite:
+			_, err = e.w.WriteAt(req.data, off)
+		case cmdWriteZeroes:
+			err = writeZeroes(e, off, length, req.flags&cmdFlagNoHole == 0)
+		case cmdTrim:
+			if e.trimmer != nil {
+				// trims are advisory.
+				if err = e.trimmer.Trim(off, length); errors.Is(err, errors.ErrUnsupported) {
+					err = nil
+				}
+			}
+		}
+		if err == nil && req.flags&cmdFlagFUA != 0 {
+			err = flush(e)
+		}
+		if err != nil {
+			return errno(err), err
+		}
+		return 0, nil
+	case cmdFlush:
+		if err := flush(e); err != nil {
+			return errno(err), err
+		}
+		return 0, nil
+	}
+	return errInval, fmt.Errorf("unknown command %d", req.typ)
+}
+
+func flush(e *export) error {
+	if e.syncer == nil || e.w == nil {
+		return nil
+	}
+	return e.syncer.Sync()
+}
+
+// writeZeroes zeroes length bytes of e at off, by trimming them if trim is
+// true and e supports it.
+func writeZeroes(e *export, off, length int64, trim bool) error {
+	if trim && e.trimmer != nil {
+		err := e.trimmer.Trim(off, length)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+	zero := make([]byte, min(length, 1<<20))
+	for length > 0 {
+		n := min(length, int64(len(zero)))
+		if _, err := e.w.WriteAt(zero[:n], off); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+// read serves a read, and returns the error value and the buffers of its
+// reply, which is structured if the client negotiated structured replies.
+func (c *conn) read(e *export, req *request) (uint32, [][]byte) {
+	var (
+		b     []byte
+		errno uint32
+		err   error
+	)
+	switch {
+	case req.length > maxPayload:
+		errno, err = errInval, fmt.Errorf("read of %d bytes is larger than %d bytes", req.length, maxPayload)
+	case !inRange(e, req):
+		errno, err = errInval, errors.New("read beyond the end of the export")
+	default:
+		b = make([]byte, req.length)
+		var n int
+		n, err = e.Data.ReadAt(b, int64(req.off))
+		if err == io.EOF {
+			// data shorter than the export reads as zeros.
+			clear(b[n:])
+			err = nil
+		}
+		if err != nil {
+			errno = errIO
+			c.srv.logf("nbd: export %q: %v", e.Name, err)
+		}
+	}
+
+	if !c.structured {
+		var h [16]byte
+		be.PutUint32(h[0:], simpleReplyMagic)
+		be.PutUint32(h[4:], errno)
+		be.PutUint64(h[8:], req.cookie)
+		if err != nil {
+			b = nil
+		}
+		return errno, [][]byte{h[:], b}
+	}
+	var typ uint16
+	var payload [][]byte
+	switch {
+	case err != nil:
+		msg := err.Error()
+		if len(msg) > maxStringSize {
+			msg = msg[:maxStringSize]
+		}
+		typ = replyTypeError
+		p := be.AppendUint32(nil, errno)
+		p = be.AppendUint16(p, uint16(len(msg)))
+		payload = [][]byte{append(p, msg...)}
+	case len(b) == 0:
+		typ = replyTypeNone
+	case sparse.IsZero(b):
+		typ = replyTypeOffsetHole
+		p := be.AppendUint64(nil, req.off)
+		payload = [][]byte{be.AppendUint32(p, req.length)}
+	default:
+		typ = replyTypeOffsetData
+		payload = [][]byte{be.AppendUint64(nil, req.off), b}
+	}
+	length := 0
+	for _, p := range payload {
+		length += len(p)
+	}
+	h := make([]byte, structuredHeaderSize)
+	be.PutUint32(h[0:], structuredReplyMagic)
+	be.PutUint16(h[4:], replyFlagDone)
+	be.PutUint16(h[6:], typ)
+	be.PutUint64(h[8:], req.cookie)
+	be.PutUint32(h[16:], uint32(length))
+	return errno, append([][]byte{h}, payload...)
+}
+
+// send writes a reply. An error closes the connection, which ends
+// transmit.
+func (c *conn) send(bufs ...[]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	for _, b := range bufs {
+		if _, err := c.w.Write(b); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		c.fail(err)
+	}
+}
+
+// fail records err and closes the connection. c.mu must be held.
+func (c *conn) fail(err error) {
+	c.err = err
+	c.c.Close()
+}
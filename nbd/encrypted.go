@@ -0,0 +1,517 @@
+package nbd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+	"golang.org/x/crypto/xts"
+)
+
+// An encrypted disk file starts with two copies of a header block, which
+// hold the data key of the disk sealed with each key of the KeyProvider
+// which can unlock it. A header is updated by writing the older copy with
+// a higher generation, so that one copy is always intact. The sectors
+// follow, encrypted with AES-256-XTS, and sectors which were never written
+// are holes.
+const (
+	encryptedMagic      = "VZCRYPT\x00"
+	encryptedVersion    = 1
+	encryptedHeaderSize = 4096
+	encryptedSectorSize = 4096
+	encryptedDataOff    = 2 * encryptedHeaderSize
+
+	dataKeySize  = 64 // AES-256-XTS
+	keySize      = 32 // AES-256-GCM
+	maxKeySlots  = 8
+	keySlotSize  = 256
+	keySlotsOff  = 32
+	maxKeyIDLen  = 63
+	sealedKeyLen = dataKeySize + 16
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// KeyProvider provides the keys which unlock encrypted disks, for example
+// from a keychain or a key management service. A key is 32 bytes long.
+type KeyProvider interface {
+	// Key returns the key with the ID id.
+	Key(id string) ([]byte, error)
+}
+
+// KeyMap is a KeyProvider of keys in memory, indexed by their IDs.
+type KeyMap map[string][]byte
+
+// Key implements KeyProvider.
+func (m KeyMap) Key(id string) ([]byte, error) {
+	key, ok := m[id]
+	if !ok {
+		return nil, fmt.Errorf("nbd: no key %q", id)
+	}
+	return key, nil
+}
+
+// Encrypted is a disk which is encrypted at rest in a sparse file. The
+// sectors are encrypted with AES-256-XTS and a random data key of the
+// disk, which is stored sealed with one or more keys of a KeyProvider.
+//
+// Rotating a key only seals the data key again, so it does not rewrite the
+// disk:
+//
+//	disk, err := nbd.OpenEncrypted("vm.disk", keys)
+//	...
+//	err = disk.RotateKey("vm-2024", "vm-2025")
+//
+// Sectors which were never written, or were trimmed, are holes in the
+// file, so the file reveals which parts of the disk are in use but not
+// their content.
+//
+// An Encrypted is the Data of an Export, and is safe for concurrent use.
+type Encrypted struct {
+	mu     sync.RWMutex
+	f      *os.File
+	keys   KeyProvider
+	size   int64
+	cipher *xts.Cipher
+
+	// the header, of which the newer copy is at hdrCopy.
+	dataKey []byte
+	gen     uint64
+	hdrCopy int
+	slots   []keySlot
+}
+
+var (
+	_ io.ReaderAt = (*Encrypted)(nil)
+	_ io.WriterAt = (*Encrypted)(nil)
+	_ Syncer      = (*Encrypted)(nil)
+	_ Trimmer     = (*Encrypted)(nil)
+)
+
+// keySlot is the data key sealed with the key id.
+type keySlot struct {
+	id     string
+	nonce  []byte
+	sealed []byte
+}
+
+// CreateEncrypted creates an encrypted disk of size bytes at path, which
+// must not exist, with a new data key sealed with the key keyID of keys.
+// The size must be a multiple of 4096.
+func CreateEncrypted(path string, size int64, keys KeyProvider, keyID string) (_ *Encrypted, err error) {
+	if size <= 0 || size%encryptedSectorSize != 0 {
+		return nil, fmt.Errorf("nbd: size %d is not a positive multiple of %d", size, encryptedSectorSize)
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	e := &Encrypted{keys: keys, size: size, dataKey: dataKey, hdrCopy: 1}
+	if e.cipher, err = xts.NewCipher(aes.NewCipher, dataKey); err != nil {
+		return nil, err
+	}
+	slot, err := e.seal(keyID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(path)
+		}
+	}()
+	e.f = f
+	if err := f.Truncate(encryptedDataOff + size); err != nil {
+		return nil, err
+	}
+	if err := e.writeHeader([]keySlot{slot}); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// OpenEncrypted opens the encrypted disk at path with the first of its
+// keys which keys provides.
+func OpenEncrypted(path string, keys KeyProvider) (*Encrypted, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	e := &Encrypted{f: f, keys: keys}
+	if err := e.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("nbd: %s: %w", path, err)
+	}
+	return e, nil
+}
+
+// load reads the newer intact copy of the header, and unseals the data key
+// with one of its keys.
+func (e *Encrypted) load() error {
+	var h []byte
+	for i := range 2 {
+		b := make([]byte, encryptedHeaderSize)
+		if _, err := e.f.ReadAt(b, int64(i)*encryptedHeaderSize); err != nil {
+			if err == io.EOF {
+				continue
+			}
+			return err
+		}
+		if string(b[:8]) != encryptedMagic || binary.LittleEndian.Uint32(b[len(b)-4:]) != crc32.Checksum(b[:len(b)-4], crc32c) {
+			continue
+		}
+		if gen := binary.LittleEndian.Uint64(b[24:]); h == nil || gen > e.gen {
+			h, e.gen, e.hdrCopy = b, gen, i
+		}
+	}
+	if h == nil {
+		return errors.New("not an encrypted disk")
+	}
+	if v := binary.LittleEndian.Uint32(h[8:]); v != encryptedVersion {
+		return fmt.Errorf("unsupported encrypted disk version %d", v)
+	}
+	if ss := binary.LittleEndian.Uint32(h[12:]); ss != encryptedSectorSize {
+		return fmt.Errorf("unsupported sector size %d", ss)
+	}
+	e.size = int64(binary.LittleEndian.Uint64(h[16:]))
+	for i := range maxKeySlots {
+		s := h[keySlotsOff+i*keySlotSize:][:keySlotSize]
+		if n := int(s[0]); n > 0 && n <= maxKeyIDLen {
+			e.slots = append(e.slots, keySlot{
+				id:     string(s[1 : 1+n]),
+				nonce:  s[64:76],
+				sealed: s[76 : 76+sealedKeyLen],
+			})
+		}
+	}
+
+	var errs []error
+	for _, slot := range e.slots {
+		dataKey, err := e.unseal(slot)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c, err := xts.NewCipher(aes.NewCipher, dataKey)
+		if err != nil {
+			return err
+		}
+		e.dataKey, e.cipher = dataKey, c
+		return nil
+	}
+	return fmt.Errorf("no key unlocks the disk: %w", errors.Join(errs...))
+}
+
+// additionalData returns the data which a sealed data key is bound to: the
+// parameters of the disk and the key ID.
+func (e *Encrypted) additionalData(id string) []byte {
+	b := make([]byte, 24, 24+len(id))
+	copy(b, encryptedMagic)
+	binary.LittleEndian.PutUint32(b[8:], encryptedVersion)
+	binary.LittleEndian.PutUint32(b[12:], encryptedSectorSize)
+	binary.LittleEndian.PutUint64(b[16:], uint64(e.size))
+	return append(b, id...)
+}
+
+// aead returns the cipher of the key id.
+func (e *Encrypted) aead(id string) (cipher.AEAD, error) {
+	key, err := e.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("nbd: key %q is %d bytes, not %d", id, len(key), keySize)
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// seal seals the data key with the key id.
+func (e *Encrypted) seal(id string) (keySlot, error) {
+	if id == "" || len(id) > maxKeyIDLen {
+		return keySlot{}, fmt.Errorf("nbd: key ID %q is empty or longer than %d bytes", id, maxKeyIDLen)
+	}
+	aead, err := e.aead(id)
+	if err != nil {
+		return keySlot{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return keySlot{}, err
+	}
+	return keySlot{
+		id:     id,
+		nonce:  nonce,
+		sealed: aead.Seal(nil, nonce, e.dataKey, e.additionalData(id)),
+	}, nil
+}
+
+func (e *Encrypted) unseal(slot keySlot) ([]byte, error) {
+	aead, err := e.aead(slot.id)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := aead.Open(nil, slot.nonce, slot.sealed, e.additionalData(slot.id))
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", slot.id, err)
+	}
+	return dataKey, nil
+}
+
+// writeHeader writes a header with slots over the older copy, and syncs
+// it.
+func (e *Encrypted) writeHeader(slots []keySlot) error {
+	h := e.additionalData("")
+	h = append(h, make([]byte, encryptedHeaderSize-len(h))...)
+	binary.LittleEndian.PutUint64(h[24:], e.gen+1)
+	for i, slot := range slots {
+		s := h[keySlotsOff+i*keySlotSize:][:keySlotSize]
+		s[0] = byte(len(slot.id))
+		copy(s[1:], slot.id)
+		copy(s[64:], slot.nonce)
+		copy(s[76:], slot.sealed)
+	}
+	binary.LittleEndian.PutUint32(h[len(h)-4:], crc32.Checksum(h[:len(h)-4], crc32c))
+	older := 1 - e.hdrCopy
+	if _, err := e.f.WriteAt(h, int64(older)*encryptedHeaderSize); err != nil {
+		return err
+	}
+	if err := e.f.Sync(); err != nil {
+		return err
+	}
+	e.gen++
+	e.hdrCopy = older
+	e.slots = slots
+	return nil
+}
+
+// KeyIDs returns the IDs of the keys which unlock the disk.
+func (e *Encrypted) KeyIDs() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	ids := make([]string, len(e.slots))
+	for i, slot := range e.slots {
+		ids[i] = slot.id
+	}
+	return ids
+}
+
+func (e *Encrypted) slot(id string) int {
+	return slices.IndexFunc(e.slots, func(s keySlot) bool { return s.id == id })
+}
+
+// AddKey lets the key id unlock the disk too.
+func (e *Encrypted) AddKey(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.slot(id) >= 0 {
+		return fmt.Errorf("nbd: key %q already unlocks the disk", id)
+	}
+	if len(e.slots) == maxKeySlots {
+		return fmt.Errorf("nbd: disk already has %d keys", maxKeySlots)
+	}
+	slot, err := e.seal(id)
+	if err != nil {
+		return err
+	}
+	return e.writeHeader(append(slices.Clone(e.slots), slot))
+}
+
+// RemoveKey stops the key id from unlocking the disk. The last key cannot
+// be removed.
+func (e *Encrypted) RemoveKey(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i := e.slot(id)
+	if i < 0 {
+		return fmt.Errorf("nbd: key %q does not unlock the disk", id)
+	}
+	if len(e.slots) == 1 {
+		return fmt.Errorf("nbd: cannot remove the last key %q", id)
+	}
+	return e.writeHeader(slices.Delete(slices.Clone(e.slots), i, i+1))
+}
+
+// RotateKey replaces the key oldID by newID at once, so that the disk is
+// unlocked by one of them even if the header is not written completely.
+func (e *Encrypted) RotateKey(oldID, newID string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i := e.slot(oldID)
+	if i < 0 {
+		return fmt.Errorf("nbd: key %q does not unlock the disk", oldID)
+	}
+	if e.slot(newID) >= 0 {
+		return fmt.Errorf("nbd: key %q already unlocks the disk", newID)
+	}
+	slot, err := e.seal(newID)
+	if err != nil {
+		return err
+	}
+	slots := slices.Clone(e.slots)
+	slots[i] = slot
+	return e.writeHeader(slots)
+}
+
+// Size returns the size of the disk.
+func (e *Encrypted) Size() int64 { return e.size }
+
+// sectors returns the bounds of the sectors which [off, off+n) covers.
+func sectors(off, n int64) (start, end int64) {
+	return off / encryptedSectorSize * encryptedSectorSize, roundUp(off+n, encryptedSectorSize)
+}
+
+// readSectors reads and decrypts the sectors at off into b.
+func (e *Encrypted) readSectors(b []byte, off int64) error {
+	if _, err := e.f.ReadAt(b, encryptedDataOff+off); err != nil {
+		return err
+	}
+	for i := 0; i < len(b); i += encryptedSectorSize {
+		s := b[i : i+encryptedSectorSize]
+		// holes read as zeros.
+		if !sparse.IsZero(s) {
+			e.cipher.Decrypt(s, s, uint64(off+int64(i))/encryptedSectorSize)
+		}
+	}
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (e *Encrypted) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("nbd: negative offset")
+	}
+	if off >= e.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(p)) > e.size-off {
+		p, eof = p[:e.size-off], io.EOF
+	}
+	start, end := sectors(off, int64(len(p)))
+	b := make([]byte, end-start)
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if err := e.readSectors(b, start); err != nil {
+		return 0, err
+	}
+	copy(p, b[off-start:])
+	return len(p), eof
+}
+
+// WriteAt implements io.WriterAt. Sectors which are partially written are
+// read and decrypted first.
+func (e *Encrypted) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || int64(len(p)) > e.size-off {
+		return 0, errors.New("nbd: write beyond the end of the encrypted disk")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.writeAt(p, off)
+}
+
+func (e *Encrypted) writeAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	start, end := sectors(off, int64(len(p)))
+	b := make([]byte, end-start)
+	if off > start {
+		if err := e.readSectors(b[:encryptedSectorSize], start); err != nil {
+			return 0, err
+		}
+	}
+	// the last sector, unless it is the first one which was read already.
+	if last := end - encryptedSectorSize; off+int64(len(p)) < end && (last > start || off == start) {
+		if err := e.readSectors(b[last-start:], last); err != nil {
+			return 0, err
+		}
+	}
+	copy(b[off-start:], p)
+	for i := 0; i < len(b); i += encryptedSectorSize {
+		s := b[i : i+encryptedSectorSize]
+		e.cipher.Encrypt(s, s, uint64(start+int64(i))/encryptedSectorSize)
+	}
+	if _, err := e.f.WriteAt(b, encryptedDataOff+start); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Trim implements Trimmer. Trimmed sectors read as zeros, and are holes in
+// the file.
+func (e *Encrypted) Trim(off, length int64) error {
+	if off < 0 || length < 0 || length > e.size-off {
+		return errors.New("nbd: trim beyond the end of the encrypted disk")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	start := min(roundUp(off, encryptedSectorSize), off+length)
+	end := max((off+length)/encryptedSectorSize*encryptedSectorSize, start)
+	if start > off {
+		if _, err := e.writeAt(make([]byte, start-off), off); err != nil {
+			return err
+		}
+	}
+	if end > start {
+		err := sparse.PunchHole(e.f, encryptedDataOff+start, end-start)
+		if errors.Is(err, errors.ErrUnsupported) {
+			// zeros read as zeros too.
+			err = e.zero(start, end-start)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if off+length > end {
+		if _, err := e.writeAt(make([]byte, off+length-end), end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zero writes zeros to the file at off.
+func (e *Encrypted) zero(off, length int64) error {
+	zero := make([]byte, min(length, 1<<20))
+	for length > 0 {
+		n := min(length, int64(len(zero)))
+		if _, err := e.f.WriteAt(zero[:n], encryptedDataOff+off); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+// Sync writes the data to storage.
+func (e *Encrypted) Sync() error { return e.f.Sync() }
+
+// Close syncs and closes the file.
+func (e *Encrypted) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	err := e.f.Sync()
+	if cerr := e.f.Close(); err == nil {
+		err = cerr
+	}
+	clear(e.dataKey)
+	return err
+}
@@ -0,0 +1,146 @@
+package nbd_test
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/nbd"
+)
+
+func TestEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vm.disk")
+	keys := nbd.KeyMap{
+		"old":   bytes.Repeat([]byte{1}, 32),
+		"new":   bytes.Repeat([]byte{2}, 32),
+		"spare": bytes.Repeat([]byte{3}, 32),
+		"short": []byte("short"),
+	}
+	const size = 1 << 20
+	if _, err := nbd.CreateEncrypted(path, size+512, keys, "old"); err == nil {
+		t.Fatal("want an error for a size which is not a multiple of the sector size")
+	}
+	if _, err := nbd.CreateEncrypted(path, size, keys, "short"); err == nil {
+		t.Fatal("want an error for a short key")
+	}
+	e, err := nbd.CreateEncrypted(path, size, keys, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Size() != size {
+		t.Fatalf("want size %d but got %d", size, e.Size())
+	}
+
+	want := make([]byte, size)
+	plain := bytes.Repeat([]byte("secret data "), 2000)
+	r := rand.New(rand.NewPCG(1, 2))
+	for range 100 {
+		off := r.Int64N(size)
+		n := min(r.Int64N(3*4096), size-off)
+		if _, err := e.WriteAt(plain[:n], off); err != nil {
+			t.Fatal(err)
+		}
+		copy(want[off:], plain[:n])
+		if r.IntN(4) == 0 {
+			off, n = r.Int64N(size), r.Int64N(5*4096)
+			n = min(n, size-off)
+			if err := e.Trim(off, n); err != nil {
+				t.Fatal(err)
+			}
+			clear(want[off : off+n])
+		}
+	}
+	got := make([]byte, size)
+	if _, err := e.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("want the written data at %d", firstDiff(got, want))
+	}
+	b := make([]byte, 10)
+	if _, err := e.ReadAt(b, 4090); err != nil || !bytes.Equal(b, want[4090:4100]) {
+		t.Fatalf("want the data across sectors but got %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(file, []byte("secret")) {
+		t.Fatal("want the data encrypted in the file")
+	}
+
+	if _, err := nbd.OpenEncrypted(path, nbd.KeyMap{"old": keys["new"]}); err == nil {
+		t.Fatal("want an error for a wrong key")
+	}
+	if e, err = nbd.OpenEncrypted(path, keys); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddKey("spare"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RotateKey("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RemoveKey("old"); err == nil {
+		t.Fatal("want an error for a key which was rotated")
+	}
+	if ids := e.KeyIDs(); !slices.Equal(ids, []string{"new", "spare"}) {
+		t.Fatalf("want keys new and spare but got %q", ids)
+	}
+	if err := e.RemoveKey("spare"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RemoveKey("new"); err == nil {
+		t.Fatal("want an error for the last key")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nbd.OpenEncrypted(path, nbd.KeyMap{"old": keys["old"], "spare": keys["spare"]}); err == nil {
+		t.Fatal("want an error for keys which were removed")
+	}
+
+	// a torn header leaves the previous one, which the new key unlocks
+	// too.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 100), 4096); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if e, err = nbd.OpenEncrypted(path, nbd.KeyMap{"new": keys["new"]}); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if ids := e.KeyIDs(); !slices.Equal(ids, []string{"new", "spare"}) {
+		t.Fatalf("want the keys of the previous header but got %q", ids)
+	}
+
+	srv := &nbd.Server{}
+	if err := srv.AddExport(nbd.Export{Name: "vm", Data: e}); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, "tcp", serve(t, srv, "tcp", "127.0.0.1:0").String())
+	replies := c.option(7, infoData("vm"))
+	if flags := be.Uint16(replies[0].data[10:]); flags&2 != 0 || flags&32 == 0 {
+		t.Fatalf("want a writable export with trim but got flags %#x", flags)
+	}
+	c.request(0, 1, 1, 100, 5, []byte("guest"))
+	copy(want[100:], "guest")
+	if cookie, errno, _ := c.simpleReply(0); errno != 0 {
+		t.Fatalf("request %d: want success but got error %d", cookie, errno)
+	}
+	c.request(0, 0, 2, 0, 8192, nil)
+	if _, errno, data := c.simpleReply(8192); errno != 0 || !bytes.Equal(data, want[:8192]) {
+		t.Fatalf("want the data of the disk but got error %d", errno)
+	}
+}
@@ -0,0 +1,386 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The cache file of an HTTPImage starts with a header block, which holds
+// the validator of the image on the server, followed by the bitmap of the
+// cached blocks. The data follows at the offsets of the image.
+const (
+	httpCacheMagic      = "VZHTTPC\x00"
+	httpCacheVersion    = 1
+	httpCacheHeaderSize = 4096
+	httpBlockSize       = 64 << 10
+	maxValidatorLen     = 1024
+
+	defaultReadahead = 1 << 20
+)
+
+// HTTPImage is a read-only disk image on an HTTP server, read with range
+// requests as the guest reads it, so that a guest boots without
+// downloading the whole image first. Blocks read once are kept in a local
+// cache file, and reads fetch the blocks following them too.
+//
+// The cache is reused when the image is opened again, as long as the
+// server reports the same strong ETag or Last-Modified time for it.
+// Otherwise, the cache is emptied. If the image changes on the server
+// while it is open, reads fail.
+//
+// An HTTPImage is the Data of a read-only Export, to be attached with
+// forcedReadOnly set:
+//
+//	img, err := nbd.OpenHTTPImage("https://artifacts.example.com/golden.img", "golden.cache")
+//	...
+//	err = srv.AddExport(nbd.Export{Name: "golden", Data: img})
+//	...
+//	attachment, err := vz.NewNetworkBlockDeviceStorageDeviceAttachment(
+//		"nbd+unix:///golden?socket=nbd.sock", 10*time.Second, true,
+//		vz.DiskSynchronizationModeNone,
+//	)
+//
+// An HTTPImage is safe for concurrent use.
+type HTTPImage struct {
+	url       string
+	client    *http.Client
+	header    http.Header
+	readahead int64
+	validator string
+	size      int64
+	removeAt  string // the path of a temporary cache file
+
+	cache   *os.File
+	dataOff int64
+
+	// fetchMu serializes requests, so that concurrent reads of a block
+	// fetch it once.
+	fetchMu sync.Mutex
+	mu      sync.RWMutex
+	bitmap  *bitmap
+}
+
+var _ io.ReaderAt = (*HTTPImage)(nil)
+
+type httpConfig struct {
+	client    *http.Client
+	header    http.Header
+	readahead int64
+}
+
+// HTTPOption is an option of OpenHTTPImage.
+type HTTPOption func(*httpConfig) error
+
+// WithHTTPClient sets the client of the requests. The default is
+// http.DefaultClient.
+func WithHTTPClient(c *http.Client) HTTPOption {
+	return func(cfg *httpConfig) error {
+		if c == nil {
+			return errors.New("nbd: nil HTTP client")
+		}
+		cfg.client = c
+		return nil
+	}
+}
+
+// WithHTTPHeader adds header to the requests, for example to authorize
+// them.
+func WithHTTPHeader(header http.Header) HTTPOption {
+	return func(cfg *httpConfig) error {
+		for k, v := range header {
+			for _, v := range v {
+				cfg.header.Add(k, v)
+			}
+		}
+		return nil
+	}
+}
+
+// WithReadahead sets how many bytes are fetched at least when a read
+// misses the cache. The default is 1 MiB, and zero fetches only the
+// blocks which are read.
+func WithReadahead(n int64) HTTPOption {
+	return func(cfg *httpConfig) error {
+		if n < 0 {
+			return fmt.Errorf("nbd: negative readahead %d", n)
+		}
+		cfg.readahead = n
+		return nil
+	}
+}
+
+// OpenHTTPImage opens the image at url, with a cache file at cachePath
+// which is created if it does not exist. If cachePath is empty, a
+// temporary cache file is used and removed by Close.
+//
+// The server must support range requests.
+func OpenHTTPImage(url, cachePath string, opts ...HTTPOption) (_ *HTTPImage, err error) {
+	cfg := &httpConfig{
+		client:    http.DefaultClient,
+		header:    make(http.Header),
+		readahead: defaultReadahead,
+	}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	img := &HTTPImage{
+		url:       url,
+		client:    cfg.client,
+		header:    cfg.header,
+		readahead: cfg.readahead,
+	}
+	if err := img.stat(); err != nil {
+		return nil, err
+	}
+	img.bitmap = newBitmap((img.size + httpBlockSize - 1) / httpBlockSize)
+	img.dataOff = httpCacheHeaderSize + img.bitmap.size()
+
+	if cachePath == "" {
+		img.cache, err = os.CreateTemp("", "nbd-http-cache")
+		if err != nil {
+			return nil, err
+		}
+		img.removeAt = img.cache.Name()
+	} else if img.cache, err = os.OpenFile(cachePath, os.O_RDWR|os.O_CREATE, 0o600); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			img.cache.Close()
+			if img.removeAt != "" {
+				os.Remove(img.removeAt)
+			}
+		}
+	}()
+	if err := img.loadCache(); err != nil {
+		return nil, fmt.Errorf("nbd: cache file %s: %w", img.cache.Name(), err)
+	}
+	return img, nil
+}
+
+// newRequest returns a request of the bytes [start, end) of the image.
+func (img *HTTPImage) newRequest(start, end int64) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, img.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range img.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	return req, nil
+}
+
+// stat requests the first byte of the image, for its size and validator.
+func (img *HTTPImage) stat() error {
+	req, err := img.newRequest(0, 1)
+	if err != nil {
+		return err
+	}
+	resp, err := img.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		if resp.StatusCode == http.StatusOK {
+			return fmt.Errorf("nbd: %s: server does not support range requests", img.url)
+		}
+		return fmt.Errorf("nbd: %s: %s", img.url, resp.Status)
+	}
+	cr := resp.Header.Get("Content-Range")
+	_, total, ok := strings.Cut(cr, "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if !ok || err != nil || size < 0 {
+		return fmt.Errorf("nbd: %s: invalid Content-Range %q", img.url, cr)
+	}
+	img.size = size
+	// weak ETags do not guarantee the same bytes.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		img.validator = etag
+	} else {
+		img.validator = resp.Header.Get("Last-Modified")
+	}
+	if len(img.validator) > maxValidatorLen {
+		img.validator = ""
+	}
+	return nil
+}
+
+// loadCache reads the bitmap of the cache file if it caches the same
+// image, and empties the file otherwise.
+func (img *HTTPImage) loadCache() error {
+	h := make([]byte, httpCacheHeaderSize)
+	n, err := img.cache.ReadAt(h, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	le := binary.LittleEndian
+	vlen := int(le.Uint16(h[24:]))
+	if n == len(h) && img.validator != "" &&
+		string(h[:8]) == httpCacheMagic &&
+		le.Uint32(h[8:]) == httpCacheVersion &&
+		le.Uint32(h[12:]) == httpBlockSize &&
+		int64(le.Uint64(h[16:])) == img.size &&
+		vlen <= maxValidatorLen && string(h[26:26+vlen]) == img.validator {
+		return img.bitmap.read(img.cache, httpCacheHeaderSize)
+	}
+
+	if err := img.cache.Truncate(0); err != nil {
+		return err
+	}
+	clear(h)
+	copy(h, httpCacheMagic)
+	le.PutUint32(h[8:], httpCacheVersion)
+	le.PutUint32(h[12:], httpBlockSize)
+	le.PutUint64(h[16:], uint64(img.size))
+	le.PutUint16(h[24:], uint16(len(img.validator)))
+	copy(h[26:], img.validator)
+	if _, err := img.cache.WriteAt(h, 0); err != nil {
+		return err
+	}
+	return img.cache.Truncate(img.dataOff + img.size)
+}
+
+// Size returns the size of the image.
+func (img *HTTPImage) Size() int64 { return img.size }
+
+// ReadAt implements io.ReaderAt.
+func (img *HTTPImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("nbd: negative offset")
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(p)) > img.size-off {
+		p, eof = p[:img.size-off], io.EOF
+	}
+	if len(p) == 0 {
+		return 0, eof
+	}
+	first, last := off/httpBlockSize, (off+int64(len(p))-1)/httpBlockSize
+	if img.missing(first, last) >= 0 {
+		if err := img.fetch(first, last); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := img.cache.ReadAt(p, img.dataOff+off); err != nil {
+		return 0, err
+	}
+	return len(p), eof
+}
+
+// missing returns the first block in [first, last] which is not cached, or
+// -1 if all of them are.
+func (img *HTTPImage) missing(first, last int64) int64 {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	for blk := first; blk <= last; blk++ {
+		if !img.bitmap.has(blk) {
+			return blk
+		}
+	}
+	return -1
+}
+
+// fetch caches the blocks in [first, last] which are missing, and the
+// blocks of the readahead after them.
+func (img *HTTPImage) fetch(first, last int64) error {
+	img.fetchMu.Lock()
+	defer img.fetchMu.Unlock()
+	// another read may have fetched some of the blocks meanwhile.
+	start := img.missing(first, last)
+	if start < 0 {
+		return nil
+	}
+	blocks := (img.size + httpBlockSize - 1) / httpBlockSize
+	end := min(max(last+1, start+img.readahead/httpBlockSize), blocks)
+	for {
+		stop := start + 1
+		img.mu.RLock()
+		for stop < end && !img.bitmap.has(stop) {
+			stop++
+		}
+		img.mu.RUnlock()
+		if err := img.fetchRange(start, stop); err != nil {
+			return err
+		}
+		if start = img.missing(stop, last); start < 0 {
+			return nil
+		}
+	}
+}
+
+// fetchRange caches the blocks in [start, stop).
+func (img *HTTPImage) fetchRange(start, stop int64) error {
+	from, to := start*httpBlockSize, min(stop*httpBlockSize, img.size)
+	req, err := img.newRequest(from, to)
+	if err != nil {
+		return err
+	}
+	if img.validator != "" {
+		req.Header.Set("If-Range", img.validator)
+	}
+	resp, err := img.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignores If-Range for an image which has changed.
+		return fmt.Errorf("nbd: %s: image has changed on the server", img.url)
+	default:
+		return fmt.Errorf("nbd: %s: %s", img.url, resp.Status)
+	}
+	if want := fmt.Sprintf("bytes %d-%d/", from, to-1); !strings.HasPrefix(resp.Header.Get("Content-Range"), want) {
+		return fmt.Errorf("nbd: %s: want Content-Range %s but got %q", img.url, want, resp.Header.Get("Content-Range"))
+	}
+	w := io.NewOffsetWriter(img.cache, img.dataOff+from)
+	if _, err := io.CopyN(w, resp.Body, to-from); err != nil {
+		return fmt.Errorf("nbd: %s: %w", img.url, err)
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	for blk := start; blk < stop; blk++ {
+		img.bitmap.set(blk)
+	}
+	return nil
+}
+
+// Close writes the bitmap of the cache file, and closes it. A temporary
+// cache file is removed.
+func (img *HTTPImage) Close() error {
+	if img.removeAt != "" {
+		img.cache.Close()
+		return os.Remove(img.removeAt)
+	}
+	img.fetchMu.Lock()
+	defer img.fetchMu.Unlock()
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	// the data is written before the bitmap which refers to it.
+	err := img.cache.Sync()
+	if err == nil {
+		_, err = img.bitmap.flush(img.cache, httpCacheHeaderSize)
+	}
+	if err == nil {
+		err = img.cache.Sync()
+	}
+	if cerr := img.cache.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package nbd_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/nbd"
+)
+
+// imageServer serves an image with range requests and counts them.
+type imageServer struct {
+	mu       sync.Mutex
+	data     []byte
+	etag     string
+	requests atomic.Int64
+}
+
+func (s *imageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	data, etag := s.data, s.etag
+	s.mu.Unlock()
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "disk.img", time.Time{}, bytes.NewReader(data))
+}
+
+func (s *imageServer) set(data []byte, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data, s.etag = data, etag
+}
+
+func TestHTTPImage(t *testing.T) {
+	data := make([]byte, 3<<20+1000)
+	for i := range data {
+		data[i] = byte(i * 7 / 5)
+	}
+	s := &imageServer{}
+	s.set(data, `"v1"`)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	cache := filepath.Join(t.TempDir(), "disk.cache")
+	auth := nbd.WithHTTPHeader(http.Header{"Authorization": {"Bearer token"}})
+
+	if _, err := nbd.OpenHTTPImage(ts.URL, cache); err == nil {
+		t.Fatal("want an error for an unauthorized request")
+	}
+	img, err := nbd.OpenHTTPImage(ts.URL, cache, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != int64(len(data)) {
+		t.Fatalf("want size %d but got %d", len(data), img.Size())
+	}
+	s.requests.Store(0)
+	read := func(img *nbd.HTTPImage, off, n int64, requests int64) {
+		t.Helper()
+		before := s.requests.Load()
+		b := make([]byte, n)
+		if _, err := img.ReadAt(b, off); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data[off:off+n]) {
+			t.Fatalf("want the data at %d", off)
+		}
+		if got := s.requests.Load() - before; got != requests {
+			t.Fatalf("read at %d: want %d requests but got %d", off, requests, got)
+		}
+	}
+	read(img, 10, 100, 1)
+	read(img, 1<<20-100, 100, 0) // read ahead
+	read(img, 1<<20-100, 200, 1)
+	read(img, 3<<20, 1000, 1)
+
+	// concurrent reads of the same blocks fetch them once.
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 4096)
+			if _, err := img.ReadAt(b, 2<<20); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := s.requests.Load(); got != 4 {
+		t.Fatalf("want 4 requests but got %d", got)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cache is reused for the same ETag.
+	if img, err = nbd.OpenHTTPImage(ts.URL, cache, auth, nbd.WithReadahead(0)); err != nil {
+		t.Fatal(err)
+	}
+	read(img, 0, 3<<20, 0)
+	read(img, 3<<20, 1000, 0)
+
+	// the image changes on the server, which empties the cache when it is
+	// opened again.
+	changed := bytes.Clone(data)
+	changed[0] = 1
+	s.set(changed, `"v2"`)
+	b := make([]byte, 1)
+	if _, err := img.ReadAt(b, 0); err != nil || b[0] != data[0] {
+		t.Fatalf("want the cached data but got %v", err)
+	}
+	img.Close()
+	if img, err = nbd.OpenHTTPImage(ts.URL, cache, auth, nbd.WithReadahead(0)); err != nil {
+		t.Fatal(err)
+	}
+	data = changed
+	read(img, 0, 10, 1)
+	s.set(data, `"v3"`)
+	if _, err := img.ReadAt(b, 2<<20); err == nil {
+		t.Fatal("want an error for an image which has changed")
+	}
+	img.Close()
+
+	// a temporary cache file is removed on Close.
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	srv := &nbd.Server{}
+	if img, err = nbd.OpenHTTPImage(ts.URL, "", auth); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := img.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+			t.Fatalf("want the cache file removed but got %s", entries[0].Name())
+		}
+	}()
+	if err := srv.AddExport(nbd.Export{Name: "golden", Data: img}); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, "tcp", serve(t, srv, "tcp", "127.0.0.1:0").String())
+	replies := c.option(7, infoData("golden"))
+	if flags := be.Uint16(replies[0].data[10:]); flags&2 == 0 {
+		t.Fatalf("want a read-only export but got flags %#x", flags)
+	}
+	c.request(0, 0, 1, 1<<20, 4096, nil)
+	if _, errno, got := c.simpleReply(4096); errno != 0 || !bytes.Equal(got, data[1<<20:1<<20+4096]) {
+		t.Fatalf("want the data but got error %d", errno)
+	}
+
+	full := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer full.Close()
+	if _, err := nbd.OpenHTTPImage(full.URL, ""); err == nil {
+		t.Fatal("want an error for a server without range requests")
+	}
+}
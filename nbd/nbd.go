@@ -0,0 +1,190 @@
+// Package nbd implements a Network Block Device server, which exports disks
+// to NetworkBlockDeviceStorageDeviceAttachment or to any other NBD client.
+//
+// A Server exports any io.ReaderAt, and writes to it if it is also an
+// io.WriterAt, so a program can serve the disks of its guests itself
+// instead of running an external NBD server:
+//
+//	f, err := os.OpenFile("disk.img", os.O_RDWR, 0)
+//	...
+//	srv := &nbd.Server{}
+//	if err := srv.AddExport(nbd.Export{Name: "disk", Data: f}); err != nil {
+//		return err
+//	}
+//	l, err := net.Listen("unix", "nbd.sock")
+//	...
+//	go srv.Serve(l)
+//	attachment, err := vz.NewNetworkBlockDeviceStorageDeviceAttachment(
+//		"nbd+unix:///disk?socket=nbd.sock", 10*time.Second, false,
+//		vz.DiskSynchronizationModeFull,
+//	)
+//
+// The server implements the fixed newstyle handshake with NBD_OPT_GO,
+// NBD_OPT_INFO, NBD_OPT_LIST and NBD_OPT_EXPORT_NAME, TLS with
+// NBD_OPT_STARTTLS, structured replies, and the flush, trim and write
+// zeroes commands, as described in
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md.
+//
+// Besides files, exports can serve an Overlay, which keeps the writes of a
+// virtual machine in a delta file over a base image shared with others,
+// QCOW2 images as raw disks, an HTTPImage read from an HTTP server, and
+// Encrypted disks, which are encrypted at rest with keys of a KeyProvider.
+//
+// The requests to each export can be limited with Limits, and Server.Stats
+// reports the numbers of requests and bytes and the latencies of each
+// export, to be correlated with the Connected and DidEncounterError
+// channels of the attachment.
+package nbd
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+)
+
+const (
+	nbdMagic      = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic      = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMagic = 0x0003e889045565a9
+
+	requestMagic         = 0x25609513
+	simpleReplyMagic     = 0x67446698
+	structuredReplyMagic = 0x668e33ef
+
+	// handshake flags of the server and the client.
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+
+	optExportName      = 1
+	optAbort           = 2
+	optList            = 3
+	optStartTLS        = 5
+	optInfo            = 6
+	optGo              = 7
+	optStructuredReply = 8
+
+	repAck         = 1
+	repServer      = 2
+	repInfo        = 3
+	repErrUnsup    = 1<<31 + 1
+	repErrInvalid  = 1<<31 + 3
+	repErrTLSReqd  = 1<<31 + 5
+	repErrUnknown  = 1<<31 + 6
+	repErrTooBig   = 1<<31 + 9
+	infoExport     = 0
+	infoName       = 1
+	infoDesc       = 2
+	infoBlockSize  = 3
+	maxOptionSize  = 64 << 10
+	maxStringSize  = 4096
+	exportNameZero = 124 // zero bytes after NBD_OPT_EXPORT_NAME
+
+	// transmission flags.
+	transHasFlags        = 1 << 0
+	transReadOnly        = 1 << 1
+	transSendFlush       = 1 << 2
+	transSendFUA         = 1 << 3
+	transSendTrim        = 1 << 5
+	transSendWriteZeroes = 1 << 6
+	transSendDF          = 1 << 7
+
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdTrim        = 4
+	cmdWriteZeroes = 6
+
+	cmdFlagFUA    = 1 << 0
+	cmdFlagNoHole = 1 << 1
+
+	replyFlagDone        = 1 << 0
+	replyTypeNone        = 0
+	replyTypeOffsetData  = 1
+	replyTypeOffsetHole  = 2
+	replyTypeError       = 1<<15 + 1
+	structuredHeaderSize = 20
+
+	// block sizes reported to clients. Requests may be up to
+	// maxPayload bytes long.
+	minBlockSize       = 1
+	preferredBlockSize = 4096
+	maxPayload         = 32 << 20
+)
+
+// error values of replies, which are the errno values of Linux.
+const (
+	errPerm   = 1
+	errIO     = 5
+	errNoMem  = 12
+	errInval  = 22
+	errNoSpc  = 28
+	errNotSup = 95
+)
+
+// Export is a disk exported by a Server.
+type Export struct {
+	// Name is the name clients ask for. The empty name is the default
+	// export of clients which do not name one.
+	Name string
+
+	// Description is shown to clients which list the exports.
+	Description string
+
+	// Data holds the content of the disk. Writes go to Data if it is an
+	// io.WriterAt and ReadOnly is false.
+	//
+	// Flushes and writes which must reach storage call Sync if Data is a
+	// Syncer, such as *os.File. Trims call Trim if Data is a Trimmer;
+	// trims of an *os.File punch holes into it.
+	Data io.ReaderAt
+
+	// Size is the size of the disk in bytes. If it is zero, it is the size
+	// of Data if Data is an *os.File or has a Size method, like
+	// *io.SectionReader and *bytes.Reader.
+	Size int64
+
+	// ReadOnly makes the export read-only.
+	ReadOnly bool
+
+	// Limits limits the rate of requests to the export, so that a busy
+	// client does not starve the clients of other exports. They can be
+	// changed with Server.SetLimits.
+	Limits Limits
+}
+
+// Syncer is implemented by data which buffers writes, such as *os.File.
+type Syncer interface {
+	Sync() error
+}
+
+// Trimmer is implemented by data which can discard a range, so that it no
+// longer uses storage and reads as zeros.
+type Trimmer interface {
+	Trim(off, length int64) error
+}
+
+// fileTrimmer punches holes into a file.
+type fileTrimmer struct{ f *os.File }
+
+func (t fileTrimmer) Trim(off, length int64) error { return sparse.PunchHole(t.f, off, length) }
+
+// errno returns the error value of a reply for err.
+func errno(err error) uint32 {
+	var e syscall.Errno
+	switch {
+	case errors.As(err, &e) && (e == syscall.ENOSPC || e == syscall.EDQUOT):
+		return errNoSpc
+	case errors.As(err, &e) && e == syscall.ENOMEM:
+		return errNoMem
+	case errors.Is(err, fs.ErrPermission):
+		return errPerm
+	case errors.Is(err, errors.ErrUnsupported):
+		return errNotSup
+	}
+	return errIO
+}
@@ -0,0 +1,349 @@
+package nbd_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/nbd"
+)
+
+var be = binary.BigEndian
+
+// client is a minimal NBD client.
+type client struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, network, addr string) *client {
+	t.Helper()
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	cl := &client{t: t, c: c, r: bufio.NewReader(c)}
+	b := cl.read(18)
+	if string(b[:8]) != "NBDMAGIC" || string(b[8:16]) != "IHAVEOPT" {
+		t.Fatalf("want a newstyle greeting but got %q", b)
+	}
+	if flags := be.Uint16(b[16:]); flags != 3 {
+		t.Fatalf("want fixed newstyle and no zeroes but got %#x", flags)
+	}
+	cl.write(be.AppendUint32(nil, 3))
+	return cl
+}
+
+func (c *client) read(n int) []byte {
+	c.t.Helper()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		c.t.Fatal(err)
+	}
+	return b
+}
+
+func (c *client) write(b []byte) {
+	c.t.Helper()
+	if _, err := c.c.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+type optReply struct {
+	typ  uint32
+	data []byte
+}
+
+// option sends an option and returns its replies up to an acknowledgement
+// or an error.
+func (c *client) option(opt uint32, data []byte) []optReply {
+	c.t.Helper()
+	b := be.AppendUint64(nil, 0x49484156454f5054)
+	b = be.AppendUint32(b, opt)
+	b = be.AppendUint32(b, uint32(len(data)))
+	c.write(append(b, data...))
+	var replies []optReply
+	for {
+		h := c.read(20)
+		if be.Uint64(h) != 0x3e889045565a9 || be.Uint32(h[8:]) != opt {
+			c.t.Fatalf("want a reply to option %d but got %x", opt, h)
+		}
+		r := optReply{typ: be.Uint32(h[12:]), data: c.read(int(be.Uint32(h[16:])))}
+		replies = append(replies, r)
+		if r.typ == 1 || r.typ >= 1<<31 {
+			return replies
+		}
+	}
+}
+
+// infoData returns the data of NBD_OPT_INFO and NBD_OPT_GO.
+func infoData(name string, infos ...uint16) []byte {
+	b := be.AppendUint32(nil, uint32(len(name)))
+	b = append(b, name...)
+	b = be.AppendUint16(b, uint16(len(infos)))
+	for _, i := range infos {
+		b = be.AppendUint16(b, i)
+	}
+	return b
+}
+
+func (c *client) request(flags, typ uint16, cookie, off uint64, length uint32, data []byte) {
+	c.t.Helper()
+	b := be.AppendUint32(nil, 0x25609513)
+	b = be.AppendUint16(b, flags)
+	b = be.AppendUint16(b, typ)
+	b = be.AppendUint64(b, cookie)
+	b = be.AppendUint64(b, off)
+	b = be.AppendUint32(b, length)
+	c.write(append(b, data...))
+}
+
+// simpleReply reads a simple reply and n bytes of data if it succeeded.
+func (c *client) simpleReply(n int) (cookie uint64, errno uint32, data []byte) {
+	c.t.Helper()
+	h := c.read(16)
+	if be.Uint32(h) != 0x67446698 {
+		c.t.Fatalf("want a simple reply but got %x", h)
+	}
+	errno, cookie = be.Uint32(h[4:]), be.Uint64(h[8:])
+	if errno == 0 && n > 0 {
+		data = c.read(n)
+	}
+	return cookie, errno, data
+}
+
+type chunk struct {
+	flags  uint16
+	typ    uint16
+	cookie uint64
+	data   []byte
+}
+
+func (c *client) structuredReply() chunk {
+	c.t.Helper()
+	h := c.read(20)
+	if be.Uint32(h) != 0x668e33ef {
+		c.t.Fatalf("want a structured reply but got %x", h)
+	}
+	return chunk{flags: be.Uint16(h[4:]), typ: be.Uint16(h[6:]), cookie: be.Uint64(h[8:]), data: c.read(int(be.Uint32(h[16:])))}
+}
+
+// readAt reads a structured reply of a read at off and returns its data.
+func (c *client) readAt(cookie, off uint64, length uint32) []byte {
+	c.t.Helper()
+	c.request(0, 0, cookie, off, length, nil)
+	ch := c.structuredReply()
+	if ch.cookie != cookie || ch.flags != 1 {
+		c.t.Fatalf("want the last chunk of request %d but got %+v", cookie, ch)
+	}
+	switch ch.typ {
+	case 1:
+		if be.Uint64(ch.data) != off {
+			c.t.Fatalf("want data at %d but got %d", off, be.Uint64(ch.data))
+		}
+		return ch.data[8:]
+	case 2:
+		if be.Uint64(ch.data) != off || be.Uint32(ch.data[8:]) != length {
+			c.t.Fatalf("want a hole of %d bytes at %d but got %x", length, off, ch.data)
+		}
+		return make([]byte, length)
+	}
+	c.t.Fatalf("want data or a hole but got %+v", ch)
+	return nil
+}
+
+func serve(t *testing.T, srv *nbd.Server, network, addr string) net.Addr {
+	t.Helper()
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; !errors.Is(err, nbd.ErrServerClosed) {
+			t.Errorf("want ErrServerClosed but got %v", err)
+		}
+	})
+	return l.Addr()
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	const size = 1 << 20
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &nbd.Server{}
+	if err := srv.AddExport(nbd.Export{Name: "disk", Description: "a disk", Data: f}); err != nil {
+		t.Fatal(err)
+	}
+	base := bytes.Repeat([]byte("base"), 1024)
+	if err := srv.AddExport(nbd.Export{Name: "base", Data: bytes.NewReader(base)}); err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, srv, "unix", filepath.Join(dir, "nbd.sock"))
+	c := dial(t, "unix", addr.String())
+
+	list := c.option(3, nil)
+	if len(list) != 3 || list[0].typ != 2 || list[1].typ != 2 {
+		t.Fatalf("want two exports but got %+v", list)
+	}
+	if got := string(list[0].data[4:]); got != "base" {
+		t.Fatalf("want base but got %q", got)
+	}
+	if got := string(list[1].data[4:]); got != "diska disk" {
+		t.Fatalf("want disk with its description but got %q", got)
+	}
+	if r := c.option(6, infoData("missing")); len(r) != 1 || r[0].typ != 1<<31+6 {
+		t.Fatalf("want NBD_REP_ERR_UNKNOWN but got %+v", r)
+	}
+	if r := c.option(10, nil); r[0].typ != 1<<31+1 {
+		t.Fatalf("want NBD_REP_ERR_UNSUP but got %+v", r)
+	}
+	if r := c.option(8, nil); r[0].typ != 1 {
+		t.Fatalf("want structured replies but got %+v", r)
+	}
+	replies := c.option(7, infoData("disk", 1, 2, 3))
+	infos := map[uint16][]byte{}
+	for _, r := range replies[:len(replies)-1] {
+		infos[be.Uint16(r.data)] = r.data[2:]
+	}
+	if got := be.Uint64(infos[0]); got != size {
+		t.Fatalf("want size %d but got %d", size, got)
+	}
+	if flags, want := be.Uint16(infos[0][8:]), uint16(1|4|8|32|64|128); flags != want {
+		t.Fatalf("want transmission flags %#x but got %#x", want, flags)
+	}
+	if string(infos[1]) != "disk" || string(infos[2]) != "a disk" {
+		t.Fatalf("want name and description but got %q and %q", infos[1], infos[2])
+	}
+	if min, max := be.Uint32(infos[3]), be.Uint32(infos[3][8:]); min != 1 || max != 32<<20 {
+		t.Fatalf("want block sizes 1 to 32 MiB but got %d to %d", min, max)
+	}
+
+	data := bytes.Repeat([]byte{0xaa}, 8192)
+	c.request(0, 1, 1, 4096, uint32(len(data)), data)
+	if cookie, errno, _ := c.simpleReply(0); cookie != 1 || errno != 0 {
+		t.Fatalf("want a write but got cookie %d and error %d", cookie, errno)
+	}
+	if got := c.readAt(2, 4096, 8192); !bytes.Equal(got, data) {
+		t.Fatal("want the written data")
+	}
+	if got := c.readAt(3, 0, 4096); !bytes.Equal(got, make([]byte, 4096)) {
+		t.Fatal("want zeros before the written data")
+	}
+
+	// write zeroes, with and without holes, trim and flush.
+	c.request(0, 6, 4, 4096, 4096, nil)
+	c.request(2, 6, 5, 8192, 100, nil)
+	c.request(0, 4, 6, 0, 4096, nil)
+	c.request(0, 3, 7, 0, 0, nil)
+	c.request(1, 1, 8, size-1, 1, []byte{1})
+	done := map[uint64]bool{}
+	for range 5 {
+		cookie, errno, _ := c.simpleReply(0)
+		if errno != 0 {
+			t.Fatalf("request %d: want success but got error %d", cookie, errno)
+		}
+		done[cookie] = true
+	}
+	if len(done) != 5 {
+		t.Fatalf("want 5 replies but got %v", done)
+	}
+	want := append(make([]byte, 4096+100), data[100+4096:]...)
+	if got := c.readAt(9, 4096, 8192); !bytes.Equal(got, want) {
+		t.Fatal("want zeroed data")
+	}
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, size-1); err != nil || b[0] != 1 {
+		t.Fatalf("want the last byte in the file but got %v and %v", b, err)
+	}
+
+	// out of range requests.
+	c.request(0, 1, 10, size-1, 2, []byte{1, 2})
+	if _, errno, _ := c.simpleReply(0); errno != 28 {
+		t.Fatalf("want ENOSPC but got %d", errno)
+	}
+	c.request(0, 0, 11, size, 1, nil)
+	ch := c.structuredReply()
+	if ch.typ != 1<<15+1 || ch.flags != 1 || be.Uint32(ch.data) != 22 {
+		t.Fatalf("want an EINVAL error chunk but got %+v", ch)
+	}
+	c.request(0, 99, 12, 0, 0, nil)
+	if _, errno, _ := c.simpleReply(0); errno != 22 {
+		t.Fatalf("want EINVAL for an unknown command but got %d", errno)
+	}
+
+	c.request(0, 2, 13, 0, 0, nil)
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("want the server to close the connection but got %v", err)
+	}
+}
+
+func TestServerReadOnly(t *testing.T) {
+	srv := &nbd.Server{ErrorLog: log.New(io.Discard, "", 0)}
+	base := bytes.Repeat([]byte("base"), 1024)
+	if err := srv.AddExport(nbd.Export{Data: bytes.NewReader(base)}); err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, srv, "tcp", "127.0.0.1:0")
+
+	// a client of the old NBD_OPT_EXPORT_NAME with the default export.
+	c := dial(t, "tcp", addr.String())
+	c.write([]byte("IHAVEOPT\x00\x00\x00\x01\x00\x00\x00\x00"))
+	b := c.read(10)
+	if size := be.Uint64(b); size != uint64(len(base)) {
+		t.Fatalf("want size %d but got %d", len(base), size)
+	}
+	if flags := be.Uint16(b[8:]); flags != 1|2 {
+		t.Fatalf("want a read-only export but got %#x", flags)
+	}
+	c.request(0, 0, 1, 4, 8, nil)
+	if cookie, errno, data := c.simpleReply(8); cookie != 1 || errno != 0 || string(data) != "basebase" {
+		t.Fatalf("want data but got cookie %d, error %d and %q", cookie, errno, data)
+	}
+	c.request(0, 1, 2, 0, 4, []byte("xxxx"))
+	if _, errno, _ := c.simpleReply(0); errno != 1 {
+		t.Fatalf("want EPERM but got %d", errno)
+	}
+	c.request(0, 6, 3, 0, 4, nil)
+	if _, errno, _ := c.simpleReply(0); errno != 1 {
+		t.Fatalf("want EPERM but got %d", errno)
+	}
+
+	// an unknown export closes the connection.
+	c = dial(t, "tcp", addr.String())
+	c.write([]byte("IHAVEOPT\x00\x00\x00\x01\x00\x00\x00\x01x"))
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("want the server to close the connection but got %v", err)
+	}
+
+	c = dial(t, "tcp", addr.String())
+	if r := c.option(2, nil); r[0].typ != 1 {
+		t.Fatalf("want an acknowledgement but got %+v", r)
+	}
+
+	if err := srv.AddExport(nbd.Export{Name: "nil"}); err == nil {
+		t.Fatal("want an error for an export without data")
+	}
+}
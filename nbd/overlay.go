@@ -0,0 +1,404 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/Code-Hex/vz/v3/internal/sparse"
+)
+
+// The delta file of an Overlay starts with a header block, followed by the
+// bitmap of the blocks in the delta file. The data follows at the offsets
+// of the disk, so that blocks which were never written are holes.
+const (
+	overlayMagic      = "VZDELTA\x00"
+	overlayVersion    = 1
+	overlayHeaderSize = 4096
+	overlayBlockSize  = 4096
+)
+
+// Overlay is a copy-on-write disk over a read-only base image. Written
+// blocks are kept in a sparse delta file, together with a bitmap of them,
+// so that many virtual machines can share one base image with a delta file
+// each.
+//
+// The bitmap is written to the delta file by Sync, after the data, so that
+// the delta file is consistent at every flush of the guest.
+//
+// An Overlay is the Data of an Export, and is safe for concurrent use.
+type Overlay struct {
+	mu       sync.RWMutex
+	basePath string
+	base     *os.File
+	delta    *os.File
+	size     int64
+	dataOff  int64
+	bitmap   *bitmap
+}
+
+var (
+	_ io.ReaderAt = (*Overlay)(nil)
+	_ io.WriterAt = (*Overlay)(nil)
+	_ Syncer      = (*Overlay)(nil)
+	_ Trimmer     = (*Overlay)(nil)
+)
+
+// OpenOverlay opens the delta file at delta over the base image at base,
+// which is opened read-only. The delta file is created if it does not
+// exist. The size of the disk is the size of the base image, which must
+// not change while the delta file exists.
+func OpenOverlay(base, delta string) (*Overlay, error) {
+	b, err := os.Open(base)
+	if err != nil {
+		return nil, err
+	}
+	// Seek also reports the size of block devices.
+	size, err := b.Seek(0, io.SeekEnd)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	m := newBitmap((size + overlayBlockSize - 1) / overlayBlockSize)
+	o := &Overlay{
+		basePath: base,
+		base:     b,
+		size:     size,
+		dataOff:  overlayHeaderSize + m.size(),
+		bitmap:   m,
+	}
+	if err := o.openDelta(delta); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+func roundUp(n, m int64) int64 { return (n + m - 1) / m * m }
+
+func (o *Overlay) openDelta(path string) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		if f, err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+			return err
+		}
+		if err := o.load(f); err != nil {
+			f.Close()
+			return fmt.Errorf("nbd: %s: %w", path, err)
+		}
+		o.delta = f
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(path)
+		}
+	}()
+	h := make([]byte, overlayHeaderSize)
+	copy(h, overlayMagic)
+	binary.LittleEndian.PutUint32(h[8:], overlayVersion)
+	binary.LittleEndian.PutUint32(h[12:], overlayBlockSize)
+	binary.LittleEndian.PutUint64(h[16:], uint64(o.size))
+	if _, err := f.WriteAt(h, 0); err != nil {
+		return err
+	}
+	if err := f.Truncate(o.dataOff + o.size); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	o.delta = f
+	return nil
+}
+
+// load reads the header and the bitmap of the delta file f.
+func (o *Overlay) load(f *os.File) error {
+	h := make([]byte, overlayHeaderSize)
+	if _, err := io.ReadFull(io.NewSectionReader(f, 0, overlayHeaderSize), h); err != nil {
+		return fmt.Errorf("not a delta file: %w", err)
+	}
+	if string(h[:8]) != overlayMagic {
+		return errors.New("not a delta file")
+	}
+	if v := binary.LittleEndian.Uint32(h[8:]); v != overlayVersion {
+		return fmt.Errorf("unsupported delta file version %d", v)
+	}
+	if bs := binary.LittleEndian.Uint32(h[12:]); bs != overlayBlockSize {
+		return fmt.Errorf("unsupported block size %d", bs)
+	}
+	if size := int64(binary.LittleEndian.Uint64(h[16:])); size != o.size {
+		return fmt.Errorf("delta file of a %d bytes disk, but %s is %d bytes", size, o.basePath, o.size)
+	}
+	if err := o.bitmap.read(f, overlayHeaderSize); err != nil {
+		return fmt.Errorf("reading the bitmap: %w", err)
+	}
+	return nil
+}
+
+// Size returns the size of the disk.
+func (o *Overlay) Size() int64 { return o.size }
+
+func (o *Overlay) has(blk int64) bool { return o.bitmap.has(blk) }
+
+// set marks the blocks in [off, off+n) as written to the delta file.
+func (o *Overlay) set(off, n int64) {
+	for blk := off / overlayBlockSize; blk*overlayBlockSize < off+n; blk++ {
+		o.bitmap.set(blk)
+	}
+}
+
+// blockLen returns the length of the block blk, which is shorter than
+// overlayBlockSize at the end of a disk of an odd size.
+func (o *Overlay) blockLen(blk int64) int64 {
+	return min(overlayBlockSize, o.size-blk*overlayBlockSize)
+}
+
+// ReadAt implements io.ReaderAt.
+func (o *Overlay) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("nbd: negative offset")
+	}
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(p)) > o.size-off {
+		p, eof = p[:o.size-off], io.EOF
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for n := 0; n < len(p); {
+		// read the run of blocks in the same file at once.
+		pos := off + int64(n)
+		inDelta := o.has(pos / overlayBlockSize)
+		end := (pos/overlayBlockSize + 1) * overlayBlockSize
+		for end < off+int64(len(p)) && o.has(end/overlayBlockSize) == inDelta {
+			end += overlayBlockSize
+		}
+		m := int(min(end, off+int64(len(p))) - pos)
+		var err error
+		if inDelta {
+			_, err = o.delta.ReadAt(p[n:n+m], o.dataOff+pos)
+		} else {
+			err = o.readBase(p[n:n+m], pos)
+		}
+		if err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return len(p), eof
+}
+
+// readBase reads p from the base image, which reads as zeros beyond its end.
+func (o *Overlay) readBase(p []byte, off int64) error {
+	n, err := o.base.ReadAt(p, off)
+	if err == io.EOF {
+		clear(p[n:])
+		err = nil
+	}
+	return err
+}
+
+// WriteAt implements io.WriterAt. Blocks which are partially written for
+// the first time are copied from the base image.
+func (o *Overlay) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || int64(len(p)) > o.size-off {
+		return 0, errors.New("nbd: write beyond the end of the overlay")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.writeAt(p, off)
+}
+
+func (o *Overlay) writeAt(p []byte, off int64) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// write whole blocks, and parts of blocks in the delta file,
+		// at once.
+		n := int64(0)
+		for n < int64(len(p)) {
+			blk := (off + n) / overlayBlockSize
+			within := (off + n) % overlayBlockSize
+			m := min(o.blockLen(blk)-within, int64(len(p))-n)
+			if m < o.blockLen(blk) && !o.has(blk) {
+				break
+			}
+			n += m
+		}
+		if n > 0 {
+			if _, err := o.delta.WriteAt(p[:n], o.dataOff+off); err != nil {
+				return written, err
+			}
+			o.set(off, n)
+		} else {
+			blk := off / overlayBlockSize
+			within := off % overlayBlockSize
+			n = min(o.blockLen(blk)-within, int64(len(p)))
+			b := make([]byte, o.blockLen(blk))
+			if err := o.readBase(b, blk*overlayBlockSize); err != nil {
+				return written, err
+			}
+			copy(b[within:], p[:n])
+			if _, err := o.delta.WriteAt(b, o.dataOff+blk*overlayBlockSize); err != nil {
+				return written, err
+			}
+			o.set(blk*overlayBlockSize, int64(len(b)))
+		}
+		written += int(n)
+		off += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Trim implements Trimmer. Trimmed blocks read as zeros, and are holes in
+// the delta file.
+func (o *Overlay) Trim(off, length int64) error {
+	if off < 0 || length < 0 || length > o.size-off {
+		return errors.New("nbd: trim beyond the end of the overlay")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	start := min(roundUp(off, overlayBlockSize), off+length)
+	end := max((off+length)/overlayBlockSize*overlayBlockSize, start)
+	if off+length == o.size {
+		end = o.size
+	}
+	if start > off {
+		if _, err := o.writeAt(make([]byte, start-off), off); err != nil {
+			return err
+		}
+	}
+	if end > start {
+		err := sparse.PunchHole(o.delta, o.dataOff+start, end-start)
+		if errors.Is(err, errors.ErrUnsupported) {
+			err = o.zero(start, end-start)
+		}
+		if err != nil {
+			return err
+		}
+		o.set(start, end-start)
+	}
+	if off+length > end {
+		if _, err := o.writeAt(make([]byte, off+length-end), end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zero writes zeros to the delta file at off.
+func (o *Overlay) zero(off, length int64) error {
+	zero := make([]byte, min(length, 1<<20))
+	for length > 0 {
+		n := min(length, int64(len(zero)))
+		if _, err := o.delta.WriteAt(zero[:n], o.dataOff+off); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+// Sync writes the data and then the bitmap of the delta file to storage.
+func (o *Overlay) Sync() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.sync()
+}
+
+func (o *Overlay) sync() error {
+	if err := o.delta.Sync(); err != nil {
+		return err
+	}
+	if ok, err := o.bitmap.flush(o.delta, overlayHeaderSize); !ok || err != nil {
+		return err
+	}
+	return o.delta.Sync()
+}
+
+// Commit writes the blocks of the delta file to the base image, and then
+// empties the delta file. The base image must not be in use by other
+// overlays, whose content would change.
+func (o *Overlay) Commit() (err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	base, err := os.OpenFile(o.basePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := base.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	b := make([]byte, 1<<20)
+	blocks := (o.size + overlayBlockSize - 1) / overlayBlockSize
+	for blk := int64(0); blk < blocks; blk++ {
+		if !o.has(blk) {
+			continue
+		}
+		end := blk + 1
+		for end < blocks && o.has(end) && (end-blk)*overlayBlockSize < int64(len(b)) {
+			end++
+		}
+		off := blk * overlayBlockSize
+		n := min(end*overlayBlockSize, o.size) - off
+		if _, err := o.delta.ReadAt(b[:n], o.dataOff+off); err != nil {
+			return err
+		}
+		if _, err := base.WriteAt(b[:n], off); err != nil {
+			return err
+		}
+		blk = end - 1
+	}
+	if err := base.Sync(); err != nil {
+		return err
+	}
+	return o.discard()
+}
+
+// Discard empties the delta file, which reverts the disk to the base
+// image.
+func (o *Overlay) Discard() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.discard()
+}
+
+func (o *Overlay) discard() error {
+	// truncating releases the storage of the bitmap and the data at once.
+	if err := o.delta.Truncate(overlayHeaderSize); err != nil {
+		return err
+	}
+	if err := o.delta.Truncate(o.dataOff + o.size); err != nil {
+		return err
+	}
+	o.bitmap.reset()
+	return o.delta.Sync()
+}
+
+// Close syncs the delta file, and closes the delta file and the base image.
+func (o *Overlay) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err := o.sync()
+	if cerr := o.delta.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := o.base.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
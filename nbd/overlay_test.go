@@ -0,0 +1,148 @@
+package nbd_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/nbd"
+)
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.img")
+	deltaPath := filepath.Join(dir, "vm.delta")
+	const size = 16*4096 + 100
+	base := make([]byte, size)
+	for i := range base {
+		base[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(basePath, base, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := nbd.OpenOverlay(basePath, deltaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Size() != size {
+		t.Fatalf("want size %d but got %d", size, o.Size())
+	}
+	want := bytes.Clone(base)
+	write := func(off int64, p []byte) {
+		t.Helper()
+		if _, err := o.WriteAt(p, off); err != nil {
+			t.Fatal(err)
+		}
+		copy(want[off:], p)
+	}
+	check := func(o *nbd.Overlay, want []byte) {
+		t.Helper()
+		got := make([]byte, size)
+		if _, err := o.ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+		if i := firstDiff(got, want); i >= 0 {
+			t.Fatalf("want %d at %d but got %d", want[i], i, got[i])
+		}
+	}
+	write(100, bytes.Repeat([]byte{1}, 10))      // copied up
+	write(2*4096, bytes.Repeat([]byte{2}, 4096)) // a whole block
+	write(4*4096-5, bytes.Repeat([]byte{3}, 4106))
+	write(106, bytes.Repeat([]byte{4}, 10)) // a block in the delta file
+	write(size-50, bytes.Repeat([]byte{5}, 50))
+	check(o, want)
+	if _, err := o.WriteAt([]byte{1}, size); err == nil {
+		t.Fatal("want an error for a write beyond the end")
+	}
+	b := make([]byte, 200)
+	if n, err := o.ReadAt(b, size-100); n != 100 || err != io.EOF {
+		t.Fatalf("want 100 bytes and io.EOF but got %d and %v", n, err)
+	}
+
+	if err := o.Trim(4096-10, 3*4096); err != nil {
+		t.Fatal(err)
+	}
+	clear(want[4096-10 : 4*4096-10])
+	check(o, want)
+
+	// the delta file keeps the data after a sync.
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(basePath); err != nil || !bytes.Equal(got, base) {
+		t.Fatalf("want an unchanged base image but got %v", err)
+	}
+	if o, err = nbd.OpenOverlay(basePath, deltaPath); err != nil {
+		t.Fatal(err)
+	}
+	check(o, want)
+
+	// a second overlay over the same base image.
+	other, err := nbd.OpenOverlay(basePath, filepath.Join(dir, "other.delta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(other, base)
+
+	if err := o.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	check(o, base)
+	want = bytes.Clone(base)
+	write(0, bytes.Repeat([]byte{6}, 5000))
+	if err := o.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	check(o, want)
+	check(other, want)
+	if got, err := os.ReadFile(basePath); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("want the committed base image but got %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &nbd.Server{}
+	if o, err = nbd.OpenOverlay(basePath, deltaPath); err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if err := srv.AddExport(nbd.Export{Name: "vm", Data: o}); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, "tcp", serve(t, srv, "tcp", "127.0.0.1:0").String())
+	replies := c.option(7, infoData("vm"))
+	if got := be.Uint64(replies[0].data[2:]); got != size {
+		t.Fatalf("want size %d but got %d", size, got)
+	}
+	c.request(0, 6, 1, 0, 4096, nil)
+	if _, errno, _ := c.simpleReply(0); errno != 0 {
+		t.Fatalf("want zeroes to be written but got error %d", errno)
+	}
+	c.request(0, 0, 2, 0, 4100, nil)
+	if _, _, data := c.simpleReply(4100); !bytes.Equal(data, append(make([]byte, 4096), want[4096:4100]...)) {
+		t.Fatal("want zeros over the base image")
+	}
+
+	if err := os.Truncate(basePath, size+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nbd.OpenOverlay(basePath, filepath.Join(dir, "other.delta")); err == nil {
+		t.Fatal("want an error for a base image of another size")
+	}
+}
+
+func firstDiff(a, b []byte) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return -1
+}
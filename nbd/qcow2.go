@@ -0,0 +1,64 @@
+package nbd
+
+import (
+	"io"
+
+	"github.com/Code-Hex/vz/v3/internal/diskimage/qcow2"
+)
+
+// QCOW2 is a qcow2 image served as a raw disk, so that guests boot cloud
+// images as they are distributed. Reads follow the backing files of the
+// image and read zero clusters as zeros. Writes allocate clusters at the
+// end of the image, so that it only grows by the data written.
+//
+// Images with internal snapshots, and images not closed cleanly by QEMU
+// with lazy refcounts, can only be opened read-only.
+//
+// A QCOW2 is the Data of an Export, and is safe for concurrent use.
+type QCOW2 struct {
+	img      *qcow2.Image
+	readOnly bool
+}
+
+var (
+	_ io.ReaderAt = (*QCOW2)(nil)
+	_ io.WriterAt = (*QCOW2)(nil)
+	_ Syncer      = (*QCOW2)(nil)
+	_ Trimmer     = (*QCOW2)(nil)
+)
+
+// OpenQCOW2 opens the qcow2 image at path, for writing unless readOnly is
+// true. Backing files are always opened read-only. Exports of read-only
+// images are read-only.
+func OpenQCOW2(path string, readOnly bool) (*QCOW2, error) {
+	img, err := qcow2.Open(path, &qcow2.Options{Writable: !readOnly})
+	if err != nil {
+		return nil, err
+	}
+	return &QCOW2{img: img, readOnly: readOnly}, nil
+}
+
+// Size returns the virtual size of the disk.
+func (q *QCOW2) Size() int64 { return q.img.Size() }
+
+// BackingFile returns the name of the backing file stored in the image, or
+// an empty string if it has none.
+func (q *QCOW2) BackingFile() string { return q.img.BackingFile() }
+
+// ReadAt implements io.ReaderAt.
+func (q *QCOW2) ReadAt(p []byte, off int64) (int, error) { return q.img.ReadAt(p, off) }
+
+// WriteAt implements io.WriterAt.
+func (q *QCOW2) WriteAt(p []byte, off int64) (int, error) { return q.img.WriteAt(p, off) }
+
+// Trim implements Trimmer. Whole clusters are unmapped, which frees their
+// space in the image.
+func (q *QCOW2) Trim(off, length int64) error { return q.img.Trim(off, length) }
+
+// Sync writes the image to storage.
+func (q *QCOW2) Sync() error { return q.img.Sync() }
+
+// Close closes the image and its backing files.
+func (q *QCOW2) Close() error { return q.img.Close() }
+
+func (q *QCOW2) isReadOnly() bool { return q.readOnly }
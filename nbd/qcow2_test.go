@@ -0,0 +1,114 @@
+package nbd_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/nbd"
+)
+
+// writeQCOW2 writes an empty qcow2 image of size bytes with 64 KiB
+// clusters over a backing file, like qemu-img create -b.
+func writeQCOW2(t *testing.T, path string, size int64, backing string) {
+	t.Helper()
+	const cs = 1 << 16
+	file := make([]byte, 4*cs)
+	copy(file, "QFI\xfb")
+	be.PutUint32(file[4:], 3)
+	be.PutUint64(file[8:], 112)
+	be.PutUint32(file[16:], uint32(len(backing)))
+	be.PutUint32(file[20:], 16)
+	be.PutUint64(file[24:], uint64(size))
+	be.PutUint32(file[36:], 1)
+	be.PutUint64(file[40:], cs)   // L1 table
+	be.PutUint64(file[48:], 2*cs) // refcount table
+	be.PutUint32(file[56:], 1)
+	be.PutUint32(file[96:], 4)
+	be.PutUint32(file[100:], 104)
+	copy(file[112:], backing)
+	be.PutUint64(file[2*cs:], 3*cs)
+	for i := range 4 {
+		be.PutUint16(file[3*cs+i*2:], 1)
+	}
+	if err := os.WriteFile(path, file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQCOW2(t *testing.T) {
+	dir := t.TempDir()
+	const size = 1 << 20
+	base := bytes.Repeat([]byte("base"), size/4)
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), base, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "disk.qcow2")
+	writeQCOW2(t, path, size, "base.raw")
+
+	q, err := nbd.OpenQCOW2(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Size() != size || q.BackingFile() != "base.raw" {
+		t.Fatalf("want %d bytes over base.raw but got %d bytes over %q", size, q.Size(), q.BackingFile())
+	}
+	srv := &nbd.Server{}
+	if err := srv.AddExport(nbd.Export{Name: "disk", Data: q}); err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, srv, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr.String())
+	if r := c.option(8, nil); r[0].typ != 1 {
+		t.Fatalf("want structured replies but got %+v", r)
+	}
+	replies := c.option(7, infoData("disk"))
+	if flags := be.Uint16(replies[0].data[10:]); flags&2 != 0 || flags&32 == 0 {
+		t.Fatalf("want a writable export with trim but got flags %#x", flags)
+	}
+
+	want := bytes.Clone(base)
+	c.request(0, 1, 1, 100, 5, []byte("guest"))
+	copy(want[100:], "guest")
+	c.request(0, 6, 2, 1<<16, 1<<17, nil) // two zero clusters
+	clear(want[1<<16 : 3<<16])
+	c.request(1, 6, 3, 5<<16+10, 20, nil)
+	clear(want[5<<16+10 : 5<<16+30])
+	for range 3 {
+		if cookie, errno, _ := c.simpleReply(0); errno != 0 {
+			t.Fatalf("request %d: want success but got error %d", cookie, errno)
+		}
+	}
+	if got := c.readAt(4, 0, size); !bytes.Equal(got, want) {
+		t.Fatalf("want the written data at %d", firstDiff(got, want))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header, L1 and refcount clusters, an L2 table and two data
+	// clusters.
+	if info.Size() != 7<<16 {
+		t.Fatalf("want an image of 7 clusters but got %d bytes", info.Size())
+	}
+
+	ro, err := nbd.OpenQCOW2(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if err := srv.AddExport(nbd.Export{Name: "ro", Data: ro}); err != nil {
+		t.Fatal(err)
+	}
+	c = dial(t, "tcp", addr.String())
+	replies = c.option(7, infoData("ro"))
+	if flags := be.Uint16(replies[0].data[10:]); flags&2 == 0 {
+		t.Fatalf("want a read-only export but got flags %#x", flags)
+	}
+	c.request(0, 0, 1, 0, 200, nil)
+	if _, errno, data := c.simpleReply(200); errno != 0 || !bytes.Equal(data, want[:200]) {
+		t.Fatalf("want the data of the image but got error %d", errno)
+	}
+}
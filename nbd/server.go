@@ -0,0 +1,223 @@
+package nbd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve after Close is called.
+var ErrServerClosed = errors.New("nbd: server closed")
+
+// Server serves exports to NBD clients. The zero value is a server without
+// exports, which are added with AddExport.
+type Server struct {
+	// ErrorLog logs errors of connections. If nil, they are logged with the
+	// standard logger of the log package.
+	ErrorLog *log.Logger
+
+	// TLSConfig, if not nil, requires clients to negotiate TLS with
+	// NBD_OPT_STARTTLS before anything else, as nbds URIs do. Clients
+	// are authenticated by their certificates if ClientAuth is
+	// tls.RequireAndVerifyClientCert, as in the configuration of
+	// CA.ServerTLSConfig.
+	TLSConfig *tls.Config
+
+	mu        sync.Mutex
+	exports   map[string]*export
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// export is an Export with the interfaces of its data.
+type export struct {
+	Export
+	w       io.WriterAt
+	syncer  Syncer
+	trimmer Trimmer
+	limiter limiter
+	stats   exportStats
+}
+
+// AddExport adds e to the exports of s, replacing the export of the same
+// name. Connected clients keep using the export they negotiated, and the
+// Stats of the new export start from zero.
+func (s *Server) AddExport(e Export) error {
+	if len(e.Name) > maxStringSize {
+		return fmt.Errorf("nbd: export name is longer than %d bytes", maxStringSize)
+	}
+	if len(e.Description) > maxStringSize {
+		return fmt.Errorf("nbd: description of export %q is longer than %d bytes", e.Name, maxStringSize)
+	}
+	if e.Data == nil {
+		return fmt.Errorf("nbd: export %q has no data", e.Name)
+	}
+	if e.Size == 0 {
+		switch d := e.Data.(type) {
+		case interface{ Size() int64 }:
+			e.Size = d.Size()
+		case *os.File:
+			info, err := d.Stat()
+			if err != nil {
+				return fmt.Errorf("nbd: export %q: %w", e.Name, err)
+			}
+			e.Size = info.Size()
+		}
+	}
+	if e.Size < 0 {
+		return fmt.Errorf("nbd: export %q has negative size %d", e.Name, e.Size)
+	}
+	if err := e.Limits.validate(); err != nil {
+		return err
+	}
+	if r, ok := e.Data.(interface{ isReadOnly() bool }); ok && r.isReadOnly() {
+		e.ReadOnly = true
+	}
+	x := &export{Export: e}
+	if w, ok := e.Data.(io.WriterAt); ok && !e.ReadOnly {
+		x.w = w
+	}
+	x.syncer, _ = e.Data.(Syncer)
+	x.trimmer, _ = e.Data.(Trimmer)
+	if f, ok := e.Data.(*os.File); ok {
+		x.trimmer = fileTrimmer{f}
+	}
+	x.limiter.set(e.Limits)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exports == nil {
+		s.exports = make(map[string]*export)
+	}
+	s.exports[e.Name] = x
+	return nil
+}
+
+// RemoveExport removes the named export. Connected clients keep using it
+// until they disconnect.
+func (s *Server) RemoveExport(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.exports, name)
+}
+
+func (s *Server) export(name string) *export {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exports[name]
+}
+
+// exportList returns the exports sorted by name.
+func (s *Server) exportList() []*export {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*export, 0, len(s.exports))
+	for _, e := range s.exports {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Serve accepts connections on l and serves each of them in a new
+// goroutine. It returns ErrServerClosed after Close, or the error of
+// l.Accept.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(c); err != nil && !errors.Is(err, net.ErrClosed) {
+				s.logf("nbd: %s: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves a client on c until it disconnects, and closes c. It
+// returns nil when the client disconnects cleanly.
+func (s *Server) ServeConn(c net.Conn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		c.Close()
+		return ErrServerClosed
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	cn := newConn(s, c)
+	e, err := cn.handshake()
+	if err != nil || e == nil {
+		return err
+	}
+	e.stats.connect()
+	defer e.stats.disconnect()
+	return cn.transmit(e)
+}
+
+// Close closes the listeners and connections of s. Requests which are
+// being served are not waited for.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
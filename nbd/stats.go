@@ -0,0 +1,274 @@
+package nbd
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limits limits the rate of the requests to an export, over all of its
+// clients, with token buckets. A request which exceeds them is delayed.
+// The zero value does not limit requests.
+type Limits struct {
+	// IOPS is the number of requests per second, and IOPSBurst the
+	// number of requests above that rate which are served at once. Zero
+	// IOPS is unlimited, and zero IOPSBurst is one second of requests.
+	IOPS      float64
+	IOPSBurst float64
+
+	// Bandwidth is the number of bytes read and written per second, and
+	// BandwidthBurst the number of bytes above that rate which are
+	// served at once. Zero Bandwidth is unlimited, and zero
+	// BandwidthBurst is one second of bytes.
+	Bandwidth      float64
+	BandwidthBurst float64
+}
+
+func (l Limits) validate() error {
+	if l.IOPS < 0 || l.IOPSBurst < 0 || l.Bandwidth < 0 || l.BandwidthBurst < 0 {
+		return fmt.Errorf("nbd: negative limits %+v", l)
+	}
+	return nil
+}
+
+// tokenBucket is a token bucket which goes into debt, so that a request of
+// more tokens than the burst waits for them rather than forever.
+type tokenBucket struct {
+	rate   float64 // tokens per second, or zero if unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) tokenBucket {
+	if burst == 0 {
+		burst = max(rate, 1)
+	}
+	return tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take takes n tokens at now, and returns how long to wait for them.
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limiter applies the Limits of an export.
+type limiter struct {
+	mu   sync.Mutex
+	iops tokenBucket
+	bw   tokenBucket
+}
+
+func (l *limiter) set(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.iops = newTokenBucket(limits.IOPS, limits.IOPSBurst)
+	l.bw = newTokenBucket(limits.Bandwidth, limits.BandwidthBurst)
+}
+
+// delay returns how long to delay a request of n bytes.
+func (l *limiter) delay(n int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	return max(l.iops.take(1, now), l.bw.take(float64(n), now))
+}
+
+// LatencyBounds are the upper bounds of the buckets of a Histogram.
+var LatencyBounds = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Histogram is a histogram of the latencies of requests, from when a
+// request is received until its reply is ready to be sent, including the
+// delay of the Limits of the export.
+type Histogram struct {
+	Count uint64
+	Sum   time.Duration
+	Max   time.Duration
+
+	// Buckets[i] counts the requests which took at most LatencyBounds[i]
+	// and longer than the bound before it. The last bucket counts the
+	// requests which took longer than a second.
+	Buckets [len(LatencyBounds) + 1]uint64
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBounds) && d > LatencyBounds[i] {
+		i++
+	}
+	h.Buckets[i]++
+	h.Count++
+	h.Sum += d
+	h.Max = max(h.Max, d)
+}
+
+// Quantile returns an upper bound of the q-quantile of the latencies, such
+// as 0.99 for the 99th percentile. It returns zero without requests.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := max(uint64(math.Ceil(q*float64(h.Count))), 1)
+	var n uint64
+	for i, c := range h.Buckets {
+		if n += c; n >= rank && i < len(LatencyBounds) {
+			return min(LatencyBounds[i], h.Max)
+		}
+	}
+	return h.Max
+}
+
+// Stats are the statistics of an export since it was added, over all of
+// its clients.
+type Stats struct {
+	// Clients is the number of clients connected now, and Connects the
+	// number of connections so far. A client which reconnects, as
+	// NetworkBlockDeviceStorageDeviceAttachment does after an error,
+	// connects again.
+	Clients  int
+	Connects uint64
+
+	// the numbers of requests, including those which failed.
+	Reads       uint64
+	Writes      uint64
+	WriteZeroes uint64
+	Flushes     uint64
+	Trims       uint64
+
+	// Errors is the number of requests which failed.
+	Errors uint64
+
+	// BytesRead and BytesWritten are the bytes of the requests which
+	// succeeded. Write zeroes requests are not counted.
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// Throttled is the number of requests which the Limits of the export
+	// delayed, by ThrottledTime in total.
+	Throttled     uint64
+	ThrottledTime time.Duration
+
+	// the latencies of reads, writes including write zeroes, flushes and
+	// trims.
+	ReadLatency  Histogram
+	WriteLatency Histogram
+	FlushLatency Histogram
+	TrimLatency  Histogram
+}
+
+// exportStats collects the Stats of an export.
+type exportStats struct {
+	mu sync.Mutex
+	s  Stats
+}
+
+func (s *exportStats) connect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s.Clients++
+	s.s.Connects++
+}
+
+func (s *exportStats) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s.Clients--
+}
+
+func (s *exportStats) throttled(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s.Throttled++
+	s.s.ThrottledTime += d
+}
+
+// record records a request which took d and failed if errno is not zero.
+func (s *exportStats) record(req *request, errno uint32, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if errno != 0 {
+		s.s.Errors++
+	}
+	var h *Histogram
+	switch req.typ {
+	case cmdRead:
+		s.s.Reads++
+		if errno == 0 {
+			s.s.BytesRead += uint64(req.length)
+		}
+		h = &s.s.ReadLatency
+	case cmdWrite:
+		s.s.Writes++
+		if errno == 0 {
+			s.s.BytesWritten += uint64(req.length)
+		}
+		h = &s.s.WriteLatency
+	case cmdWriteZeroes:
+		s.s.WriteZeroes++
+		h = &s.s.WriteLatency
+	case cmdFlush:
+		s.s.Flushes++
+		h = &s.s.FlushLatency
+	case cmdTrim:
+		s.s.Trims++
+		h = &s.s.TrimLatency
+	default:
+		return
+	}
+	h.observe(d)
+}
+
+func (s *exportStats) get() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.s
+}
+
+// Stats returns the statistics of the named export. It reports false if
+// there is no such export.
+func (s *Server) Stats(name string) (Stats, bool) {
+	e := s.export(name)
+	if e == nil {
+		return Stats{}, false
+	}
+	return e.stats.get(), true
+}
+
+// SetLimits changes the Limits of the named export, which apply to its
+// connected clients at once.
+func (s *Server) SetLimits(name string, limits Limits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	e := s.export(name)
+	if e == nil {
+		return fmt.Errorf("nbd: unknown export %q", name)
+	}
+	e.limiter.set(limits)
+	return nil
+}
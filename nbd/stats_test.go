@@ -0,0 +1,162 @@
+package nbd_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/nbd"
+)
+
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	const size = 1 << 20
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	srv := &nbd.Server{}
+	if err := srv.AddExport(nbd.Export{Name: "disk", Data: f, Limits: nbd.Limits{IOPS: -1}}); err == nil {
+		t.Fatal("want an error for negative limits")
+	}
+	if err := srv.AddExport(nbd.Export{Name: "disk", Data: f}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.Stats("missing"); ok {
+		t.Fatal("want no stats of a missing export")
+	}
+	if err := srv.SetLimits("missing", nbd.Limits{}); err == nil {
+		t.Fatal("want an error for a missing export")
+	}
+	c := dial(t, "tcp", serve(t, srv, "tcp", "127.0.0.1:0").String())
+	if r := c.option(7, infoData("disk")); r[len(r)-1].typ != 1 {
+		t.Fatalf("want the export but got %+v", r)
+	}
+
+	c.request(0, 1, 1, 0, 4096, make([]byte, 4096))
+	c.request(0, 0, 2, 0, 4096, nil)
+	c.request(0, 0, 3, size, 1, nil) // beyond the end
+	c.request(0, 6, 4, 4096, 8192, nil)
+	c.request(0, 4, 5, 0, 4096, nil)
+	c.request(0, 3, 6, 0, 0, nil)
+	failed := 0
+	for range 6 {
+		cookie, errno, _ := c.simpleReply(0)
+		if errno != 0 {
+			failed++
+		}
+		if cookie == 2 {
+			c.read(4096)
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("want one error but got %d", failed)
+	}
+	s, ok := srv.Stats("disk")
+	if !ok {
+		t.Fatal("want the stats of the export")
+	}
+	want := nbd.Stats{
+		Clients: 1, Connects: 1,
+		Reads: 2, Writes: 1, WriteZeroes: 1, Flushes: 1, Trims: 1,
+		Errors:    1,
+		BytesRead: 4096, BytesWritten: 4096,
+	}
+	got := s
+	got.ReadLatency, got.WriteLatency, got.FlushLatency, got.TrimLatency = nbd.Histogram{}, nbd.Histogram{}, nbd.Histogram{}, nbd.Histogram{}
+	if got != want {
+		t.Fatalf("want %+v but got %+v", want, got)
+	}
+	for name, h := range map[string]nbd.Histogram{"read": s.ReadLatency, "write": s.WriteLatency, "flush": s.FlushLatency, "trim": s.TrimLatency} {
+		n := uint64(1)
+		if name != "flush" && name != "trim" {
+			n = 2
+		}
+		var total uint64
+		for _, b := range h.Buckets {
+			total += b
+		}
+		if h.Count != n || total != n || h.Sum < h.Max || h.Quantile(1) != h.Max {
+			t.Fatalf("want %d %s latencies but got %+v", n, name, h)
+		}
+	}
+
+	// 20 requests per second with a burst of 1.
+	if err := srv.SetLimits("disk", nbd.Limits{IOPS: 20, IOPSBurst: 1}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := range 5 {
+		c.request(0, 0, uint64(i), 0, 512, nil)
+	}
+	for range 5 {
+		if _, errno, _ := c.simpleReply(512); errno != 0 {
+			t.Fatalf("want success but got error %d", errno)
+		}
+	}
+	if d := time.Since(start); d < 180*time.Millisecond {
+		t.Fatalf("want 5 requests to take 200ms but took %v", d)
+	}
+	if s, _ = srv.Stats("disk"); s.Throttled < 3 || s.ThrottledTime < 300*time.Millisecond {
+		t.Fatalf("want throttled requests but got %d in %v", s.Throttled, s.ThrottledTime)
+	}
+
+	// 1 MiB per second with a burst of 64 KiB.
+	if err := srv.SetLimits("disk", nbd.Limits{Bandwidth: 1 << 20, BandwidthBurst: 64 << 10}); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	c.request(0, 1, 1, 0, 256<<10, make([]byte, 256<<10))
+	if _, errno, _ := c.simpleReply(0); errno != 0 {
+		t.Fatalf("want success but got error %d", errno)
+	}
+	if d := time.Since(start); d < 180*time.Millisecond {
+		t.Fatalf("want a write of 256 KiB to take 190ms but took %v", d)
+	}
+
+	// a client which disconnects does not wait for its delayed requests.
+	if err := srv.SetLimits("disk", nbd.Limits{IOPS: 0.1, IOPSBurst: 1}); err != nil {
+		t.Fatal(err)
+	}
+	c.request(0, 3, 1, 0, 0, nil)
+	c.request(0, 3, 2, 0, 0, nil)
+	c.simpleReply(0)
+	c.request(0, 2, 3, 0, 0, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for s, _ = srv.Stats("disk"); s.Clients != 0; s, _ = srv.Stats("disk") {
+		if time.Now().After(deadline) {
+			t.Fatal("want the client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	var h nbd.Histogram
+	if q := h.Quantile(0.5); q != 0 {
+		t.Fatalf("want 0 without requests but got %v", q)
+	}
+	h.Buckets[0] = 90                     // up to 50µs
+	h.Buckets[4] = 9                      // up to 1ms
+	h.Buckets[len(nbd.LatencyBounds)] = 1 // longer than a second
+	h.Count, h.Max = 100, 3*time.Second
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, 50 * time.Microsecond},
+		{0.9, 50 * time.Microsecond},
+		{0.95, time.Millisecond},
+		{0.99, time.Millisecond},
+		{0.999, 3 * time.Second},
+	} {
+		if got := h.Quantile(tc.q); got != tc.want {
+			t.Fatalf("q%v: want %v but got %v", tc.q, tc.want, got)
+		}
+	}
+}
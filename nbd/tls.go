@@ -0,0 +1,198 @@
+package nbd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// certificateValidity is how long the certificates of a CA are valid.
+const certificateValidity = 365 * 24 * time.Hour
+
+// The files of the tls-certificates directory of a client, as read by
+// libnbd and qemu.
+const (
+	caCertFile     = "ca-cert.pem"
+	clientCertFile = "client-cert.pem"
+	clientKeyFile  = "client-key.pem"
+)
+
+// CA is a throwaway certificate authority, which issues the certificates
+// of a server and its clients for mutual TLS without any other PKI:
+//
+//	ca, err := nbd.NewCA("vm")
+//	...
+//	srv := &nbd.Server{}
+//	srv.TLSConfig, err = ca.ServerTLSConfig("127.0.0.1")
+//	...
+//	err = ca.WriteClientCertificates("certs", "vm-client")
+//	...
+//	u := &vz.NBDURL{TLS: true, Host: "127.0.0.1", Port: port, ExportName: "disk", TLSCertificates: "certs"}
+//
+// The key of a CA is kept in memory only, so certificates can only be
+// issued by the program which created it.
+type CA struct {
+	// Certificate is the certificate of the CA.
+	Certificate *x509.Certificate
+
+	key crypto.Signer
+}
+
+// NewCA creates a CA with a new key and a self-signed certificate of the
+// common name commonName, valid for a year.
+func NewCA(commonName string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := certificateTemplate(commonName)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.MaxPathLenZero = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Certificate: cert, key: key}, nil
+}
+
+func certificateTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		// allow for clocks which are a little behind.
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(certificateValidity),
+	}, nil
+}
+
+// CertPool returns a pool of the certificate of the CA.
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// issue issues a certificate of a new key for tmpl.
+func (ca *CA) issue(tmpl *x509.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Certificate, key.Public(), ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// IssueServerCertificate issues a server certificate for hosts, which are
+// host names or IP addresses.
+func (ca *CA) IssueServerCertificate(hosts ...string) (tls.Certificate, error) {
+	if len(hosts) == 0 {
+		return tls.Certificate{}, errors.New("nbd: server certificate without hosts")
+	}
+	tmpl, err := certificateTemplate(hosts[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return ca.issue(tmpl)
+}
+
+// IssueClientCertificate issues a client certificate of the common name
+// commonName.
+func (ca *CA) IssueClientCertificate(commonName string) (tls.Certificate, error) {
+	tmpl, err := certificateTemplate(commonName)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return ca.issue(tmpl)
+}
+
+// ServerTLSConfig returns the TLS configuration of a Server for hosts,
+// with a server certificate for them, which requires clients to present a
+// certificate issued by the CA.
+func (ca *CA) ServerTLSConfig(hosts ...string) (*tls.Config, error) {
+	cert, err := ca.IssueServerCertificate(hosts...)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.CertPool(),
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// WriteClientCertificates issues a client certificate of the common name
+// commonName, and writes it to dir with its key and the certificate of the
+// CA, as ca-cert.pem, client-cert.pem and client-key.pem. dir is created
+// if it does not exist, and is the tls-certificates query parameter of an
+// nbds URI.
+func (ca *CA) WriteClientCertificates(dir, commonName string) error {
+	cert, err := ca.IssueClientCertificate(commonName)
+	if err != nil {
+		return err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	files := []struct {
+		name  string
+		block *pem.Block
+		perm  os.FileMode
+	}{
+		{caCertFile, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw}, 0o644},
+		{clientCertFile, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}, 0o644},
+		{clientKeyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: key}, 0o600},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(dir, f.name), pem.EncodeToMemory(f.block), f.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
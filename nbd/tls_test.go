@@ -0,0 +1,142 @@
+package nbd_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/nbd"
+)
+
+// startTLS negotiates TLS with config, and returns the error of the TLS
+// handshake.
+func (c *client) startTLS(config *tls.Config) error {
+	c.t.Helper()
+	if r := c.option(5, nil); r[0].typ != 1 {
+		c.t.Fatalf("want NBD_OPT_STARTTLS acknowledged but got %+v", r)
+	}
+	tc := tls.Client(c.c, config)
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.c = tc
+	c.r.Reset(tc)
+	return nil
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("tls!"), 1024)
+	path := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ca, err := nbd.NewCA("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &nbd.Server{ErrorLog: log.New(io.Discard, "", 0)}
+	if srv.TLSConfig, err = ca.ServerTLSConfig("127.0.0.1", "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddExport(nbd.Export{Name: "disk", Data: f, ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, srv, "tcp", "127.0.0.1:0").String()
+
+	// the client configuration from the tls-certificates directory.
+	certs := filepath.Join(dir, "certs")
+	if err := ca.WriteClientCertificates(certs, "vm"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certs, "client-cert.pem"), filepath.Join(certs, "client-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := os.ReadFile(filepath.Join(certs, "ca-cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("want the certificate of the CA in ca-cert.pem")
+	}
+	if info, err := os.Stat(filepath.Join(certs, "client-key.pem")); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("want a private client key but got %v, %v", info.Mode(), err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   "127.0.0.1",
+	}
+
+	c := dial(t, "tcp", addr)
+	for _, opt := range []uint32{3, 7} {
+		if r := c.option(opt, infoData("disk")); r[0].typ != 1<<31+5 {
+			t.Fatalf("option %d: want NBD_REP_ERR_TLS_REQD but got %+v", opt, r)
+		}
+	}
+	if err := c.startTLS(config); err != nil {
+		t.Fatal(err)
+	}
+	if r := c.option(5, nil); r[0].typ != 1<<31+3 {
+		t.Fatalf("want NBD_REP_ERR_INVALID for a second NBD_OPT_STARTTLS but got %+v", r)
+	}
+	if r := c.option(7, infoData("disk")); r[len(r)-1].typ != 1 {
+		t.Fatalf("want the export over TLS but got %+v", r)
+	}
+	c.request(0, 0, 1, 0, 4096, nil)
+	if _, errno, got := c.simpleReply(4096); errno != 0 || !bytes.Equal(got, data[:4096]) {
+		t.Fatalf("want the data over TLS but got error %d", errno)
+	}
+
+	// NBD_OPT_EXPORT_NAME without TLS closes the connection.
+	c = dial(t, "tcp", addr)
+	c.write(append(be.AppendUint64(nil, 0x49484156454f5054), 0, 0, 0, 1, 0, 0, 0, 4, 'd', 'i', 's', 'k'))
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("want the connection closed but got %v", err)
+	}
+
+	other, err := nbd.NewCA("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := other.IssueClientCertificate("vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, config := range map[string]*tls.Config{
+		"no certificate":       {RootCAs: roots, ServerName: "localhost"},
+		"certificate of other": {Certificates: []tls.Certificate{otherCert}, RootCAs: roots, ServerName: "localhost"},
+		"server of other":      {Certificates: []tls.Certificate{cert}, RootCAs: other.CertPool(), ServerName: "localhost"},
+	} {
+		c := dial(t, "tcp", addr)
+		if err := c.startTLS(config); err != nil {
+			continue
+		}
+		// with TLS 1.3, the server rejects the certificate of a
+		// client after the client has finished the handshake.
+		c.c.Write(append(be.AppendUint64(nil, 0x49484156454f5054), 0, 0, 0, 3, 0, 0, 0, 0))
+		if _, err := io.ReadFull(c.r, make([]byte, 20)); err == nil {
+			t.Fatalf("%s: want a failed TLS handshake", name)
+		}
+	}
+
+	// a server without TLS does not support NBD_OPT_STARTTLS.
+	plain := &nbd.Server{}
+	c = dial(t, "tcp", serve(t, plain, "tcp", "127.0.0.1:0").String())
+	if r := c.option(5, nil); r[0].typ != 1<<31+1 {
+		t.Fatalf("want NBD_REP_ERR_UNSUP but got %+v", r)
+	}
+}
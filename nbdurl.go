@@ -0,0 +1,264 @@
+package vz
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidNBDURL is returned, wrapped with the reason, for a URL which is not a valid
+// NBD URI.
+var ErrInvalidNBDURL = errors.New("invalid NBD URL")
+
+// defaultNBDPort is the port of an NBD server over TCP when a URL has none.
+const defaultNBDPort = 10809
+
+// maxNBDExportNameLen is the longest export name which the NBD protocol allows.
+const maxNBDExportNameLen = 4096
+
+// NBDURL is the URI of an export of an NBD (Network Block Device) server, in the format
+// specified by https://github.com/NetworkBlockDevice/nbd/blob/master/doc/uri.md.
+//
+// A URL with a Socket connects to a Unix domain socket (nbd+unix or nbds+unix), and
+// otherwise to Host and Port over TCP (nbd or nbds):
+//
+//	u := &vz.NBDURL{Socket: "/tmp/nbd.sock", ExportName: "disk"}
+//	u.String() // nbd+unix:///disk?socket=/tmp/nbd.sock
+//
+//	u = &vz.NBDURL{TLS: true, Host: "192.168.64.1", ExportName: "disk", TLSCertificates: "/etc/pki/nbd"}
+//	u.String() // nbds://192.168.64.1/disk?tls-certificates=/etc/pki/nbd
+type NBDURL struct {
+	// TLS is true for the nbds and nbds+unix schemes, which connect with TLS.
+	TLS bool
+
+	// Host is the host name or IP address of a server over TCP.
+	Host string
+
+	// Port is the port of a server over TCP. Zero means the default port 10809.
+	Port int
+
+	// Socket is the path of the Unix domain socket of the server.
+	Socket string
+
+	// ExportName is the name of the export. An empty name is the default export of the
+	// server.
+	ExportName string
+
+	// TLSCertificates is the directory of the certificates to connect with TLS, as the
+	// tls-certificates query parameter.
+	TLSCertificates string
+
+	// Query holds the other query parameters of the URL, which are passed on as they are.
+	Query url.Values
+}
+
+// ParseNBDURL parses rawURL as an NBD URI. The error wraps ErrInvalidNBDURL if rawURL is
+// not a valid NBD URI.
+func ParseNBDURL(rawURL string) (*NBDURL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidNBDURL, err)
+	}
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w %q: %s", ErrInvalidNBDURL, rawURL, fmt.Sprintf(format, args...))
+	}
+	var unix bool
+	n := &NBDURL{}
+	switch u.Scheme {
+	case "nbd":
+	case "nbds":
+		n.TLS = true
+	case "nbd+unix":
+		unix = true
+	case "nbds+unix":
+		n.TLS, unix = true, true
+	case "":
+		return nil, invalid("missing scheme, want nbd, nbds, nbd+unix or nbds+unix")
+	default:
+		return nil, invalid("unsupported scheme %q, want nbd, nbds, nbd+unix or nbds+unix", u.Scheme)
+	}
+	if u.Opaque != "" {
+		return nil, invalid("want %s:// followed by the server", u.Scheme)
+	}
+	if u.User != nil {
+		return nil, invalid("user information is not allowed")
+	}
+	if u.Fragment != "" {
+		return nil, invalid("fragment is not allowed")
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, invalid("%v", err)
+	}
+	for _, key := range []string{"socket", "tls-certificates"} {
+		if v, ok := query[key]; ok {
+			if len(v) != 1 {
+				return nil, invalid("%s query parameter is given %d times", key, len(v))
+			}
+			if v[0] == "" {
+				return nil, invalid("%s query parameter is empty", key)
+			}
+		}
+	}
+	n.Socket = query.Get("socket")
+	n.TLSCertificates = query.Get("tls-certificates")
+	query.Del("socket")
+	query.Del("tls-certificates")
+	if len(query) > 0 {
+		n.Query = query
+	}
+	if unix {
+		if u.Host != "" {
+			return nil, invalid("%s URL must not have a host, use %s:///export?socket=path", u.Scheme, u.Scheme)
+		}
+		if n.Socket == "" {
+			return nil, invalid("%s URL requires the socket query parameter", u.Scheme)
+		}
+	} else {
+		if n.Socket != "" {
+			return nil, invalid("socket query parameter is only allowed with nbd+unix and nbds+unix")
+		}
+		n.Host = u.Hostname()
+		if n.Host == "" {
+			return nil, invalid("missing host")
+		}
+		if port := u.Port(); port != "" {
+			if n.Port, err = strconv.Atoi(port); err != nil || n.Port < 1 || n.Port > 65535 {
+				return nil, invalid("invalid port %q", port)
+			}
+		} else if strings.HasSuffix(u.Host, ":") {
+			return nil, invalid("empty port")
+		}
+	}
+	// the export name follows the first slash, so nbd://host//name is the export /name.
+	n.ExportName = strings.TrimPrefix(u.Path, "/")
+	if err := n.validate(); err != nil {
+		return nil, invalid("%v", err)
+	}
+	return n, nil
+}
+
+// Validate reports whether u is a valid NBD URI. The error wraps ErrInvalidNBDURL.
+func (u *NBDURL) Validate() error {
+	if err := u.validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidNBDURL, err)
+	}
+	return nil
+}
+
+func (u *NBDURL) validate() error {
+	if u.Socket != "" {
+		if u.Host != "" || u.Port != 0 {
+			return errors.New("a URL with a socket must not have a host or port")
+		}
+	} else {
+		if u.Host == "" {
+			return errors.New("missing host or socket")
+		}
+		if strings.ContainsAny(u.Host, "/?#@ ") {
+			return fmt.Errorf("invalid host %q", u.Host)
+		}
+		if u.Port < 0 || u.Port > 65535 {
+			return fmt.Errorf("invalid port %d", u.Port)
+		}
+	}
+	if len(u.ExportName) > maxNBDExportNameLen {
+		return fmt.Errorf("export name is longer than %d bytes", maxNBDExportNameLen)
+	}
+	if u.TLSCertificates != "" && !u.TLS {
+		return errors.New("tls-certificates query parameter requires TLS, use nbds or nbds+unix")
+	}
+	for key := range u.Query {
+		if key == "socket" || key == "tls-certificates" {
+			return fmt.Errorf("%s must be set with the field of NBDURL, not Query", key)
+		}
+	}
+	return nil
+}
+
+// Scheme returns the scheme of u: nbd, nbds, nbd+unix or nbds+unix.
+func (u *NBDURL) Scheme() string {
+	scheme := "nbd"
+	if u.TLS {
+		scheme = "nbds"
+	}
+	if u.Socket != "" {
+		scheme += "+unix"
+	}
+	return scheme
+}
+
+// Addr returns the address of the server: the path of the socket, or the host and port
+// over TCP.
+func (u *NBDURL) Addr() string {
+	if u.Socket != "" {
+		return u.Socket
+	}
+	port := u.Port
+	if port == 0 {
+		port = defaultNBDPort
+	}
+	return net.JoinHostPort(u.Host, strconv.Itoa(port))
+}
+
+// String returns u as an NBD URI. It does not validate u.
+func (u *NBDURL) String() string {
+	host := ""
+	if u.Socket == "" {
+		host = u.Host
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if u.Port != 0 {
+			host += ":" + strconv.Itoa(u.Port)
+		}
+	}
+	s := (&url.URL{Scheme: u.Scheme(), Host: host, Path: "/" + u.ExportName}).String()
+	if u.Socket == "" && u.ExportName == "" {
+		s = strings.TrimSuffix(s, "/")
+	}
+
+	var query []string
+	if u.Socket != "" {
+		query = append(query, "socket="+nbdQueryEscape(u.Socket))
+	}
+	if u.TLSCertificates != "" {
+		query = append(query, "tls-certificates="+nbdQueryEscape(u.TLSCertificates))
+	}
+	keys := make([]string, 0, len(u.Query))
+	for key := range u.Query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, v := range u.Query[key] {
+			query = append(query, nbdQueryEscape(key)+"="+nbdQueryEscape(v))
+		}
+	}
+	if len(query) > 0 {
+		s += "?" + strings.Join(query, "&")
+	}
+	return s
+}
+
+// nbdQueryEscape escapes s for a query parameter, but leaves slashes and colons as they
+// are, since NBD clients expect paths like socket=/tmp/nbd.sock.
+func nbdQueryEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/', c == ':':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
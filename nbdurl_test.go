@@ -0,0 +1,133 @@
+package vz_test
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3"
+)
+
+func TestParseNBDURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		want vz.NBDURL
+		str  string // the URL built back, if it differs
+		addr string
+	}{
+		{
+			url:  "nbd://example.com",
+			want: vz.NBDURL{Host: "example.com"},
+			addr: "example.com:10809",
+		},
+		{
+			url:  "nbd://127.0.0.1:10810/disk",
+			want: vz.NBDURL{Host: "127.0.0.1", Port: 10810, ExportName: "disk"},
+			addr: "127.0.0.1:10810",
+		},
+		{
+			url:  "nbd://[::1]:10810/",
+			want: vz.NBDURL{Host: "::1", Port: 10810},
+			str:  "nbd://[::1]:10810",
+			addr: "[::1]:10810",
+		},
+		{
+			url:  "nbds://example.com//golden%20image?tls-certificates=/etc/pki/nbd",
+			want: vz.NBDURL{TLS: true, Host: "example.com", ExportName: "/golden image", TLSCertificates: "/etc/pki/nbd"},
+			addr: "example.com:10809",
+		},
+		{
+			url:  "nbd+unix:///disk?socket=/tmp/nbd.sock",
+			want: vz.NBDURL{Socket: "/tmp/nbd.sock", ExportName: "disk"},
+			addr: "/tmp/nbd.sock",
+		},
+		{
+			url:  "nbd+unix:///?socket=nbd%20dir/nbd.sock",
+			want: vz.NBDURL{Socket: "nbd dir/nbd.sock"},
+			addr: "nbd dir/nbd.sock",
+		},
+		{
+			url: "nbds+unix:///disk?tls-hostname=server&socket=/tmp/nbd.sock&tls-certificates=/etc/pki/nbd",
+			want: vz.NBDURL{
+				TLS:             true,
+				Socket:          "/tmp/nbd.sock",
+				ExportName:      "disk",
+				TLSCertificates: "/etc/pki/nbd",
+				Query:           url.Values{"tls-hostname": {"server"}},
+			},
+			str:  "nbds+unix:///disk?socket=/tmp/nbd.sock&tls-certificates=/etc/pki/nbd&tls-hostname=server",
+			addr: "/tmp/nbd.sock",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.url, func(t *testing.T) {
+			got, err := vz.ParseNBDURL(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Fatalf("want %+v but got %+v", tc.want, *got)
+			}
+			str := tc.str
+			if str == "" {
+				str = tc.url
+			}
+			if got.String() != str {
+				t.Fatalf("want %q but got %q", str, got.String())
+			}
+			if got.Addr() != tc.addr {
+				t.Fatalf("want address %q but got %q", tc.addr, got.Addr())
+			}
+			again, err := vz.ParseNBDURL(got.String())
+			if err != nil || !reflect.DeepEqual(again, got) {
+				t.Fatalf("want %+v parsed again but got %+v, %v", got, again, err)
+			}
+		})
+	}
+}
+
+func TestParseNBDURLInvalid(t *testing.T) {
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{"/tmp/nbd.sock", "missing scheme"},
+		{"http://example.com/disk", `unsupported scheme "http"`},
+		{"nbd:example.com", "want nbd:// followed by the server"},
+		{"nbd:///disk", "missing host"},
+		{"nbd://example.com:0/disk", `invalid port "0"`},
+		{"nbd://example.com:65536/disk", `invalid port "65536"`},
+		{"nbd://example.com:/disk", "empty port"},
+		{"nbd://user@example.com/disk", "user information"},
+		{"nbd://example.com/disk#part", "fragment"},
+		{"nbd://example.com/disk?socket=/tmp/nbd.sock", "socket query parameter is only allowed"},
+		{"nbd://example.com/disk?tls-certificates=/etc/pki", "requires TLS"},
+		{"nbd+unix:///disk", "requires the socket query parameter"},
+		{"nbd+unix:///disk?socket=", "socket query parameter is empty"},
+		{"nbd+unix:///disk?socket=a&socket=b", "given 2 times"},
+		{"nbd+unix://localhost/disk?socket=/tmp/nbd.sock", "must not have a host"},
+		{"nbd://example.com/" + strings.Repeat("x", 4097), "longer than 4096 bytes"},
+	}
+	for _, tc := range cases {
+		_, err := vz.ParseNBDURL(tc.url)
+		if !errors.Is(err, vz.ErrInvalidNBDURL) || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: want an error with %q but got %v", tc.url, tc.want, err)
+		}
+	}
+
+	invalid := []*vz.NBDURL{
+		{},
+		{Host: "example.com", Socket: "/tmp/nbd.sock"},
+		{Host: "example.com", Port: 70000},
+		{Host: "example.com/disk"},
+		{Socket: "/tmp/nbd.sock", TLSCertificates: "/etc/pki"},
+		{Socket: "/tmp/nbd.sock", Query: url.Values{"socket": {"/tmp/other.sock"}}},
+	}
+	for _, u := range invalid {
+		if err := u.Validate(); !errors.Is(err, vz.ErrInvalidNBDURL) {
+			t.Errorf("%+v: want ErrInvalidNBDURL but got %v", u, err)
+		}
+	}
+}
@@ -69,6 +69,39 @@ const (
 	DiskImageSynchronizationModeNone
 )
 
+// DiskImageStorageDeviceAttachmentOption is an option for NewDiskImageStorageDeviceAttachment
+// and NewDiskImageStorageDeviceAttachmentWithCacheAndSync.
+type DiskImageStorageDeviceAttachmentOption func(*diskImageStorageDeviceAttachmentOptions)
+
+type diskImageStorageDeviceAttachmentOptions struct {
+	checkFormat bool
+}
+
+// WithDiskImageFormatCheck detects the format of the disk image before the attachment is created.
+//
+// If the disk image is in a format which Virtualization.framework can not attach, such as qcow2 or
+// a compressed file, an error wrapping ErrUnsupportedDiskImageFormat which describes the detected
+// format is returned instead of the generic ErrorInvalidDiskImage error from the framework.
+func WithDiskImageFormatCheck() DiskImageStorageDeviceAttachmentOption {
+	return func(o *diskImageStorageDeviceAttachmentOptions) {
+		o.checkFormat = true
+	}
+}
+
+func checkDiskImageStorageDeviceAttachment(diskPath string, opts []DiskImageStorageDeviceAttachmentOption) error {
+	if _, err := os.Stat(diskPath); err != nil {
+		return err
+	}
+	o := &diskImageStorageDeviceAttachmentOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.checkFormat {
+		return checkDiskImageFormat(diskPath)
+	}
+	return nil
+}
+
 // NewDiskImageStorageDeviceAttachment initialize the attachment from a local file path.
 // Returns error is not nil, assigned with the error if the initialization failed.
 //
@@ -77,11 +110,11 @@ const (
 //
 // This is only supported on macOS 11 and newer, error will
 // be returned on older versions.
-func NewDiskImageStorageDeviceAttachment(diskPath string, readOnly bool) (*DiskImageStorageDeviceAttachment, error) {
+func NewDiskImageStorageDeviceAttachment(diskPath string, readOnly bool, opts ...DiskImageStorageDeviceAttachmentOption) (*DiskImageStorageDeviceAttachment, error) {
 	if err := macOSAvailable(11); err != nil {
 		return nil, err
 	}
-	if _, err := os.Stat(diskPath); err != nil {
+	if err := checkDiskImageStorageDeviceAttachment(diskPath, opts); err != nil {
 		return nil, err
 	}
 
@@ -117,11 +150,11 @@ func NewDiskImageStorageDeviceAttachment(diskPath string, readOnly bool) (*DiskI
 //
 // This is only supported on macOS 12 and newer, error will
 // be returned on older versions.
-func NewDiskImageStorageDeviceAttachmentWithCacheAndSync(diskPath string, readOnly bool, cachingMode DiskImageCachingMode, syncMode DiskImageSynchronizationMode) (*DiskImageStorageDeviceAttachment, error) {
+func NewDiskImageStorageDeviceAttachmentWithCacheAndSync(diskPath string, readOnly bool, cachingMode DiskImageCachingMode, syncMode DiskImageSynchronizationMode, opts ...DiskImageStorageDeviceAttachmentOption) (*DiskImageStorageDeviceAttachment, error) {
 	if err := macOSAvailable(12); err != nil {
 		return nil, err
 	}
-	if _, err := os.Stat(diskPath); err != nil {
+	if err := checkDiskImageStorageDeviceAttachment(diskPath, opts); err != nil {
 		return nil, err
 	}
 
@@ -438,12 +471,18 @@ var _ StorageDeviceAttachment = (*NetworkBlockDeviceStorageDeviceAttachment)(nil
 // - forcedReadOnly if true forces the disk attachment to be read-only, regardless of whether or not the NBD server supports write requests.
 // - syncMode is one of the available DiskSynchronizationMode options.
 //
+// The url is parsed with ParseNBDURL first, so that a malformed URI returns an error wrapping
+// ErrInvalidNBDURL here instead of failing once the virtual machine starts.
+//
 // This is only supported on macOS 14 and newer, error will
 // be returned on older versions.
 func NewNetworkBlockDeviceStorageDeviceAttachment(url string, timeout time.Duration, forcedReadOnly bool, syncMode DiskSynchronizationMode) (*NetworkBlockDeviceStorageDeviceAttachment, error) {
 	if err := macOSAvailable(14); err != nil {
 		return nil, err
 	}
+	if _, err := ParseNBDURL(url); err != nil {
+		return nil, err
+	}
 
 	didEncounterError := infinity.NewChannel[error]()
 	connected := infinity.NewChannel[struct{}]()
@@ -483,6 +522,18 @@ func NewNetworkBlockDeviceStorageDeviceAttachment(url string, timeout time.Durat
 	return attachment, nil
 }
 
+// NewNetworkBlockDeviceStorageDeviceAttachmentFromURL creates a new network block device storage attachment
+// like NewNetworkBlockDeviceStorageDeviceAttachment, from an NBDURL which is validated first.
+//
+// This is only supported on macOS 14 and newer, error will
+// be returned on older versions.
+func NewNetworkBlockDeviceStorageDeviceAttachmentFromURL(u *NBDURL, timeout time.Duration, forcedReadOnly bool, syncMode DiskSynchronizationMode) (*NetworkBlockDeviceStorageDeviceAttachment, error) {
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+	return NewNetworkBlockDeviceStorageDeviceAttachment(u.String(), timeout, forcedReadOnly, syncMode)
+}
+
 // Connected receive the signal via channel when the NBD client successfully connects or reconnects with the server.
 //
 // The NBD connection with the server takes place when the VM is first started, and reconnection attempts take place when the connection
@@ -1,6 +1,7 @@
 package vz_test
 
 import (
+	"errors"
 	"log"
 	"os"
 	"os/exec"
@@ -66,6 +67,29 @@ func TestBlockDeviceIdentifier(t *testing.T) {
 	}
 }
 
+func TestDiskImageStorageDeviceAttachmentFormatCheck(t *testing.T) {
+	if vz.Available(11) {
+		t.Skip("vz.NewDiskImageStorageDeviceAttachment is supported from macOS 11")
+	}
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "disk.img")
+	if err := vz.CreateDiskImage(raw, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vz.NewDiskImageStorageDeviceAttachment(raw, false, vz.WithDiskImageFormatCheck()); err != nil {
+		t.Fatal(err)
+	}
+
+	qcow2 := filepath.Join(dir, "disk.qcow2")
+	if err := os.WriteFile(qcow2, append([]byte("QFI\xfb"), make([]byte, 508)...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := vz.NewDiskImageStorageDeviceAttachment(qcow2, false, vz.WithDiskImageFormatCheck())
+	if !errors.Is(err, vz.ErrUnsupportedDiskImageFormat) {
+		t.Fatalf("want ErrUnsupportedDiskImageFormat but got %v", err)
+	}
+}
+
 func TestBlockDeviceWithCacheAndSyncMode(t *testing.T) {
 	if vz.Available(12) {
 		t.Skip("vz.NewDiskImageStorageDeviceAttachmentWithCacheAndSync is supported from macOS 12")
@@ -0,0 +1,415 @@
+// Package tarfs reads tar archives into an fs.FS, e.g. a file system
+// exported by "docker export" or the layers of a container image, so that
+// they can be written to disk images with ext4.Format or erofs.Write.
+//
+// The Sys method of every fs.FileInfo returns the *tar.Header of the file,
+// which carries its owner, permission bits, device numbers and extended
+// attributes, so images built from an FS keep them.
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// whiteoutPrefix marks a file of a lower layer as deleted.
+	whiteoutPrefix = ".wh."
+
+	// opaqueWhiteout marks a directory whose content in the lower layers
+	// is hidden.
+	opaqueWhiteout = ".wh..wh..opq"
+
+	// maxLinks is the number of symbolic links followed while resolving a
+	// path, the same limit as Linux.
+	maxLinks = 40
+)
+
+// FS is a read-only file system holding the files of tar archives in
+// memory. It implements fs.FS, fs.ReadDirFS and fs.StatFS. Symbolic links
+// are followed within the file system, and absolute link targets are
+// resolved from its root.
+type FS struct {
+	root *node
+}
+
+var (
+	_ fs.FS        = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+)
+
+// node is a file or directory.
+type node struct {
+	hdr      *tar.Header
+	data     []byte
+	children map[string]*node // of a directory
+	layer    int              // the layer which added the node
+
+	// target is the file a hard link refers to.
+	target *node
+}
+
+func (n *node) isDir() bool { return n.hdr.Typeflag == tar.TypeDir }
+
+// New reads the tar archives layers in order, like the layers of a
+// container image: files of later archives replace those of earlier ones,
+// and the whiteout files ".wh.<name>" and ".wh..wh..opq" delete files of
+// earlier archives, as the OCI image specification describes.
+//
+// Leading "/" and "./" are removed from the names, and names leaving the
+// root with ".." are rejected. Directories which only appear as parents of
+// other files have the permission bits 0755, are owned by root and were
+// modified at the Unix epoch.
+func New(layers ...io.Reader) (*FS, error) {
+	f := &FS{root: newDir(".", -1)}
+	for i, r := range layers {
+		if err := f.add(tar.NewReader(r), i); err != nil {
+			return nil, err
+		}
+	}
+	// a hard link to a file which was replaced later keeps the content it
+	// had, and becomes a file of its own.
+	walkNodes(f.root, func(n *node) {
+		if n.target == nil {
+			return
+		}
+		if t, err := f.lookup(n.hdr.Linkname, false); err != nil || t != n.target {
+			hdr := *n.target.hdr
+			hdr.Name = n.hdr.Name
+			n.hdr, n.data, n.target = &hdr, n.target.data, nil
+		}
+	})
+	return f, nil
+}
+
+func newDir(name string, layer int) *node {
+	return &node{
+		hdr: &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     name + "/",
+			Mode:     0o755,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		},
+		children: make(map[string]*node),
+		layer:    layer,
+	}
+}
+
+func walkNodes(n *node, fn func(*node)) {
+	fn(n)
+	for _, c := range n.children {
+		walkNodes(c, fn)
+	}
+}
+
+// cleanName returns the name of a tar entry relative to the root.
+func cleanName(name string) (string, error) {
+	name = strings.TrimPrefix(name, "/")
+	clean := path.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("tarfs: %s: name leaves the root", name)
+	}
+	return clean, nil
+}
+
+func (f *FS) add(tr *tar.Reader, layer int) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, err := cleanName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		dirName, base := path.Split(name)
+		dir, err := f.mkdirAll(strings.TrimSuffix(dirName, "/"), layer)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case name == ".":
+			if hdr.Typeflag != tar.TypeDir {
+				return fmt.Errorf("tarfs: the root is not a directory")
+			}
+			f.root.hdr = hdr
+			continue
+		case base == opaqueWhiteout:
+			for childName, c := range dir.children {
+				if c.layer < layer {
+					delete(dir.children, childName)
+				}
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			delete(dir.children, strings.TrimPrefix(base, whiteoutPrefix))
+			continue
+		}
+
+		n := &node{hdr: hdr, layer: layer}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if old, ok := dir.children[base]; ok && old.isDir() {
+				// the directory keeps its content and gets the new metadata.
+				old.hdr, old.layer = hdr, layer
+				continue
+			}
+			n.children = make(map[string]*node)
+		case tar.TypeReg, tar.TypeGNUSparse:
+			hdr.Typeflag = tar.TypeReg
+			if n.data, err = io.ReadAll(tr); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := cleanName(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			t, err := f.lookup(target, false)
+			if err != nil {
+				return fmt.Errorf("tarfs: %s: hard link to missing file %s", name, hdr.Linkname)
+			}
+			if t.target != nil {
+				// a link to a link refers to the same file.
+				target, t = t.hdr.Linkname, t.target
+			}
+			if t.hdr.Typeflag != tar.TypeReg {
+				return fmt.Errorf("tarfs: %s: hard link to %s which is not a regular file", name, hdr.Linkname)
+			}
+			hdr.Linkname = target
+			n.target = t
+		case tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		default:
+			return fmt.Errorf("tarfs: %s: unsupported type %q", name, hdr.Typeflag)
+		}
+		dir.children[base] = n
+	}
+}
+
+// mkdirAll returns the directory name, creating it and its parents if they
+// do not exist.
+func (f *FS) mkdirAll(name string, layer int) (*node, error) {
+	dir := f.root
+	if name == "" || name == "." {
+		return dir, nil
+	}
+	for i, elem := range strings.Split(name, "/") {
+		n, ok := dir.children[elem]
+		if !ok {
+			n = newDir(strings.Join(strings.Split(name, "/")[:i+1], "/"), layer)
+			dir.children[elem] = n
+		}
+		if !n.isDir() {
+			return nil, fmt.Errorf("tarfs: %s: not a directory", name)
+		}
+		dir = n
+	}
+	return dir, nil
+}
+
+// lookup returns the node of name. Symbolic links are followed, except for
+// the last element of name if follow is false.
+func (f *FS) lookup(name string, follow bool) (*node, error) {
+	links := 0
+	for {
+		n, rest, err := f.resolve(name, follow)
+		if err != nil || rest == "" {
+			return n, err
+		}
+		if links++; links > maxLinks {
+			return nil, errors.New("too many levels of symbolic links")
+		}
+		name = rest
+	}
+}
+
+// resolve walks name until it reaches a symbolic link to follow, and
+// returns the name with the link replaced by its target in that case.
+func (f *FS) resolve(name string, follow bool) (*node, string, error) {
+	if name == "." {
+		return f.root, "", nil
+	}
+	elems := strings.Split(name, "/")
+	n := f.root
+	for i, elem := range elems {
+		if !n.isDir() {
+			return nil, "", fs.ErrNotExist
+		}
+		next, ok := n.children[elem]
+		if !ok {
+			return nil, "", fs.ErrNotExist
+		}
+		last := i == len(elems)-1
+		if next.hdr.Typeflag == tar.TypeSymlink && (follow || !last) {
+			target := next.hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(strings.Join(elems[:i], "/"), target)
+			}
+			target = path.Join(target, strings.Join(elems[i+1:], "/"))
+			// like a chroot, ".." of the root is the root.
+			target = strings.TrimPrefix(path.Clean("/"+target), "/")
+			if target == "" {
+				target = "."
+			}
+			return nil, target, nil
+		}
+		n = next
+	}
+	return n, "", nil
+}
+
+func (f *FS) walk(op, name string, follow bool) (*node, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n, err := f.lookup(name, follow)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return n, nil
+}
+
+// Open opens the named file or directory, following symbolic links.
+func (f *FS) Open(name string) (fs.File, error) {
+	n, err := f.walk("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := newFileInfo(path.Base(name), n)
+	if n.isDir() {
+		return &dirFile{fileInfo: info, entries: n.entries()}, nil
+	}
+	data := n.data
+	if n.target != nil {
+		data = n.target.data
+	}
+	return &file{fileInfo: info, Reader: bytes.NewReader(data)}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := f.walk("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !n.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return n.entries(), nil
+}
+
+// Stat returns the fs.FileInfo of the named file, following symbolic links.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	n, err := f.walk("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(path.Base(name), n), nil
+}
+
+// Lstat returns the fs.FileInfo of the named file without following a
+// symbolic link at the end of name. Together with ReadLink, it makes FS
+// an fs.ReadLinkFS from Go 1.25.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	n, err := f.walk("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(path.Base(name), n), nil
+}
+
+// ReadLink returns the target of the named symbolic link.
+func (f *FS) ReadLink(name string) (string, error) {
+	n, err := f.walk("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if n.hdr.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return n.hdr.Linkname, nil
+}
+
+// entries returns the entries of the directory n sorted by name.
+func (n *node) entries() []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(n.children))
+	for name, c := range n.children {
+		entries = append(entries, fs.FileInfoToDirEntry(newFileInfo(name, c)))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// fileInfo describes a file by its tar header. A hard link has the size and
+// mode of the file it refers to, and Sys returns its own header.
+type fileInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+	hdr  *tar.Header
+}
+
+func newFileInfo(name string, n *node) *fileInfo {
+	info := &fileInfo{FileInfo: n.hdr.FileInfo(), name: name, size: int64(len(n.data)), hdr: n.hdr}
+	if n.target != nil {
+		info.FileInfo, info.size = n.target.hdr.FileInfo(), int64(len(n.target.data))
+	}
+	return info
+}
+
+func (fi *fileInfo) Name() string { return fi.name }
+func (fi *fileInfo) Size() int64  { return fi.size }
+func (fi *fileInfo) Sys() any     { return fi.hdr }
+
+type file struct {
+	*fileInfo
+	*bytes.Reader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.fileInfo, nil }
+func (f *file) Close() error               { return nil }
+
+type dirFile struct {
+	*fileInfo
+	entries []fs.DirEntry
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.fileInfo, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,227 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/tarfs"
+)
+
+var modTime = time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC)
+
+type entry struct {
+	hdr  tar.Header
+	data string
+}
+
+func archive(t *testing.T, entries ...entry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = modTime
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func dir(name string, mode int64) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: mode}}
+}
+
+func reg(name, data string, mode int64) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode}, data: data}
+}
+
+func link(typ byte, name, target string) entry {
+	return entry{hdr: tar.Header{Typeflag: typ, Name: name, Linkname: target, Mode: 0o777}}
+}
+
+func TestFS(t *testing.T) {
+	base := archive(t,
+		dir("./", 0o755),
+		dir("./etc/", 0o755),
+		reg("./etc/passwd", "root:x:0:0::/root:/bin/sh\n", 0o644),
+		reg("./etc/shadow", "root:*::0:::::\n", 0o640),
+		entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./bin/busybox", Mode: 0o4755, Uid: 0, Gid: 0}, data: "busybox"},
+		link(tar.TypeSymlink, "./bin/sh", "busybox"),
+		link(tar.TypeSymlink, "./sbin", "bin"),
+		link(tar.TypeSymlink, "./usr/bin/env", "/bin/busybox"),
+		link(tar.TypeLink, "./bin/ls", "bin/busybox"),
+		entry{hdr: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3}},
+		entry{
+			hdr: tar.Header{
+				Typeflag:   tar.TypeReg,
+				Name:       "home/user/.profile",
+				Mode:       0o600,
+				Uid:        1000,
+				Gid:        1000,
+				PAXRecords: map[string]string{"SCHILY.xattr.user.comment": "hello"},
+			},
+			data: "export PS1='$ '\n",
+		},
+		reg("opt/old/a", "a", 0o644),
+		reg("var/lib/gone", "gone", 0o644),
+	)
+	layer := archive(t,
+		reg("etc/passwd", "root:x:0:0::/root:/bin/ash\n", 0o644),
+		reg("var/lib/.wh.gone", "", 0o644),
+		reg("opt/old/.wh..wh..opq", "", 0o644),
+		reg("opt/old/b", "b", 0o644),
+		reg("bin/busybox", "busybox 2", 0o755),
+	)
+	fsys, err := tarfs.New(base, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "etc/passwd", "etc/shadow", "bin/busybox", "bin/sh", "bin/ls", "dev/null", "home/user/.profile", "opt/old/b", "usr/bin/env"); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"etc/passwd":   "root:x:0:0::/root:/bin/ash\n",
+		"bin/sh":       "busybox 2",
+		"sbin/sh":      "busybox 2",
+		"usr/bin/env":  "busybox 2",
+		"bin/ls":       "busybox",
+		"opt/old/b":    "b",
+		"bin/busybox":  "busybox 2",
+		"etc/shadow":   "root:*::0:::::\n",
+		"sbin/busybox": "busybox 2",
+	}
+	for name, want := range files {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s: want %q but got %q", name, want, got)
+		}
+	}
+	for _, name := range []string{"var/lib/gone", "opt/old/a"} {
+		if _, err := fs.Stat(fsys, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s: want fs.ErrNotExist but got %v", name, err)
+		}
+	}
+
+	target, err := fsys.ReadLink("usr/bin/env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "/bin/busybox" {
+		t.Fatalf("want /bin/busybox but got %s", target)
+	}
+	info, err := fsys.Lstat("sbin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Type() != fs.ModeSymlink {
+		t.Fatalf("want a symbolic link but got %s", info.Mode())
+	}
+
+	info, err = fsys.Stat("home/user/.profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := info.Sys().(*tar.Header)
+	if hdr.Uid != 1000 || hdr.Gid != 1000 || hdr.PAXRecords["SCHILY.xattr.user.comment"] != "hello" {
+		t.Fatalf("want the owner 1000:1000 and user.comment but got %d:%d %v", hdr.Uid, hdr.Gid, hdr.PAXRecords)
+	}
+	for name, want := range map[string]fs.FileMode{
+		"home":        fs.ModeDir | 0o755,
+		"dev/null":    fs.ModeDevice | fs.ModeCharDevice | 0o666,
+		"bin/ls":      fs.ModeSetuid | 0o755,
+		"bin/busybox": 0o755,
+		"etc/shadow":  0o640,
+	} {
+		info, err := fsys.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Fatalf("%s: want %s but got %s", name, want, info.Mode())
+		}
+	}
+	// the hard link kept the content of the replaced file.
+	info, err = fsys.Stat("bin/ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr := info.Sys().(*tar.Header); hdr.Typeflag != tar.TypeReg || info.Size() != 7 {
+		t.Fatalf("want a regular file of 7 bytes but got type %q of %d bytes", hdr.Typeflag, info.Size())
+	}
+}
+
+func TestHardLink(t *testing.T) {
+	fsys, err := tarfs.New(archive(t,
+		reg("a", "data", 0o644),
+		link(tar.TypeLink, "b", "a"),
+		link(tar.TypeLink, "c", "./b"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "c"} {
+		info, err := fsys.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := info.Sys().(*tar.Header)
+		if hdr.Typeflag != tar.TypeLink || hdr.Linkname != "a" || info.Size() != 4 {
+			t.Fatalf("%s: want a hard link to a of 4 bytes but got type %q to %s of %d bytes", name, hdr.Typeflag, hdr.Linkname, info.Size())
+		}
+	}
+}
+
+func TestNewError(t *testing.T) {
+	cases := map[string]*bytes.Buffer{
+		"escape":       archive(t, reg("../etc/passwd", "x", 0o644)),
+		"missing link": archive(t, link(tar.TypeLink, "a", "b")),
+		"not a dir":    archive(t, reg("a", "x", 0o644), reg("a/b", "y", 0o644)),
+	}
+	for name, r := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := tarfs.New(r); err == nil {
+				t.Fatal("want an error")
+			}
+		})
+	}
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	fsys, err := tarfs.New(archive(t,
+		link(tar.TypeSymlink, "a", "b"),
+		link(tar.TypeSymlink, "b", "a"),
+		link(tar.TypeSymlink, "up", "../../.."),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "a"); err == nil {
+		t.Fatal("want an error for a symbolic link loop")
+	}
+	info, err := fs.Stat(fsys, "up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Fatalf("want the root but got %s", info.Mode())
+	}
+}